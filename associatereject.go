@@ -0,0 +1,49 @@
+package netdicom
+
+// This file implements reporting association rejections to the service user.
+
+import (
+	"fmt"
+
+	"github.com/giesekow/go-netdicom/pdu"
+)
+
+// AssociateRejectError reports that the peer rejected the association with an
+// A-ASSOCIATE-RJ PDU (P3.8 9.3.4). Use Transient to decide whether to retry
+// later; see also DialServiceUser.
+type AssociateRejectError struct {
+	Result pdu.RejectResultType
+	Source pdu.SourceType
+	Reason pdu.RejectReasonType
+}
+
+// Transient returns true if the peer rejected the association with
+// pdu.ResultRejectedTransient, i.e., the association may succeed if proposed
+// again later. Otherwise the rejection is permanent.
+func (e *AssociateRejectError) Transient() bool {
+	return e.Result == pdu.ResultRejectedTransient
+}
+
+// SourceDescription returns the description of the source of the rejection,
+// e.g., "DICOM UL service-user".
+func (e *AssociateRejectError) SourceDescription() string {
+	return e.asPDU().SourceDescription()
+}
+
+// ReasonDescription returns the description of the reason of the rejection,
+// e.g., "called AE title not recognized".
+func (e *AssociateRejectError) ReasonDescription() string {
+	return e.asPDU().ReasonDescription()
+}
+
+func (e *AssociateRejectError) asPDU() *pdu.AAssociateRj {
+	return &pdu.AAssociateRj{Result: e.Result, Source: e.Source, Reason: e.Reason}
+}
+
+func (e *AssociateRejectError) Error() string {
+	result := "permanent"
+	if e.Transient() {
+		result = "transient"
+	}
+	return fmt.Sprintf("association rejected by peer (%s, source: %s, reason: %s)", result, e.SourceDescription(), e.ReasonDescription())
+}
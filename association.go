@@ -0,0 +1,129 @@
+package netdicom
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/grailbio/go-dicom"
+)
+
+// Association is an established association over which a sequence of DIMSE
+// operations can be run, e.g., to store all the objects of a study without
+// re-associating for each. Obtain one from ServiceUser.Association.
+//
+// Association is safe for concurrent use. The number of outstanding
+// operations is limited to the asynchronous operations window negotiated with
+// the peer (see ServiceUserParams.MaxOperationsInvoked), so operations are
+// run one at a time unless the peer agreed to more.
+type Association struct {
+	su *ServiceUser
+	cm *contextManager
+
+	// Holds one token per outstanding operation; its capacity is the
+	// negotiated window. Nil if the window is unlimited.
+	window chan struct{}
+}
+
+// Association blocks until the association handshake completes and returns
+// the association. Every call returns the same object.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) Association() (*Association, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.assoc == nil {
+		su.assoc = &Association{su: su, cm: su.cm}
+		if su.cm.maxOpsInvoked > 0 {
+			su.assoc.window = make(chan struct{}, su.cm.maxOpsInvoked)
+		}
+	}
+	return su.assoc, nil
+}
+
+// Waits until another operation can be started.
+func (a *Association) acquire() {
+	if a.window != nil {
+		a.window <- struct{}{}
+	}
+}
+
+func (a *Association) release() {
+	if a.window != nil {
+		<-a.window
+	}
+}
+
+// Send sends a DIMSE request on the presentation context negotiated for
+// sopClassUID and waits for the response with the matching message ID.
+// newCommand is called with the message ID allocated for the request and
+// must return a request carrying that ID. data is the request's data payload,
+// encoded in the transfer syntax of the context (see NegotiatedContexts), or
+// nil if the request has none.
+//
+// Responses with a pending status, e.g., C-FIND matches, are passed to
+// onPending if it is non-nil. Send returns the final response and its data
+// payload. A non-success status doesn't count as an error.
+func (a *Association) Send(
+	sopClassUID string,
+	newCommand func(messageID dimse.MessageID) dimse.Message,
+	data []byte,
+	onPending func(rsp dimse.Message, data []byte)) (dimse.Message, []byte, error) {
+	context, err := a.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.acquire()
+	defer a.release()
+	cs, err := a.su.disp.newCommand(a.cm, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.su.disp.deleteCommand(cs)
+	cmd := newCommand(cs.messageID)
+	if cmd.GetMessageID() != cs.messageID {
+		return nil, nil, fmt.Errorf("dicom.Association(%s): request %v has message ID %d; expect %d",
+			a.cm.label, cmd, cmd.GetMessageID(), cs.messageID)
+	}
+	if cmd.GetStatus() != nil {
+		return nil, nil, fmt.Errorf("dicom.Association(%s): %v is not a request", a.cm.label, cmd)
+	}
+	cs.sendMessage(cmd, data)
+	for {
+		event, ok := <-cs.upcallCh
+		if !ok {
+			return nil, nil, a.su.closedError(fmt.Errorf("dicom.Association(%s): Connection closed while waiting for the response to message %d",
+				a.cm.label, cs.messageID))
+		}
+		status := event.command.GetStatus()
+		if status == nil {
+			return nil, nil, fmt.Errorf("dicom.Association(%s): received request %v while waiting for the response to message %d",
+				a.cm.label, event.command, cs.messageID)
+		}
+		if status.Status == dimse.StatusPending {
+			if onPending != nil {
+				onPending(event.command, event.data)
+			}
+			continue
+		}
+		return event.command, event.data, nil
+	}
+}
+
+// CStore sends "ds" using C-STORE, like ServiceUser.CStoreFromReader, and
+// returns the status sent by the peer.
+func (a *Association) CStore(ds *dicom.DataSet) (dimse.Status, error) {
+	a.acquire()
+	defer a.release()
+	return a.su.cstoreDataSet(context.Background(), ds)
+}
+
+// Abort aborts the association, like ServiceUser.Abort. Operations in progress
+// on the association fail.
+func (a *Association) Abort(source pdu.AbortSourceType, reason pdu.AbortReasonType) error {
+	return a.su.Abort(source, reason)
+}
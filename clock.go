@@ -0,0 +1,19 @@
+package netdicom
+
+import "time"
+
+// Clock is the source of time for the state machine's timers. Tests replace
+// it to fire timers without waiting for them.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after duration d.
+	AfterFunc(d time.Duration, f func())
+}
+
+// realClock is the default Clock. It uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
@@ -1,6 +1,8 @@
 package commandset
 
 import (
+	"sync"
+
 	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
@@ -226,8 +228,15 @@ var tagInfos = []tag.Info{
 	},
 }
 
+var initOnce sync.Once
+
+// Init registers the command tags with the tag dictionary, so that command
+// elements encode and decode with the right VR. It is safe to call Init more
+// than once. Package dimse calls it at initialization.
 func Init() {
-	for _, info := range tagInfos {
-		tag.Add(info, false)
-	}
+	initOnce.Do(func() {
+		for _, info := range tagInfos {
+			tag.Add(info, false)
+		}
+	})
 }
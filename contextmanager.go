@@ -1,14 +1,24 @@
 package netdicom
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 
+	"github.com/giesekow/go-netdicom/pdu"
 	"github.com/giesekow/go-netdicom/pdu/pdu_item"
-	"github.com/grailbio/go-dicom"
-	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomuid"
 )
 
+// ErrNoAcceptedContext is returned, wrapped, by operations on a SOP class that
+// the peer didn't accept a presentation context for, either because it wasn't
+// proposed (see ServiceUserParams.SOPClasses) or because the peer rejected it.
+// Unlike network failures, retrying on the same association is futile; a new
+// association that proposes the SOP class is needed.
+var ErrNoAcceptedContext = errors.New("no accepted presentation context")
+
 type contextManagerEntry struct {
 	contextID         byte
 	abstractSyntaxUID string
@@ -25,9 +35,12 @@ type contextManagerEntry struct {
 // handshake.  ContextID values are 1, 3, 5, etc.  One contextManager is created
 // per association.
 type contextManager struct {
-	label string // for diagnostics only.
+	label  string // for diagnostics only.
+	logger Logger // The logger of the association.
 
-	// The two maps are inverses of each other.
+	// The two maps are inverses of each other, except that a SOP class
+	// proposed in several contexts maps to the one that operations use:
+	// the first accepted one.
 	contextIDToAbstractSyntaxNameMap map[byte]*contextManagerEntry
 	abstractSyntaxNameToContextIDMap map[string]*contextManagerEntry
 
@@ -39,6 +52,45 @@ type contextManager struct {
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
 
+	// The asynchronous operations window negotiated during the handshake
+	// (P3.7 D.3.3.3). Both values are from the viewpoint of the requestor
+	// (the service user), and zero means "unlimited". They default to 1,
+	// i.e., synchronous operations, when the peer doesn't negotiate the
+	// window.
+	maxOpsInvoked   int
+	maxOpsPerformed int
+
+	// User identity sent by the client. Set only on the provider side, and
+	// only if the client sent one.
+	peerUserIdentity *pdu_item.UserIdentitySubItem
+	// Server response to the user identity. Set only on the user side, and
+	// only if the server sent one.
+	peerUserIdentityResponse []byte
+
+	// SOP classes for which the requestor (the service user) may act as
+	// an SCP, as agreed through SCP/SCU role selection (P3.7 D.3.3.4).
+	// C-GET needs this, since the provider sends the datasets back using
+	// C-STORE.
+	requestorSCPRoles map[string]bool
+	// SOP classes for which the requestor proposed role selection, but the
+	// acceptor didn't answer, so the default roles apply: the requestor is
+	// an SCU only (P3.7 D.3.3.4). Set only on the user side.
+	defaultRoleSOPClasses map[string]bool
+	// SOP classes for which role selection was proposed. Set only on the
+	// user side, by generateAssociateRequest.
+	proposedRoleSOPClasses []string
+
+	// Service-class-application-information accepted by the acceptor (the
+	// service provider) through SOP class extended negotiation (P3.7
+	// D.3.3.5), keyed by SOP class UID. A SOP class is absent if the
+	// acceptor didn't accept any.
+	extendedNegotiation map[string][]byte
+
+	// SOP class common extended negotiation sent by the requestor (P3.7
+	// D.3.3.6), keyed by SOP class UID. Set only on the provider side; the
+	// acceptor doesn't respond to it.
+	commonExtendedNegotiation map[string]CommonExtendedNegotiation
+
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
 	// A_ASSOCIATE_RQ PDU. Once an A_ASSOCIATE_AC PDU arrives, tmpRequests
@@ -51,30 +103,44 @@ type contextManager struct {
 func newContextManager(label string) *contextManager {
 	c := &contextManager{
 		label:                            label,
+		logger:                           withLogValues(nil, "association", label),
 		contextIDToAbstractSyntaxNameMap: make(map[byte]*contextManagerEntry),
 		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
+		maxOpsInvoked:                    1,
+		maxOpsPerformed:                  1,
+		requestorSCPRoles:                make(map[string]bool),
+		defaultRoleSOPClasses:            make(map[string]bool),
+		extendedNegotiation:              make(map[string][]byte),
+		commonExtendedNegotiation:        make(map[string]CommonExtendedNegotiation),
 		tmpRequests:                      make(map[byte]*pdu_item.PresentationContextItem),
 	}
 	return c
 }
 
+// Max number of presentation contexts in an association. Context IDs are odd
+// integers between 1 and 255 (P3.8 9.3.2.2).
+const maxPresentationContexts = 128
+
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
-// maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
-func (m *contextManager) generateAssociateRequest(
-	sopClassUIDs []string, transferSyntaxUIDs []string) []pdu_item.SubItem {
+// DefaultMaxPDUSize is the maximum PDU size, in bytes, that the clients is
+// willing to receive. It is encoded in one of the items.
+func (m *contextManager) generateAssociateRequest(params ServiceUserParams) []pdu_item.SubItem {
 	items := []pdu_item.SubItem{
 		&pdu_item.ApplicationContextItem{
 			Name: pdu_item.DICOMApplicationContextItemName,
 		}}
-	var contextID byte = 1
-	for _, sop := range sopClassUIDs {
+	// validateServiceUserParams limits the number of SOP classes, so the
+	// IDs never wrap around.
+	contexts := params.presentationContexts()
+	doassert(len(contexts) <= maxPresentationContexts, contexts)
+	for i, c := range contexts {
+		contextID := byte(2*i + 1) // must be odd.
 		syntaxItems := []pdu_item.SubItem{
-			&pdu_item.AbstractSyntaxSubItem{Name: sop},
+			&pdu_item.AbstractSyntaxSubItem{Name: c.SOPClassUID},
 		}
-		for _, syntaxUID := range transferSyntaxUIDs {
+		for _, syntaxUID := range c.TransferSyntaxes {
 			syntaxItems = append(syntaxItems, &pdu_item.TransferSyntaxSubItem{Name: syntaxUID})
 		}
 		item := &pdu_item.PresentationContextItem{
@@ -85,95 +151,316 @@ func (m *contextManager) generateAssociateRequest(
 		}
 		items = append(items, item)
 		m.tmpRequests[contextID] = item
-		contextID += 2 // must be odd.
 	}
-	items = append(items,
-		&pdu_item.UserInformationItem{
-			Items: []pdu_item.SubItem{
-				&pdu_item.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu_item.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu_item.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
-
+	userInfo := &pdu_item.UserInformationItem{
+		Items: []pdu_item.SubItem{
+			&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)},
+			&pdu_item.ImplementationClassUIDSubItem{Name: params.ImplementationClassUID},
+			&pdu_item.ImplementationVersionNameSubItem{Name: params.ImplementationVersionName}}}
+	if params.MaxOperationsInvoked != 0 || params.MaxOperationsPerformed != 0 {
+		userInfo.Items = append(userInfo.Items,
+			&pdu_item.AsynchronousOperationsWindowSubItem{
+				MaxOpsInvoked:   params.MaxOperationsInvoked,
+				MaxOpsPerformed: params.MaxOperationsPerformed,
+			})
+	}
+	for _, sop := range params.SCPRoleSOPClasses {
+		userInfo.Items = append(userInfo.Items,
+			&pdu_item.RoleSelectionSubItem{SOPClassUID: sop, SCURole: 1, SCPRole: 1})
+	}
+	m.proposedRoleSOPClasses = params.SCPRoleSOPClasses
+	sopClasses := params.proposedSOPClasses()
+	for _, sop := range sopClasses {
+		if info, ok := params.ExtendedNegotiation[sop]; ok {
+			userInfo.Items = append(userInfo.Items,
+				&pdu_item.ExtendedNegotiationSubItem{SOPClassUID: sop, ServiceClassApplicationInfo: info})
+		}
+	}
+	for _, sop := range sopClasses {
+		if c, ok := params.CommonExtendedNegotiation[sop]; ok {
+			userInfo.Items = append(userInfo.Items,
+				&pdu_item.CommonExtendedNegotiationSubItem{
+					SOPClassUID:                sop,
+					ServiceClassUID:            c.ServiceClassUID,
+					RelatedGeneralSOPClassUIDs: c.RelatedGeneralSOPClassUIDs,
+				})
+		}
+	}
+	if id := params.UserIdentity; id != nil {
+		userInfo.Items = append(userInfo.Items,
+			&pdu_item.UserIdentitySubItem{
+				Type:                      id.Type,
+				PositiveResponseRequested: id.PositiveResponseRequested,
+				PrimaryField:              id.PrimaryField,
+				SecondaryField:            id.SecondaryField,
+			})
+	}
+	items = append(items, userInfo)
 	return items
 }
 
+// associateRejectError is returned by onAssociateRequest when the
+// A-ASSOCIATE-RQ is to be rejected. It carries the source and reason to send
+// in A-ASSOCIATE-RJ (P3.8 9.3.4).
+type associateRejectError struct {
+	source pdu.SourceType
+	reason pdu.RejectReasonType
+	err    error
+}
+
+func (e *associateRejectError) Error() string { return e.err.Error() }
+func (e *associateRejectError) Unwrap() error { return e.err }
+
+// Returns an error that rejects the association with the given source and
+// reason.
+func newAssociateRejectError(source pdu.SourceType, reason pdu.RejectReasonType, format string, args ...interface{}) error {
+	return &associateRejectError{source: source, reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// Checks the AE titles of an A-ASSOCIATE-RQ against the provider's
+// configuration. If the request is to be rejected, the error is an
+// *associateRejectError.
+func checkAETitles(params ServiceProviderParams, calledAETitle, callingAETitle string) error {
+	if called := strings.TrimSpace(calledAETitle); !aeTitleListed(params.CalledAETitles, called) {
+		return newAssociateRejectError(pdu.SourceULServiceUser, pdu.RejectReasonCalledAETitleNotRecognized,
+			"dicom.onAssociateRequest: Unknown called AE title %q", called)
+	}
+	if calling := strings.TrimSpace(callingAETitle); !aeTitleListed(params.CallingAETitles, calling) {
+		return newAssociateRejectError(pdu.SourceULServiceUser, pdu.RejectReasonCallingAETitleNotRecognized,
+			"dicom.onAssociateRequest: Calling AE title %q is not allowed", calling)
+	}
+	return nil
+}
+
+// Returns true if "titles" is empty or lists "title", ignoring leading and
+// trailing spaces.
+func aeTitleListed(titles []string, title string) bool {
+	if len(titles) == 0 {
+		return true
+	}
+	for _, t := range titles {
+		if strings.TrimSpace(t) == title {
+			return true
+		}
+	}
+	return false
+}
+
 // Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns a list of items to be sent in
-// the A_ASSOCIATE_AC pdu.
-func (m *contextManager) onAssociateRequest(requestItems []pdu_item.SubItem) ([]pdu_item.SubItem, error) {
+// the A_ASSOCIATE_AC pdu. If the request is to be rejected, the error is an
+// *associateRejectError. Malformed requests are rejected by the ACSE, and
+// requests without any presentation context, or for an application context
+// other than params.ApplicationContextName, by the service user.
+//
+// A request whose presentation contexts are all rejected is still accepted,
+// as P3.8 9.3.3.2 permits; the requestor learns the result of each context
+// from the A-ASSOCIATE-AC.
+func (m *contextManager) onAssociateRequest(params ServiceProviderParams, requestItems []pdu_item.SubItem) ([]pdu_item.SubItem, error) {
+	appContextName := params.ApplicationContextName
+	if appContextName == "" {
+		appContextName = pdu_item.DICOMApplicationContextItemName
+	}
 	responses := []pdu_item.SubItem{
 		&pdu_item.ApplicationContextItem{
-			Name: pdu_item.DICOMApplicationContextItemName,
+			Name: appContextName,
 		},
 	}
+	foundAppContext := false
+	var asyncOpsWindow *pdu_item.AsynchronousOperationsWindowSubItem
+	var roleSelections []*pdu_item.RoleSelectionSubItem
+	var extendedNegotiations []*pdu_item.ExtendedNegotiationSubItem
+	numPresentationContexts := 0
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu_item.ApplicationContextItem:
-			if ri.Name != pdu_item.DICOMApplicationContextItemName {
-				dicomlog.Vprintf(0, "dicom.onAssociateRequest(%s): Found illegal applicationcontextname. Expect %v, found %v",
-					m.label, ri.Name, pdu_item.DICOMApplicationContextItemName)
+			foundAppContext = true
+			// Names may be padded to an even length.
+			if name := strings.TrimRight(ri.Name, "\x00 "); name != appContextName {
+				return nil, newAssociateRejectError(pdu.SourceULServiceUser, pdu.RejectReasonApplicationContextNameNotSupported,
+					"dicom.onAssociateRequest(%s): Unsupported application context name %q, expect %q",
+					m.label, name, appContextName)
 			}
 		case *pdu_item.PresentationContextItem:
+			numPresentationContexts++
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var proposedTransferSyntaxUIDs []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu_item.AbstractSyntaxSubItem:
 					if sopUID != "" {
-						return nil, fmt.Errorf("dicom.onAssociateRequest: Multiple AbstractSyntaxSubItem found in %v",
+						return nil, newAssociateRejectError(pdu.SourceULServiceProviderACSE, pdu.RejectReasonNone,
+							"dicom.onAssociateRequest: Multiple AbstractSyntaxSubItem found in %v",
 							ri.String())
 					}
 					sopUID = c.Name
 				case *pdu_item.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					proposedTransferSyntaxUIDs = append(proposedTransferSyntaxUIDs, c.Name)
 				default:
-					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
+					return nil, newAssociateRejectError(pdu.SourceULServiceProviderACSE, pdu.RejectReasonNone,
+						"dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
-				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
+			if sopUID == "" || len(proposedTransferSyntaxUIDs) == 0 {
+				return nil, newAssociateRejectError(pdu.SourceULServiceProviderACSE, pdu.RejectReasonNone,
+					"dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
+			result := pdu_item.PresentationContextAccepted
+			pickedTransferSyntaxUID := pickTransferSyntax(params.TransferSyntaxes, proposedTransferSyntaxUIDs)
+			if pickedTransferSyntaxUID == "" {
+				m.logger.Warn("None of the proposed transfer syntaxes is supported",
+					"sopClass", dicomuid.UIDString(sopUID), "transferSyntaxes", proposedTransferSyntaxUIDs)
+				result = pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported
+				// P3.8 9.3.3.2: the transfer syntax is not
+				// significant when the context is rejected.
+				pickedTransferSyntaxUID = proposedTransferSyntaxUIDs[0]
+			}
 			responses = append(responses, &pdu_item.PresentationContextItem{
 				Type:      pdu_item.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			dicomlog.Vprintf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
-				m.label, m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
+			logVerbose(m.logger, "Adding context mapping",
+				"sopClass", sopUID, "transferSyntax", pickedTransferSyntaxUID, "contextID", ri.ContextID)
 			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu_item.PresentationContextAccepted)
+			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result)
 		case *pdu_item.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu_item.UserInformationMaximumLengthItem:
-					m.peerMaxPDUSize = int(c.MaximumLengthReceived)
+					m.peerMaxPDUSize = maxPDUSizeFromLength(c.MaximumLengthReceived)
 				case *pdu_item.ImplementationClassUIDSubItem:
 					m.peerImplementationClassUID = c.Name
 				case *pdu_item.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu_item.AsynchronousOperationsWindowSubItem:
+					asyncOpsWindow = &pdu_item.AsynchronousOperationsWindowSubItem{
+						MaxOpsInvoked:   limitOps(c.MaxOpsInvoked, params.MaxOperationsInvoked),
+						MaxOpsPerformed: limitOps(c.MaxOpsPerformed, params.MaxOperationsPerformed),
+					}
+					m.maxOpsInvoked = int(asyncOpsWindow.MaxOpsInvoked)
+					m.maxOpsPerformed = int(asyncOpsWindow.MaxOpsPerformed)
+				case *pdu_item.UserIdentitySubItem:
+					m.peerUserIdentity = c
+				case *pdu_item.RoleSelectionSubItem:
+					role := &pdu_item.RoleSelectionSubItem{
+						SOPClassUID: c.SOPClassUID,
+						SCURole:     c.SCURole,
+						SCPRole:     c.SCPRole,
+					}
+					if params.RoleSelection != nil {
+						scu, scp := params.RoleSelection(c.SOPClassUID, c.SCURole == 1, c.SCPRole == 1)
+						if !scu {
+							role.SCURole = 0
+						}
+						if !scp {
+							role.SCPRole = 0
+						}
+					}
+					roleSelections = append(roleSelections, role)
+					m.requestorSCPRoles[c.SOPClassUID] = role.SCPRole == 1
+				case *pdu_item.ExtendedNegotiationSubItem:
+					if params.ExtendedNegotiation == nil {
+						break
+					}
+					info := params.ExtendedNegotiation(c.SOPClassUID, c.ServiceClassApplicationInfo)
+					if info == nil {
+						break
+					}
+					m.extendedNegotiation[c.SOPClassUID] = info
+					extendedNegotiations = append(extendedNegotiations, &pdu_item.ExtendedNegotiationSubItem{
+						SOPClassUID:                 c.SOPClassUID,
+						ServiceClassApplicationInfo: info,
+					})
+				case *pdu_item.CommonExtendedNegotiationSubItem:
+					m.commonExtendedNegotiation[c.SOPClassUID] = CommonExtendedNegotiation{
+						ServiceClassUID:            c.ServiceClassUID,
+						RelatedGeneralSOPClassUIDs: c.RelatedGeneralSOPClassUIDs,
+					}
 				}
 			}
 		}
 	}
-	responses = append(responses,
-		&pdu_item.UserInformationItem{
-			Items: []pdu_item.SubItem{&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
-	dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
-		m.label, len(m.contextIDToAbstractSyntaxNameMap),
-		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
+	if !foundAppContext {
+		return nil, newAssociateRejectError(pdu.SourceULServiceUser, pdu.RejectReasonApplicationContextNameNotSupported,
+			"dicom.onAssociateRequest(%s): No application context name proposed", m.label)
+	}
+	if numPresentationContexts == 0 {
+		return nil, newAssociateRejectError(pdu.SourceULServiceUser, pdu.RejectReasonNone,
+			"dicom.onAssociateRequest(%s): No presentation context proposed", m.label)
+	}
+	userInfo := &pdu_item.UserInformationItem{
+		Items: []pdu_item.SubItem{
+			&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)},
+			&pdu_item.ImplementationClassUIDSubItem{Name: params.ImplementationClassUID},
+			&pdu_item.ImplementationVersionNameSubItem{Name: params.ImplementationVersionName}}}
+	if asyncOpsWindow != nil {
+		// P3.7 D.3.3.3.1: the window is included in A-ASSOCIATE-AC only
+		// if it was proposed in A-ASSOCIATE-RQ.
+		userInfo.Items = append(userInfo.Items, asyncOpsWindow)
+	}
+	for _, c := range roleSelections {
+		userInfo.Items = append(userInfo.Items, c)
+	}
+	for _, c := range extendedNegotiations {
+		// P3.7 D.3.3.5: the acceptor omits the item for the SOP
+		// classes whose extended negotiation it doesn't support.
+		userInfo.Items = append(userInfo.Items, c)
+	}
+	responses = append(responses, userInfo)
+	m.logger.Debug("Received associate request",
+		"contexts", len(m.contextIDToAbstractSyntaxNameMap),
+		"maxPDU", m.peerMaxPDUSize, "implClass", m.peerImplementationClassUID, "version", m.peerImplementationVersionName,
+		"asyncOps", fmt.Sprintf("%v/%v", m.maxOpsInvoked, m.maxOpsPerformed))
 	return responses, nil
 }
 
+// Returns the number of asynchronous operations to accept, given the number
+// "proposed" by the requestor and the "limit" set by the acceptor. Zero means
+// unlimited in both.
+func limitOps(proposed uint16, limit int) uint16 {
+	if limit <= 0 || (proposed != 0 && int(proposed) <= limit) {
+		return proposed
+	}
+	if limit > math.MaxUint16 {
+		return 0
+	}
+	return uint16(limit)
+}
+
+// Picks the transfer syntax for a presentation context. "supported" lists the
+// syntaxes accepted by the provider, most preferred first, and "proposed" lists
+// the syntaxes offered by the user. Returns the first syntax in "supported"
+// that's also in "proposed", or "" if there is none. If "supported" is empty,
+// returns the first proposed syntax.
+func pickTransferSyntax(supported, proposed []string) string {
+	if len(supported) == 0 {
+		return proposed[0]
+	}
+	for _, uid := range supported {
+		for _, p := range proposed {
+			if uid == p {
+				return uid
+			}
+		}
+	}
+	return ""
+}
+
 // Called by the user (client) to when A_ASSOCIATE_AC PDU arrives from the provider.
 func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error {
+	seenContextIDs := make(map[byte]bool)
 	for _, responseItem := range responses {
 		switch ri := responseItem.(type) {
 		case *pdu_item.PresentationContextItem:
+			if seenContextIDs[ri.ContextID] {
+				// Accepting it would overwrite the mapping
+				// recorded for the first item.
+				return fmt.Errorf("dicom.onAssociateResponse(%s): Duplicate context ID %d in A_ASSOCIATE_AC: %v",
+					m.label, ri.ContextID, ri.String())
+			}
+			seenContextIDs[ri.ContextID] = true
 			var pickedTransferSyntaxUID string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -211,7 +498,8 @@ func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error
 				return fmt.Errorf("dicom.onAssociateResponse(%s): The A-ASSOCIATE request lacks the abstract syntax item for tag %v (this shouldn't happen)", m.label, ri.ContextID)
 			}
 			if ri.Result != pdu_item.PresentationContextAccepted {
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Abstract syntax %v, transfer syntax %v was rejected by the server: %s", m.label, dicomuid.UIDString(sopUID), dicomuid.UIDString(pickedTransferSyntaxUID), ri.Result.String())
+				m.logger.Warn("Presentation context rejected by the server",
+					"sopClass", dicomuid.UIDString(sopUID), "transferSyntax", dicomuid.UIDString(pickedTransferSyntaxUID), "result", ri.Result.String())
 			}
 			if !found {
 				// Generally, we expect the server to pick a
@@ -221,34 +509,63 @@ func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error
 				// the point of reporting the list in
 				// A-ASSOCIATE-RQ, but that's only one of
 				// DICOM's pointless complexities.
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): The server picked TransferSyntaxUID '%s' for %s, which is not in the list proposed, %v",
-					m.label,
-					dicomuid.UIDString(pickedTransferSyntaxUID),
-					dicomuid.UIDString(sopUID),
-					request.Items)
+				m.logger.Warn("The server picked a transfer syntax that wasn't proposed",
+					"transferSyntax", dicomuid.UIDString(pickedTransferSyntaxUID),
+					"sopClass", dicomuid.UIDString(sopUID),
+					"proposed", request.Items)
 			}
 			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result)
 		case *pdu_item.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu_item.UserInformationMaximumLengthItem:
-					m.peerMaxPDUSize = int(c.MaximumLengthReceived)
+					m.peerMaxPDUSize = maxPDUSizeFromLength(c.MaximumLengthReceived)
 				case *pdu_item.ImplementationClassUIDSubItem:
 					m.peerImplementationClassUID = c.Name
 				case *pdu_item.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu_item.AsynchronousOperationsWindowSubItem:
+					m.maxOpsInvoked = int(c.MaxOpsInvoked)
+					m.maxOpsPerformed = int(c.MaxOpsPerformed)
+				case *pdu_item.UserIdentityResponseSubItem:
+					m.peerUserIdentityResponse = c.ServerResponse
+				case *pdu_item.RoleSelectionSubItem:
+					m.requestorSCPRoles[c.SOPClassUID] = c.SCPRole == 1
+				case *pdu_item.ExtendedNegotiationSubItem:
+					m.extendedNegotiation[c.SOPClassUID] = c.ServiceClassApplicationInfo
 				}
 			}
 		}
 	}
-	dicomlog.Vprintf(1, "dicom.onAssociateResponse(%s): Received associate response, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
-		m.label,
-		len(m.contextIDToAbstractSyntaxNameMap),
-		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
+	for _, sop := range m.proposedRoleSOPClasses {
+		if _, ok := m.requestorSCPRoles[sop]; !ok {
+			// P3.7 D.3.3.4: an acceptor that omits the sub-item
+			// rejects the proposal, and the default roles apply.
+			m.logger.Debug("No role selection returned; acting as SCU only",
+				"sopClass", dicomuid.UIDString(sop))
+			m.requestorSCPRoles[sop] = false
+			m.defaultRoleSOPClasses[sop] = true
+		}
+	}
+	m.logger.Debug("Received associate response",
+		"contexts", len(m.contextIDToAbstractSyntaxNameMap),
+		"maxPDU", m.peerMaxPDUSize, "implClass", m.peerImplementationClassUID, "version", m.peerImplementationVersionName,
+		"asyncOps", fmt.Sprintf("%v/%v", m.maxOpsInvoked, m.maxOpsPerformed))
 	return nil
 }
 
+// Returns the max size of the PDUs to send to a peer whose maximum length
+// sub-item carries "length". Zero means that the peer accepts PDUs of any
+// length (P3.8 D.1.1), in which case PDUs are limited to DefaultMaxPDUSize,
+// the size this side accepts. If the peer omits the sub-item, which some
+// legacy SCPs do, the default set by newContextManager applies.
+func maxPDUSizeFromLength(length uint32) int {
+	if length == 0 {
+		return DefaultMaxPDUSize
+	}
+	return int(length)
+}
+
 // Add a mapping between a (global) UID and a (per-session) context ID.
 func addContextMapping(
 	m *contextManager,
@@ -256,9 +573,8 @@ func addContextMapping(
 	transferSyntaxUID string,
 	contextID byte,
 	result pdu_item.PresentationContextResult) {
-	dicomlog.Vprintf(2, "dicom.addContextMapping(%v): Map context %d -> %s, %s",
-		m.label, contextID, dicomuid.UIDString(abstractSyntaxUID),
-		dicomuid.UIDString(transferSyntaxUID))
+	logVerbose(m.logger, "Mapping context", "contextID", contextID,
+		"sopClass", dicomuid.UIDString(abstractSyntaxUID), "transferSyntax", dicomuid.UIDString(transferSyntaxUID))
 	doassert(result >= 0 && result <= 4, result)
 	doassert(contextID%2 == 1, contextID)
 	if result == 0 {
@@ -272,9 +588,130 @@ func addContextMapping(
 		result:            result,
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
+	if prev, ok := m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID]; ok {
+		// The SOP class was proposed in several contexts. Prefer an
+		// accepted one, then the one proposed first, i.e., with the
+		// lowest ID, regardless of the order of the responses.
+		prevAccepted := prev.result == pdu_item.PresentationContextAccepted
+		accepted := result == pdu_item.PresentationContextAccepted
+		if prevAccepted && !accepted || prevAccepted == accepted && prev.contextID < contextID {
+			return
+		}
+	}
 	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
 }
 
+// NegotiatedContext is the outcome of negotiating one presentation context
+// during the association handshake.
+type NegotiatedContext struct {
+	ContextID         byte
+	AbstractSyntaxUID string
+	// The transfer syntax picked by the provider. It may be empty if the
+	// context was rejected.
+	TransferSyntaxUID string
+	Result            pdu_item.PresentationContextResult
+}
+
+// Accepted returns true iff the provider accepted the context.
+func (c NegotiatedContext) Accepted() bool {
+	return c.Result == pdu_item.PresentationContextAccepted
+}
+
+// Returns the list of negotiated contexts, sorted by context ID.
+func (m *contextManager) negotiatedContexts() []NegotiatedContext {
+	contexts := make([]NegotiatedContext, 0, len(m.contextIDToAbstractSyntaxNameMap))
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		contexts = append(contexts, NegotiatedContext{
+			ContextID:         e.contextID,
+			AbstractSyntaxUID: e.abstractSyntaxUID,
+			TransferSyntaxUID: e.transferSyntaxUID,
+			Result:            e.result,
+		})
+	}
+	sort.Slice(contexts, func(i, j int) bool {
+		return contexts[i].ContextID < contexts[j].ContextID
+	})
+	return contexts
+}
+
+// AssociationInfo is a snapshot of the parameters negotiated during the
+// association handshake.
+type AssociationInfo struct {
+	CalledAETitle  string
+	CallingAETitle string
+
+	// Max size of the PDUs the peer accepts.
+	PeerMaxPDUSize int
+
+	// Implementation class UID and version name advertised by the peer.
+	// They are empty if the peer didn't send them.
+	PeerImplementationClassUID    string
+	PeerImplementationVersionName string
+
+	// Asynchronous operations window, from the viewpoint of the requestor
+	// (the service user). Zero means unlimited.
+	MaxOperationsInvoked   int
+	MaxOperationsPerformed int
+
+	// The accepted presentation contexts, sorted by context ID.
+	Contexts []AssociationContext
+}
+
+// AssociationContext is a presentation context accepted during the
+// association handshake.
+type AssociationContext struct {
+	ContextID         byte
+	AbstractSyntaxUID string
+	TransferSyntaxUID string
+
+	// Set if the requestor (the service user) may act as an SCP for the
+	// abstract syntax, as agreed through SCP/SCU role selection (P3.7
+	// D.3.3.4). The requestor may always act as an SCU.
+	RequestorSCPRole bool
+	// Set on the user side if it proposed role selection for the abstract
+	// syntax, but the acceptor didn't answer. The default roles then
+	// apply, so RequestorSCPRole is false.
+	DefaultRoles bool
+
+	// The service class and related general SOP classes of the abstract
+	// syntax, as sent by the requestor through SOP class common extended
+	// negotiation (P3.7 D.3.3.6). Set only on the provider side, and only
+	// if the requestor sent them.
+	CommonExtendedNegotiation *CommonExtendedNegotiation
+}
+
+// Returns a snapshot of the negotiated parameters. Must be called after the
+// handshake completes. The AE titles are as found in the A-ASSOCIATE PDUs,
+// where they are padded with spaces.
+func (m *contextManager) associationInfo(calledAETitle, callingAETitle string) *AssociationInfo {
+	info := &AssociationInfo{
+		CalledAETitle:                 strings.TrimSpace(calledAETitle),
+		CallingAETitle:                strings.TrimSpace(callingAETitle),
+		PeerMaxPDUSize:                m.peerMaxPDUSize,
+		PeerImplementationClassUID:    m.peerImplementationClassUID,
+		PeerImplementationVersionName: m.peerImplementationVersionName,
+		MaxOperationsInvoked:          m.maxOpsInvoked,
+		MaxOperationsPerformed:        m.maxOpsPerformed,
+	}
+	for _, c := range m.negotiatedContexts() {
+		if !c.Accepted() {
+			continue
+		}
+		ac := AssociationContext{
+			ContextID:         c.ContextID,
+			AbstractSyntaxUID: c.AbstractSyntaxUID,
+			TransferSyntaxUID: c.TransferSyntaxUID,
+			RequestorSCPRole:  m.requestorSCPRoles[c.AbstractSyntaxUID],
+			DefaultRoles:      m.defaultRoleSOPClasses[c.AbstractSyntaxUID],
+		}
+		if cen, ok := m.commonExtendedNegotiation[c.AbstractSyntaxUID]; ok {
+			ac.CommonExtendedNegotiation = &cen
+		}
+		info.Contexts = append(info.Contexts, ac)
+	}
+	return info
+}
+
 func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	if e.result != pdu_item.PresentationContextAccepted {
 		return fmt.Errorf("dicom.checkContextRejection %v: Trying to use rejected context <%v, %v>: %s",
@@ -286,19 +723,50 @@ func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	return nil
 }
 
-// Convert an UID to a context ID.
+// Convert an UID to a context ID. The error wraps ErrNoAcceptedContext if
+// there's no accepted context for the UID.
 func (m *contextManager) lookupByAbstractSyntaxUID(name string) (contextManagerEntry, error) {
 	e, ok := m.abstractSyntaxNameToContextIDMap[name]
 	if !ok {
-		return contextManagerEntry{}, fmt.Errorf("dicom.checkContextRejection %v: Unknown syntax %s", m.label, dicomuid.UIDString(name))
+		return contextManagerEntry{}, fmt.Errorf("dicom.lookupByAbstractSyntaxUID %v: %w: syntax %s wasn't negotiated", m.label, ErrNoAcceptedContext, dicomuid.UIDString(name))
 	}
 	err := m.checkContextRejection(e)
 	if err != nil {
-		return contextManagerEntry{}, err
+		return contextManagerEntry{}, fmt.Errorf("%w: %w", ErrNoAcceptedContext, err)
 	}
 	return *e, nil
 }
 
+// Returns the accepted context with the lowest ID that has the given abstract
+// and transfer syntaxes. A SOP class may have been proposed in several contexts,
+// e.g., one per transfer syntax.
+func (m *contextManager) lookupByAbstractAndTransferSyntaxUID(abstractSyntaxUID, transferSyntaxUID string) (contextManagerEntry, bool) {
+	var found *contextManagerEntry
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		if e.abstractSyntaxUID != abstractSyntaxUID || e.transferSyntaxUID != transferSyntaxUID ||
+			e.result != pdu_item.PresentationContextAccepted {
+			continue
+		}
+		if found == nil || e.contextID < found.contextID {
+			found = e
+		}
+	}
+	if found == nil {
+		return contextManagerEntry{}, false
+	}
+	return *found, true
+}
+
+// Returns the abstract and transfer syntaxes negotiated for contextID, e.g.,
+// to decode the payload that CommandAssembler.AddDataPDU returns for it.
+func (m *contextManager) syntaxesByContextID(contextID byte) (abstractSyntaxUID, transferSyntaxUID string, err error) {
+	e, err := m.lookupByContextID(contextID)
+	if err != nil {
+		return "", "", err
+	}
+	return e.abstractSyntaxUID, e.transferSyntaxUID, nil
+}
+
 // Convert a contextID to a UID.
 func (m *contextManager) lookupByContextID(contextID byte) (contextManagerEntry, error) {
 	e, ok := m.contextIDToAbstractSyntaxNameMap[contextID]
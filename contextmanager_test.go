@@ -0,0 +1,474 @@
+package netdicom
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/giesekow/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiatedContextsWithRejections(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses: []string{
+			dicomuid.VerificationSOPClass,
+			sopclass.StorageClasses[0],
+			sopclass.StorageClasses[1],
+		},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+	})
+	response := func(contextID byte, result pdu_item.PresentationContextResult, transferSyntaxUID string) *pdu_item.PresentationContextItem {
+		return &pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextResponse,
+			ContextID: contextID,
+			Result:    result,
+			Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: transferSyntaxUID}},
+		}
+	}
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{
+		response(1, pdu_item.PresentationContextAccepted, dicomuid.ImplicitVRLittleEndian),
+		response(3, pdu_item.PresentationContextProviderRejectionAbstractSyntaxNotSupported, dicomuid.ImplicitVRLittleEndian),
+		response(5, pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported, dicomuid.ExplicitVRLittleEndian),
+	}))
+
+	contexts := cm.negotiatedContexts()
+	require.Equal(t, []NegotiatedContext{
+		{ContextID: 1, AbstractSyntaxUID: dicomuid.VerificationSOPClass, TransferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+			Result: pdu_item.PresentationContextAccepted},
+		{ContextID: 3, AbstractSyntaxUID: sopclass.StorageClasses[0], TransferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+			Result: pdu_item.PresentationContextProviderRejectionAbstractSyntaxNotSupported},
+		{ContextID: 5, AbstractSyntaxUID: sopclass.StorageClasses[1], TransferSyntaxUID: dicomuid.ExplicitVRLittleEndian,
+			Result: pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported},
+	}, contexts)
+	require.True(t, contexts[0].Accepted())
+	require.False(t, contexts[1].Accepted())
+
+	_, err := cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
+	require.NoError(t, err)
+	_, err = cm.lookupByAbstractSyntaxUID(sopclass.StorageClasses[0])
+	require.ErrorIs(t, err, ErrNoAcceptedContext)
+	_, err = cm.lookupByAbstractSyntaxUID(dicomuid.StudyRootQRFind) // Not proposed.
+	require.ErrorIs(t, err, ErrNoAcceptedContext)
+}
+
+func TestProposedContexts(t *testing.T) {
+	storage := sopclass.StorageClasses[0]
+	const jpegBaseline = "1.2.840.10008.1.2.4.50"
+	params := ServiceUserParams{
+		SOPClasses: []string{dicomuid.VerificationSOPClass},
+		ProposedContexts: []ProposedContext{
+			{SOPClassUID: storage, TransferSyntaxes: []string{jpegBaseline}},
+			{SOPClassUID: storage, TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian}},
+			{SOPClassUID: storage, TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+		},
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(params)
+	var proposed []*pdu_item.PresentationContextItem
+	for _, item := range items {
+		if c, ok := item.(*pdu_item.PresentationContextItem); ok {
+			proposed = append(proposed, c)
+		}
+	}
+	require.Len(t, proposed, 4)
+	require.Equal(t, byte(3), proposed[1].ContextID)
+	require.Equal(t, []pdu_item.SubItem{
+		&pdu_item.AbstractSyntaxSubItem{Name: storage},
+		&pdu_item.TransferSyntaxSubItem{Name: jpegBaseline},
+	}, proposed[1].Items)
+
+	// A provider that doesn't support JPEG, and accepts the other two.
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+	}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+
+	// The first accepted context wins, on both sides.
+	for _, cm := range []*contextManager{user, provider} {
+		context, err := cm.lookupByAbstractSyntaxUID(storage)
+		require.NoError(t, err)
+		require.Equal(t, byte(5), context.contextID)
+		require.Equal(t, dicomuid.ExplicitVRLittleEndian, context.transferSyntaxUID)
+	}
+	// Unless the transfer syntax is given.
+	context, ok := user.lookupByAbstractAndTransferSyntaxUID(storage, dicomuid.ImplicitVRLittleEndian)
+	require.True(t, ok)
+	require.Equal(t, byte(7), context.contextID)
+	_, ok = user.lookupByAbstractAndTransferSyntaxUID(storage, jpegBaseline) // Rejected.
+	require.False(t, ok)
+	contexts := user.negotiatedContexts()
+	require.Len(t, contexts, 4)
+	require.False(t, contexts[1].Accepted())
+	require.True(t, contexts[2].Accepted())
+	require.True(t, contexts[3].Accepted())
+}
+
+func TestProviderTransferSyntaxPreference(t *testing.T) {
+	const jpegLossless = "1.2.840.10008.1.2.4.70"
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(ServiceUserParams{
+		SOPClasses: []string{dicomuid.VerificationSOPClass},
+		TransferSyntaxes: []string{
+			dicomuid.ImplicitVRLittleEndian,
+			jpegLossless,
+			dicomuid.ExplicitVRLittleEndian,
+		},
+	})
+
+	negotiate := func(supported []string) NegotiatedContext {
+		provider := newContextManager("provider")
+		responses, err := provider.onAssociateRequest(ServiceProviderParams{TransferSyntaxes: supported}, items)
+		require.NoError(t, err)
+		contexts := provider.negotiatedContexts()
+		require.Len(t, contexts, 1)
+
+		user := newContextManager("user")
+		user.generateAssociateRequest(ServiceUserParams{
+			SOPClasses:       []string{dicomuid.VerificationSOPClass},
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		})
+		require.NoError(t, user.onAssociateResponse(responses))
+		require.Equal(t, contexts, user.negotiatedContexts())
+		return contexts[0]
+	}
+
+	// Without a preference, the first syntax proposed by the user wins.
+	c := negotiate(nil)
+	require.True(t, c.Accepted())
+	require.Equal(t, dicomuid.ImplicitVRLittleEndian, c.TransferSyntaxUID)
+
+	// Otherwise the provider's preference order decides.
+	c = negotiate([]string{dicomuid.ExplicitVRLittleEndian, jpegLossless, dicomuid.ImplicitVRLittleEndian})
+	require.True(t, c.Accepted())
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, c.TransferSyntaxUID)
+	c = negotiate([]string{dicomuid.ExplicitVRBigEndian, jpegLossless})
+	require.True(t, c.Accepted())
+	require.Equal(t, jpegLossless, c.TransferSyntaxUID)
+
+	c = negotiate([]string{dicomuid.ExplicitVRBigEndian})
+	require.False(t, c.Accepted())
+	require.Equal(t, pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported, c.Result)
+}
+
+func TestSCPRoleSelection(t *testing.T) {
+	params := ServiceUserParams{
+		SOPClasses:       sopclass.QRGetClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Equal(t, sopclass.StorageClasses, params.SCPRoleSOPClasses)
+
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(params)
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	for _, m := range []*contextManager{user, provider} {
+		require.True(t, m.requestorSCPRoles[sopclass.StorageClasses[0]])
+		require.False(t, m.requestorSCPRoles[dicomuid.PatientRootQRGet])
+	}
+
+	// Role selection isn't proposed unless C-GET is used.
+	params = ServiceUserParams{SOPClasses: sopclass.StorageClasses}
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Empty(t, params.SCPRoleSOPClasses)
+}
+
+func TestSCPRoleSelectionPolicy(t *testing.T) {
+	params := ServiceUserParams{
+		SOPClasses:       sopclass.QRGetClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(params)
+	provider := newContextManager("provider")
+	ctStorage := sopclass.StorageClasses[0]
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{
+		RoleSelection: func(sopClassUID string, scuRole, scpRole bool) (bool, bool) {
+			// Grants the SCP role for one class only, and never
+			// the SCU role.
+			require.True(t, scuRole)
+			require.True(t, scpRole)
+			return false, sopClassUID == ctStorage
+		},
+	}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	for _, m := range []*contextManager{user, provider} {
+		require.True(t, m.requestorSCPRoles[ctStorage])
+		require.False(t, m.requestorSCPRoles[sopclass.StorageClasses[1]])
+	}
+	for _, item := range responses {
+		if userInfo, ok := item.(*pdu_item.UserInformationItem); ok {
+			for _, subItem := range userInfo.Items {
+				if role, ok := subItem.(*pdu_item.RoleSelectionSubItem); ok {
+					require.Equal(t, byte(0), role.SCURole)
+				}
+			}
+		}
+	}
+}
+
+func TestAsyncOperationsWindowLimits(t *testing.T) {
+	negotiate := func(invoked, performed uint16, limitInvoked, limitPerformed int) (int, int) {
+		user := newContextManager("user")
+		items := user.generateAssociateRequest(ServiceUserParams{
+			SOPClasses:             []string{dicomuid.VerificationSOPClass},
+			TransferSyntaxes:       []string{dicomuid.ImplicitVRLittleEndian},
+			MaxOperationsInvoked:   invoked,
+			MaxOperationsPerformed: performed,
+		})
+		provider := newContextManager("provider")
+		responses, err := provider.onAssociateRequest(ServiceProviderParams{
+			MaxOperationsInvoked:   limitInvoked,
+			MaxOperationsPerformed: limitPerformed,
+		}, items)
+		require.NoError(t, err)
+		require.NoError(t, user.onAssociateResponse(responses))
+		require.Equal(t, provider.maxOpsInvoked, user.maxOpsInvoked)
+		require.Equal(t, provider.maxOpsPerformed, user.maxOpsPerformed)
+		return user.maxOpsInvoked, user.maxOpsPerformed
+	}
+	invoked, performed := negotiate(5, 3, 0, 0)
+	require.Equal(t, []int{5, 3}, []int{invoked, performed})
+	invoked, performed = negotiate(5, 3, 2, 4)
+	require.Equal(t, []int{2, 3}, []int{invoked, performed})
+	// An unlimited proposal is lowered to the limit.
+	invoked, performed = negotiate(0, 3, 8, 0)
+	require.Equal(t, []int{8, 3}, []int{invoked, performed})
+}
+
+func TestSCPRoleSelectionNotAnswered(t *testing.T) {
+	params := ServiceUserParams{
+		SOPClasses:       sopclass.QRGetClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(params)
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{}, items)
+	require.NoError(t, err)
+	// An acceptor that doesn't support role selection.
+	for _, item := range responses {
+		if userInfo, ok := item.(*pdu_item.UserInformationItem); ok {
+			var subItems []pdu_item.SubItem
+			for _, subItem := range userInfo.Items {
+				if _, ok := subItem.(*pdu_item.RoleSelectionSubItem); !ok {
+					subItems = append(subItems, subItem)
+				}
+			}
+			userInfo.Items = subItems
+		}
+	}
+	require.NoError(t, user.onAssociateResponse(responses))
+	storage := sopclass.StorageClasses[0]
+	require.False(t, user.requestorSCPRoles[storage])
+	info := user.associationInfo("provider", "user")
+	var found bool
+	for _, c := range info.Contexts {
+		if c.AbstractSyntaxUID == storage {
+			found = true
+			require.True(t, c.DefaultRoles)
+			require.False(t, c.RequestorSCPRole)
+		}
+		if c.AbstractSyntaxUID == dicomuid.PatientRootQRGet {
+			// Role selection wasn't proposed for it.
+			require.False(t, c.DefaultRoles)
+		}
+	}
+	require.True(t, found)
+}
+
+func TestExtendedNegotiationRelationalQuery(t *testing.T) {
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind, dicomuid.StudyRootQRMove},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		// Relational queries, combined date-time matching, fuzzy
+		// person-name matching.
+		ExtendedNegotiation: map[string][]byte{dicomuid.StudyRootQRFind: {1, 1, 1}},
+	})
+
+	var proposedSOPClasses []string
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{
+		ExtendedNegotiation: func(sopClassUID string, proposed []byte) []byte {
+			proposedSOPClasses = append(proposedSOPClasses, sopClassUID)
+			// Only relational queries are supported.
+			return []byte{proposed[0], 0, 0}
+		},
+	}, items)
+	require.NoError(t, err)
+	require.Equal(t, []string{dicomuid.StudyRootQRFind}, proposedSOPClasses)
+	require.NoError(t, user.onAssociateResponse(responses))
+	for _, m := range []*contextManager{user, provider} {
+		require.Equal(t, map[string][]byte{dicomuid.StudyRootQRFind: {1, 0, 0}}, m.extendedNegotiation)
+	}
+
+	// Without a callback, the provider declines extended negotiation.
+	user = newContextManager("user")
+	items = user.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:          []string{dicomuid.StudyRootQRFind},
+		TransferSyntaxes:    []string{dicomuid.ImplicitVRLittleEndian},
+		ExtendedNegotiation: map[string][]byte{dicomuid.StudyRootQRFind: {1}},
+	})
+	responses, err = newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.Empty(t, user.extendedNegotiation)
+}
+
+func TestCommonExtendedNegotiation(t *testing.T) {
+	const privateSRStorage = "1.2.3.4.5.6"
+	cen := CommonExtendedNegotiation{
+		ServiceClassUID:            "1.2.840.10008.4.2", // Storage service class.
+		RelatedGeneralSOPClassUIDs: []string{"1.2.840.10008.5.1.4.1.1.88.22", "1.2.840.10008.5.1.4.1.1.88.33"},
+	}
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{privateSRStorage, dicomuid.VerificationSOPClass},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		CommonExtendedNegotiation: map[string]CommonExtendedNegotiation{
+			privateSRStorage: cen,
+			// Not proposed, so ignored.
+			dicomuid.StudyRootQRFind: {ServiceClassUID: "1.2.840.10008.4.3"},
+		},
+	})
+	// Send the request through the wire format.
+	data, err := pdu.EncodePDU(&pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items:           items,
+	})
+	require.NoError(t, err)
+	v, err := pdu.ReadPDU(bytes.NewReader(data), DefaultMaxPDUSize)
+	require.NoError(t, err)
+
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(ServiceProviderParams{}, v.(*pdu.AAssociateRQ).Items)
+	require.NoError(t, err)
+	require.Equal(t, map[string]CommonExtendedNegotiation{privateSRStorage: cen}, provider.commonExtendedNegotiation)
+	info := provider.associationInfo("provider", "user")
+	require.Len(t, info.Contexts, 2)
+	require.Equal(t, privateSRStorage, info.Contexts[0].AbstractSyntaxUID)
+	require.Equal(t, &cen, info.Contexts[0].CommonExtendedNegotiation)
+	require.Nil(t, info.Contexts[1].CommonExtendedNegotiation)
+
+	// The acceptor doesn't respond to the sub-item.
+	for _, item := range responses {
+		if userInfo, ok := item.(*pdu_item.UserInformationItem); ok {
+			for _, subItem := range userInfo.Items {
+				_, ok := subItem.(*pdu_item.CommonExtendedNegotiationSubItem)
+				require.False(t, ok, subItem.String())
+			}
+		}
+	}
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.Empty(t, user.commonExtendedNegotiation)
+}
+
+func TestPeerMaxPDUSizeWithoutMaximumLength(t *testing.T) {
+	params := ServiceUserParams{
+		SOPClasses:       []string{dicomuid.VerificationSOPClass},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	}
+	items := newContextManager("user").generateAssociateRequest(params)
+	for _, test := range []struct {
+		name string
+		// Rewrites the maximum length sub-item of A-ASSOCIATE-AC, or
+		// returns nil to drop it.
+		rewrite func(*pdu_item.UserInformationMaximumLengthItem) pdu_item.SubItem
+		want    int
+	}{
+		{"absent", func(*pdu_item.UserInformationMaximumLengthItem) pdu_item.SubItem { return nil }, 16384},
+		{"unlimited", func(c *pdu_item.UserInformationMaximumLengthItem) pdu_item.SubItem {
+			return &pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: 0}
+		}, DefaultMaxPDUSize},
+		{"limited", func(c *pdu_item.UserInformationMaximumLengthItem) pdu_item.SubItem { return c }, DefaultMaxPDUSize},
+	} {
+		responses, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, items)
+		require.NoError(t, err)
+		for _, item := range responses {
+			userInfo, ok := item.(*pdu_item.UserInformationItem)
+			if !ok {
+				continue
+			}
+			var subItems []pdu_item.SubItem
+			for _, subItem := range userInfo.Items {
+				if c, ok := subItem.(*pdu_item.UserInformationMaximumLengthItem); ok {
+					if subItem = test.rewrite(c); subItem == nil {
+						continue
+					}
+				}
+				subItems = append(subItems, subItem)
+			}
+			userInfo.Items = subItems
+		}
+		user := newContextManager("user")
+		user.generateAssociateRequest(params)
+		require.NoError(t, user.onAssociateResponse(responses), test.name)
+		require.Equal(t, test.want, user.peerMaxPDUSize, test.name)
+
+		// Data can be sent to the peer.
+		sm := &stateMachine{label: "test", contextManager: user}
+		var n int
+		require.NoError(t, forEachDataPDU(sm, dicomuid.VerificationSOPClass, true, make([]byte, 20000), func(*pdu.PDataTf) error { n++; return nil }), test.name)
+		require.NotZero(t, n, test.name)
+	}
+}
+
+func TestSyntaxesOfAssembledCommand(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.VerificationSOPClass, sopclass.StorageClasses[0]},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{
+		&pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextResponse,
+			ContextID: 1,
+			Result:    pdu_item.PresentationContextAccepted,
+			Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian}},
+		},
+		&pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextResponse,
+			ContextID: 3,
+			Result:    pdu_item.PresentationContextAccepted,
+			Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ExplicitVRLittleEndian}},
+		},
+	}))
+
+	var b bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&b, &dimse.CStoreRq{
+		AffectedSOPClassUID:    sopclass.StorageClasses[0],
+		MessageID:              1,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: "1.2.3",
+	}))
+	var assembler dimse.CommandAssembler
+	contextID, command, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 3, Command: true, Last: true, Value: b.Bytes()},
+		{ContextID: 3, Command: false, Last: true, Value: []byte{1, 2}},
+	}})
+	require.NoError(t, err)
+	require.NotNil(t, command)
+	abstractSyntaxUID, transferSyntaxUID, err := cm.syntaxesByContextID(contextID)
+	require.NoError(t, err)
+	require.Equal(t, sopclass.StorageClasses[0], abstractSyntaxUID)
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, transferSyntaxUID)
+
+	_, _, err = cm.syntaxesByContextID(5)
+	require.Error(t, err)
+}
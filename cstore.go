@@ -1,22 +1,51 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/giesekow/go-netdicom/dimse"
 	"github.com/grailbio/go-dicom"
-	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 )
 
+// Identifies the C-MOVE request that triggered a C-STORE sub-operation (P3.7
+// 9.1.1.1). The zero value means that the C-STORE isn't a C-MOVE sub-operation.
+type moveOriginator struct {
+	aeTitle   string          // AE title of the C-MOVE requestor.
+	messageID dimse.MessageID // Message ID of the C-MOVE request.
+}
+
 // Helper function used by C-{STORE,GET,MOVE} to send a dataset using C-STORE
-// over an already-established association.
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+// over an already-established association. It returns ctx.Err() if ctx is
+// done before the response arrives.
+func runCStoreOnAssociation(ctx context.Context, upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	messageID dimse.MessageID,
+	priority dimse.Priority,
+	ds *dicom.DataSet,
+	origin moveOriginator) error {
+	resp, err := sendCStore(ctx, upcallCh, downcallCh, cm, messageID, priority, ds, origin)
+	if err != nil {
+		return err
+	}
+	if resp.Status.Status != 0 {
+		return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
+	}
+	return nil
+}
+
+// Sends "ds" using C-STORE and returns the response from the peer. The error
+// is non-nil only if the response couldn't be obtained, e.g., because ctx is
+// done.
+func sendCStore(ctx context.Context, upcallCh chan upcallEvent, downcallCh chan stateEvent,
 	cm *contextManager,
 	messageID dimse.MessageID,
-	ds *dicom.DataSet) error {
+	priority dimse.Priority,
+	ds *dicom.DataSet,
+	origin moveOriginator) (*dimse.CStoreRsp, error) {
 	var getElement = func(tag dicomtag.Tag) (string, error) {
 		elem, err := ds.FindElementByTag(tag)
 		if err != nil {
@@ -30,24 +59,24 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	}
 	sopInstanceUID, err := getElement(dicomtag.MediaStorageSOPInstanceUID)
 	if err != nil {
-		return fmt.Errorf("dicom.cstore: data lacks SOPInstanceUID: %v", err)
+		return nil, fmt.Errorf("dicom.cstore: data lacks SOPInstanceUID: %v", err)
 	}
 	sopClassUID, err := getElement(dicomtag.MediaStorageSOPClassUID)
 	if err != nil {
-		return fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
+		return nil, fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
 	}
 	dicomlog.Vprintf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID)
 	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
-		return err
+		return nil, err
 	}
 	dicomlog.Vprintf(1, "dicom.cstore(%s): using transfersyntax %s to send sop class %s, instance %s",
 		cm.label,
 		dicomuid.UIDString(context.transferSyntaxUID),
 		dicomuid.UIDString(sopClassUID),
 		sopInstanceUID)
-	bodyEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
+	bodyEncoder := newDataSetEncoder(context.transferSyntaxUID)
 	for _, elem := range ds.Elements {
 		if elem.Tag.Group == dicomtag.MetadataGroup {
 			continue
@@ -56,35 +85,56 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	}
 	if err := bodyEncoder.Error(); err != nil {
 		dicomlog.Vprintf(0, "dicom.cstore(%s): body encoder failed: %v", cm.label, err)
-		return err
+		return nil, err
 	}
 	downcallCh <- stateEvent{
 		event: evt09,
 		dimsePayload: &stateEventDIMSEPayload{
 			abstractSyntaxName: sopClassUID,
 			command: &dimse.CStoreRq{
-				AffectedSOPClassUID:    sopClassUID,
-				MessageID:              messageID,
-				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
-				AffectedSOPInstanceUID: sopInstanceUID,
+				AffectedSOPClassUID:                  sopClassUID,
+				MessageID:                            messageID,
+				Priority:                             priority,
+				CommandDataSetType:                   dimse.CommandDataSetTypeNonNull,
+				AffectedSOPInstanceUID:               sopInstanceUID,
+				MoveOriginatorApplicationEntityTitle: origin.aeTitle,
+				MoveOriginatorMessageID:              origin.messageID,
 			},
 			data: bodyEncoder.Bytes(),
 		},
 	}
 	for {
 		dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
-		event, ok := <-upcallCh
+		var event upcallEvent
+		var ok bool
+		select {
+		case event, ok = <-upcallCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if !ok {
-			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+			return nil, fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
 		}
 		dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CStoreRsp)
 		doassert(ok) // TODO(saito)
-		if resp.Status.Status != 0 {
-			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
-		}
-		return nil
+		return resp, nil
+	}
+}
+
+// Decodes the data of C-STORE request "c", encoded in transferSyntaxUID, into a
+// dataset. The dataset is prefixed with the transfer syntax and the SOP class
+// and instance UIDs, as if it were read from a file.
+func decodeCStoreDataSet(transferSyntaxUID string, c *dimse.CStoreRq, data []byte) (*dicom.DataSet, error) {
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return nil, err
 	}
+	return &dicom.DataSet{Elements: append([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, c.AffectedSOPClassUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, c.AffectedSOPInstanceUID),
+	}, elems...)}, nil
 }
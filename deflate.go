@@ -0,0 +1,100 @@
+package netdicom
+
+// This file implements the Deflated Explicit VR Little Endian transfer syntax
+// (P3.5 A.5), whose data payloads are compressed as a whole.
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// errInflatedPayloadTooLarge is returned when an inflated data payload exceeds
+// the max data size of the command assembler.
+var errInflatedPayloadTooLarge = errors.New("inflated data payload too large")
+
+// Returns true if data payloads in the given transfer syntax are deflated.
+// The state machine inflates and deflates them, so that the rest of the
+// library sees explicit VR little endian datasets.
+func isDeflatedTransferSyntax(uid string) bool {
+	// UIDs in PDUs may be padded to an even length.
+	return strings.TrimRight(uid, "\x00 ") == dicomuid.DeflatedExplicitVRLittleEndian
+}
+
+// Compresses a dataset encoded in explicit VR little endian. As required by
+// P3.5 A.5, the stream has no zlib header, and is padded to an even length.
+func deflatePayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len()%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompresses a deflated data payload into w. The padding byte after the end
+// of the stream, if any, is ignored. Fails with errInflatedPayloadTooLarge if
+// the result exceeds maxSize bytes, e.g., because of a malicious peer.
+func inflatePayloadTo(w io.Writer, r io.Reader, maxSize int64) error {
+	fr := flate.NewReader(r)
+	defer fr.Close()
+	n, err := io.Copy(w, io.LimitReader(fr, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("dicom.inflatePayload: %w", err)
+	}
+	if n > maxSize {
+		return fmt.Errorf("dicom.inflatePayload: %w: more than %d bytes", errInflatedPayloadTooLarge, maxSize)
+	}
+	return nil
+}
+
+// Similar to inflatePayloadTo, but inflates in memory.
+func inflatePayload(data []byte, maxSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := inflatePayloadTo(&buf, bytes.NewReader(data), maxSize); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the deflated data payload spooled to "path" by its inflated
+// contents. The file is rewritten under a temporary name and renamed, as in
+// WritePart10File.
+func inflateSpoolFile(path string, maxSize int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = inflatePayloadTo(out, in, maxSize)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), path)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
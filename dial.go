@@ -0,0 +1,99 @@
+package netdicom
+
+// This file implements connecting to a peer with retries.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/grailbio/go-dicom/dicomlog"
+)
+
+// RetryPolicy defines how DialServiceUser retries failed connection
+// attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of connection attempts, including the
+	// first one. If zero, 3 attempts are made.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt. The delay
+	// doubles after each further attempt, up to MaxBackoff. If zero, they
+	// default to 1 second and 30 seconds.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DialServiceUser creates a ServiceUser, connects it to the server at the
+// given "host:port", and waits for the association handshake to complete.
+// Attempts that fail transiently, e.g., because the connection was refused
+// or the peer rejected the association with a transient result such as
+// "temporary congestion", or aborted the handshake, are retried with
+// exponential backoff as specified by "retry". Permanent rejections and
+// aborts that report a protocol error are not retried. The last error is
+// returned if all attempts fail.
+//
+// As with NewServiceUserContext, the association is aborted when ctx is
+// done, and ctx also bounds the retries.
+func DialServiceUser(ctx context.Context, params ServiceUserParams, serverAddr string, retry RetryPolicy) (*ServiceUser, error) {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 3
+	}
+	if retry.InitialBackoff <= 0 {
+		retry.InitialBackoff = time.Second
+	}
+	if retry.MaxBackoff <= 0 {
+		retry.MaxBackoff = 30 * time.Second
+	}
+	backoff := retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		su, err := NewServiceUserContext(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		su.Connect(serverAddr)
+		err = su.waitUntilReady()
+		if err == nil {
+			return su, nil
+		}
+		if attempt >= retry.MaxAttempts || !isTransientConnectError(err) {
+			return nil, err
+		}
+		dicomlog.Vprintf(0, "dicom.DialServiceUser(%s): Attempt %d failed, retrying in %v: %v", serverAddr, attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff = min(2*backoff, retry.MaxBackoff)
+	}
+}
+
+// Returns true if "err", returned by ServiceUser.waitUntilReady, is worth
+// retrying: the peer could not be reached, or it rejected or aborted the
+// association for a reason that may go away.
+func isTransientConnectError(err error) bool {
+	var rj *AssociateRejectError
+	if errors.As(err, &rj) {
+		// The reasons of the presentation-related source, temporary
+		// congestion and local limit exceeded, are transient by nature
+		// even if a peer marks them permanent.
+		return rj.Transient() || rj.Source == pdu.SourceULServiceProviderPresentation
+	}
+	var abort *AbortError
+	if errors.As(err, &abort) {
+		// A peer that aborts the handshake without a reason, e.g., because
+		// it is overloaded, may accept a later attempt. A protocol error
+		// reported by its service provider would only recur.
+		return abort.Source == pdu.AbortSourceServiceUser || abort.Reason == pdu.AbortReasonNotSpecified
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -9,9 +9,10 @@ import (
 )
 
 type CEchoRq struct {
-	MessageID          MessageID
-	CommandDataSetType CommandDataSetType
-	Extra              []*dicom.Element // Unparsed elements
+	AffectedSOPClassUID string
+	MessageID           MessageID
+	CommandDataSetType  CommandDataSetType
+	Extra               []*dicom.Element // Unparsed elements
 }
 
 func (v *CEchoRq) Encode(e io.Writer) error {
@@ -22,6 +23,14 @@ func (v *CEchoRq) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
+	if v.AffectedSOPClassUID != "" {
+		elem, err = NewElement(commandset.AffectedSOPClassUID, v.AffectedSOPClassUID)
+		if err != nil {
+			return fmt.Errorf("CEchoRq.Encode: failed to create AffectedSOPClassUID element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+
 	elem, err = NewElement(commandset.MessageID, v.MessageID)
 	if err != nil {
 		return fmt.Errorf("CEchoRq.Encode: failed to create MessageID element: %w", err)
@@ -44,6 +53,10 @@ func (v *CEchoRq) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CEchoRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CEchoRq) CommandField() uint16 {
 	return CommandFieldCEchoRq
 }
@@ -57,12 +70,17 @@ func (v *CEchoRq) GetStatus() *Status {
 }
 
 func (v *CEchoRq) String() string {
-	return fmt.Sprintf("CEchoRq{MessageID:%v CommandDataSetType:%v}}", v.MessageID, v.CommandDataSetType)
+	return fmt.Sprintf("CEchoRq{AffectedSOPClassUID:%v MessageID:%v CommandDataSetType:%v}}", v.AffectedSOPClassUID, v.MessageID, v.CommandDataSetType)
 }
 
 func (CEchoRq) decode(d *MessageDecoder) (*CEchoRq, error) {
 	v := &CEchoRq{}
 	var err error
+	v.AffectedSOPClassUID, err = d.GetString(commandset.AffectedSOPClassUID, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("CEchoRq.decode: failed to get AffectedSOPClassUID: %w", err)
+	}
+
 	v.MessageID, err = d.GetUInt16(commandset.MessageID, RequiredElement)
 	if err != nil {
 		return nil, fmt.Errorf("CEchoRq.decode: failed to get MessageID: %w", err)
@@ -9,6 +9,7 @@ import (
 )
 
 type CEchoRsp struct {
+	AffectedSOPClassUID       string
 	MessageIDBeingRespondedTo MessageID
 	CommandDataSetType        CommandDataSetType
 	Status                    Status
@@ -24,6 +25,14 @@ func (v *CEchoRsp) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
+	if v.AffectedSOPClassUID != "" {
+		elem, err = NewElement(commandset.AffectedSOPClassUID, v.AffectedSOPClassUID)
+		if err != nil {
+			return fmt.Errorf("CEchoRsp.Encode: failed to create AffectedSOPClassUID element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+
 	elem, err = NewElement(commandset.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
 	if err != nil {
 		return fmt.Errorf("CEchoRsp.Encode: failed to create MessageIDBeingRespondedTo element: %w", err)
@@ -55,6 +64,10 @@ func (v *CEchoRsp) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CEchoRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CEchoRsp) CommandField() uint16 {
 	return CommandFieldCEchoRsp
 }
@@ -68,13 +81,18 @@ func (v *CEchoRsp) GetStatus() *Status {
 }
 
 func (v *CEchoRsp) String() string {
-	return fmt.Sprintf("CEchoRsp{MessageIDBeingRespondedTo:%v CommandDataSetType:%v Status:%v}}", v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.Status)
+	return fmt.Sprintf("CEchoRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.Status)
 }
 
 func (CEchoRsp) decode(d *MessageDecoder) (*CEchoRsp, error) {
 	v := &CEchoRsp{}
 	var err error
 
+	v.AffectedSOPClassUID, err = d.GetString(commandset.AffectedSOPClassUID, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("cEchoRsp.decode: failed to decode AffectedSOPClassUID: %w", err)
+	}
+
 	v.MessageIDBeingRespondedTo, err = d.GetUInt16(commandset.MessageIDBeingRespondedTo, RequiredElement)
 	if err != nil {
 		return nil, fmt.Errorf("cEchoRsp.decode: failed to decode MessageIDBeingRespondedTo: %w", err)
@@ -11,7 +11,7 @@ import (
 type CFindRq struct {
 	AffectedSOPClassUID string
 	MessageID           MessageID
-	Priority            uint16
+	Priority            Priority
 	CommandDataSetType  CommandDataSetType
 	Extra               []*dicom.Element // Unparsed elements
 }
@@ -37,7 +37,7 @@ func (v *CFindRq) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
-	elem, err = NewElement(commandset.Priority, v.Priority)
+	elem, err = NewElement(commandset.Priority, uint16(v.Priority))
 	if err != nil {
 		return fmt.Errorf("CFindRq.Encode: failed to create Priority element: %w", err)
 	}
@@ -62,6 +62,10 @@ func (v *CFindRq) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CFindRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CFindRq) CommandField() uint16 {
 	return CommandFieldCFindRq
 }
@@ -92,7 +96,7 @@ func (CFindRq) decode(d *MessageDecoder) (*CFindRq, error) {
 		return nil, fmt.Errorf("cFindRq.decode: failed to decode MessageID: %w", err)
 	}
 
-	v.Priority, err = d.GetUInt16(commandset.Priority, RequiredElement)
+	v.Priority, err = d.GetPriority()
 	if err != nil {
 		return nil, fmt.Errorf("cFindRq.decode: failed to decode Priority: %w", err)
 	}
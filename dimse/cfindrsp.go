@@ -61,6 +61,10 @@ func (v *CFindRsp) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CFindRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CFindRsp) CommandField() uint16 {
 	return CommandFieldCFindRsp
 }
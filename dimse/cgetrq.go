@@ -11,7 +11,7 @@ import (
 type CGetRq struct {
 	AffectedSOPClassUID string
 	MessageID           MessageID
-	Priority            uint16
+	Priority            Priority
 	CommandDataSetType  CommandDataSetType
 	Extra               []*dicom.Element // Unparsed elements
 }
@@ -37,7 +37,7 @@ func (v *CGetRq) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
-	elem, err = NewElement(commandset.Priority, v.Priority)
+	elem, err = NewElement(commandset.Priority, uint16(v.Priority))
 	if err != nil {
 		return fmt.Errorf("CGetRq.Encode: failed to create Priority element: %w", err)
 	}
@@ -61,6 +61,10 @@ func (v *CGetRq) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CGetRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CGetRq) CommandField() uint16 {
 	return CommandFieldCGetRq
 }
@@ -91,7 +95,7 @@ func (CGetRq) decode(d *MessageDecoder) (*CGetRq, error) {
 		return nil, fmt.Errorf("cGetRq.decode: failed to decode MessageID: %w", err)
 	}
 
-	v.Priority, err = d.GetUInt16(commandset.Priority, RequiredElement)
+	v.Priority, err = d.GetPriority()
 	if err != nil {
 		return nil, fmt.Errorf("cGetRq.decode: failed to decode Priority: %w", err)
 	}
@@ -98,6 +98,10 @@ func (v *CGetRsp) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CGetRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CGetRsp) CommandField() uint16 {
 	return CommandFieldCGetRsp
 }
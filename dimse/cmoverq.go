@@ -11,7 +11,7 @@ import (
 type CMoveRq struct {
 	AffectedSOPClassUID string
 	MessageID           MessageID
-	Priority            uint16
+	Priority            Priority
 	MoveDestination     string
 	CommandDataSetType  CommandDataSetType
 	Extra               []*dicom.Element // Unparsed elements
@@ -38,7 +38,7 @@ func (v *CMoveRq) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
-	elem, err = NewElement(commandset.Priority, v.Priority)
+	elem, err = NewElement(commandset.Priority, uint16(v.Priority))
 	if err != nil {
 		return fmt.Errorf("CMoveRq.Encode: failed to create Priority element: %w", err)
 	}
@@ -68,6 +68,10 @@ func (v *CMoveRq) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CMoveRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CMoveRq) CommandField() uint16 {
 	return CommandFieldCMoveRq
 }
@@ -98,7 +102,7 @@ func (CMoveRq) decode(d *MessageDecoder) (*CMoveRq, error) {
 		return nil, fmt.Errorf("cMoveRq.decode: failed to decode MessageID: %w", err)
 	}
 
-	v.Priority, err = d.GetUInt16(commandset.Priority, RequiredElement)
+	v.Priority, err = d.GetPriority()
 	if err != nil {
 		return nil, fmt.Errorf("cMoveRq.decode: failed to decode Priority: %w", err)
 	}
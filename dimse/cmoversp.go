@@ -98,6 +98,10 @@ func (v *CMoveRsp) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CMoveRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CMoveRsp) CommandField() uint16 {
 	return CommandFieldCMoveRsp
 }
@@ -3,25 +3,71 @@ package dimse
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 
+	"github.com/giesekow/go-netdicom/commandset"
 	"github.com/giesekow/go-netdicom/pdu"
 	"github.com/suyashkumar/dicom"
-	"github.com/suyashkumar/dicom/pkg/tag"
+	dicomtag "github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Default limits on the size of an assembled command and data payload. See
+// CommandAssembler.
+const (
+	DefaultMaxCommandSize int64 = 1 << 20
+	DefaultMaxDataSize    int64 = 4 << 30
 )
 
 // CommandAssembler is a helper that assembles a DIMSE command message and data
 // payload from a sequence of P_DATA_TF PDUs.
+//
+// By default, the data payload is buffered in memory and returned by
+// AddDataPDU. If NewDataWriter is set, the payload is instead streamed to the
+// writer it returns as P_DATA_TF PDUs arrive.
 type CommandAssembler struct {
+	// NewDataWriter, if non-nil, is called once the command has been parsed
+	// and the command has a data payload. The payload is then written to the
+	// returned writer, and AddDataPDU returns a nil payload on completion.
+	// If it returns a nil writer, the payload is buffered as usual.
+	NewDataWriter func(contextID byte, command Message) (io.Writer, error)
+
+	// Maximum number of bytes accepted for the command and the data
+	// payload of one message. AddDataPDU returns an error once a peer sends
+	// more. If zero, DefaultMaxCommandSize and DefaultMaxDataSize are used.
+	MaxCommandSize int64
+	MaxDataSize    int64
+
+	// SkipUnknownCommands, if set, makes AddDataPDU return commands with an
+	// unrecognized command field, e.g., vendor-specific ones, as
+	// *UnknownMessage instead of failing with ErrUnknownCommand. Their data
+	// payload, if any, is assembled as usual.
+	SkipUnknownCommands bool
+
+	// StrictCommands, if set, makes AddDataPDU fail with ErrUnexpectedElement
+	// on commands with elements that their message type doesn't define,
+	// other than those in AllowedCommandElements. See ReadMessageStrict.
+	StrictCommands         bool
+	AllowedCommandElements []dicomtag.Tag
+
 	contextID      byte
 	commandBytes   []byte
 	command        Message
 	dataBytes      []byte
+	dataWriter     io.Writer // Set iff the payload is being streamed.
+	dataSize       int64     // Number of data bytes received so far.
 	readAllCommand bool
 
 	readAllData bool
 }
 
+// DecodeDIMSECommandMap decodes the elements of an encoded DIMSE command
+// into a map, for logging and debugging. Well-known elements are keyed by
+// name, e.g., "CommandField" and "MessageID"; the others are keyed by tag,
+// e.g., "(0000,1000)", and hold their raw value. Decoding stops at the
+// first malformed element. Use ReadMessage to decode commands.
 func DecodeDIMSECommandMap(raw []byte) map[string]interface{} {
 	result := make(map[string]interface{})
 	reader := bytes.NewReader(raw)
@@ -48,6 +94,9 @@ func DecodeDIMSECommandMap(raw []byte) map[string]interface{} {
 		}
 
 		// Read value
+		if int64(length) > int64(reader.Len()) {
+			break
+		}
 		val := make([]byte, length)
 		n, _ := reader.Read(val)
 		if n != int(length) {
@@ -91,8 +140,13 @@ func DecodeDIMSECommandMap(raw []byte) map[string]interface{} {
 
 // AddDataPDU is to be called for each P_DATA_TF PDU received from the
 // network. If the fragment is marked as the last one, AddDataPDU returns
-// <SOPUID, TransferSyntaxUID, payload, nil>.  If it needs more fragments, it
-// returns <"", "", nil, nil>.  On error, it returns a non-nil error.
+// <contextID, command, payload, nil>.  If it needs more fragments, it returns
+// <0, nil, nil, nil>.  On error, it returns a non-nil error. The payload is nil
+// if it was streamed to the writer returned by NewDataWriter.
+//
+// The payload is encoded in the transfer syntax negotiated for contextID. The
+// assembler doesn't know the negotiated presentation contexts, so the caller
+// must map contextID to its abstract and transfer syntaxes.
 func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte, error) {
 	for _, item := range pdu.Items {
 		if commandAssembler.contextID == 0 {
@@ -100,20 +154,37 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 		} else if commandAssembler.contextID != item.ContextID {
 			return 0, nil, nil, fmt.Errorf("mixed context: %d %d", commandAssembler.contextID, item.ContextID)
 		}
+		// P3.8 E.2: the command fragments come first, followed by the
+		// data fragments, if any. They may be split across PDUs in any
+		// way, including both kinds in one PDU.
 		if item.Command {
+			if commandAssembler.readAllCommand {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: found a command fragment after the last command fragment")
+			}
+			if n := int64(len(commandAssembler.commandBytes) + len(item.Value)); n > commandAssembler.maxCommandSize() {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: command size %dB exceeds the limit of %dB", n, commandAssembler.maxCommandSize())
+			}
 			commandAssembler.commandBytes = append(commandAssembler.commandBytes, item.Value...)
 			if item.Last {
-				if commandAssembler.readAllCommand {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 command chunks with the Last bit set")
-				}
 				commandAssembler.readAllCommand = true
+				if err := commandAssembler.parseCommand(); err != nil {
+					return 0, nil, nil, err
+				}
 			}
 		} else {
-			commandAssembler.dataBytes = append(commandAssembler.dataBytes, item.Value...)
+			if !commandAssembler.readAllCommand {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: found a data fragment before the last command fragment")
+			}
+			if commandAssembler.command.GetCommandDataSetType() == CommandDataSetTypeNull {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: found a data fragment for %v, which has no data", commandAssembler.command)
+			}
+			if commandAssembler.readAllData {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
+			}
+			if err := commandAssembler.addData(item.Value); err != nil {
+				return 0, nil, nil, err
+			}
 			if item.Last {
-				if commandAssembler.readAllData {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
-				}
 				commandAssembler.readAllData = true
 			}
 		}
@@ -121,57 +192,213 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 	if !commandAssembler.readAllCommand {
 		return 0, nil, nil, nil
 	}
-	if commandAssembler.command == nil {
-		bytesLen := len(commandAssembler.commandBytes)
-		var parser dicom.Dataset
-		var err error = nil
-		if bytesLen < 100 {
-			data := DecodeDIMSECommandMap(commandAssembler.commandBytes)
-			messageId, msgid_ok := data["MessageID"]
-			commandField, cmd_ok := data["CommandField"]
-			priority, pr_ok := data["Priority"]
+	if commandAssembler.command.GetCommandDataSetType() != CommandDataSetTypeNull && !commandAssembler.readAllData {
+		return 0, nil, nil, nil
+	}
+	contextID := commandAssembler.contextID
+	command := commandAssembler.command
+	dataBytes := commandAssembler.dataBytes
+	*commandAssembler = CommandAssembler{
+		NewDataWriter:          commandAssembler.NewDataWriter,
+		MaxCommandSize:         commandAssembler.MaxCommandSize,
+		MaxDataSize:            commandAssembler.MaxDataSize,
+		SkipUnknownCommands:    commandAssembler.SkipUnknownCommands,
+		StrictCommands:         commandAssembler.StrictCommands,
+		AllowedCommandElements: commandAssembler.AllowedCommandElements,
+	}
+	return contextID, command, dataBytes, nil
+	// TODO(saito) Verify that there's no unread items after the last command&data.
+}
 
-			if cmd_ok && int(commandField.(uint16)) == 48 {
+// Decodes the command once all its fragments have arrived, and opens the data
+// writer if the command has data to stream.
+func (commandAssembler *CommandAssembler) parseCommand() error {
+	command, err := commandAssembler.decodeCommand(commandAssembler.commandBytes)
+	if err != nil {
+		return err
+	}
+	commandAssembler.command = command
+	if commandAssembler.NewDataWriter != nil && command.GetCommandDataSetType() != CommandDataSetTypeNull {
+		return commandAssembler.openDataWriter()
+	}
+	return nil
+}
 
-				e1, _ := dicom.NewElement(tag.Tag{Group: 0x0000, Element: 0x0100}, []int{int(48)})
-				e2, _ := dicom.NewElement(tag.Tag{Group: 0x0000, Element: 0x0110}, []int{int(1)})
-				e3, _ := dicom.NewElement(tag.Tag{Group: 0x0000, Element: 0x0800}, []int{int(257)})
+// Decode a DIMSE command. Commands are always encoded in implicit VR little
+// endian (P3.7 6.3.1), regardless of the transfer syntax of the context. If
+// SkipUnknownCommands is set, a command with an unrecognized command field is
+// returned as *UnknownMessage.
+func (commandAssembler *CommandAssembler) decodeCommand(commandBytes []byte) (Message, error) {
+	if err := checkCommandGroupLength(commandBytes); err != nil {
+		return nil, err
+	}
+	dataset, err := readCommandElements(commandBytes)
+	if err != nil {
+		return nil, err
+	}
+	var message Message
+	if commandAssembler.StrictCommands {
+		message, err = ReadMessageStrict(dataset, commandAssembler.AllowedCommandElements...)
+	} else {
+		message, err = ReadMessage(dataset)
+	}
+	if commandAssembler.SkipUnknownCommands && errors.Is(err, ErrUnknownCommand) {
+		return ReadUnknownMessage(dataset)
+	}
+	return message, err
+}
 
-				if msgid_ok {
-					e2, _ = dicom.NewElement(tag.Tag{Group: 0x0000, Element: 0x0110}, []int{int(messageId.(uint16))})
-				}
+// Size of the tag and the value length of an element in implicit VR.
+const implicitElementHeaderSize = 8
 
-				if pr_ok {
-					e3, _ = dicom.NewElement(tag.Tag{Group: 0x0000, Element: 0x0800}, []int{int(priority.(uint16))})
-				}
+// Reads the elements of an encoded command. They are read directly as implicit
+// VR little endian, since dicom.Parser can't parse commands shorter than 100
+// bytes, e.g., C-ECHO, without a transfer syntax in metadata. The VR of each
+// element is taken from the dictionary; elements missing from it, e.g.,
+// vendor-specific ones, are read as UN.
+func readCommandElements(commandBytes []byte) (*dicom.Dataset, error) {
+	var dataset dicom.Dataset
+	for len(commandBytes) > 0 {
+		if len(commandBytes) < implicitElementHeaderSize {
+			return nil, fmt.Errorf("P_DATA_TF: failed to parse command bytes: %dB left after the last element", len(commandBytes))
+		}
+		t := dicomtag.Tag{
+			Group:   binary.LittleEndian.Uint16(commandBytes[0:2]),
+			Element: binary.LittleEndian.Uint16(commandBytes[2:4]),
+		}
+		length := binary.LittleEndian.Uint32(commandBytes[4:8])
+		commandBytes = commandBytes[implicitElementHeaderSize:]
+		if int64(length) > int64(len(commandBytes)) {
+			return nil, fmt.Errorf("P_DATA_TF: failed to parse command bytes: element %v has a %dB value, but only %dB are left",
+				t, length, len(commandBytes))
+		}
+		elem, err := newCommandElement(t, commandBytes[:length])
+		if err != nil {
+			return nil, fmt.Errorf("P_DATA_TF: failed to parse command bytes: %w", err)
+		}
+		dataset.Elements = append(dataset.Elements, elem)
+		commandBytes = commandBytes[length:]
+	}
+	return &dataset, nil
+}
 
-				parser = dicom.Dataset{
-					Elements: []*dicom.Element{e1, e2, e3},
-				}
+// Creates an element with tag "t" from its encoded value, like dicom.Parser
+// does for implicit VR.
+func newCommandElement(t dicomtag.Tag, value []byte) (*dicom.Element, error) {
+	vr := "UN"
+	if info, err := dicomtag.Find(t); err == nil {
+		vr = info.VRs[0]
+	}
+	var data any
+	switch vrKind := dicomtag.GetVRKind(t, vr); vrKind {
+	case dicomtag.VRUInt16List, dicomtag.VRInt16List, dicomtag.VRTagList:
+		if len(value)%2 != 0 {
+			return nil, fmt.Errorf("element %v has an odd length %d for VR %s", t, len(value), vr)
+		}
+		ints := make([]int, 0, len(value)/2)
+		for i := 0; i < len(value); i += 2 {
+			v := binary.LittleEndian.Uint16(value[i:])
+			if vrKind == dicomtag.VRInt16List {
+				ints = append(ints, int(int16(v)))
 			} else {
-				parser = dicom.Dataset{}
+				ints = append(ints, int(v))
 			}
-
-		} else {
-			ioReader := bytes.NewReader(commandAssembler.commandBytes)
-			parser, err = dicom.Parse(ioReader, int64(ioReader.Len()), nil, dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
 		}
-
-		if err != nil {
-			return 0, nil, nil, fmt.Errorf("P_DATA_TF: failed to parse command bytes: %w", err)
+		data = ints
+	case dicomtag.VRUInt32List, dicomtag.VRInt32List:
+		if len(value)%4 != 0 {
+			return nil, fmt.Errorf("element %v has length %d, not a multiple of 4, for VR %s", t, len(value), vr)
 		}
-		commandAssembler.command, err = ReadMessage(&parser)
-		if err != nil {
-			return 0, nil, nil, err
+		ints := make([]int, 0, len(value)/4)
+		for i := 0; i < len(value); i += 4 {
+			v := binary.LittleEndian.Uint32(value[i:])
+			if vrKind == dicomtag.VRInt32List {
+				ints = append(ints, int(int32(v)))
+			} else {
+				ints = append(ints, int(v))
+			}
 		}
+		data = ints
+	case dicomtag.VRStringList, dicomtag.VRString, dicomtag.VRDate:
+		str := string(value)
+		if strings.TrimSpace(str) != "" {
+			// Values are padded to an even length.
+			str = strings.Trim(str, " \x00")
+		}
+		data = strings.Split(str, "\\")
+	default:
+		data = append([]byte(nil), value...)
 	}
-	if commandAssembler.command.HasData() && !commandAssembler.readAllData {
-		return 0, nil, nil, nil
+	v, err := dicom.NewValue(data)
+	if err != nil {
+		return nil, err
 	}
-	contextID := commandAssembler.contextID
-	command := commandAssembler.command
-	dataBytes := commandAssembler.dataBytes
-	*commandAssembler = CommandAssembler{}
-	return contextID, command, dataBytes, nil
-	// TODO(saito) Verify that there's no unread items after the last command&data.
+	return &dicom.Element{
+		Tag:                    t,
+		ValueRepresentation:    dicomtag.GetVRKind(t, vr),
+		RawValueRepresentation: vr,
+		ValueLength:            uint32(len(value)),
+		Value:                  v,
+	}, nil
+}
+
+// Checks that the CommandGroupLength element (0000,0000), which comes first
+// since elements are sorted by tag, matches the number of bytes that follow
+// it. A mismatch means that the command was truncated or corrupted. Commands
+// that lack the element are left for ReadMessage to judge.
+func checkCommandGroupLength(commandBytes []byte) error {
+	if len(commandBytes) < commandGroupLengthElementSize ||
+		binary.LittleEndian.Uint16(commandBytes[0:2]) != commandset.CommandGroupLength.Group ||
+		binary.LittleEndian.Uint16(commandBytes[2:4]) != commandset.CommandGroupLength.Element {
+		return nil
+	}
+	if n := binary.LittleEndian.Uint32(commandBytes[4:8]); n != 4 {
+		return fmt.Errorf("P_DATA_TF: CommandGroupLength has a %dB value; expect 4B", n)
+	}
+	declared := int64(binary.LittleEndian.Uint32(commandBytes[8:12]))
+	if actual := int64(len(commandBytes) - commandGroupLengthElementSize); declared != actual {
+		return fmt.Errorf("P_DATA_TF: CommandGroupLength is %d, but the command has %dB after it; the command is truncated or corrupt", declared, actual)
+	}
+	return nil
+}
+
+func (commandAssembler *CommandAssembler) maxCommandSize() int64 {
+	if commandAssembler.MaxCommandSize > 0 {
+		return commandAssembler.MaxCommandSize
+	}
+	return DefaultMaxCommandSize
+}
+
+func (commandAssembler *CommandAssembler) maxDataSize() int64 {
+	if commandAssembler.MaxDataSize > 0 {
+		return commandAssembler.MaxDataSize
+	}
+	return DefaultMaxDataSize
+}
+
+func (commandAssembler *CommandAssembler) addData(value []byte) error {
+	commandAssembler.dataSize += int64(len(value))
+	if commandAssembler.dataSize > commandAssembler.maxDataSize() {
+		return fmt.Errorf("P_DATA_TF: data size %dB exceeds the limit of %dB", commandAssembler.dataSize, commandAssembler.maxDataSize())
+	}
+	if commandAssembler.dataWriter != nil {
+		if _, err := commandAssembler.dataWriter.Write(value); err != nil {
+			return fmt.Errorf("P_DATA_TF: failed to write data: %w", err)
+		}
+		return nil
+	}
+	commandAssembler.dataBytes = append(commandAssembler.dataBytes, value...)
+	return nil
+}
+
+// Obtain the writer from NewDataWriter. It is called as soon as the command
+// is complete, before any data fragment is accepted, so there is nothing
+// buffered to flush.
+func (commandAssembler *CommandAssembler) openDataWriter() error {
+	w, err := commandAssembler.NewDataWriter(commandAssembler.contextID, commandAssembler.command)
+	if err != nil {
+		return fmt.Errorf("P_DATA_TF: failed to create data writer: %w", err)
+	}
+	commandAssembler.dataWriter = w
+	return nil
 }
@@ -11,7 +11,7 @@ import (
 type CStoreRq struct {
 	AffectedSOPClassUID                  string
 	MessageID                            MessageID
-	Priority                             uint16
+	Priority                             Priority
 	CommandDataSetType                   CommandDataSetType
 	AffectedSOPInstanceUID               string
 	MoveOriginatorApplicationEntityTitle string
@@ -40,7 +40,7 @@ func (v *CStoreRq) Encode(e io.Writer) error {
 	}
 	elems = append(elems, elem)
 
-	elem, err = NewElement(commandset.Priority, v.Priority)
+	elem, err = NewElement(commandset.Priority, uint16(v.Priority))
 	if err != nil {
 		return fmt.Errorf("CStoreRq.Encode: failed to create Priority element: %w", err)
 	}
@@ -85,6 +85,10 @@ func (v *CStoreRq) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CStoreRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CStoreRq) CommandField() uint16 {
 	return CommandFieldCStoreRq
 }
@@ -115,7 +119,7 @@ func (CStoreRq) decode(d *MessageDecoder) (*CStoreRq, error) {
 		return nil, fmt.Errorf("cStoreRq.decode: failed to decode MessageID: %w", err)
 	}
 
-	v.Priority, err = d.GetUInt16(commandset.Priority, RequiredElement)
+	v.Priority, err = d.GetPriority()
 	if err != nil {
 		return nil, fmt.Errorf("cStoreRq.decode: failed to decode Priority: %w", err)
 	}
@@ -68,6 +68,10 @@ func (v *CStoreRsp) HasData() bool {
 	return v.CommandDataSetType != CommandDataSetTypeNull
 }
 
+func (v *CStoreRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
 func (v *CStoreRsp) CommandField() uint16 {
 	return CommandFieldCStoreRsp
 }
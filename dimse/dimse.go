@@ -11,13 +11,32 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 
+	"github.com/giesekow/go-netdicom/commandset"
 	"github.com/suyashkumar/dicom"
 	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
+func init() {
+	// Register the command tags before any command is encoded or decoded.
+	// The tag dictionary isn't safe to modify while it is being read.
+	commandset.Init()
+}
+
 // Encode the given elements. The elements are sorted in ascending tag order.
 func EncodeElements(e io.Writer, elems []*dicom.Element) error {
+	if w, ok := e.(*sizeWriter); ok {
+		// Called by EncodedSize: only the size is needed.
+		for _, elem := range elems {
+			n, err := encodedElementSize(elem)
+			if err != nil {
+				return fmt.Errorf("EncodeElements: error sizing element %s: %w", elem.Tag.String(), err)
+			}
+			w.n += n
+		}
+		return nil
+	}
 	writer, err := dicom.NewWriter(e)
 	if err != nil {
 		return fmt.Errorf("EncodeElements: failed to create writer: %w", err)
@@ -35,6 +54,38 @@ func EncodeElements(e io.Writer, elems []*dicom.Element) error {
 	return nil
 }
 
+// Returns the number of bytes EncodeElements writes for "elem": the tag and
+// the length, 4 bytes each in implicit VR, followed by the value, padded to
+// an even length. The values found in commands are sized directly; other
+// elements, e.g., in the Extra field of a message, are encoded.
+func encodedElementSize(elem *dicom.Element) (int, error) {
+	const headerSize = 8
+	if elem.Value != nil {
+		switch v := elem.Value.GetValue().(type) {
+		case []string:
+			n := len(strings.Join(v, "\\"))
+			return headerSize + n + n%2, nil
+		case []int:
+			switch elem.RawValueRepresentation {
+			case "US", "SS", "AT": // An AT value is a <group, element> pair of ints.
+				return headerSize + 2*len(v), nil
+			case "UL", "SL":
+				return headerSize + 4*len(v), nil
+			}
+		}
+	}
+	var w countingWriter
+	writer, err := dicom.NewWriter(&w)
+	if err != nil {
+		return 0, err
+	}
+	writer.SetTransferSyntax(binary.LittleEndian, true)
+	if err := writer.WriteElement(elem); err != nil {
+		return 0, err
+	}
+	return w.n, nil
+}
+
 func NewElement(tag tag.Tag, value any) (*dicom.Element, error) {
 	switch v := value.(type) {
 	case string:
@@ -43,6 +94,8 @@ func NewElement(tag tag.Tag, value any) (*dicom.Element, error) {
 		return dicom.NewElement(tag, v)
 	case int:
 		return dicom.NewElement(tag, []int{v})
+	case []int:
+		return dicom.NewElement(tag, v)
 	case int8:
 		return dicom.NewElement(tag, []int{int(v)})
 	case uint8:
@@ -1,55 +1,640 @@
 package dimse_test
 
-// import (
-// 	"encoding/binary"
-// 	"testing"
-
-// 	"github.com/grailbio/go-dicom/dicomio"
-// 	"github.com/giesekow/go-netdicom/dimse/dimse_commands"
-// )
-
-// func testDIMSE(t *testing.T, v Message) {
-// 	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
-// 	EncodeMessage(e, v)
-// 	bytes := e.Bytes()
-// 	d := dicomio.NewBytesDecoder(bytes, binary.LittleEndian, dicomio.ImplicitVR)
-// 	v2 := dimse_commands.ReadMessage(d)
-// 	err := d.Finish()
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	if v.String() != v2.String() {
-// 		t.Errorf("%v <-> %v", v, v2)
-// 	}
-// }
-
-// func TestCStoreRq(t *testing.T) {
-// 	testDIMSE(t, &dimse_commands.CStoreRq{
-// 		"1.2.3",
-// 		0x1234,
-// 		0x2345,
-// 		1,
-// 		"3.4.5",
-// 		"foohah",
-// 		0x3456, nil})
-// }
-
-// func TestCStoreRsp(t *testing.T) {
-// 	testDIMSE(t, &dimse_commands.CStoreRsp{
-// 		"1.2.3",
-// 		0x1234,
-// 		CommandDataSetTypeNull,
-// 		"3.4.5",
-// 		Status{Status: StatusCode(0x3456)},
-// 		nil})
-// }
-
-// func TestCEchoRq(t *testing.T) {
-// 	testDIMSE(t, &dimse_commands.CEchoRq{0x1234, 1, nil})
-// }
-
-// func TestCEchoRsp(t *testing.T) {
-// 	testDIMSE(t, &dimse_commands.CEchoRsp{0x1234, 1,
-// 		Status{Status: StatusCode(0x2345)},
-// 		nil})
-// }
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/giesekow/go-netdicom/commandset"
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/stretchr/testify/require"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Encode "v", decode the result, and check that the two are the same.
+func testDIMSE(t *testing.T, v dimse.Message) {
+	var b bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&b, v))
+	items := []pdu.PresentationDataValueItem{{ContextID: 1, Command: true, Last: true, Value: b.Bytes()}}
+	if v.HasData() {
+		items = append(items, pdu.PresentationDataValueItem{ContextID: 1, Last: true})
+	}
+	var assembler dimse.CommandAssembler
+	_, v2, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: items})
+	require.NoError(t, err)
+	require.NotNil(t, v2)
+	require.Equal(t, v.String(), v2.String())
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	failure := dimse.Status{Status: dimse.StatusCode(0xa700), ErrorComment: "foohah"}
+	for _, test := range []struct {
+		name string
+		msg  dimse.Message
+	}{
+		{"CStoreRq", &dimse.CStoreRq{
+			AffectedSOPClassUID:                  "1.2.3",
+			MessageID:                            0x1234,
+			Priority:                             dimse.PriorityLow,
+			CommandDataSetType:                   dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID:               "3.4.5",
+			MoveOriginatorApplicationEntityTitle: "foohah",
+			MoveOriginatorMessageID:              0x3456,
+		}},
+		{"CStoreRsp", &dimse.CStoreRsp{
+			AffectedSOPClassUID:       "1.2.3",
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    "3.4.5",
+			Status:                    failure,
+		}},
+		{"CFindRq", &dimse.CFindRq{
+			AffectedSOPClassUID: "1.2.3",
+			MessageID:           0x1234,
+			Priority:            dimse.PriorityHigh,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		}},
+		{"CFindRsp", &dimse.CFindRsp{
+			AffectedSOPClassUID:       "1.2.3",
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+			Status:                    dimse.Status{Status: dimse.StatusPending},
+		}},
+		{"CGetRq", &dimse.CGetRq{
+			AffectedSOPClassUID: "1.2.3",
+			MessageID:           0x1234,
+			Priority:            dimse.PriorityMedium,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		}},
+		{"CGetRsp", &dimse.CGetRsp{
+			AffectedSOPClassUID:            "1.2.3",
+			MessageIDBeingRespondedTo:      0x1234,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			NumberOfRemainingSuboperations: 1,
+			NumberOfCompletedSuboperations: 2,
+			NumberOfFailedSuboperations:    3,
+			NumberOfWarningSuboperations:   4,
+			Status:                         dimse.Status{Status: dimse.StatusPending},
+		}},
+		{"CMoveRq", &dimse.CMoveRq{
+			AffectedSOPClassUID: "1.2.3",
+			MessageID:           0x1234,
+			Priority:            dimse.PriorityLow,
+			MoveDestination:     "destae",
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		}},
+		{"CMoveRsp", &dimse.CMoveRsp{
+			AffectedSOPClassUID:            "1.2.3",
+			MessageIDBeingRespondedTo:      0x1234,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			NumberOfRemainingSuboperations: 5,
+			NumberOfCompletedSuboperations: 6,
+			NumberOfFailedSuboperations:    7,
+			NumberOfWarningSuboperations:   8,
+			Status:                         failure,
+		}},
+		{"CEchoRq", &dimse.CEchoRq{
+			AffectedSOPClassUID: "1.2.840.10008.1.1",
+			MessageID:           0x1234,
+			CommandDataSetType:  dimse.CommandDataSetTypeNull,
+		}},
+		{"CEchoRsp", &dimse.CEchoRsp{
+			AffectedSOPClassUID:       "1.2.840.10008.1.1",
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Success,
+		}},
+		{"CCancelRq", &dimse.CCancelRq{
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) { testDIMSE(t, test.msg) })
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	failure := dimse.Status{Status: dimse.CStoreDataSetDoesNotMatchSOPClass, ErrorID: 7}
+	failure.SetOffendingElement(tag.Tag{Group: 0x0010, Element: 0x0010}, tag.Tag{Group: 0x0020, Element: 0x000d})
+	for _, v := range []dimse.Message{
+		&dimse.CEchoRq{MessageID: 1, CommandDataSetType: dimse.CommandDataSetTypeNull},
+		&dimse.CStoreRq{
+			AffectedSOPClassUID:                  "1.2.840.10008.5.1.4.1.1.7",
+			MessageID:                            2,
+			CommandDataSetType:                   dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID:               "1.2.3", // Odd length, padded.
+			MoveOriginatorApplicationEntityTitle: "MOVER",
+			MoveOriginatorMessageID:              3,
+		},
+		&dimse.CFindRsp{
+			AffectedSOPClassUID:       "1.2.840.10008.5.1.4.1.2.2.1",
+			MessageIDBeingRespondedTo: 4,
+			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+			Status:                    dimse.Status{Status: dimse.StatusPending},
+		},
+		&dimse.CMoveRsp{
+			AffectedSOPClassUID:            "1.2.840.10008.5.1.4.1.2.2.2",
+			MessageIDBeingRespondedTo:      5,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			NumberOfCompletedSuboperations: 6,
+			Status:                         dimse.Status{Status: dimse.StatusCode(0xa702), ErrorComment: "out of resources"},
+		},
+		&dimse.CStoreRsp{
+			AffectedSOPClassUID:       "1.2.840.10008.5.1.4.1.1.7",
+			MessageIDBeingRespondedTo: 8,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    "1.2.34",
+			Status:                    failure,
+		},
+	} {
+		var b bytes.Buffer
+		require.NoError(t, dimse.EncodeMessage(&b, v))
+		size, err := dimse.EncodedSize(v)
+		require.NoError(t, err)
+		require.Equal(t, b.Len(), size, v.String())
+	}
+}
+
+func TestPriorityValues(t *testing.T) {
+	require.Equal(t, uint16(0x0000), uint16(dimse.PriorityMedium))
+	require.Equal(t, uint16(0x0001), uint16(dimse.PriorityHigh))
+	require.Equal(t, uint16(0x0002), uint16(dimse.PriorityLow))
+	require.Equal(t, "PriorityHigh", dimse.PriorityHigh.String())
+	require.Equal(t, "Priority(3)", dimse.Priority(3).String())
+}
+
+// Split "data" into P_DATA_TF PDUs of at most chunkSize bytes each.
+func splitIntoPDUs(contextID byte, command bool, data []byte, chunkSize int) []*pdu.PDataTf {
+	var pdus []*pdu.PDataTf
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		pdus = append(pdus, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: contextID,
+			Command:   command,
+			Last:      n == len(data),
+			Value:     data[:n],
+		}}})
+		data = data[n:]
+	}
+	return pdus
+}
+
+func TestCommandAssemblerStreaming(t *testing.T) {
+	cmd := &dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.840.10008.5.1.4.1.1.77.1.6",
+		MessageID:              0x1234,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: "1.2.3.4.5",
+	}
+	var cmdBytes bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&cmdBytes, cmd))
+
+	// A synthetic object spanning many PDUs. The assembler must hand it to
+	// the writer piece by piece instead of returning it. The limit applies
+	// to streamed payloads too, so it's lowered to the size of the object
+	// instead of allocating an object of the default size.
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	hash := sha256.New()
+	var nWriters int
+	assembler := dimse.CommandAssembler{
+		MaxDataSize: int64(len(data)),
+		NewDataWriter: func(contextID byte, command dimse.Message) (io.Writer, error) {
+			require.Equal(t, byte(3), contextID)
+			require.Equal(t, dimse.CommandFieldCStoreRq, command.CommandField())
+			nWriters++
+			return hash, nil
+		},
+	}
+	pdus := append(splitIntoPDUs(3, true, cmdBytes.Bytes(), 16384),
+		splitIntoPDUs(3, false, data, 16384)...)
+	for i, p := range pdus {
+		contextID, command, payload, err := assembler.AddDataPDU(p)
+		require.NoError(t, err)
+		if i < len(pdus)-1 {
+			require.Nil(t, command)
+			continue
+		}
+		require.Equal(t, byte(3), contextID)
+		require.Equal(t, cmd.String(), command.String())
+		require.Nil(t, payload)
+	}
+	require.Equal(t, 1, nWriters)
+	expected := sha256.Sum256(data)
+	require.Equal(t, expected[:], hash.Sum(nil))
+}
+
+func TestCommandAssemblerMaxCommandSize(t *testing.T) {
+	assembler := dimse.CommandAssembler{MaxCommandSize: 1024}
+	var err error
+	// A peer that never sets the Last bit.
+	for i := 0; i < 100 && err == nil; i++ {
+		_, _, _, err = assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: 1,
+			Command:   true,
+			Value:     make([]byte, 100),
+		}}})
+	}
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the limit")
+}
+
+func TestCommandAssemblerMaxDataSize(t *testing.T) {
+	assembler := dimse.CommandAssembler{MaxDataSize: 1024}
+	_, _, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: encodeCommand(t, cStoreRqWithData)},
+	}})
+	require.NoError(t, err)
+	for i := 0; i < 100 && err == nil; i++ {
+		_, _, _, err = assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: 1,
+			Command:   false,
+			Value:     make([]byte, 100),
+		}}})
+	}
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the limit")
+}
+
+var cStoreRqWithData = &dimse.CStoreRq{
+	AffectedSOPClassUID:    "1.2.840.10008.5.1.4.1.1.7",
+	MessageID:              1,
+	CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+	AffectedSOPInstanceUID: "1.2.3",
+}
+
+func encodeCommand(t *testing.T, v dimse.Message) []byte {
+	var b bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&b, v))
+	return b.Bytes()
+}
+
+func TestDecodeDIMSECommandMap(t *testing.T) {
+	var b bytes.Buffer
+	for _, e := range []struct {
+		group, element uint16
+		value          []byte
+	}{
+		{0x0000, 0x0100, []byte{0x30, 0x00}}, // C-ECHO-RQ
+		{0x0000, 0x0110, []byte{0x07, 0x00}},
+		{0x0000, 0x1000, []byte("1.2")},
+		// Truncated: claims more bytes than remain.
+		{0x0000, 0x0800, []byte{0x00}},
+	} {
+		length := uint32(len(e.value))
+		if e.element == 0x0800 {
+			length = 0xffffffff
+		}
+		binary.Write(&b, binary.LittleEndian, e.group)
+		binary.Write(&b, binary.LittleEndian, e.element)
+		binary.Write(&b, binary.LittleEndian, length)
+		b.Write(e.value)
+	}
+	require.Equal(t, map[string]interface{}{
+		"CommandField": uint16(0x30),
+		"MessageID":    uint16(7),
+		"(0000,1000)":  []byte("1.2"),
+	}, dimse.DecodeDIMSECommandMap(b.Bytes()))
+}
+
+func TestCommandAssemblerCommandFragmentAfterLast(t *testing.T) {
+	var assembler dimse.CommandAssembler
+	_, _, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: encodeCommand(t, cStoreRqWithData)},
+		// Looks like a data fragment, but has the command bit set.
+		{ContextID: 1, Command: true, Value: make([]byte, 8)},
+	}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "command fragment after the last command fragment")
+}
+
+func TestCommandAssemblerWrongCommandGroupLength(t *testing.T) {
+	// A CommandGroupLength element that claims 100 bytes, followed by a
+	// 10-byte CommandField element.
+	command := binary.LittleEndian.AppendUint16(nil, 0x0000)
+	command = binary.LittleEndian.AppendUint16(command, 0x0000)
+	command = binary.LittleEndian.AppendUint32(command, 4)
+	command = binary.LittleEndian.AppendUint32(command, 100)
+	command = binary.LittleEndian.AppendUint16(command, 0x0000)
+	command = binary.LittleEndian.AppendUint16(command, 0x0100)
+	command = binary.LittleEndian.AppendUint32(command, 2)
+	command = binary.LittleEndian.AppendUint16(command, dimse.CommandFieldCEchoRq)
+
+	var assembler dimse.CommandAssembler
+	_, _, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: command},
+	}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "CommandGroupLength is 100, but the command has 10B after it")
+}
+
+// P3.8 E.2 lets the command and data fragments be split across PDUs in any
+// way, as long as all the command fragments come first.
+func TestCommandAssemblerLegalInterleavings(t *testing.T) {
+	cmd := encodeCommand(t, cStoreRqWithData)
+	data := []byte{1, 2, 3, 4, 5, 6}
+	cmdItem := func(value []byte, last bool) pdu.PresentationDataValueItem {
+		return pdu.PresentationDataValueItem{ContextID: 1, Command: true, Last: last, Value: value}
+	}
+	dataItem := func(value []byte, last bool) pdu.PresentationDataValueItem {
+		return pdu.PresentationDataValueItem{ContextID: 1, Last: last, Value: value}
+	}
+	for _, test := range []struct {
+		name string
+		pdus [][]pdu.PresentationDataValueItem
+	}{
+		{"one PDU", [][]pdu.PresentationDataValueItem{
+			{cmdItem(cmd, true), dataItem(data, true)},
+		}},
+		{"data with the last command fragment", [][]pdu.PresentationDataValueItem{
+			{cmdItem(cmd[:10], false)},
+			{cmdItem(cmd[10:], true), dataItem(data[:2], false)},
+			{dataItem(data[2:], true)},
+		}},
+		{"data across PDUs", [][]pdu.PresentationDataValueItem{
+			{cmdItem(cmd, true)},
+			{dataItem(data[:2], false), dataItem(data[2:4], false)},
+			{dataItem(data[4:], true)},
+		}},
+	} {
+		var assembler dimse.CommandAssembler
+		for i, items := range test.pdus {
+			contextID, command, payload, err := assembler.AddDataPDU(&pdu.PDataTf{Items: items})
+			require.NoError(t, err, test.name)
+			if i < len(test.pdus)-1 {
+				require.Nil(t, command, test.name)
+				continue
+			}
+			require.Equal(t, byte(1), contextID, test.name)
+			require.Equal(t, cStoreRqWithData.String(), command.String(), test.name)
+			require.Equal(t, data, payload, test.name)
+		}
+	}
+}
+
+func TestCommandAssemblerIllegalInterleavings(t *testing.T) {
+	echo := encodeCommand(t, &dimse.CEchoRq{MessageID: 1, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	store := encodeCommand(t, cStoreRqWithData)
+	for _, test := range []struct {
+		name  string
+		items []pdu.PresentationDataValueItem
+		err   string
+	}{
+		{"data before the command", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Value: []byte{1, 2}},
+		}, "data fragment before the last command fragment"},
+		{"data between command fragments", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Value: store[:10]},
+			{ContextID: 1, Value: []byte{1, 2}},
+			{ContextID: 1, Command: true, Last: true, Value: store[10:]},
+		}, "data fragment before the last command fragment"},
+		{"data for a command without data", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: echo},
+			{ContextID: 1, Last: true, Value: []byte{1, 2}},
+		}, "which has no data"},
+		{"data after the last data fragment", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: store},
+			{ContextID: 1, Last: true, Value: []byte{1, 2}},
+			{ContextID: 1, Last: true, Value: []byte{3, 4}},
+		}, ">1 data chunks"},
+	} {
+		var assembler dimse.CommandAssembler
+		_, _, _, err := assembler.AddDataPDU(&pdu.PDataTf{Items: test.items})
+		require.Error(t, err, test.name)
+		require.Contains(t, err.Error(), test.err, test.name)
+	}
+}
+
+func TestCommandAssemblerSkipUnknownCommands(t *testing.T) {
+	messageID, err := dimse.NewElement(commandset.MessageID, uint16(7))
+	require.NoError(t, err)
+	// A private command with a payload.
+	cmd := &dimse.UnknownMessage{
+		Field:              0x0ff1,
+		CommandDataSetType: dimse.CommandDataSetTypeNonNull,
+		Elements:           []*dicom.Element{messageID},
+	}
+	var cmdBytes bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&cmdBytes, cmd))
+	data := []byte{1, 2, 3, 4}
+	pdus := append(splitIntoPDUs(1, true, cmdBytes.Bytes(), 16384), splitIntoPDUs(1, false, data, 16384)...)
+
+	var assembler dimse.CommandAssembler
+	_, _, _, err = assembler.AddDataPDU(pdus[0])
+	require.ErrorIs(t, err, dimse.ErrUnknownCommand)
+
+	assembler = dimse.CommandAssembler{SkipUnknownCommands: true}
+	_, command, _, err := assembler.AddDataPDU(pdus[0])
+	require.NoError(t, err)
+	require.Nil(t, command, "command returned before its payload")
+	_, command, payload, err := assembler.AddDataPDU(pdus[1])
+	require.NoError(t, err)
+	require.IsType(t, &dimse.UnknownMessage{}, command)
+	require.Equal(t, uint16(0x0ff1), command.CommandField())
+	require.Equal(t, dimse.MessageID(7), command.GetMessageID())
+	require.Equal(t, data, payload)
+}
+
+func TestReadMessageStrict(t *testing.T) {
+	newElement := func(tag tag.Tag, v interface{}) *dicom.Element {
+		elem, err := dimse.NewElement(tag, v)
+		require.NoError(t, err)
+		return elem
+	}
+	// A C-ECHO request that also carries AffectedSOPInstanceUID, which
+	// C-ECHO doesn't define.
+	dataset := dicom.Dataset{Elements: []*dicom.Element{
+		newElement(commandset.CommandGroupLength, uint32(0)),
+		newElement(commandset.CommandField, dimse.CommandFieldCEchoRq),
+		newElement(commandset.MessageID, uint16(3)),
+		newElement(commandset.CommandDataSetType, uint16(dimse.CommandDataSetTypeNull)),
+		newElement(commandset.AffectedSOPInstanceUID, "1.2.3"),
+	}}
+
+	msg, err := dimse.ReadMessage(&dataset)
+	require.NoError(t, err)
+	extra := msg.(*dimse.CEchoRq).Extra // CommandGroupLength is left out.
+	require.Len(t, extra, 1)
+	require.Equal(t, commandset.AffectedSOPInstanceUID, extra[0].Tag)
+
+	_, err = dimse.ReadMessageStrict(&dataset)
+	require.ErrorIs(t, err, dimse.ErrUnexpectedElement)
+
+	msg, err = dimse.ReadMessageStrict(&dataset, commandset.AffectedSOPInstanceUID)
+	require.NoError(t, err)
+	require.Equal(t, dimse.MessageID(3), msg.GetMessageID())
+
+	// AffectedSOPClassUID is a standard element of C-ECHO.
+	dataset.Elements[4] = newElement(commandset.AffectedSOPClassUID, "1.2.840.10008.1.1")
+	msg, err = dimse.ReadMessageStrict(&dataset)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.840.10008.1.1", msg.(*dimse.CEchoRq).AffectedSOPClassUID)
+}
+
+func TestGetCommandDataSetType(t *testing.T) {
+	for _, dataSetType := range []dimse.CommandDataSetType{dimse.CommandDataSetTypeNull, dimse.CommandDataSetTypeNonNull} {
+		// Listing the types as dimse.Message checks at compile time that
+		// they all implement GetCommandDataSetType.
+		for _, v := range []dimse.Message{
+			&dimse.CStoreRq{CommandDataSetType: dataSetType},
+			&dimse.CStoreRsp{CommandDataSetType: dataSetType},
+			&dimse.CFindRq{CommandDataSetType: dataSetType},
+			&dimse.CFindRsp{CommandDataSetType: dataSetType},
+			&dimse.CGetRq{CommandDataSetType: dataSetType},
+			&dimse.CGetRsp{CommandDataSetType: dataSetType},
+			&dimse.CMoveRq{CommandDataSetType: dataSetType},
+			&dimse.CMoveRsp{CommandDataSetType: dataSetType},
+			&dimse.CEchoRq{CommandDataSetType: dataSetType},
+			&dimse.CEchoRsp{CommandDataSetType: dataSetType},
+			&dimse.CCancelRq{CommandDataSetType: dataSetType},
+			&dimse.NEventReportRq{CommandDataSetType: dataSetType},
+			&dimse.NEventReportRsp{CommandDataSetType: dataSetType},
+			&dimse.NActionRq{CommandDataSetType: dataSetType},
+			&dimse.NActionRsp{CommandDataSetType: dataSetType},
+			&dimse.UnknownMessage{CommandDataSetType: dataSetType},
+		} {
+			require.Equal(t, dataSetType, v.GetCommandDataSetType(), v.String())
+			require.Equal(t, dataSetType != dimse.CommandDataSetTypeNull, v.HasData(), v.String())
+		}
+	}
+}
+
+// Encode "v", feed it to a CommandAssembler in chunks of chunkSize bytes, and
+// return the decoded message.
+func assembleCommand(t *testing.T, v dimse.Message, chunkSize int) dimse.Message {
+	var b bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&b, v))
+	var assembler dimse.CommandAssembler
+	var command dimse.Message
+	for _, p := range splitIntoPDUs(1, true, b.Bytes(), chunkSize) {
+		require.Nil(t, command, "command decoded before the last fragment")
+		var err error
+		_, command, _, err = assembler.AddDataPDU(p)
+		require.NoError(t, err)
+	}
+	require.NotNil(t, command)
+	return command
+}
+
+func TestCommandAssemblerShortCommands(t *testing.T) {
+	for _, v := range []dimse.Message{
+		&dimse.CEchoRq{
+			MessageID:          0x1234,
+			CommandDataSetType: dimse.CommandDataSetTypeNull,
+		},
+		&dimse.CEchoRsp{
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Success,
+		},
+		&dimse.CStoreRsp{
+			AffectedSOPClassUID:       "1.2",
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    "3.4",
+			Status:                    dimse.Status{Status: dimse.StatusCode(0xa700)},
+		},
+	} {
+		for _, chunkSize := range []int{1, 7, 16384} {
+			require.Equal(t, v.String(), assembleCommand(t, v, chunkSize).String())
+		}
+	}
+}
+
+func TestCommandAssemblerDecodesCEchoRq(t *testing.T) {
+	// A C-ECHO-RQ as sent by DCMTK's echoscu, in implicit VR little endian.
+	// It is shorter than 100 bytes.
+	command := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x38, 0x00, 0x00, 0x00, // CommandGroupLength: 56
+		0x00, 0x00, 0x02, 0x00, 0x12, 0x00, 0x00, 0x00, // AffectedSOPClassUID
+		'1', '.', '2', '.', '8', '4', '0', '.', '1', '0', '0', '0', '8', '.', '1', '.', '1', 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x30, 0x00, // CommandField: C-ECHO-RQ
+		0x00, 0x00, 0x10, 0x01, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, // MessageID: 1
+		0x00, 0x00, 0x00, 0x08, 0x02, 0x00, 0x00, 0x00, 0x01, 0x01, // CommandDataSetType: null
+	}
+	var c dimse.CommandAssembler
+	contextID, v, data, err := c.AddDataPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: command},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, byte(1), contextID)
+	require.Nil(t, data)
+	echo, ok := v.(*dimse.CEchoRq)
+	require.True(t, ok, v.String())
+	require.Equal(t, "1.2.840.10008.1.1", echo.AffectedSOPClassUID)
+	require.Equal(t, dimse.MessageID(1), echo.MessageID)
+	require.Equal(t, dimse.CommandDataSetTypeNull, echo.CommandDataSetType)
+	require.Empty(t, echo.Extra)
+}
+
+func TestStatusErrorIDAndOffendingElement(t *testing.T) {
+	v := &dimse.CStoreRsp{
+		AffectedSOPClassUID:       "1.2",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    "3.4",
+		Status: dimse.Status{
+			Status:       dimse.CStoreDataSetDoesNotMatchSOPClass,
+			ErrorComment: "Bad dataset",
+			ErrorID:      0x1234,
+		},
+	}
+	offendingElement := []tag.Tag{
+		{Group: 0x0010, Element: 0x0010},
+		{Group: 0x0020, Element: 0x000d},
+	}
+	v.Status.SetOffendingElement(offendingElement...)
+	require.Equal(t, offendingElement, v.Status.OffendingElement())
+	got := assembleCommand(t, v, 16384).(*dimse.CStoreRsp)
+	require.Equal(t, v.Status, got.Status)
+	require.Equal(t, offendingElement, got.Status.OffendingElement())
+
+	v.Status.SetOffendingElement()
+	require.Nil(t, v.Status.OffendingElement())
+}
+
+func TestSubOperationProgress(t *testing.T) {
+	pending := dimse.Status{Status: dimse.StatusPending}
+	var p dimse.SubOperationProgress
+	for _, rsp := range []dimse.Message{
+		&dimse.CMoveRsp{NumberOfRemainingSuboperations: 5, Status: pending},
+		&dimse.CMoveRsp{NumberOfRemainingSuboperations: 4, NumberOfCompletedSuboperations: 1, Status: pending},
+		// The counters that are zero are omitted, so they decode as zero.
+		&dimse.CMoveRsp{NumberOfRemainingSuboperations: 2, NumberOfFailedSuboperations: 1, Status: pending},
+		&dimse.CMoveRsp{NumberOfCompletedSuboperations: 2, Status: pending},
+	} {
+		require.True(t, p.Update(rsp))
+	}
+	require.Equal(t, dimse.SubOperationProgress{Remaining: 2, Completed: 2, Failed: 1}, p)
+	require.Equal(t, 5, p.Total())
+
+	require.False(t, p.Update(&dimse.CFindRsp{Status: pending}))
+	require.True(t, p.Update(&dimse.CMoveRsp{
+		NumberOfCompletedSuboperations: 3,
+		NumberOfFailedSuboperations:    1,
+		NumberOfWarningSuboperations:   1,
+		// Sub-operations complete - one or more failures or warnings.
+		Status: dimse.Status{Status: dimse.StatusCode(0xb000)},
+	}))
+	require.Equal(t, dimse.SubOperationProgress{Completed: 3, Failed: 1, Warning: 1, Done: true}, p)
+	require.Equal(t, 5, p.Total())
+
+	// C-GET responses carry the same counters.
+	p = dimse.SubOperationProgress{}
+	require.True(t, p.Update(&dimse.CGetRsp{NumberOfRemainingSuboperations: 3, Status: pending}))
+	require.True(t, p.Update(&dimse.CGetRsp{
+		NumberOfRemainingSuboperations: 2,
+		NumberOfCompletedSuboperations: 1,
+		Status:                         dimse.Status{Status: dimse.StatusCancel},
+	}))
+	require.Equal(t, dimse.SubOperationProgress{Remaining: 2, Completed: 1, Done: true}, p)
+}
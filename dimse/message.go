@@ -1,5 +1,7 @@
 package dimse
 
+//go:generate stringer -type Priority
+
 import (
 	"bytes"
 	"encoding/binary"
@@ -24,6 +26,9 @@ type Message interface {
 	GetStatus() *Status
 	// HasData is true if we expect P_DATA_TF packets after the command packets.
 	HasData() bool
+	// GetCommandDataSetType returns the CommandDataSetType field, which
+	// tells whether a data set follows the command.
+	GetCommandDataSetType() CommandDataSetType
 }
 
 const (
@@ -38,18 +43,27 @@ const (
 	CommandFieldCMoveRsp  uint16 = 0x8021
 	CommandFieldCEchoRq   uint16 = 0x0030
 	CommandFieldCEchoRsp  uint16 = 0x8030
+	CommandFieldCCancelRq uint16 = 0x0FFF
+
+	CommandFieldNEventReportRq  uint16 = 0x0100
+	CommandFieldNEventReportRsp uint16 = 0x8100
+	CommandFieldNActionRq       uint16 = 0x0130
+	CommandFieldNActionRsp      uint16 = 0x8130
 )
 
 type MessageID = uint16
 
+// Priority is the priority of a request, encoded in (0000,0700). P3.7 C.
+type Priority uint16
+
+const (
+	PriorityMedium Priority = 0x0000
+	PriorityHigh   Priority = 0x0001
+	PriorityLow    Priority = 0x0002
+)
+
 func ReadMessage(dataset *dicom.Dataset) (message Message, err error) {
-	mDecoder := MessageDecoder{
-		elements: make(map[dicomtag.Tag]*dicom.Element),
-	}
-	for _, elem := range dataset.Elements {
-		tag := elem.Tag
-		mDecoder.elements[tag] = elem
-	}
+	mDecoder := newMessageDecoder(dataset)
 	commandField, err := mDecoder.GetUInt16(commandset.CommandField, RequiredElement)
 	if err != nil {
 		return nil, fmt.Errorf("ReadMessage: failed to get command field: %w", err)
@@ -57,6 +71,27 @@ func ReadMessage(dataset *dicom.Dataset) (message Message, err error) {
 	return mDecoder.Decode(commandField)
 }
 
+// ReadMessageStrict is similar to ReadMessage, but fails with
+// ErrUnexpectedElement if the command has an element that its message type
+// doesn't define, e.g., a private element some implementations add, instead
+// of keeping it in the Extra field of the message. CommandGroupLength and the
+// tags in "allowed" are accepted.
+func ReadMessageStrict(dataset *dicom.Dataset, allowed ...dicomtag.Tag) (Message, error) {
+	mDecoder := newMessageDecoder(dataset)
+	commandField, err := mDecoder.GetUInt16(commandset.CommandField, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("ReadMessageStrict: failed to get command field: %w", err)
+	}
+	message, err := mDecoder.Decode(commandField)
+	if err != nil {
+		return nil, err
+	}
+	if err := mDecoder.checkNoUnparsedElements(allowed); err != nil {
+		return nil, fmt.Errorf("ReadMessageStrict: %v: %w", message, err)
+	}
+	return message, nil
+}
+
 // EncodeMessage serializes the given message. Errors are reported through e.Error()
 func EncodeMessage(out io.Writer, v Message) error {
 	writer, err := dicom.NewWriter(out)
@@ -77,3 +112,40 @@ func EncodeMessage(out io.Writer, v Message) error {
 	out.Write(subEncoderBuffer.Bytes())
 	return nil
 }
+
+// Size of the CommandGroupLength element that EncodeMessage prepends to the
+// command: tag (4 bytes), length (4 bytes) and a UL value (4 bytes), in
+// implicit VR.
+const commandGroupLengthElementSize = 12
+
+// EncodedSize returns the number of bytes EncodeMessage writes for v, e.g.,
+// to size a buffer or to check a command against a size limit before sending
+// it. The size is computed from the elements of v, without encoding them.
+func EncodedSize(v Message) (int, error) {
+	var w sizeWriter
+	if err := v.Encode(&w); err != nil {
+		return 0, fmt.Errorf("EncodedSize: error encoding message: %w", err)
+	}
+	return commandGroupLengthElementSize + w.n, nil
+}
+
+// sizeWriter is passed to Message.Encode by EncodedSize. EncodeElements adds
+// up the sizes of the elements in it instead of encoding them.
+type sizeWriter struct {
+	n int
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// countingWriter discards the data written to it, counting the bytes.
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
@@ -1,7 +1,9 @@
 package dimse
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/giesekow/go-netdicom/commandset"
 	"github.com/suyashkumar/dicom"
@@ -13,6 +15,22 @@ type MessageDecoder struct {
 	elements map[dicomtag.Tag]*dicom.Element
 }
 
+func newMessageDecoder(dataset *dicom.Dataset) *MessageDecoder {
+	d := &MessageDecoder{elements: make(map[dicomtag.Tag]*dicom.Element)}
+	for _, elem := range dataset.Elements {
+		d.elements[elem.Tag] = elem
+	}
+	return d
+}
+
+// ErrUnknownCommand is returned when decoding a command whose command field
+// isn't one of the CommandField* constants.
+var ErrUnknownCommand = errors.New("unknown DIMSE command")
+
+// ErrUnexpectedElement is returned by ReadMessageStrict when a command has an
+// element that its message type doesn't define.
+var ErrUnexpectedElement = errors.New("unexpected DIMSE command element")
+
 type isOptionalElement int
 
 const (
@@ -55,16 +73,45 @@ func (d *MessageDecoder) Decode(commandField uint16) (Message, error) {
 		return CEchoRq{}.decode(d)
 	case CommandFieldCEchoRsp:
 		return CEchoRsp{}.decode(d)
+	case CommandFieldCCancelRq:
+		return CCancelRq{}.decode(d)
+	case CommandFieldNEventReportRq:
+		return NEventReportRq{}.decode(d)
+	case CommandFieldNEventReportRsp:
+		return NEventReportRsp{}.decode(d)
+	case CommandFieldNActionRq:
+		return NActionRq{}.decode(d)
+	case CommandFieldNActionRsp:
+		return NActionRsp{}.decode(d)
 	default:
-		return nil, fmt.Errorf("unknown DIMSE command 0x%x", commandField)
+		return nil, fmt.Errorf("%w 0x%x", ErrUnknownCommand, commandField)
 	}
 }
 
+// Checks that the decoder consumed all the elements of the command except
+// CommandGroupLength and those in "allowed".
+func (d *MessageDecoder) checkNoUnparsedElements(allowed []dicomtag.Tag) error {
+	for tag := range d.elements {
+		if tag == commandset.CommandGroupLength || slices.Contains(allowed, tag) {
+			continue
+		}
+		return fmt.Errorf("%w %v", ErrUnexpectedElement, tag)
+	}
+	return nil
+}
+
+// UnparsedElements returns the elements that no getter has consumed, sorted
+// by tag. Group lengths, e.g., CommandGroupLength, are left out, since they
+// are recomputed when the message is encoded.
 func (d *MessageDecoder) UnparsedElements() []*dicom.Element {
 	elems := make([]*dicom.Element, 0, len(d.elements))
-	for _, elem := range d.elements {
+	for tag, elem := range d.elements {
+		if tag.Element == 0x0000 {
+			continue
+		}
 		elems = append(elems, elem)
 	}
+	slices.SortFunc(elems, func(a, b *dicom.Element) int { return a.Tag.Compare(b.Tag) })
 	return elems
 }
 
@@ -78,9 +125,26 @@ func (d *MessageDecoder) GetStatus() (s Status, err error) {
 	if err != nil {
 		return s, fmt.Errorf("GetStatus: failed to get error comment: %w", err)
 	}
+	s.ErrorID, err = d.GetUInt16(commandset.ErrorID, OptionalElement)
+	if err != nil {
+		return s, fmt.Errorf("GetStatus: failed to get error ID: %w", err)
+	}
+	offendingElement, err := d.GetTags(commandset.OffendingElement, OptionalElement)
+	if err != nil {
+		return s, fmt.Errorf("GetStatus: failed to get offending element: %w", err)
+	}
+	s.SetOffendingElement(offendingElement...)
 	return s, nil
 }
 
+func (d *MessageDecoder) GetPriority() (Priority, error) {
+	priority, err := d.GetUInt16(commandset.Priority, RequiredElement)
+	if err != nil {
+		return PriorityMedium, fmt.Errorf("GetPriority: failed to get priority: %w", err)
+	}
+	return Priority(priority), nil
+}
+
 func (d *MessageDecoder) GetCommandDataSetType() (CommandDataSetType, error) {
 	cmdDataSetType, err := d.GetUInt16(commandset.CommandDataSetType, RequiredElement)
 	if err != nil {
@@ -115,6 +179,30 @@ func (d *MessageDecoder) GetString(tag dicomtag.Tag, optional isOptionalElement)
 	return v[0], nil
 }
 
+// Find an element with "tag", and extract a list of tags (VR AT) from it.
+func (d *MessageDecoder) GetTags(tag dicomtag.Tag, optional isOptionalElement) ([]dicomtag.Tag, error) {
+	elem := d.elements[tag]
+	if elem == nil {
+		if optional == RequiredElement {
+			return nil, fmt.Errorf("GetTags: tag %s not found", tag.String())
+		}
+		return nil, nil
+	}
+	if elem.Value == nil || elem.Value.ValueType() != dicom.Ints {
+		return nil, fmt.Errorf("GetTags: element %s is not a tag list", tag.String())
+	}
+	v, ok := elem.Value.GetValue().([]int)
+	if !ok || len(v)%2 != 0 {
+		return nil, fmt.Errorf("GetTags: failed to convert tag %s to a list of <group, element> pairs", tag.String())
+	}
+	var tags []dicomtag.Tag
+	for i := 0; i < len(v); i += 2 {
+		tags = append(tags, dicomtag.Tag{Group: uint16(v[i]), Element: uint16(v[i+1])})
+	}
+	delete(d.elements, tag)
+	return tags, nil
+}
+
 // Find an element with "tag", and extract a uint16 from it. Errors are reported in d.err.
 func (d *MessageDecoder) GetUInt16(tag dicomtag.Tag, optional isOptionalElement) (uint16, error) {
 	elem := d.elements[tag]
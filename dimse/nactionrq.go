@@ -0,0 +1,121 @@
+package dimse
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/giesekow/go-netdicom/commandset"
+	"github.com/suyashkumar/dicom"
+)
+
+type NActionRq struct {
+	RequestedSOPClassUID    string
+	MessageID               MessageID
+	CommandDataSetType      CommandDataSetType
+	RequestedSOPInstanceUID string
+	ActionTypeID            uint16
+	Extra                   []*dicom.Element // Unparsed elements
+}
+
+func (v *NActionRq) Encode(e io.Writer) error {
+	elems := []*dicom.Element{}
+
+	elem, err := NewElement(commandset.CommandField, v.CommandField())
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create CommandField element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.RequestedSOPClassUID, v.RequestedSOPClassUID)
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create RequestedSOPClassUID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.MessageID, v.MessageID)
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create MessageID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.CommandDataSetType, uint16(v.CommandDataSetType))
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create CommandDataSetType element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.RequestedSOPInstanceUID, v.RequestedSOPInstanceUID)
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create RequestedSOPInstanceUID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.ActionTypeID, v.ActionTypeID)
+	if err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to create ActionTypeID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elems = append(elems, v.Extra...)
+	if err := EncodeElements(e, elems); err != nil {
+		return fmt.Errorf("NActionRq.Encode: failed to encode elements: %w", err)
+	}
+	return nil
+}
+
+func (v *NActionRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NActionRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
+func (v *NActionRq) CommandField() uint16 {
+	return CommandFieldNActionRq
+}
+
+func (v *NActionRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NActionRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NActionRq) String() string {
+	return fmt.Sprintf("NActionRq{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v ActionTypeID:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID, v.ActionTypeID)
+}
+
+func (NActionRq) decode(d *MessageDecoder) (*NActionRq, error) {
+	v := &NActionRq{}
+	var err error
+
+	v.RequestedSOPClassUID, err = d.GetString(commandset.RequestedSOPClassUID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRq.decode: failed to decode RequestedSOPClassUID: %w", err)
+	}
+
+	v.MessageID, err = d.GetUInt16(commandset.MessageID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRq.decode: failed to decode MessageID: %w", err)
+	}
+
+	v.CommandDataSetType, err = d.GetCommandDataSetType()
+	if err != nil {
+		return nil, fmt.Errorf("nActionRq.decode: failed to decode CommandDataSetType: %w", err)
+	}
+
+	v.RequestedSOPInstanceUID, err = d.GetString(commandset.RequestedSOPInstanceUID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRq.decode: failed to decode RequestedSOPInstanceUID: %w", err)
+	}
+
+	v.ActionTypeID, err = d.GetUInt16(commandset.ActionTypeID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRq.decode: failed to decode ActionTypeID: %w", err)
+	}
+
+	v.Extra = d.UnparsedElements()
+	return v, nil
+}
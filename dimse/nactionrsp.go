@@ -0,0 +1,139 @@
+package dimse
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/giesekow/go-netdicom/commandset"
+	"github.com/suyashkumar/dicom"
+)
+
+type NActionRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        CommandDataSetType
+	AffectedSOPInstanceUID    string
+	ActionTypeID              uint16
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NActionRsp) Encode(e io.Writer) error {
+	elems := []*dicom.Element{}
+
+	elem, err := NewElement(commandset.CommandField, v.CommandField())
+	if err != nil {
+		return fmt.Errorf("NActionRsp.Encode: failed to create CommandField element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	if v.AffectedSOPClassUID != "" {
+		elem, err = NewElement(commandset.AffectedSOPClassUID, v.AffectedSOPClassUID)
+		if err != nil {
+			return fmt.Errorf("NActionRsp.Encode: failed to create AffectedSOPClassUID element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+
+	elem, err = NewElement(commandset.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
+	if err != nil {
+		return fmt.Errorf("NActionRsp.Encode: failed to create MessageIDBeingRespondedTo element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.CommandDataSetType, uint16(v.CommandDataSetType))
+	if err != nil {
+		return fmt.Errorf("NActionRsp.Encode: failed to create CommandDataSetType element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	if v.AffectedSOPInstanceUID != "" {
+		elem, err = NewElement(commandset.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID)
+		if err != nil {
+			return fmt.Errorf("NActionRsp.Encode: failed to create AffectedSOPInstanceUID element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+
+	if v.ActionTypeID != 0 {
+		elem, err = NewElement(commandset.ActionTypeID, v.ActionTypeID)
+		if err != nil {
+			return fmt.Errorf("NActionRsp.Encode: failed to create ActionTypeID element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+
+	statusElems, err := v.Status.ToElements()
+	if err != nil {
+		return fmt.Errorf("NActionRsp.Encode: failed to create Status elements: %w", err)
+	}
+	elems = append(elems, statusElems...)
+
+	elems = append(elems, v.Extra...)
+	if err := EncodeElements(e, elems); err != nil {
+		return fmt.Errorf("NActionRsp.Encode: failed to encode elements: %w", err)
+	}
+	return nil
+}
+
+func (v *NActionRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NActionRsp) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
+func (v *NActionRsp) CommandField() uint16 {
+	return CommandFieldNActionRsp
+}
+
+func (v *NActionRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NActionRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NActionRsp) String() string {
+	return fmt.Sprintf("NActionRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v ActionTypeID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.ActionTypeID, v.Status)
+}
+
+func (NActionRsp) decode(d *MessageDecoder) (*NActionRsp, error) {
+	v := &NActionRsp{}
+	var err error
+
+	v.AffectedSOPClassUID, err = d.GetString(commandset.AffectedSOPClassUID, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode AffectedSOPClassUID: %w", err)
+	}
+
+	v.MessageIDBeingRespondedTo, err = d.GetUInt16(commandset.MessageIDBeingRespondedTo, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode MessageIDBeingRespondedTo: %w", err)
+	}
+
+	v.CommandDataSetType, err = d.GetCommandDataSetType()
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode CommandDataSetType: %w", err)
+	}
+
+	v.AffectedSOPInstanceUID, err = d.GetString(commandset.AffectedSOPInstanceUID, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode AffectedSOPInstanceUID: %w", err)
+	}
+
+	v.ActionTypeID, err = d.GetUInt16(commandset.ActionTypeID, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode ActionTypeID: %w", err)
+	}
+
+	v.Status, err = d.GetStatus()
+	if err != nil {
+		return nil, fmt.Errorf("nActionRsp.decode: failed to decode Status: %w", err)
+	}
+
+	v.Extra = d.UnparsedElements()
+	return v, nil
+}
@@ -0,0 +1,121 @@
+package dimse
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/giesekow/go-netdicom/commandset"
+	"github.com/suyashkumar/dicom"
+)
+
+type NEventReportRq struct {
+	AffectedSOPClassUID    string
+	MessageID              MessageID
+	CommandDataSetType     CommandDataSetType
+	AffectedSOPInstanceUID string
+	EventTypeID            uint16
+	Extra                  []*dicom.Element // Unparsed elements
+}
+
+func (v *NEventReportRq) Encode(e io.Writer) error {
+	elems := []*dicom.Element{}
+
+	elem, err := NewElement(commandset.CommandField, v.CommandField())
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create CommandField element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.AffectedSOPClassUID, v.AffectedSOPClassUID)
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create AffectedSOPClassUID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.MessageID, v.MessageID)
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create MessageID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.CommandDataSetType, uint16(v.CommandDataSetType))
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create CommandDataSetType element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID)
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create AffectedSOPInstanceUID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elem, err = NewElement(commandset.EventTypeID, v.EventTypeID)
+	if err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to create EventTypeID element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	elems = append(elems, v.Extra...)
+	if err := EncodeElements(e, elems); err != nil {
+		return fmt.Errorf("NEventReportRq.Encode: failed to encode elements: %w", err)
+	}
+	return nil
+}
+
+func (v *NEventReportRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NEventReportRq) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
+func (v *NEventReportRq) CommandField() uint16 {
+	return CommandFieldNEventReportRq
+}
+
+func (v *NEventReportRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NEventReportRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NEventReportRq) String() string {
+	return fmt.Sprintf("NEventReportRq{AffectedSOPClassUID:%v MessageID:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v EventTypeID:%v}}", v.AffectedSOPClassUID, v.MessageID, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.EventTypeID)
+}
+
+func (NEventReportRq) decode(d *MessageDecoder) (*NEventReportRq, error) {
+	v := &NEventReportRq{}
+	var err error
+
+	v.AffectedSOPClassUID, err = d.GetString(commandset.AffectedSOPClassUID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nEventReportRq.decode: failed to decode AffectedSOPClassUID: %w", err)
+	}
+
+	v.MessageID, err = d.GetUInt16(commandset.MessageID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nEventReportRq.decode: failed to decode MessageID: %w", err)
+	}
+
+	v.CommandDataSetType, err = d.GetCommandDataSetType()
+	if err != nil {
+		return nil, fmt.Errorf("nEventReportRq.decode: failed to decode CommandDataSetType: %w", err)
+	}
+
+	v.AffectedSOPInstanceUID, err = d.GetString(commandset.AffectedSOPInstanceUID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nEventReportRq.decode: failed to decode AffectedSOPInstanceUID: %w", err)
+	}
+
+	v.EventTypeID, err = d.GetUInt16(commandset.EventTypeID, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("nEventReportRq.decode: failed to decode EventTypeID: %w", err)
+	}
+
+	v.Extra = d.UnparsedElements()
+	return v, nil
+}
@@ -1,4 +1,5 @@
 //go:generate stringer -type StatusCode
+//go:generate stringer -type StatusCategory
 package dimse
 
 import (
@@ -6,6 +7,7 @@ import (
 
 	"github.com/giesekow/go-netdicom/commandset"
 	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
 // Status represents a result of a DIMSE call.  P3.7 C defines list of status
@@ -16,6 +18,39 @@ type Status struct {
 
 	// Optional error payloads.
 	ErrorComment string // Encoded as (0000,0902)
+	ErrorID      uint16 // Encoded as (0000,0903). Zero if absent.
+
+	// Encoded as (0000,0901). The tags are kept behind a pointer, so that
+	// Status stays comparable, e.g., to Success; two statuses with offending
+	// elements are == only if they share them. Use OffendingElement and
+	// SetOffendingElement to access them.
+	offendingElement *[]tag.Tag
+}
+
+// OffendingElement returns the tags of the offending element (0000,0901),
+// or nil if absent.
+func (s Status) OffendingElement() []tag.Tag {
+	if s.offendingElement == nil {
+		return nil
+	}
+	return *s.offendingElement
+}
+
+// String formats s the way %v formats a struct, but with the tags of the
+// offending element instead of their address.
+func (s Status) String() string {
+	return fmt.Sprintf("{%v %v %v %v}", s.Status, s.ErrorComment, s.ErrorID, s.OffendingElement())
+}
+
+// SetOffendingElement sets the tags of the offending element (0000,0901).
+// Passing no tags removes it.
+func (s *Status) SetOffendingElement(tags ...tag.Tag) {
+	if len(tags) == 0 {
+		s.offendingElement = nil
+		return
+	}
+	tags = append([]tag.Tag(nil), tags...)
+	s.offendingElement = &tags
 }
 
 // Success is an OK status for a call.
@@ -35,10 +70,20 @@ const (
 	StatusNotAuthorized         StatusCode = 0x0124
 	StatusPending               StatusCode = 0xff00
 
-	// C-STORE-specific status codes. P3.4 GG4-1
+	// General failure codes that a C-STORE SCP may return. P3.7 C.
+	StatusDuplicateSOPInstance        StatusCode = 0x0111
+	StatusRefusedSOPClassNotSupported StatusCode = 0x0122
+
+	// C-STORE-specific status codes. P3.4 B.2.3 and GG4-1. The failure
+	// codes are the first of a range, e.g., any of 0xa700-0xa7ff means out
+	// of resources.
 	CStoreOutOfResources              StatusCode = 0xa700
 	CStoreCannotUnderstand            StatusCode = 0xc000
 	CStoreDataSetDoesNotMatchSOPClass StatusCode = 0xa900
+	// Warnings: the SCP stored the data set despite the noted problem.
+	CStoreCoercionOfDataElements             StatusCode = 0xb000
+	CStoreElementsDiscarded                  StatusCode = 0xb006
+	CStoreDataSetDoesNotMatchSOPClassWarning StatusCode = 0xb007
 
 	// C-FIND-specific status codes.
 	CFindUnableToProcess StatusCode = 0xc000
@@ -54,6 +99,48 @@ const (
 	StatusAttributeListError       StatusCode = 0x0107
 )
 
+// StatusCategory is the class of a StatusCode, as defined in P3.7 C.
+type StatusCategory int
+
+const (
+	StatusCategorySuccess StatusCategory = iota
+	StatusCategoryPending
+	StatusCategoryCancel
+	StatusCategoryWarning
+	StatusCategoryFailure
+)
+
+// Category classifies the status code according to P3.7 C. Codes that
+// aren't assigned to any category are treated as failures.
+func (s StatusCode) Category() StatusCategory {
+	switch {
+	case s == StatusSuccess:
+		return StatusCategorySuccess
+	case s == StatusPending || s == 0xff01:
+		return StatusCategoryPending
+	case s == StatusCancel:
+		return StatusCategoryCancel
+	case s == 0x0001 || s == StatusAttributeListError || s == StatusAttributeValueOutOfRange:
+		return StatusCategoryWarning
+	case s >= 0xb000 && s <= 0xbfff:
+		return StatusCategoryWarning
+	default:
+		return StatusCategoryFailure
+	}
+}
+
+// IsSuccess returns true iff the code reports a successful completion.
+func (s StatusCode) IsSuccess() bool { return s.Category() == StatusCategorySuccess }
+
+// IsPending returns true iff more responses follow, e.g., for C-FIND matches.
+func (s StatusCode) IsPending() bool { return s.Category() == StatusCategoryPending }
+
+// IsWarning returns true iff the operation completed with a warning.
+func (s StatusCode) IsWarning() bool { return s.Category() == StatusCategoryWarning }
+
+// IsFailure returns true iff the operation failed.
+func (s StatusCode) IsFailure() bool { return s.Category() == StatusCategoryFailure }
+
 func (s *Status) ToElements() ([]*dicom.Element, error) {
 	statusElement, err := NewElement(commandset.Status, int(s.Status))
 	if err != nil {
@@ -67,5 +154,24 @@ func (s *Status) ToElements() ([]*dicom.Element, error) {
 		}
 		elems = append(elems, errorCommentElement)
 	}
+	if s.ErrorID != 0 {
+		errorIDElement, err := NewElement(commandset.ErrorID, s.ErrorID)
+		if err != nil {
+			return nil, fmt.Errorf("Status.ToElements: error creating error ID element with ID %v: %w", s.ErrorID, err)
+		}
+		elems = append(elems, errorIDElement)
+	}
+	if offendingElement := s.OffendingElement(); len(offendingElement) > 0 {
+		// AT values are encoded as a list of <group, element> pairs.
+		var values []int
+		for _, t := range offendingElement {
+			values = append(values, int(t.Group), int(t.Element))
+		}
+		offendingElement, err := NewElement(commandset.OffendingElement, values)
+		if err != nil {
+			return nil, fmt.Errorf("Status.ToElements: error creating offending element with tags %v: %w", offendingElement, err)
+		}
+		elems = append(elems, offendingElement)
+	}
 	return elems, nil
 }
@@ -0,0 +1,68 @@
+package dimse_test
+
+import (
+	"testing"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCodeCategory(t *testing.T) {
+	for _, test := range []struct {
+		code     dimse.StatusCode
+		category dimse.StatusCategory
+	}{
+		{dimse.StatusSuccess, dimse.StatusCategorySuccess},
+		{dimse.StatusPending, dimse.StatusCategoryPending},
+		{0xff01, dimse.StatusCategoryPending},
+		{dimse.StatusCancel, dimse.StatusCategoryCancel},
+		{0x0001, dimse.StatusCategoryWarning},
+		{dimse.StatusAttributeListError, dimse.StatusCategoryWarning},
+		{dimse.StatusAttributeValueOutOfRange, dimse.StatusCategoryWarning},
+		{0xafff, dimse.StatusCategoryFailure},
+		{0xb000, dimse.StatusCategoryWarning},
+		{0xb007, dimse.StatusCategoryWarning},
+		{0xbfff, dimse.StatusCategoryWarning},
+		{0xc000, dimse.StatusCategoryFailure},
+		{0xcfff, dimse.StatusCategoryFailure},
+		{0xa000, dimse.StatusCategoryFailure},
+		{dimse.CStoreOutOfResources, dimse.StatusCategoryFailure},
+		{dimse.StatusInvalidArgumentValue, dimse.StatusCategoryFailure},
+		{dimse.StatusUnrecognizedOperation, dimse.StatusCategoryFailure},
+		{0xfe01, dimse.StatusCategoryFailure},
+		{0xff02, dimse.StatusCategoryFailure},
+	} {
+		require.Equal(t, test.category, test.code.Category(), "code 0x%04x", uint16(test.code))
+		require.Equal(t, test.category == dimse.StatusCategorySuccess, test.code.IsSuccess())
+		require.Equal(t, test.category == dimse.StatusCategoryPending, test.code.IsPending())
+		require.Equal(t, test.category == dimse.StatusCategoryWarning, test.code.IsWarning())
+		require.Equal(t, test.category == dimse.StatusCategoryFailure, test.code.IsFailure())
+	}
+}
+
+func TestCStoreStatusCodes(t *testing.T) {
+	// P3.4 B.2.3 and P3.7 C.
+	for _, test := range []struct {
+		code     dimse.StatusCode
+		value    uint16
+		name     string
+		category dimse.StatusCategory
+	}{
+		{dimse.StatusSuccess, 0x0000, "StatusSuccess", dimse.StatusCategorySuccess},
+		{dimse.StatusDuplicateSOPInstance, 0x0111, "StatusDuplicateSOPInstance", dimse.StatusCategoryFailure},
+		{dimse.StatusRefusedSOPClassNotSupported, 0x0122, "StatusRefusedSOPClassNotSupported", dimse.StatusCategoryFailure},
+		{dimse.StatusInvalidObjectInstance, 0x0117, "StatusInvalidObjectInstance", dimse.StatusCategoryFailure},
+		{dimse.StatusNotAuthorized, 0x0124, "StatusNotAuthorized", dimse.StatusCategoryFailure},
+		{dimse.CStoreOutOfResources, 0xa700, "CStoreOutOfResources", dimse.StatusCategoryFailure},
+		{dimse.CStoreDataSetDoesNotMatchSOPClass, 0xa900, "CStoreDataSetDoesNotMatchSOPClass", dimse.StatusCategoryFailure},
+		{dimse.CStoreCannotUnderstand, 0xc000, "CStoreCannotUnderstand", dimse.StatusCategoryFailure},
+		{dimse.CStoreCoercionOfDataElements, 0xb000, "CStoreCoercionOfDataElements", dimse.StatusCategoryWarning},
+		{dimse.CStoreElementsDiscarded, 0xb006, "CStoreElementsDiscarded", dimse.StatusCategoryWarning},
+		{dimse.CStoreDataSetDoesNotMatchSOPClassWarning, 0xb007, "CStoreDataSetDoesNotMatchSOPClassWarning", dimse.StatusCategoryWarning},
+	} {
+		require.Equal(t, test.value, uint16(test.code), test.name)
+		require.Equal(t, test.name, test.code.String())
+		require.Equal(t, test.category, test.code.Category(), test.name)
+	}
+	require.Equal(t, "StatusCode(45057)", dimse.StatusCode(0xb001).String())
+}
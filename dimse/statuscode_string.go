@@ -4,26 +4,31 @@ package dimse
 
 import "fmt"
 
-const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
+const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusDuplicateSOPInstanceStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusRefusedSOPClassNotSupportedStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCoercionOfDataElementsCStoreElementsDiscardedCStoreDataSetDoesNotMatchSOPClassWarningCStoreCannotUnderstandStatusCancelStatusPending"
 
 var _StatusCode_map = map[StatusCode]string{
 	0:     _StatusCode_name[0:13],
 	262:   _StatusCode_name[13:40],
 	263:   _StatusCode_name[40:64],
-	274:   _StatusCode_name[64:90],
-	277:   _StatusCode_name[90:116],
-	278:   _StatusCode_name[116:146],
-	279:   _StatusCode_name[146:173],
-	292:   _StatusCode_name[173:192],
-	529:   _StatusCode_name[192:219],
-	42752: _StatusCode_name[219:239],
-	42753: _StatusCode_name[239:290],
-	42754: _StatusCode_name[290:337],
-	43009: _StatusCode_name[337:364],
-	43264: _StatusCode_name[364:397],
-	49152: _StatusCode_name[397:419],
-	65024: _StatusCode_name[419:431],
-	65280: _StatusCode_name[431:444],
+	273:   _StatusCode_name[64:90],
+	274:   _StatusCode_name[90:116],
+	277:   _StatusCode_name[116:142],
+	278:   _StatusCode_name[142:172],
+	279:   _StatusCode_name[172:199],
+	290:   _StatusCode_name[199:232],
+	292:   _StatusCode_name[232:251],
+	529:   _StatusCode_name[251:278],
+	42752: _StatusCode_name[278:298],
+	42753: _StatusCode_name[298:349],
+	42754: _StatusCode_name[349:396],
+	43009: _StatusCode_name[396:423],
+	43264: _StatusCode_name[423:456],
+	45056: _StatusCode_name[456:484],
+	45062: _StatusCode_name[484:507],
+	45063: _StatusCode_name[507:547],
+	49152: _StatusCode_name[547:569],
+	65024: _StatusCode_name[569:581],
+	65280: _StatusCode_name[581:594],
 }
 
 func (i StatusCode) String() string {
@@ -0,0 +1,65 @@
+package dimse
+
+// Implements tracking the progress of C-GET and C-MOVE sub-operations (P3.7
+// C.4.2.1.6 and C.4.3.1.3).
+
+import "fmt"
+
+// SubOperationProgress is the tally of the sub-operations of a C-GET or C-MOVE
+// request, as reported by the peer in its responses. Fold each response into
+// it with Update.
+type SubOperationProgress struct {
+	Remaining int
+	Completed int
+	Failed    int
+	Warning   int
+
+	// Done is set once the final, i.e., non-pending, response is folded in.
+	Done bool
+}
+
+// Update folds rsp, a CGetRsp or CMoveRsp, into the tally, and returns false
+// if rsp is of another type.
+//
+// The counters in a response are cumulative, but the peer may omit any of
+// them, which decodes as zero. So the completed, failed and warning counts
+// never decrease, and a pending response without the remaining count leaves
+// it alone. The final response sets it as is, e.g., to the sub-operations left
+// undone by a cancellation, or to zero if omitted.
+func (p *SubOperationProgress) Update(rsp Message) bool {
+	var remaining, completed, failed, warning uint16
+	var status Status
+	switch v := rsp.(type) {
+	case *CGetRsp:
+		remaining, completed, failed, warning = v.NumberOfRemainingSuboperations, v.NumberOfCompletedSuboperations, v.NumberOfFailedSuboperations, v.NumberOfWarningSuboperations
+		status = v.Status
+	case *CMoveRsp:
+		remaining, completed, failed, warning = v.NumberOfRemainingSuboperations, v.NumberOfCompletedSuboperations, v.NumberOfFailedSuboperations, v.NumberOfWarningSuboperations
+		status = v.Status
+	default:
+		return false
+	}
+	p.Completed = max(p.Completed, int(completed))
+	p.Failed = max(p.Failed, int(failed))
+	p.Warning = max(p.Warning, int(warning))
+	if status.Status.IsPending() {
+		if remaining != 0 {
+			p.Remaining = int(remaining)
+		}
+	} else {
+		p.Remaining = int(remaining)
+		p.Done = true
+	}
+	return true
+}
+
+// Total returns the number of sub-operations known so far, i.e., the ones
+// remaining and the ones done.
+func (p SubOperationProgress) Total() int {
+	return p.Remaining + p.Completed + p.Failed + p.Warning
+}
+
+func (p SubOperationProgress) String() string {
+	return fmt.Sprintf("SubOperationProgress{Remaining:%d Completed:%d Failed:%d Warning:%d Done:%v}",
+		p.Remaining, p.Completed, p.Failed, p.Warning, p.Done)
+}
@@ -0,0 +1,108 @@
+package dimse
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/giesekow/go-netdicom/commandset"
+	"github.com/suyashkumar/dicom"
+	dicomtag "github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// UnknownMessage is a DIMSE command whose command field this package doesn't
+// understand, e.g., a vendor-specific private command. It is returned by
+// CommandAssembler only when SkipUnknownCommands is set; ReadMessage reports
+// such commands as ErrUnknownCommand.
+type UnknownMessage struct {
+	Field uint16 // Value of the CommandField element.
+	// Zero if the command doesn't have a CommandDataSetType element.
+	CommandDataSetType CommandDataSetType
+	// The remaining elements of the command, in the order they were
+	// received, excluding CommandGroupLength.
+	Elements []*dicom.Element
+}
+
+func (v *UnknownMessage) Encode(e io.Writer) error {
+	elems := []*dicom.Element{}
+	elem, err := NewElement(commandset.CommandField, v.Field)
+	if err != nil {
+		return fmt.Errorf("UnknownMessage.Encode: failed to create CommandField element: %w", err)
+	}
+	elems = append(elems, elem)
+
+	if v.CommandDataSetType != 0 {
+		elem, err = NewElement(commandset.CommandDataSetType, uint16(v.CommandDataSetType))
+		if err != nil {
+			return fmt.Errorf("UnknownMessage.Encode: failed to create CommandDataSetType element: %w", err)
+		}
+		elems = append(elems, elem)
+	}
+	elems = append(elems, v.Elements...)
+	if err := EncodeElements(e, elems); err != nil {
+		return fmt.Errorf("UnknownMessage.Encode: failed to encode elements: %w", err)
+	}
+	return nil
+}
+
+// HasData is true unless the command says it has no payload. Commands
+// without a CommandDataSetType element are assumed to have none.
+func (v *UnknownMessage) HasData() bool {
+	return v.CommandDataSetType != 0 && v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *UnknownMessage) GetCommandDataSetType() CommandDataSetType {
+	return v.CommandDataSetType
+}
+
+func (v *UnknownMessage) CommandField() uint16 {
+	return v.Field
+}
+
+// GetMessageID returns the value of the MessageID element, or of
+// MessageIDBeingRespondedTo if there's none. It returns zero if neither is
+// present.
+func (v *UnknownMessage) GetMessageID() MessageID {
+	for _, tag := range []dicomtag.Tag{commandset.MessageID, commandset.MessageIDBeingRespondedTo} {
+		for _, elem := range v.Elements {
+			if elem.Tag != tag || elem.Value == nil {
+				continue
+			}
+			if ints, ok := elem.Value.GetValue().([]int); ok && len(ints) > 0 {
+				return MessageID(ints[0])
+			}
+		}
+	}
+	return 0
+}
+
+func (v *UnknownMessage) GetStatus() *Status {
+	return nil
+}
+
+func (v *UnknownMessage) String() string {
+	return fmt.Sprintf("UnknownMessage{Field:0x%x CommandDataSetType:%v Elements:%d}", v.Field, v.CommandDataSetType, len(v.Elements))
+}
+
+// ReadUnknownMessage wraps the elements of a command in an UnknownMessage,
+// regardless of its command field.
+func ReadUnknownMessage(dataset *dicom.Dataset) (*UnknownMessage, error) {
+	d := newMessageDecoder(dataset)
+	v := &UnknownMessage{}
+	var err error
+	v.Field, err = d.GetUInt16(commandset.CommandField, RequiredElement)
+	if err != nil {
+		return nil, fmt.Errorf("ReadUnknownMessage: failed to get command field: %w", err)
+	}
+	dataSetType, err := d.GetUInt16(commandset.CommandDataSetType, OptionalElement)
+	if err != nil {
+		return nil, fmt.Errorf("ReadUnknownMessage: failed to get CommandDataSetType: %w", err)
+	}
+	v.CommandDataSetType = CommandDataSetType(dataSetType)
+	// Keep the order of the elements, which d.elements loses.
+	for _, elem := range dataset.Elements {
+		if _, ok := d.elements[elem.Tag]; ok && elem.Tag != commandset.CommandGroupLength {
+			v.Elements = append(v.Elements, elem)
+		}
+	}
+	return v, nil
+}
@@ -1,19 +1,36 @@
 package netdicom
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
 	"github.com/giesekow/go-netdicom/sopclass"
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
@@ -21,6 +38,8 @@ import (
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	suyashdicom "github.com/suyashkumar/dicom"
+	suyashtag "github.com/suyashkumar/dicom/pkg/tag"
 )
 
 var provider *ServiceProvider
@@ -203,6 +222,564 @@ func TestStore(t *testing.T) {
 	checkFileBodiesEqual(t, dataset, out)
 }
 
+func TestPerSOPClassCStoreHandlers(t *testing.T) {
+	image := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	report := mustReadDICOMFile("testdata/reportsi.dcm")
+	mustGetUID := func(ds *dicom.DataSet, tag dicomtag.Tag) string {
+		elem, err := ds.FindElementByTag(tag)
+		require.NoError(t, err)
+		return elem.MustGetString()
+	}
+
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	type stored struct {
+		handler string
+		req     *CStoreRequest
+	}
+	storedCh := make(chan stored, 2)
+	register := func(name, sopClassUID string) {
+		sp.RegisterCStoreHandler(sopClassUID, func(req *CStoreRequest) dimse.Status {
+			storedCh <- stored{name, req}
+			return dimse.Success
+		})
+	}
+	register("image", mustGetUID(image, dicomtag.MediaStorageSOPClassUID))
+	register("report", mustGetUID(report, dicomtag.MediaStorageSOPClassUID))
+	register("default", "")
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	for _, tc := range []struct {
+		handler string
+		ds      *dicom.DataSet
+	}{{"report", report}, {"image", image}} {
+		require.NoError(t, su.CStore(tc.ds))
+		s := <-storedCh
+		assert.Equal(t, tc.handler, s.handler)
+		assert.Equal(t, mustGetUID(tc.ds, dicomtag.MediaStorageSOPInstanceUID), s.req.SOPInstanceUID)
+		// The provider picks the first syntax proposed.
+		assert.Equal(t, dicomuid.ImplicitVRLittleEndian, s.req.TransferSyntaxUID)
+		assert.Equal(t, mustGetUID(tc.ds, dicomtag.MediaStorageSOPInstanceUID),
+			mustGetUID(s.req.DataSet, dicomtag.MediaStorageSOPInstanceUID))
+		assert.Empty(t, s.req.MoveOriginatorAETitle)
+		checkFileBodiesEqual(t, tc.ds, s.req.DataSet)
+	}
+}
+
+func TestHandlersReceivePriority(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	priorities := make(chan dimse.Priority, 2)
+	sp.RegisterCStoreHandler("", func(req *CStoreRequest) dimse.Status {
+		priorities <- req.Priority
+		return dimse.Success
+	})
+	sp.RegisterCFindRequestHandler(dicomuid.StudyRootQRFind, func(req *CFindRequest, emit func(match *dicom.DataSet) error) dimse.Status {
+		priorities <- req.Priority
+		return dimse.Success
+	})
+	go sp.Run()
+	defer sp.Close()
+
+	sopClassUID, err := dataset.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	require.NoError(t, err)
+	su, err := NewServiceUser(StorageSCUParams(QueryRetrieveSCUParams(ServiceUserParams{Priority: dimse.PriorityHigh}),
+		sopClassUID.MustGetString()))
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(dataset))
+	require.Equal(t, dimse.PriorityHigh, <-priorities)
+	for result := range su.CFind(QRLevelStudy, nil) {
+		require.NoError(t, result.Err)
+	}
+	require.Equal(t, dimse.PriorityHigh, <-priorities)
+}
+
+func TestStoreExplicitVRBigEndian(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		TransferSyntaxes: []string{dicomuid.ExplicitVRBigEndian},
+	}, "localhost:0")
+	require.NoError(t, err)
+	reqCh := make(chan *CStoreRequest, 1)
+	sp.RegisterCStoreHandler("", func(req *CStoreRequest) dimse.Status {
+		reqCh <- req
+		return dimse.Success
+	})
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(dataset))
+	req := <-reqCh
+	elem, err := req.DataSet.FindElementByTag(dicomtag.TransferSyntaxUID)
+	require.NoError(t, err)
+	assert.Equal(t, dicomuid.ExplicitVRBigEndian, elem.MustGetString())
+	checkFileBodiesEqual(t, dataset, req.DataSet)
+}
+
+func TestStoreDeflated(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		TransferSyntaxes: []string{dicomuid.DeflatedExplicitVRLittleEndian},
+	}, "localhost:0")
+	require.NoError(t, err)
+	reqCh := make(chan *CStoreRequest, 1)
+	sp.RegisterCStoreHandler("", func(req *CStoreRequest) dimse.Status {
+		reqCh <- req
+		return dimse.Success
+	})
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.DeflatedExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(dataset))
+	req := <-reqCh
+	assert.Equal(t, dicomuid.DeflatedExplicitVRLittleEndian, req.TransferSyntaxUID)
+	checkFileBodiesEqual(t, dataset, req.DataSet)
+}
+
+func TestStoreSpoolsDataToFile(t *testing.T) {
+	// Make the object larger than a PDU, so that the payload is spooled
+	// across many P-DATA-TF PDUs.
+	const documentSize = DefaultMaxPDUSize + 1<<20
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	document := dicom.MustNewElement(dicomtag.EncapsulatedDocument, make([]byte, documentSize))
+	i := sort.Search(len(dataset.Elements), func(i int) bool {
+		return dataset.Elements[i].Tag.Compare(document.Tag) > 0
+	})
+	dataset.Elements = append(dataset.Elements[:i], append([]*dicom.Element{document}, dataset.Elements[i:]...)...)
+
+	spoolDir := t.TempDir()
+	type spooled struct {
+		path string
+		ds   *dicom.DataSet
+		err  error
+	}
+	spooledCh := make(chan spooled, 1)
+	status := dimse.Success
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		SpoolDir: spoolDir,
+		CStoreFile: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, dataPath string) dimse.Status {
+			s := spooled{path: dataPath}
+			var data []byte
+			if data, s.err = os.ReadFile(dataPath); s.err == nil {
+				s.ds, s.err = decodeCStoreDataSet(transferSyntaxUID,
+					&dimse.CStoreRq{AffectedSOPClassUID: sopClassUID, AffectedSOPInstanceUID: sopInstanceUID}, data)
+			}
+			spooledCh <- s
+			return status
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	info, err := su.AssociationInfo()
+	require.NoError(t, err)
+	require.Greater(t, documentSize, info.PeerMaxPDUSize)
+	// The spool file is removed whether the handler succeeds or fails.
+	for _, status = range []dimse.Status{dimse.Success, {Status: dimse.CStoreOutOfResources}} {
+		err := su.CStore(dataset)
+		if status.Status == dimse.StatusSuccess {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+		}
+		s := <-spooledCh
+		require.NoError(t, s.err)
+		assert.Equal(t, spoolDir, filepath.Dir(s.path))
+		checkFileBodiesEqual(t, dataset, s.ds)
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(s.path)
+			return os.IsNotExist(err)
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestWritePart10File(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	path := filepath.Join(t.TempDir(), "stored.dcm")
+	written := make(chan string, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if err := WritePart10File(path, transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
+				return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+			}
+			written <- transferSyntaxUID
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(dataset))
+	transferSyntaxUID := <-written
+
+	out, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	require.NoError(t, err)
+	elem, err := out.FindElementByTag(dicomtag.TransferSyntaxUID)
+	require.NoError(t, err)
+	assert.Equal(t, transferSyntaxUID, elem.MustGetString())
+	checkFileBodiesEqual(t, dataset, out)
+	// Only the file is left in the directory.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestParseReceivedObject(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	received := make(chan *ReceivedObject, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			obj, err := ParseReceivedObject(transferSyntaxUID, data)
+			if err != nil {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+			}
+			received <- obj
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(dataset))
+	obj := <-received
+
+	mustGetUID := func(tag dicomtag.Tag) string {
+		elem, err := dataset.FindElementByTag(tag)
+		require.NoError(t, err)
+		return elem.MustGetString()
+	}
+	assert.Equal(t, mustGetUID(dicomtag.SOPClassUID), obj.SOPClassUID)
+	assert.Equal(t, mustGetUID(dicomtag.SOPInstanceUID), obj.SOPInstanceUID)
+	// The provider picks the first syntax proposed.
+	assert.Equal(t, dicomuid.ImplicitVRLittleEndian, obj.TransferSyntaxUID)
+	elem, err := obj.DataSet.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+	require.NoError(t, err)
+	assert.Equal(t, obj.SOPInstanceUID, elem.MustGetString())
+	checkFileBodiesEqual(t, dataset, obj.DataSet)
+}
+
+func TestEncodeIdentifier(t *testing.T) {
+	identifier := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ImplicitVRLittleEndian),
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		{Tag: dicomtag.Tag{Group: 0x0010, Element: 0x0000}, VR: "UL", Value: []interface{}{uint32(1234)}},
+		dicom.MustNewElement(dicomtag.PatientName, "DOE^JOHN"),
+		dicom.MustNewElement(dicomtag.PatientID, "P0001"),
+	}}
+	for _, transferSyntaxUID := range []string{
+		dicomuid.ImplicitVRLittleEndian,
+		dicomuid.ExplicitVRLittleEndian,
+		dicomuid.ExplicitVRBigEndian,
+	} {
+		t.Run(transferSyntaxUID, func(t *testing.T) {
+			data, err := EncodeIdentifier(identifier, transferSyntaxUID)
+			require.NoError(t, err)
+			elems, err := readElementsInBytes(data, transferSyntaxUID)
+			require.NoError(t, err)
+			// The meta and group length elements are dropped.
+			require.Len(t, elems, 3)
+			assert.Equal(t, dicomtag.QueryRetrieveLevel, elems[0].Tag)
+			assert.Equal(t, "PATIENT", elems[0].MustGetString())
+			assert.Equal(t, dicomtag.PatientName, elems[1].Tag)
+			assert.Equal(t, "DOE^JOHN", elems[1].MustGetString())
+			assert.Equal(t, dicomtag.PatientID, elems[2].Tag)
+			assert.Equal(t, "P0001", elems[2].MustGetString())
+		})
+	}
+
+	_, err := EncodeIdentifier(identifier, "1.2.3.4")
+	require.Error(t, err)
+}
+
+func TestAssociationStoresSequentially(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	connCh := make(chan net.Conn, 3)
+	sp.RegisterCStoreHandler("", func(req *CStoreRequest) dimse.Status {
+		connCh <- req.Conn.RawConn
+		return dimse.Success
+	})
+	go sp.Run()
+
+	// The CT image is sent as is in a context of its own, and the
+	// uncompressed report in the context for its SOP class.
+	const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.StorageClasses,
+		ProposedContexts: []ProposedContext{
+			{SOPClassUID: ctImageStorage, TransferSyntaxes: []string{testFileTransferSyntaxUID}},
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	assoc, err := su.Association()
+	require.NoError(t, err)
+	for _, path := range []string{"testdata/IM-0001-0003.dcm", "testdata/reportsi.dcm", "testdata/IM-0001-0003.dcm"} {
+		status, err := assoc.CStore(mustReadDICOMFile(path))
+		require.NoError(t, err)
+		assert.Equal(t, dimse.StatusSuccess, status.Status)
+	}
+
+	// All three objects arrived over one connection.
+	conn := <-connCh
+	assert.Equal(t, conn, <-connCh)
+	assert.Equal(t, conn, <-connCh)
+}
+
+// Counts C-STORE requests per connection, keyed by the remote address.
+type storeCounter struct {
+	mu      sync.Mutex
+	perConn map[string]int
+}
+
+func (c *storeCounter) add(remoteAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perConn == nil {
+		c.perConn = map[string]int{}
+	}
+	c.perConn[remoteAddr]++
+}
+
+func (c *storeCounter) counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := map[string]int{}
+	for addr, n := range c.perConn {
+		counts[addr] = n
+	}
+	return counts
+}
+
+// Starts a provider that counts the associations it accepts, and, if stores
+// is non-nil, the C-STORE requests it receives.
+func newCountingServiceProvider(t *testing.T, nAssociations *int32, stores *storeCounter) *ServiceProvider {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AssocRQ: func(conn ConnectionState) dimse.Status {
+			atomic.AddInt32(nAssociations, 1)
+			return dimse.Success
+		},
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if stores != nil {
+				stores.add(conn.RemoteAddr)
+			}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	return sp
+}
+
+func TestAssociationPoolStores(t *testing.T) {
+	var nAssociations int32
+	var stores storeCounter
+	sp := newCountingServiceProvider(t, &nAssociations, &stores)
+	defer sp.Close()
+	pool := NewAssociationPool(0, RetryPolicy{})
+	defer pool.Close()
+
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	params := ServiceUserParams{SOPClasses: sopclass.StorageClasses}
+	for i := 0; i < 3; i++ {
+		su, err := pool.Get(params, sp.ListenAddr().String())
+		require.NoError(t, err)
+		require.NoError(t, su.CStore(dataset))
+		pool.Put(su)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&nAssociations))
+	// All three stores arrived over the one pooled connection.
+	counts := stores.counts()
+	require.Len(t, counts, 1)
+	for _, n := range counts {
+		require.Equal(t, 3, n)
+	}
+}
+
+func TestAssociationPoolReleasesIdleAssociations(t *testing.T) {
+	var nAssociations int32
+	sp := newCountingServiceProvider(t, &nAssociations, nil)
+	defer sp.Close()
+	pool := NewAssociationPool(100*time.Millisecond, RetryPolicy{})
+	defer pool.Close()
+
+	params := ServiceUserParams{SOPClasses: sopclass.VerificationClasses}
+	su0, err := pool.Get(params, sp.ListenAddr().String())
+	require.NoError(t, err)
+	pool.Put(su0)
+	su1, err := pool.Get(params, sp.ListenAddr().String())
+	require.NoError(t, err)
+	require.Same(t, su0, su1)
+	// Associations with other parameters aren't shared.
+	su2, err := pool.Get(ServiceUserParams{SOPClasses: sopclass.StorageClasses}, sp.ListenAddr().String())
+	require.NoError(t, err)
+	require.NotSame(t, su1, su2)
+	pool.Put(su2)
+	pool.Put(su1)
+
+	require.Eventually(t, func() bool { return !su1.active() }, 5*time.Second, 10*time.Millisecond)
+	su3, err := pool.Get(params, sp.ListenAddr().String())
+	require.NoError(t, err)
+	require.NotSame(t, su1, su3)
+	pool.Put(su3)
+	require.Equal(t, int32(3), atomic.LoadInt32(&nAssociations))
+}
+
+// Associations are shared only by callers with the same parameters, e.g.,
+// credentials.
+func TestAssociationPoolKey(t *testing.T) {
+	base := ServiceUserParams{SOPClasses: sopclass.VerificationClasses}
+	key := newPoolKey(base, "pacs:104")
+	require.True(t, key.reusable)
+	require.Equal(t, key, newPoolKey(base, "pacs:104"))
+
+	alice := &UserIdentity{Type: pdu_item.UserIdentityUsernameAndPasscode, PrimaryField: []byte("alice"), SecondaryField: []byte("secret")}
+	bob := &UserIdentity{Type: pdu_item.UserIdentityUsernameAndPasscode, PrimaryField: []byte("bob"), SecondaryField: []byte("secret")}
+	for name, change := range map[string]func(p *ServiceUserParams){
+		"user identity":       func(p *ServiceUserParams) { p.UserIdentity = alice },
+		"other user identity": func(p *ServiceUserParams) { p.UserIdentity = bob },
+		"TLS":                 func(p *ServiceUserParams) { p.TLSConfig = &tls.Config{} },
+		"priority":            func(p *ServiceUserParams) { p.Priority = dimse.PriorityHigh },
+		"SCP role":            func(p *ServiceUserParams) { p.SCPRoleSOPClasses = sopclass.VerificationClasses },
+		"extended negotiation": func(p *ServiceUserParams) {
+			p.ExtendedNegotiation = map[string][]byte{dicomuid.VerificationSOPClass: {1}}
+		},
+		"common extended negotiation": func(p *ServiceUserParams) {
+			p.CommonExtendedNegotiation = map[string]CommonExtendedNegotiation{dicomuid.VerificationSOPClass: {ServiceClassUID: "1.2.3"}}
+		},
+		"socket options": func(p *ServiceUserParams) { p.SocketOptions.Nagle = true },
+		"read timeout":   func(p *ServiceUserParams) { p.ReadTimeout = time.Second },
+	} {
+		params := base
+		change(&params)
+		require.NotEqual(t, key, newPoolKey(params, "pacs:104"), name)
+	}
+	require.NotEqual(t,
+		newPoolKey(ServiceUserParams{UserIdentity: alice}, "pacs:104"),
+		newPoolKey(ServiceUserParams{UserIdentity: bob}, "pacs:104"))
+
+	// Dialers can't be compared, so their associations aren't reused.
+	params := base
+	params.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userEnd, providerEnd := net.Pipe()
+		go RunProviderForConn(providerEnd, ServiceProviderParams{})
+		return userEnd, nil
+	}
+	require.False(t, newPoolKey(params, "pacs:104").reusable)
+	pool := NewAssociationPool(0, RetryPolicy{})
+	defer pool.Close()
+	su0, err := pool.Get(params, "pacs:104")
+	require.NoError(t, err)
+	pool.Put(su0)
+	su1, err := pool.Get(params, "pacs:104")
+	require.NoError(t, err)
+	require.NotSame(t, su0, su1)
+	pool.Put(su1)
+}
+
+func TestAssociationSend(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
+	defer su.Release()
+	assoc, err := su.Association()
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		var sentID dimse.MessageID
+		rsp, data, err := assoc.Send(dicomuid.VerificationSOPClass, func(messageID dimse.MessageID) dimse.Message {
+			sentID = messageID
+			return &dimse.CEchoRq{MessageID: messageID, CommandDataSetType: dimse.CommandDataSetTypeNull}
+		}, nil, nil)
+		require.NoError(t, err)
+		assert.Nil(t, data)
+		echo := rsp.(*dimse.CEchoRsp)
+		assert.Equal(t, sentID, echo.MessageIDBeingRespondedTo)
+		assert.Equal(t, dimse.StatusSuccess, echo.Status.Status)
+	}
+}
+
+func TestCommonExtendedNegotiationRoundTrip(t *testing.T) {
+	const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	infos := make(chan *AssociationInfo, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AssocRQ: func(conn ConnectionState) dimse.Status {
+			infos <- conn.Association
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	cen := CommonExtendedNegotiation{
+		ServiceClassUID:            "1.2.840.10008.4.2", // Storage service class.
+		RelatedGeneralSOPClassUIDs: []string{"1.2.840.10008.5.1.4.1.1.88.22"},
+	}
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: []string{dicomuid.VerificationSOPClass, ctImageStorage},
+		CommonExtendedNegotiation: map[string]CommonExtendedNegotiation{
+			ctImageStorage: cen,
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	userInfo, err := su.AssociationInfo()
+	require.NoError(t, err)
+
+	providerInfo := <-infos
+	require.NotNil(t, providerInfo)
+	var found bool
+	for _, c := range providerInfo.Contexts {
+		switch c.AbstractSyntaxUID {
+		case ctImageStorage:
+			found = true
+			assert.Equal(t, &cen, c.CommonExtendedNegotiation)
+		default:
+			assert.Nil(t, c.CommonExtendedNegotiation, c.AbstractSyntaxUID)
+		}
+	}
+	require.True(t, found)
+	// The acceptor doesn't respond to the sub-item.
+	for _, c := range userInfo.Contexts {
+		assert.Nil(t, c.CommonExtendedNegotiation, c.AbstractSyntaxUID)
+	}
+}
+
 // Arrange so that the cstore server returns an error. The client should detect
 // that.
 func TestStoreFailure0(t *testing.T) {
@@ -217,6 +794,156 @@ func TestStoreFailure0(t *testing.T) {
 	}
 }
 
+// Relays connections from a local port to "serverAddr", passing the
+// A-ASSOCIATE-AC from the server through "rewrite".
+func startACRewritingProxy(t *testing.T, serverAddr string, rewrite func(*pdu.AAssociateAC)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	relay := func(from, to net.Conn) error {
+		v, err := pdu.ReadPDU(from, DefaultMaxPDUSize)
+		if err != nil {
+			return err
+		}
+		if ac, ok := v.(*pdu.AAssociateAC); ok {
+			rewrite(ac)
+		}
+		data, err := pdu.EncodePDU(v)
+		if err != nil {
+			return err
+		}
+		_, err = to.Write(data)
+		return err
+	}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", serverAddr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			if relay(client, server) != nil || relay(server, client) != nil {
+				client.Close()
+				server.Close()
+				continue
+			}
+			go func() {
+				io.Copy(server, client)
+				server.Close()
+			}()
+			go func() {
+				io.Copy(client, server)
+				client.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// Some legacy SCPs omit the maximum length sub-item in A-ASSOCIATE-AC, or set
+// it to zero, meaning unlimited.
+func TestStoreWithoutPeerMaxLength(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	for _, test := range []struct {
+		name   string
+		length func() pdu_item.SubItem
+		want   int
+	}{
+		{"absent", func() pdu_item.SubItem { return nil }, 16384},
+		{"zero", func() pdu_item.SubItem { return &pdu_item.UserInformationMaximumLengthItem{} }, DefaultMaxPDUSize},
+	} {
+		proxy := startACRewritingProxy(t, provider.ListenAddr().String(), func(ac *pdu.AAssociateAC) {
+			for _, item := range ac.Items {
+				userInfo, ok := item.(*pdu_item.UserInformationItem)
+				if !ok {
+					continue
+				}
+				var subItems []pdu_item.SubItem
+				for _, subItem := range userInfo.Items {
+					if _, ok := subItem.(*pdu_item.UserInformationMaximumLengthItem); ok {
+						subItem = test.length()
+					}
+					if subItem != nil {
+						subItems = append(subItems, subItem)
+					}
+				}
+				userInfo.Items = subItems
+			}
+		})
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+		require.NoError(t, err)
+		su.Connect(proxy.Addr().String())
+		info, err := su.AssociationInfo()
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.want, info.PeerMaxPDUSize, test.name)
+		require.NoError(t, su.CStore(dataset), test.name)
+		su.Release()
+		proxy.Close()
+
+		out, err := getCStoreData()
+		require.NoError(t, err, test.name)
+		checkFileBodiesEqual(t, dataset, out)
+	}
+}
+
+// The transfer syntax of testdata/IM-0001-0003.dcm, JPEG 2000.
+const testFileTransferSyntaxUID = "1.2.840.10008.1.2.4.91"
+
+// mustNewFileServiceUser is like mustNewServiceUser, but it also proposes
+// testFileTransferSyntaxUID, so that the file can be stored without
+// transcoding.
+func mustNewFileServiceUser(t *testing.T) *ServiceUser {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: TransferSyntaxesForDataSet(testFileTransferSyntaxUID),
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
+	return su
+}
+
+func TestStoreFromFile(t *testing.T) {
+	su := mustNewFileServiceUser(t)
+	defer su.Release()
+	status, err := su.CStoreFromFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusSuccess, status.Status)
+
+	out, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, mustReadDICOMFile("testdata/IM-0001-0003.dcm"), out)
+}
+
+func TestStoreFromReaderFailureStatus(t *testing.T) {
+	cstoreStatus = dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: "Foohah"}
+	defer func() { cstoreStatus = dimse.Success }()
+	f, err := os.Open("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	defer f.Close()
+	su := mustNewFileServiceUser(t)
+	defer su.Release()
+	status, err := su.CStoreFromReader(f)
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusNotAuthorized, status.Status)
+	require.Equal(t, "Foohah", status.ErrorComment)
+}
+
+func TestStoreFromFileTransferSyntaxMismatch(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{"1.2.840.10008.1.2.4.70"}, // JPEG lossless
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(provider.ListenAddr().String())
+	_, err = su.CStoreFromFile("testdata/IM-0001-0003.dcm")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no presentation context accepts")
+}
+
 func getProviderPort() string {
 	match := regexp.MustCompile("(\\d+)$").FindStringSubmatch(provider.ListenAddr().String())
 	return match[1]
@@ -284,6 +1011,10 @@ func (fi *testFaultInjector) onSend(data []byte) faultInjectorAction {
 	return faultInjectorContinue
 }
 
+func (fi *testFaultInjector) onReceive(data []byte) []byte {
+	return data
+}
+
 func (fi *testFaultInjector) String() string {
 	return "testFaultInjector"
 }
@@ -314,62 +1045,1682 @@ func TestEcho(t *testing.T) {
 	}
 }
 
-func TestFind(t *testing.T) {
-	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+func TestCEchoStatus(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
 	defer su.Release()
-	filter := []*dicom.Element{
-		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
-	}
-	var namesFound []string
+	status, err := su.CEchoStatus()
+	require.NoError(t, err)
+	assert.Equal(t, dimse.StatusSuccess, status.Status)
 
-	for result := range su.CFind(QRLevelPatient, filter) {
-		log.Printf("Got result: %v", result)
-		if result.Err != nil {
-			t.Error(result.Err)
-			continue
-		}
-		for _, elem := range result.Elements {
-			if elem.Tag != dicomtag.PatientName {
-				t.Error(elem)
-			}
-			namesFound = append(namesFound, elem.MustGetString())
-		}
-	}
-	if len(namesFound) != 2 || namesFound[0] != "johndoe" || namesFound[1] != "johndoe2" {
-		t.Error(namesFound)
-	}
+	// The verification SOP class must be proposed.
+	su = mustNewServiceUser(t, sopclass.StorageClasses)
+	defer su.Release()
+	_, err = su.CEchoStatus()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "verification SOP class")
 }
 
-func TestCGet(t *testing.T) {
-	su := mustNewServiceUser(t, sopclass.QRGetClasses)
+func TestNoAcceptedContext(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
 	defer su.Release()
-	filter := []*dicom.Element{
-		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
-	}
+	identifier := []*dicom.Element{dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT")}
+	_, err := su.CGetWithSOPClass(dicomuid.PatientRootQRGet, identifier, nil)
+	require.ErrorIs(t, err, ErrNoAcceptedContext)
+	_, err = su.CMove(dicomuid.PatientRootQRMove, "dest", identifier, nil)
+	require.ErrorIs(t, err, ErrNoAcceptedContext)
 
-	var cgetData []byte
+	// The association is still usable.
+	_, err = su.CEchoStatus()
+	require.NoError(t, err)
+}
 
-	err := su.CGet(QRLevelPatient, filter,
-		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
-			log.Printf("Got data: %v %v %v %d bytes", transferSyntaxUID, sopClassUID, sopInstanceUID, len(data))
-			require.True(t, len(cgetData) == 0, "Received multiple C-GET responses")
-			e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-			dicom.WriteFileHeader(e,
-				[]*dicom.Element{
-					dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
-					dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
-					dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
-				})
-			e.WriteBytes(data)
-			cgetData = e.Bytes()
-			return dimse.Success
-		})
+func TestRegisterCEchoHandler(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
 	require.NoError(t, err)
-	require.True(t, len(cgetData) > 0, "No data received")
-	ds, err := dicom.ReadDataSetInBytes(cgetData, dicom.ReadOptions{})
+	connStates := make(chan ConnectionState, 2)
+	sp.RegisterCEchoHandler(func(connState ConnectionState) dimse.Status {
+		connStates <- connState
+		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: "go away"}
+	})
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "ECHOSCP",
+		CallingAETitle: "ECHOSCU",
+		SOPClasses:     sopclass.VerificationClasses,
+	})
 	require.NoError(t, err)
-	expected := mustReadDICOMFile("testdata/reportsi.dcm")
-	checkFileBodiesEqual(t, expected, ds)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	status, err := su.CEchoStatus()
+	require.NoError(t, err)
+	assert.Equal(t, dimse.StatusNotAuthorized, status.Status)
+	assert.Error(t, su.CEcho())
+	connState := <-connStates
+	assert.Equal(t, "ECHOSCP", strings.TrimSpace(connState.CalledAETitle))
+	assert.Equal(t, "ECHOSCU", strings.TrimSpace(connState.CallingAETitle))
+}
+
+func TestDefaultCEchoHandler(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+}
+
+func TestCEchoStrictCommands(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{StrictCommands: true}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     sopclass.VerificationClasses,
+		StrictCommands: true,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	status, err := su.CEchoStatus()
+	require.NoError(t, err)
+	assert.Equal(t, dimse.StatusSuccess, status.Status)
+}
+
+func TestOnTransition(t *testing.T) {
+	// Collects the transitions of one side until its association ends.
+	newTracer := func() (TransitionTracer, chan []string) {
+		var transitions []string
+		done := make(chan []string, 1)
+		return func(association string, transition StateTransition) {
+			transitions = append(transitions, transition.String())
+			if transition.NewState == "sta01" {
+				done <- transitions
+			}
+		}, done
+	}
+	providerTracer, providerDone := newTracer()
+	sp, err := NewServiceProvider(ServiceProviderParams{OnTransition: providerTracer}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	userTracer, userDone := newTracer()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:   sopclass.VerificationClasses,
+		OnTransition: userTracer,
+	})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	su.Release()
+
+	assert.Equal(t, []string{
+		"sta01 --evt01/AE-1--> sta04",
+		"sta04 --evt02/AE-2--> sta05",
+		"sta05 --evt03/AE-3--> sta06",
+		"sta06 --evt09/DT-1--> sta06", // C-ECHO-RQ
+		"sta06 --evt10/DT-2--> sta06", // C-ECHO-RSP
+		"sta06 --evt11/AR-1--> sta07",
+		"sta07 --evt13/AR-3--> sta01",
+	}, <-userDone)
+	assert.Equal(t, []string{
+		"sta01 --evt05/AE-5--> sta02",
+		"sta02 --evt06/AE-6--> sta03",
+		"sta03 --evt07/AE-7--> sta06",
+		"sta06 --evt10/DT-2--> sta06", // C-ECHO-RQ
+		"sta06 --evt09/DT-1--> sta06", // C-ECHO-RSP
+		"sta06 --evt12/AR-2--> sta08",
+		"sta08 --evt14/AR-4--> sta13",
+		"sta13 --evt17/AR-5--> sta01",
+	}, <-providerDone)
+}
+
+func TestMultipleListenAddrs(t *testing.T) {
+	sp, err := NewServiceProviderOnAddrs(ServiceProviderParams{}, []string{"127.0.0.1:0", "127.0.0.1:0"})
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		sp.Run()
+		close(done)
+	}()
+	addrs := sp.ListenAddrs()
+	require.Len(t, addrs, 2)
+	require.NotEqual(t, addrs[0].String(), addrs[1].String())
+	require.Equal(t, addrs[0], sp.ListenAddr())
+	for _, addr := range addrs {
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+		require.NoError(t, err)
+		su.Connect(addr.String())
+		_, err = su.AssociationInfo()
+		require.NoError(t, err, addr.String())
+		su.Release()
+	}
+
+	// Close stops all the listeners.
+	require.NoError(t, sp.Close())
+	<-done
+	for _, addr := range addrs {
+		_, err := net.Dial("tcp", addr.String())
+		require.Error(t, err, addr.String())
+	}
+}
+
+// Opens an association with "sp" over a raw connection, and starts sending a
+// command without finishing it.
+func startTransferToProvider(t *testing.T, sp *ServiceProvider) net.Conn {
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	writeTestPDU(t, conn, &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items: newContextManager("test").generateAssociateRequest(ServiceUserParams{
+			SOPClasses:       sopclass.VerificationClasses,
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}),
+	})
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAssociateAC{}, v)
+	writeTestPDU(t, conn, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+		ContextID: 1,
+		Command:   true,
+		Value:     make([]byte, 16),
+	}}})
+	require.Eventually(t, func() bool { return sp.NumAssociations() == 1 }, 10*time.Second, 10*time.Millisecond)
+	return conn
+}
+
+func TestShutdownDrainsAssociations(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	conn := startTransferToProvider(t, sp)
+	defer conn.Close()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- sp.Shutdown(context.Background()) }()
+	// New associations are refused, but the one in progress goes on.
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", sp.ListenAddr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	}, 10*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the association ended: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeTestPDU(t, conn, &pdu.AReleaseRq{})
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+	conn.Close()
+	require.NoError(t, <-shutdownErr)
+	require.Equal(t, 0, sp.NumAssociations())
+}
+
+func TestShutdownAbortsAfterDeadline(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	conn := startTransferToProvider(t, sp)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() {
+		// The straggler is aborted.
+		v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+		if err == nil {
+			_, ok := v.(*pdu.AAbort)
+			assert.True(t, ok, v.String())
+		}
+		conn.Close()
+	}()
+	require.ErrorIs(t, sp.Shutdown(ctx), context.DeadlineExceeded)
+	require.Equal(t, 0, sp.NumAssociations())
+}
+
+func TestIdleTimeoutReleasesAssociation(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:  sopclass.VerificationClasses,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.waitUntilReady())
+	require.Eventually(t, func() bool { return sp.NumAssociations() == 0 }, 10*time.Second, 10*time.Millisecond)
+	require.Nil(t, su.AbortError())
+}
+
+// Listens on a local port, and answers the first len(rejections) connections
+// with the given A-ASSOCIATE-RJs or A-ABORTs and the following ones as a
+// verification SCP. Returns the listener and a counter of the accepted
+// connections.
+func listenWithRejections(t *testing.T, rejections ...pdu.PDU) (net.Listener, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n := int(accepted.Add(1))
+			if n > len(rejections) {
+				RunProviderForConn(conn, ServiceProviderParams{})
+				continue
+			}
+			if _, err := pdu.ReadPDU(conn, DefaultMaxPDUSize); err == nil {
+				data, err := pdu.EncodePDU(rejections[n-1])
+				if err == nil {
+					conn.Write(data)
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return listener, &accepted
+}
+
+func TestDialServiceUserRetriesTransientRejections(t *testing.T) {
+	congestion := &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedTransient,
+		Source: pdu.SourceULServiceProviderPresentation,
+		Reason: pdu.RejectReasonTemporaryCongestion,
+	}
+	listener, accepted := listenWithRejections(t, congestion, congestion)
+	defer listener.Close()
+	su, err := DialServiceUser(context.Background(), ServiceUserParams{SOPClasses: sopclass.VerificationClasses},
+		listener.Addr().String(), RetryPolicy{InitialBackoff: time.Millisecond})
+	require.NoError(t, err)
+	defer su.Release()
+	_, err = su.AssociationInfo()
+	require.NoError(t, err)
+	require.Equal(t, int32(3), accepted.Load())
+}
+
+func TestDialServiceUserPermanentRejection(t *testing.T) {
+	listener, accepted := listenWithRejections(t, &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+	})
+	defer listener.Close()
+	_, err := DialServiceUser(context.Background(), ServiceUserParams{SOPClasses: sopclass.VerificationClasses},
+		listener.Addr().String(), RetryPolicy{InitialBackoff: time.Millisecond})
+	var rj *AssociateRejectError
+	require.True(t, errors.As(err, &rj), err)
+	require.Equal(t, pdu.RejectReasonCalledAETitleNotRecognized, rj.Reason)
+	require.Equal(t, int32(1), accepted.Load())
+}
+
+func TestDialServiceUserRetriesAbortedHandshake(t *testing.T) {
+	listener, accepted := listenWithRejections(t, &pdu.AAbort{Source: pdu.AbortSourceServiceUser})
+	defer listener.Close()
+	su, err := DialServiceUser(context.Background(), ServiceUserParams{SOPClasses: sopclass.VerificationClasses},
+		listener.Addr().String(), RetryPolicy{InitialBackoff: time.Millisecond})
+	require.NoError(t, err)
+	defer su.Release()
+	require.Equal(t, int32(2), accepted.Load())
+
+	// A protocol error reported by the peer's service provider is not
+	// retried.
+	listener, accepted = listenWithRejections(t, &pdu.AAbort{
+		Source: pdu.AbortSourceServiceProvider,
+		Reason: pdu.AbortReasonUnexpectedPDU,
+	})
+	defer listener.Close()
+	_, err = DialServiceUser(context.Background(), ServiceUserParams{SOPClasses: sopclass.VerificationClasses},
+		listener.Addr().String(), RetryPolicy{InitialBackoff: time.Millisecond})
+	var abort *AbortError
+	require.True(t, errors.As(err, &abort), err)
+	require.Equal(t, pdu.AbortReasonUnexpectedPDU, abort.Reason)
+	require.Equal(t, int32(1), accepted.Load())
+}
+
+func TestDialServiceUserConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	_, err = DialServiceUser(context.Background(), ServiceUserParams{SOPClasses: sopclass.VerificationClasses},
+		addr, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	require.Error(t, err)
+	require.True(t, isTransientConnectError(err), err)
+}
+
+func TestAsyncOperationsWindow(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:             sopclass.VerificationClasses,
+		MaxOperationsInvoked:   5,
+		MaxOperationsPerformed: 3,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(provider.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	invoked, performed, err := su.AsyncOperationsWindow()
+	require.NoError(t, err)
+	assert.Equal(t, 5, invoked)
+	assert.Equal(t, 3, performed)
+}
+
+func TestAsyncOperationsWindowDefault(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
+	defer su.Release()
+	invoked, performed, err := su.AsyncOperationsWindow()
+	require.NoError(t, err)
+	assert.Equal(t, 1, invoked)
+	assert.Equal(t, 1, performed)
+}
+
+func TestPeerImplementation(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
+	defer su.Release()
+	classUID, versionName, err := su.PeerImplementation()
+	require.NoError(t, err)
+	assert.Equal(t, dicom.GoDICOMImplementationClassUID, classUID)
+	assert.Equal(t, dicom.GoDICOMImplementationVersionName, versionName)
+}
+
+func TestProviderImplementationVersionNameTooLong(t *testing.T) {
+	_, err := NewServiceProvider(ServiceProviderParams{
+		ImplementationVersionName: strings.Repeat("x", 17),
+	}, ":0")
+	require.ErrorContains(t, err, "longer than 16 bytes")
+}
+
+func newAuthenticatingProvider(t *testing.T) *ServiceProvider {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		Authenticate: func(conn ConnectionState, identity *UserIdentity) ([]byte, error) {
+			if identity == nil || identity.Type != pdu_item.UserIdentityUsernameAndPasscode {
+				return nil, errors.New("username and passcode required")
+			}
+			if string(identity.PrimaryField) != "alice" || string(identity.SecondaryField) != "secret" {
+				return nil, errors.New("bad credentials")
+			}
+			return nil, nil
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	return sp
+}
+
+func TestUserIdentity(t *testing.T) {
+	sp := newAuthenticatingProvider(t)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		UserIdentity: &UserIdentity{
+			Type:                      pdu_item.UserIdentityUsernameAndPasscode,
+			PrimaryField:              []byte("alice"),
+			SecondaryField:            []byte("secret"),
+			PositiveResponseRequested: true,
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+}
+
+func TestUserIdentityRejected(t *testing.T) {
+	sp := newAuthenticatingProvider(t)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		UserIdentity: &UserIdentity{
+			Type:           pdu_item.UserIdentityUsernameAndPasscode,
+			PrimaryField:   []byte("alice"),
+			SecondaryField: []byte("wrong"),
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	err = su.CEcho()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Connection failed")
+}
+
+// newSelfSignedTLSConfigs creates a self-signed certificate for "localhost"
+// and returns the matching server and client TLS configs.
+func newSelfSignedTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	return server, client
+}
+
+func TestCEchoOverTLS(t *testing.T) {
+	serverConfig, clientConfig := newSelfSignedTLSConfigs(t)
+	tlsVersion := make(chan uint16, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(connState ConnectionState) dimse.Status {
+			tlsVersion <- connState.TLS.Version
+			return dimse.Success
+		},
+		TLSConfig: serverConfig,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		TLSConfig:  clientConfig,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	assert.NotZero(t, <-tlsVersion, "C-ECHO wasn't received over TLS")
+}
+
+func TestCEchoOverTLSUntrustedServer(t *testing.T) {
+	serverConfig, _ := newSelfSignedTLSConfigs(t)
+	_, clientConfig := newSelfSignedTLSConfigs(t)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:     onCEchoRequest,
+		TLSConfig: serverConfig,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		TLSConfig:  clientConfig,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CEcho())
+}
+
+// testMetrics counts the PDUs and DIMSE outcomes reported to it.
+type testMetrics struct {
+	mu       sync.Mutex
+	sent     map[pdu.Type]int
+	received map[pdu.Type]int
+	outcomes map[uint16]dimse.StatusCategory
+	nEnded   int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		sent:     map[pdu.Type]int{},
+		received: map[pdu.Type]int{},
+		outcomes: map[uint16]dimse.StatusCategory{},
+	}
+}
+
+func (m *testMetrics) PDUSent(association string, pduType pdu.Type, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[pduType]++
+}
+
+func (m *testMetrics) PDUReceived(association string, pduType pdu.Type, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received[pduType]++
+}
+
+func (m *testMetrics) DIMSEOperationCompleted(association string, commandField uint16, category dimse.StatusCategory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[commandField] = category
+}
+
+func (m *testMetrics) AssociationEnded(association string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nEnded++
+}
+
+// A net.Conn that records the socket options set on it.
+type socketOptionsConn struct {
+	net.Conn
+	err     error // Returned by the setters, if set.
+	mu      sync.Mutex
+	options []string
+}
+
+func (c *socketOptionsConn) record(option string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options = append(c.options, option)
+	return c.err
+}
+
+func (c *socketOptionsConn) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.options...)
+}
+
+func (c *socketOptionsConn) SetNoDelay(noDelay bool) error {
+	return c.record(fmt.Sprintf("NoDelay=%v", noDelay))
+}
+
+func (c *socketOptionsConn) SetReadBuffer(bytes int) error {
+	return c.record(fmt.Sprintf("ReadBuffer=%d", bytes))
+}
+
+func (c *socketOptionsConn) SetWriteBuffer(bytes int) error {
+	return c.record(fmt.Sprintf("WriteBuffer=%d", bytes))
+}
+
+func (c *socketOptionsConn) SetKeepAlive(keepalive bool) error {
+	return c.record(fmt.Sprintf("KeepAlive=%v", keepalive))
+}
+
+func (c *socketOptionsConn) SetKeepAlivePeriod(d time.Duration) error {
+	return c.record(fmt.Sprintf("KeepAlivePeriod=%v", d))
+}
+
+func TestSocketOptions(t *testing.T) {
+	userEnd, providerEnd := net.Pipe()
+	userConn := &socketOptionsConn{Conn: userEnd}
+	providerConn := &socketOptionsConn{Conn: providerEnd}
+	go RunProviderForConn(providerConn, ServiceProviderParams{
+		SocketOptions: SocketOptions{ReadBufferSize: 1 << 20, KeepAlive: 30 * time.Second},
+	})
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:    sopclass.VerificationClasses,
+		SocketOptions: SocketOptions{Nagle: true, WriteBufferSize: 1 << 21, KeepAlive: -1},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(userConn)
+	require.NoError(t, su.waitUntilReady())
+
+	assert.Equal(t, []string{"NoDelay=false", "WriteBuffer=2097152", "KeepAlive=false"}, userConn.recorded())
+	assert.Equal(t, []string{"NoDelay=true", "ReadBuffer=1048576", "KeepAlive=true", "KeepAlivePeriod=30s"}, providerConn.recorded())
+
+	// Failures are logged to the association's logger.
+	logger := &testLogger{}
+	applySocketOptions(&socketOptionsConn{err: errors.New("not supported")}, SocketOptions{},
+		withLogValues(logger, "association", "test"))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.entries, 1)
+	assert.Equal(t, testLogEntry{"warn", "Failed to set socket option",
+		[]interface{}{"association", "test", "option", "TCP_NODELAY", "err", errors.New("not supported")}}, logger.entries[0])
+}
+
+func TestCustomDialer(t *testing.T) {
+	var dialed []string
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			userEnd, providerEnd := net.Pipe()
+			go RunProviderForConn(providerEnd, ServiceProviderParams{})
+			return userEnd, nil
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect("pacs.example.com:104")
+	require.NoError(t, su.waitUntilReady())
+	require.Equal(t, []string{"tcp pacs.example.com:104"}, dialed)
+
+	// Dial errors are reported as with net.Dial.
+	dialErr := errors.New("proxy unreachable")
+	su, err = NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dialErr
+		},
+	})
+	require.NoError(t, err)
+	su.Connect("pacs.example.com:104")
+	require.ErrorIs(t, su.waitUntilReady(), dialErr)
+}
+
+func TestMetricsAfterCEcho(t *testing.T) {
+	metrics := newTestMetrics()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Metrics:    metrics,
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	metrics.mu.Lock()
+	assert.Equal(t, 1, metrics.sent[pdu.TypeAAssociateRq])
+	assert.Equal(t, 1, metrics.sent[pdu.TypePDataTf])
+	assert.Equal(t, 1, metrics.received[pdu.TypeAAssociateAc])
+	assert.Equal(t, 1, metrics.received[pdu.TypePDataTf])
+	assert.Equal(t, dimse.StatusCategorySuccess, metrics.outcomes[dimse.CommandFieldCEchoRsp])
+	metrics.mu.Unlock()
+
+	su.Release()
+	require.Eventually(t, func() bool {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.nEnded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConcurrentAssociations(t *testing.T) {
+	const limit = 2
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:                     onCEchoRequest,
+		MaxConcurrentAssociations: limit,
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	var users []*ServiceUser
+	for i := 0; i < limit; i++ {
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+		require.NoError(t, err)
+		su.Connect(sp.ListenAddr().String())
+		require.NoError(t, su.CEcho())
+		users = append(users, su)
+	}
+	require.Equal(t, limit, sp.NumAssociations())
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	writeTestPDU(t, conn, &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items: newContextManager("test").generateAssociateRequest(ServiceUserParams{
+			SOPClasses:       sopclass.VerificationClasses,
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}),
+	})
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.Equal(t, &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedTransient,
+		Source: pdu.SourceULServiceProviderPresentation,
+		Reason: pdu.RejectReasonLocalLimitExceeded,
+	}, v)
+
+	// Once an association ends, new ones are accepted again.
+	users[0].Release()
+	require.Eventually(t, func() bool { return sp.NumAssociations() < limit }, 10*time.Second, 10*time.Millisecond)
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	users[1].Release()
+}
+
+func TestFind(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var namesFound []string
+
+	for result := range su.CFind(QRLevelPatient, filter) {
+		log.Printf("Got result: %v", result)
+		if result.Err != nil {
+			t.Error(result.Err)
+			continue
+		}
+		for _, elem := range result.Elements {
+			if elem.Tag != dicomtag.PatientName {
+				t.Error(elem)
+			}
+			namesFound = append(namesFound, elem.MustGetString())
+		}
+	}
+	if len(namesFound) != 2 || namesFound[0] != "johndoe" || namesFound[1] != "johndoe2" {
+		t.Error(namesFound)
+	}
+}
+
+func TestFindWithSOPClass(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+	defer su.Release()
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var namesFound []string
+	for result := range su.CFindWithSOPClass(dicomuid.PatientRootQRFind, identifier) {
+		require.NoError(t, result.Err)
+		for _, elem := range result.Elements {
+			namesFound = append(namesFound, elem.MustGetString())
+		}
+	}
+	require.Equal(t, []string{"johndoe", "johndoe2"}, namesFound)
+}
+
+func TestFindQuery(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+	defer su.Release()
+	query := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}}
+	results, err := su.CFindQuery(dicomuid.PatientRootQRFind, query)
+	require.NoError(t, err)
+	var namesFound []string
+	for result := range results {
+		require.NoError(t, result.Err)
+		require.NotNil(t, result.Response)
+		require.Equal(t, dimse.StatusPending, result.Response.Status.Status)
+		for _, elem := range result.Elements {
+			namesFound = append(namesFound, elem.MustGetString())
+		}
+	}
+	require.Equal(t, []string{"johndoe", "johndoe2"}, namesFound)
+
+	// The error is returned up front if the request can't be sent.
+	results, err = su.CFindQuery(dicomuid.VerificationSOPClass, query)
+	require.Error(t, err)
+	require.Nil(t, results)
+}
+
+func TestFindFailure(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CFind: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CFindResult) {
+			ch <- CFindResult{
+				Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")},
+			}
+			ch <- CFindResult{Err: errors.New("database unavailable")}
+			close(ch)
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	var results []CFindResult
+	for result := range su.CFind(QRLevelPatient, nil) {
+		results = append(results, result)
+	}
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.Len(t, results[0].Elements, 1)
+	require.Error(t, results[1].Err)
+	assert.Contains(t, results[1].Err.Error(), "database unavailable")
+}
+
+func TestRegisterCFindHandler(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	queries := make(chan *dicom.DataSet, 1)
+	sp.RegisterCFindHandler(dicomuid.StudyRootQRFind, func(query *dicom.DataSet, emit func(match *dicom.DataSet) error) dimse.Status {
+		queries <- query
+		for _, name := range []string{"johndoe", "johndoe2"} {
+			if err := emit(&dicom.DataSet{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, name)}}); err != nil {
+				return dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: err.Error()}
+			}
+		}
+		return dimse.Success
+	})
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(QueryRetrieveSCUParams(ServiceUserParams{}))
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	var namesFound []string
+	for result := range su.CFind(QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "john*")}) {
+		require.NoError(t, result.Err)
+		for _, elem := range result.Elements {
+			namesFound = append(namesFound, elem.MustGetString())
+		}
+	}
+	require.Equal(t, []string{"johndoe", "johndoe2"}, namesFound)
+	query := <-queries
+	elem, err := query.FindElementByTag(dicomtag.PatientName)
+	require.NoError(t, err)
+	require.Equal(t, "john*", elem.MustGetString())
+}
+
+func TestCFindHandlerCanceled(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	stopped := make(chan error, 1)
+	sp.RegisterCFindHandler(dicomuid.StudyRootQRFind, func(query *dicom.DataSet, emit func(match *dicom.DataSet) error) dimse.Status {
+		// Emits matches until the client cancels the request.
+		for {
+			if err := emit(&dicom.DataSet{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}); err != nil {
+				stopped <- err
+				// Overridden by the status of the cancellation.
+				return dimse.Success
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(QueryRetrieveSCUParams(VerificationSCUParams(ServiceUserParams{})))
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := su.CFindContext(ctx, QRLevelStudy, nil)
+	require.NoError(t, (<-ch).Err)
+	cancel()
+	for range ch {
+	}
+	select {
+	case err := <-stopped:
+		require.ErrorIs(t, err, ErrCFindCanceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("C-FIND handler not stopped")
+	}
+	require.NoError(t, su.CEcho())
+}
+
+// Associates with the provider at the other end of "conn", proposing
+// sopClassUID on context ID 1, without asynchronous operations.
+func associateTestConn(t *testing.T, conn net.Conn, sopClassUID string) {
+	writeTestPDU(t, conn, &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items: newContextManager("test").generateAssociateRequest(ServiceUserParams{
+			SOPClasses:       []string{sopClassUID},
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}),
+	})
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAssociateAC{}, v)
+}
+
+// Associates with the provider at the other end of "conn", proposing
+// StudyRootQRFind on context ID 1, and sends a C-FIND-RQ with message ID 1.
+func startTestCFind(t *testing.T, conn net.Conn) {
+	associateTestConn(t, conn, dicomuid.StudyRootQRFind)
+	query, err := writeElementsToBytes([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "STUDY"),
+	}, dicomuid.ImplicitVRLittleEndian)
+	require.NoError(t, err)
+	writeTestDIMSE(t, conn, &dimse.CFindRq{
+		AffectedSOPClassUID: dicomuid.StudyRootQRFind,
+		MessageID:           1,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, query)
+}
+
+// Sends "msg" and "data", if any, on context ID 1.
+func writeTestDIMSE(t *testing.T, conn net.Conn, msg dimse.Message, data []byte) {
+	var command bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&command, msg))
+	items := []pdu.PresentationDataValueItem{{ContextID: 1, Command: true, Last: true, Value: command.Bytes()}}
+	if data != nil {
+		items = append(items, pdu.PresentationDataValueItem{ContextID: 1, Last: true, Value: data})
+	}
+	for _, item := range items {
+		writeTestPDU(t, conn, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{item}})
+	}
+}
+
+// Reads PDUs until a whole DIMSE message arrives, and returns it.
+func readTestDIMSE(t *testing.T, conn net.Conn, assembler *dimse.CommandAssembler) dimse.Message {
+	for {
+		v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+		require.NoError(t, err)
+		pdataTf, ok := v.(*pdu.PDataTf)
+		require.True(t, ok, "expected P-DATA-TF, got %v", v)
+		_, msg, _, err := assembler.AddDataPDU(pdataTf)
+		require.NoError(t, err)
+		if msg != nil {
+			return msg
+		}
+	}
+}
+
+func TestCFindHandlerBackpressure(t *testing.T) {
+	const numMatches = 5
+	var emitted atomic.Int32
+	done := make(chan struct{})
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go RunProviderForConn(serverConn, ServiceProviderParams{
+		CFindHandlers: map[string]CFindHandler{
+			dicomuid.StudyRootQRFind: func(query *dicom.DataSet, emit func(match *dicom.DataSet) error) dimse.Status {
+				defer close(done)
+				for i := 0; i < numMatches; i++ {
+					if err := emit(&dicom.DataSet{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}); err != nil {
+						return dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: err.Error()}
+					}
+					emitted.Add(1)
+				}
+				return dimse.Success
+			},
+		},
+	})
+
+	// A client that reads the responses one PDU at a time. net.Pipe doesn't
+	// buffer, so the provider can't write a PDU until the client reads it.
+	startTestCFind(t, clientConn)
+
+	// emit returns once the response is queued, but the next call waits
+	// until the client has read it.
+	for i := int32(1); i <= numMatches; i++ {
+		require.Eventually(t, func() bool { return emitted.Load() == i }, 10*time.Second, time.Millisecond)
+		require.Never(t, func() bool { return emitted.Load() > i }, 50*time.Millisecond, time.Millisecond)
+		// The command and the match.
+		for j := 0; j < 2; j++ {
+			v, err := pdu.ReadPDU(clientConn, DefaultMaxPDUSize)
+			require.NoError(t, err)
+			require.IsType(t, &pdu.PDataTf{}, v)
+		}
+	}
+	<-done
+	v, err := pdu.ReadPDU(clientConn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.True(t, v.(*pdu.PDataTf).Items[0].Command, "final response")
+
+	writeTestPDU(t, clientConn, &pdu.AReleaseRq{})
+	v, err = pdu.ReadPDU(clientConn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+}
+
+func TestCFindHandlerUndecodableQuery(t *testing.T) {
+	called := make(chan struct{}, 1)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go RunProviderForConn(serverConn, ServiceProviderParams{
+		CFindHandlers: map[string]CFindHandler{
+			dicomuid.StudyRootQRFind: func(query *dicom.DataSet, emit func(match *dicom.DataSet) error) dimse.Status {
+				called <- struct{}{}
+				return dimse.Success
+			},
+		},
+	})
+	startTestCFind(t, clientConn)
+	var assembler dimse.CommandAssembler
+	readTestDIMSE(t, clientConn, &assembler) // The response to the valid query.
+
+	// An element whose length exceeds the payload.
+	writeTestDIMSE(t, clientConn, &dimse.CFindRq{
+		AffectedSOPClassUID: dicomuid.StudyRootQRFind,
+		MessageID:           2,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, []byte{0x10, 0x00, 0x10, 0x00, 0xff, 0xff, 0xff, 0x7f})
+	rsp, ok := readTestDIMSE(t, clientConn, &assembler).(*dimse.CFindRsp)
+	require.True(t, ok)
+	require.Equal(t, dimse.MessageID(2), rsp.MessageIDBeingRespondedTo)
+	require.Equal(t, dimse.CFindUnableToProcess, rsp.Status.Status)
+	require.Len(t, called, 1)
+}
+
+func TestSlowCStoreHandlerWindow(t *testing.T) {
+	const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	defer close(release)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go RunProviderForConn(serverConn, ServiceProviderParams{
+		DefaultCStoreHandler: func(req *CStoreRequest) dimse.Status {
+			started <- struct{}{}
+			<-release
+			return dimse.Success
+		},
+	})
+	associateTestConn(t, clientConn, ctImageStorage)
+	data, err := writeElementsToBytes([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.SOPClassUID, ctImageStorage),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3"),
+	}, dicomuid.ImplicitVRLittleEndian)
+	require.NoError(t, err)
+
+	// Without asynchronous operations, the provider handles one request at
+	// a time. It queues a second one, sent before the response to the first
+	// one, but a third one makes it abort instead of queueing requests
+	// without bound.
+	for messageID := dimse.MessageID(1); messageID <= 3; messageID++ {
+		writeTestDIMSE(t, clientConn, &dimse.CStoreRq{
+			AffectedSOPClassUID:    ctImageStorage,
+			MessageID:              messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: "1.2.3",
+		}, data)
+	}
+	v, err := pdu.ReadPDU(clientConn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("C-STORE handler not started")
+	}
+	require.Empty(t, started)
+}
+
+func TestCFindCancel(t *testing.T) {
+	var generated atomic.Int32
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go RunProviderForConn(serverConn, ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			for i := 0; i < 1000; i++ {
+				ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}
+				generated.Add(1)
+				time.Sleep(time.Millisecond)
+			}
+		},
+	})
+	startTestCFind(t, clientConn)
+
+	var assembler dimse.CommandAssembler
+	rsp := readTestDIMSE(t, clientConn, &assembler).(*dimse.CFindRsp)
+	require.Equal(t, dimse.StatusPending, rsp.Status.Status)
+	writeTestDIMSE(t, clientConn, &dimse.CCancelRq{
+		MessageIDBeingRespondedTo: 1,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+	}, nil)
+	// Matches sent before the C-CANCEL arrived are followed by the final
+	// response.
+	for rsp.Status.Status.IsPending() {
+		rsp = readTestDIMSE(t, clientConn, &assembler).(*dimse.CFindRsp)
+	}
+	require.Equal(t, dimse.StatusCancel, rsp.Status.Status)
+	// The final response doesn't wait for the callback to finish.
+	require.Less(t, generated.Load(), int32(1000))
+
+	writeTestPDU(t, clientConn, &pdu.AReleaseRq{})
+	v, err := pdu.ReadPDU(clientConn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+}
+
+func TestCGet(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRGetClasses)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+
+	var cgetData []byte
+
+	err := su.CGet(QRLevelPatient, filter,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			log.Printf("Got data: %v %v %v %d bytes", transferSyntaxUID, sopClassUID, sopInstanceUID, len(data))
+			require.True(t, len(cgetData) == 0, "Received multiple C-GET responses")
+			e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+			dicom.WriteFileHeader(e,
+				[]*dicom.Element{
+					dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+					dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
+					dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+				})
+			e.WriteBytes(data)
+			cgetData = e.Bytes()
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	require.True(t, len(cgetData) > 0, "No data received")
+	ds, err := dicom.ReadDataSetInBytes(cgetData, dicom.ReadOptions{})
+	require.NoError(t, err)
+	expected := mustReadDICOMFile("testdata/reportsi.dcm")
+	checkFileBodiesEqual(t, expected, ds)
+}
+
+func TestCGetWithSOPClass(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRGetClasses)
+	defer su.Release()
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var received []*dicom.DataSet
+	resp, err := su.CGetWithSOPClass(dicomuid.PatientRootQRGet, identifier,
+		func(ds *dicom.DataSet) dimse.Status {
+			received = append(received, ds)
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	require.Len(t, received, 1)
+	checkFileBodiesEqual(t, mustReadDICOMFile("testdata/reportsi.dcm"), received[0])
+}
+
+func TestCGetDeclinesUndecodableTransferSyntax(t *testing.T) {
+	const jpeg2000 = "1.2.840.10008.1.2.4.90" // JPEG 2000 Image Compression (Lossless Only)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		TransferSyntaxes: []string{jpeg2000},
+		CGet:             onCGetRequest,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:                  sopclass.QRGetClasses,
+		TransferSyntaxes:            []string{jpeg2000, dicomuid.ExplicitVRLittleEndian},
+		UndecodableTransferSyntaxes: []string{jpeg2000},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	resp, err := su.CGetWithSOPClass(dicomuid.PatientRootQRGet, identifier,
+		func(ds *dicom.DataSet) dimse.Status {
+			t.Error("onStore called for a dataset in an undecodable transfer syntax")
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	require.Equal(t, uint16(0), resp.NumberOfCompletedSuboperations)
+	require.Equal(t, uint16(1), resp.NumberOfFailedSuboperations)
+}
+
+func TestCMove(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:   "mover",
+		RemoteAEs: map[string]string{"dest": provider.ListenAddr().String()},
+		CMove: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/IM-0001-0003.dcm"
+			for i := 1; i >= 0; i-- {
+				ch <- CMoveResult{Remaining: i, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var progress []dimse.CMoveRsp
+	resp, err := su.CMove(dicomuid.PatientRootQRMove, "dest", identifier, func(rsp *dimse.CMoveRsp) {
+		progress = append(progress, *rsp)
+	})
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	require.Equal(t, uint16(2), resp.NumberOfCompletedSuboperations)
+	require.Len(t, progress, 2)
+	require.Equal(t, uint16(1), progress[0].NumberOfRemainingSuboperations)
+	require.Equal(t, uint16(1), progress[0].NumberOfCompletedSuboperations)
+	require.Equal(t, uint16(0), progress[1].NumberOfRemainingSuboperations)
+	require.Equal(t, uint16(2), progress[1].NumberOfCompletedSuboperations)
+
+	_, err = su.CMove(dicomuid.PatientRootQRMove, "", identifier, nil)
+	require.Error(t, err)
+}
+
+func TestCMoveDestinations(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "mover",
+		CMove: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/IM-0001-0003.dcm"
+			ch <- CMoveResult{Remaining: 0, Path: path, DataSet: mustReadDICOMFile(path)}
+			close(ch)
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	require.NoError(t, sp.RegisterMoveDestination("dest", provider.ListenAddr().String()))
+	require.Error(t, sp.RegisterMoveDestination("a-title-longer-than-16", provider.ListenAddr().String()))
+	go sp.Run()
+	defer sp.Close()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	resp, err := su.CMove(dicomuid.PatientRootQRMove, "dest", identifier, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	assert.Equal(t, uint16(1), resp.NumberOfCompletedSuboperations)
+
+	resp, err = su.CMove(dicomuid.PatientRootQRMove, "nowhere", identifier, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dimse.CMoveMoveDestinationUnknown, resp.Status.Status)
+
+	// Illegal titles are rejected before the request is sent.
+	_, err = su.CMove(dicomuid.PatientRootQRMove, "back\\slash", identifier, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid destination")
+}
+
+func TestCMoveSetsMoveOriginator(t *testing.T) {
+	dest, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	requests := make(chan *CStoreRequest, 1)
+	dest.RegisterCStoreHandler("", func(req *CStoreRequest) dimse.Status {
+		requests <- req
+		return dimse.Success
+	})
+	go dest.Run()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:   "mover",
+		RemoteAEs: map[string]string{"dest": dest.ListenAddr().String()},
+		CMove: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/IM-0001-0003.dcm"
+			ch <- CMoveResult{Remaining: 0, Path: path, DataSet: mustReadDICOMFile(path)}
+			close(ch)
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "originator",
+		SOPClasses:     sopclass.QRMoveClasses,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT"),
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	resp, err := su.CMove(dicomuid.PatientRootQRMove, "dest", identifier, nil)
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	req := <-requests
+	assert.Equal(t, "originator", req.MoveOriginatorAETitle)
+	assert.Equal(t, resp.MessageIDBeingRespondedTo, req.MoveOriginatorMessageID)
+}
+
+// Runs a storage commitment SCP on "conn" that commits the first instance of
+// each request and reports a failure for the rest, through N-EVENT-REPORT on
+// the same association. Each report is preceded by one for an unknown
+// transaction, and is sent twice. The statuses of the N-EVENT-REPORT
+// responses are sent to "statuses", and failures of the SCP to "errs".
+func runStorageCommitmentSCP(conn net.Conn, statuses chan dimse.StatusCode, errs chan error) {
+	upcallCh := make(chan upcallEvent, 128)
+	disp := newServiceDispatcher("commitment-scp")
+	newItem := func(elems []*dicom.Element) *dicom.Element {
+		var values []interface{}
+		for _, elem := range elems {
+			values = append(values, elem)
+		}
+		return dicom.MustNewElement(dicomtag.Item, values...)
+	}
+	sendReport := func(cs *serviceCommandState, c *dimse.NActionRq, transactionUID string, items [][]*dicom.Element) error {
+		var failed []interface{}
+		for _, item := range items[1:] {
+			failed = append(failed, newItem(append(item, dicom.MustNewElement(dicomtag.FailureReason, uint16(0x0112)))))
+		}
+		report, err := writeElementsToBytes([]*dicom.Element{
+			dicom.MustNewElement(dicomtag.TransactionUID, transactionUID),
+			dicom.MustNewElement(dicomtag.ReferencedSOPSequence, newItem(items[0])),
+			dicom.MustNewElement(dicomtag.FailedSOPSequence, failed...),
+		}, cs.context.transferSyntaxUID)
+		if err != nil {
+			return err
+		}
+		rs, err := disp.newCommand(cs.cm, cs.context)
+		if err != nil {
+			return err
+		}
+		defer disp.deleteCommand(rs)
+		rs.sendMessage(&dimse.NEventReportRq{
+			AffectedSOPClassUID:    c.RequestedSOPClassUID,
+			MessageID:              rs.messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: StorageCommitmentSOPInstanceUID,
+			EventTypeID:            2,
+		}, report)
+		event, ok := <-rs.upcallCh
+		if !ok {
+			return fmt.Errorf("association closed while waiting for N-EVENT-REPORT-RSP")
+		}
+		statuses <- event.command.GetStatus().Status
+		return nil
+	}
+	handle := func(c *dimse.NActionRq, data []byte, cs *serviceCommandState) error {
+		if c.RequestedSOPInstanceUID != StorageCommitmentSOPInstanceUID || c.ActionTypeID != 1 {
+			return fmt.Errorf("unexpected N-ACTION-RQ: %v", c)
+		}
+		elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+		if err != nil {
+			return err
+		}
+		transactionUID, err := elems[0].GetString()
+		if err != nil {
+			return err
+		}
+		items, err := sequenceItems(elems[1])
+		if err != nil {
+			return err
+		}
+		cs.sendMessage(&dimse.NActionRsp{
+			AffectedSOPClassUID:       c.RequestedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+			Status:                    dimse.Success,
+		}, nil)
+		for _, uid := range []string{"1.2.3.999", transactionUID, transactionUID} {
+			if err := sendReport(cs, c, uid, items); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	disp.registerCallback(dimse.CommandFieldNActionRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			if err := handle(msg.(*dimse.NActionRq), data, cs); err != nil {
+				errs <- err
+			}
+		})
+	go runStateMachineForServiceProvider(context.Background(), conn, ServiceProviderParams{}, upcallCh, disp.downcallCh, "commitment-scp")
+	for event := range upcallCh {
+		if event.eventType == upcallEventData {
+			disp.handleEvent(event)
+		}
+	}
+	disp.close()
+}
+
+func TestStorageCommit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	statuses := make(chan dimse.StatusCode, 16)
+	errs := make(chan error, 16)
+	go runStorageCommitmentSCP(serverConn, statuses, errs)
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageCommitmentClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(clientConn)
+	const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	committed := SOPInstanceRef{SOPClassUID: ctImageStorage, SOPInstanceUID: "1.2.3.1"}
+	missing := SOPInstanceRef{SOPClassUID: ctImageStorage, SOPInstanceUID: "1.2.3.2"}
+	// The second request is served only if the stray reports of the first
+	// didn't wedge the association.
+	for i := 0; i < 2; i++ {
+		result, err := su.StorageCommit([]SOPInstanceRef{committed, missing})
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(result.TransactionUID, "2.25."))
+		assert.Equal(t, []SOPInstanceRef{committed}, result.Committed)
+		assert.Equal(t, []StorageCommitmentFailure{{SOPInstanceRef: missing, FailureReason: 0x0112}}, result.Failed)
+
+		// Reports for unknown transactions, including repeated ones,
+		// are refused.
+		var got []dimse.StatusCode
+		for len(got) < 3 {
+			select {
+			case status := <-statuses:
+				got = append(got, status)
+			case err := <-errs:
+				require.NoError(t, err)
+			case <-time.After(10 * time.Second):
+				require.FailNow(t, "timed out waiting for N-EVENT-REPORT-RSP", "got %v", got)
+			}
+		}
+		assert.Equal(t, []dimse.StatusCode{dimse.StatusInvalidArgumentValue, dimse.StatusSuccess, dimse.StatusInvalidArgumentValue}, got)
+	}
+}
+
+// Runs a C-FIND SCP on "conn" that sends one match, then waits for C-CANCEL,
+// which it sends to "cancels", before sending the final response. It also
+// answers C-ECHO.
+// Runs a C-FIND SCP on conn that sends one match, then waits for a C-CANCEL,
+// passes it to "cancels", and sends the final response. Unexpected requests
+// are reported to "errs".
+func runSlowCFindSCP(conn net.Conn, cancels chan *dimse.CCancelRq, errs chan error) {
+	upcallCh := make(chan upcallEvent, 128)
+	disp := newServiceDispatcher("find-scp")
+	disp.registerCallback(dimse.CommandFieldCFindRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			c := msg.(*dimse.CFindRq)
+			match, err := writeElementsToBytes([]*dicom.Element{
+				dicom.MustNewElement(dicomtag.PatientName, "foo"),
+			}, cs.context.transferSyntaxUID)
+			if err != nil {
+				errs <- err
+				return
+			}
+			cs.sendMessage(&dimse.CFindRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+				Status:                    dimse.Status{Status: dimse.StatusPending},
+			}, match)
+			event, ok := <-cs.upcallCh
+			if !ok {
+				errs <- errors.New("association closed before C-CANCEL")
+				return
+			}
+			cancel, ok := event.command.(*dimse.CCancelRq)
+			if !ok {
+				errs <- fmt.Errorf("expected C-CANCEL, got %v", event.command)
+				return
+			}
+			cancels <- cancel
+			cs.sendMessage(&dimse.CFindRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Status{Status: dimse.StatusCancel},
+			}, nil)
+		})
+	disp.registerCallback(dimse.CommandFieldCEchoRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			cs.sendMessage(&dimse.CEchoRsp{
+				MessageIDBeingRespondedTo: msg.GetMessageID(),
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Success,
+			}, nil)
+		})
+	go runStateMachineForServiceProvider(context.Background(), conn, ServiceProviderParams{}, upcallCh, disp.downcallCh, "find-scp")
+	for event := range upcallCh {
+		if event.eventType == upcallEventData {
+			disp.handleEvent(event)
+		}
+	}
+	disp.close()
+}
+
+func TestCFindContextCancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cancels := make(chan *dimse.CCancelRq, 1)
+	errs := make(chan error, 1)
+	go runSlowCFindSCP(serverConn, cancels, errs)
+
+	su, err := NewServiceUser(QueryRetrieveSCUParams(VerificationSCUParams(ServiceUserParams{
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})))
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(clientConn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := su.CFindContext(ctx, QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foo*")})
+	result := <-ch
+	require.NoError(t, result.Err)
+	require.NotEmpty(t, result.Elements)
+
+	cancel()
+	result = <-ch
+	require.ErrorIs(t, result.Err, context.Canceled)
+	_, ok := <-ch
+	require.False(t, ok)
+	select {
+	case c := <-cancels:
+		require.Equal(t, dimse.CommandDataSetTypeNull, c.CommandDataSetType)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("C-CANCEL not received")
+	}
+
+	// The final response to the canceled C-FIND doesn't abort the
+	// association.
+	require.NoError(t, su.CEcho())
+}
+
+func TestResponseExtra(t *testing.T) {
+	// A vendor-specific command element, unknown to the dimse package and to
+	// the tag dictionary. It's built by hand, since dicom.NewElement requires
+	// a registered tag.
+	vendorTag := suyashtag.Tag{Group: 0x0000, Element: 0x7f01}
+	vendorValue, err := suyashdicom.NewValue([]string{"detail"})
+	require.NoError(t, err)
+	vendorElem := &suyashdicom.Element{
+		Tag:                    vendorTag,
+		ValueRepresentation:    suyashtag.VRString,
+		RawValueRepresentation: "LO",
+		Value:                  vendorValue,
+	}
+	match, err := writeElementsToBytes([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foo"),
+	}, dicomuid.ImplicitVRLittleEndian)
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		upcallCh := make(chan upcallEvent, 128)
+		disp := newServiceDispatcher("extra-scp")
+		disp.registerCallback(dimse.CommandFieldCEchoRq,
+			func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+				c := msg.(*dimse.CEchoRq)
+				cs.sendMessage(&dimse.CEchoRsp{
+					AffectedSOPClassUID:       c.AffectedSOPClassUID,
+					MessageIDBeingRespondedTo: c.MessageID,
+					CommandDataSetType:        dimse.CommandDataSetTypeNull,
+					Status:                    dimse.Success,
+					Extra:                     []*suyashdicom.Element{vendorElem},
+				}, nil)
+			})
+		disp.registerCallback(dimse.CommandFieldCStoreRq,
+			func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+				c := msg.(*dimse.CStoreRq)
+				cs.sendMessage(&dimse.CStoreRsp{
+					AffectedSOPClassUID:       c.AffectedSOPClassUID,
+					MessageIDBeingRespondedTo: c.MessageID,
+					CommandDataSetType:        dimse.CommandDataSetTypeNull,
+					AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+					Status:                    dimse.Status{Status: dimse.CStoreOutOfResources},
+					Extra:                     []*suyashdicom.Element{vendorElem},
+				}, nil)
+			})
+		disp.registerCallback(dimse.CommandFieldCFindRq,
+			func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+				c := msg.(*dimse.CFindRq)
+				cs.sendMessage(&dimse.CFindRsp{
+					AffectedSOPClassUID:       c.AffectedSOPClassUID,
+					MessageIDBeingRespondedTo: c.MessageID,
+					CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+					Status:                    dimse.Status{Status: dimse.StatusPending},
+					Extra:                     []*suyashdicom.Element{vendorElem},
+				}, match)
+				cs.sendMessage(&dimse.CFindRsp{
+					AffectedSOPClassUID:       c.AffectedSOPClassUID,
+					MessageIDBeingRespondedTo: c.MessageID,
+					CommandDataSetType:        dimse.CommandDataSetTypeNull,
+					Status:                    dimse.Success,
+				}, nil)
+			})
+		go runStateMachineForServiceProvider(context.Background(), serverConn, ServiceProviderParams{}, upcallCh, disp.downcallCh, "extra-scp")
+		for event := range upcallCh {
+			if event.eventType == upcallEventData {
+				disp.handleEvent(event)
+			}
+		}
+		disp.close()
+	}()
+
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, err := dataset.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	require.NoError(t, err)
+	su, err := NewServiceUser(StorageSCUParams(QueryRetrieveSCUParams(VerificationSCUParams(ServiceUserParams{
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})), sopClassUID.MustGetString()))
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(clientConn)
+
+	// The unknown element is decoded with the UN VR.
+	requireVendorElem := func(extra []*suyashdicom.Element) {
+		require.Len(t, extra, 1)
+		require.Equal(t, vendorTag, extra[0].Tag)
+		require.Equal(t, []byte("detail"), extra[0].Value.GetValue())
+	}
+	echoResp, err := su.CEchoResponse()
+	require.NoError(t, err)
+	require.Equal(t, dimse.Success, echoResp.Status)
+	requireVendorElem(echoResp.Extra)
+
+	storeResp, err := su.CStoreResponse(context.Background(), dataset)
+	require.NoError(t, err)
+	require.Equal(t, dimse.CStoreOutOfResources, storeResp.Status.Status)
+	requireVendorElem(storeResp.Extra)
+
+	var results []CFindResult
+	for result := range su.CFind(QRLevelStudy, nil) {
+		require.NoError(t, result.Err)
+		results = append(results, result)
+	}
+	require.Len(t, results, 1)
+	require.NotNil(t, results[0].Response)
+	requireVendorElem(results[0].Response.Extra)
 }
 
 func TestReleaseWithoutConnect(t *testing.T) {
@@ -26,6 +26,10 @@ type FaultInjector interface {
 	// "newState"
 	onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType)
 	onSend(data []byte) faultInjectorAction
+	// Called with the raw bytes of each PDU received from the peer, before
+	// they are decoded. The returned bytes are decoded instead, so the
+	// injector can corrupt or truncate the PDU.
+	onReceive(data []byte) []byte
 }
 
 // SetUserFaultInjector sets the fault injector to be used by all user (client)
@@ -121,6 +125,23 @@ func (f *fuzzFaultInjector) onSend(data []byte) faultInjectorAction {
 	return faultInjectorContinue
 }
 
+func (f *fuzzFaultInjector) onReceive(data []byte) []byte {
+	if len(f.fuzz) == 0 || len(data) == 0 {
+		return data
+	}
+	op := fuzzByte(f)
+	if op >= 0xf0 {
+		// Truncate the PDU.
+		return data[:fuzzExponentialInRange(f, len(data))]
+	}
+	if op >= 0xc0 {
+		// Mutate a byte.
+		offset := fuzzExponentialInRange(f, len(data))
+		data[offset] = fuzzByte(f)
+	}
+	return data
+}
+
 func (f *fuzzFaultInjector) String() string {
 	s := "statehistory:{"
 	for i, e := range f.stateHistory {
@@ -0,0 +1,33 @@
+package netdicom
+
+// This file implements encoding query identifiers for C-FIND responders.
+
+import (
+	"fmt"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// EncodeIdentifier encodes ds, e.g., a C-FIND match, as the data payload of a
+// DIMSE message sent on a presentation context that negotiated
+// transferSyntaxUID. The byte order and VR explicitness follow the transfer
+// syntax, regardless of the encoding ds was read in.
+//
+// Group length elements (gggg,0000) are dropped, since their values depend on
+// the encoding the dataset was read in, and so are file meta elements
+// (0002,xxxx), which have no place in a message payload.
+func EncodeIdentifier(ds *dicom.DataSet, transferSyntaxUID string) ([]byte, error) {
+	elems := make([]*dicom.Element, 0, len(ds.Elements))
+	for _, elem := range ds.Elements {
+		if elem.Tag.Element == 0 || elem.Tag.Group == dicomtag.MetadataGroup {
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	data, err := writeElementsToBytes(elems, transferSyntaxUID)
+	if err != nil {
+		return nil, fmt.Errorf("dicom.EncodeIdentifier: %w", err)
+	}
+	return data, nil
+}
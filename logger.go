@@ -0,0 +1,127 @@
+package netdicom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom/dicomlog"
+)
+
+// Logger receives the log messages of associations. keysAndValues holds
+// alternating keys and values that qualify the message, e.g.,
+// "association", "user-12", "err", err. Messages logged by the state machine
+// always carry the "association" key, whose value identifies the association.
+//
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// VerboseLogger is an optional extension of Logger. Verbose receives the
+// messages that are more detailed than Debug ones, e.g., every PDU sent and
+// received and every state transition. A Logger that doesn't implement
+// VerboseLogger receives them through Debug.
+type VerboseLogger interface {
+	Logger
+	Verbose(msg string, keysAndValues ...interface{})
+}
+
+// Logs a message through l.Verbose if l implements VerboseLogger, or l.Debug
+// otherwise.
+func logVerbose(l Logger, msg string, keysAndValues ...interface{}) {
+	if vl, ok := l.(VerboseLogger); ok {
+		vl.Verbose(msg, keysAndValues...)
+		return
+	}
+	l.Debug(msg, keysAndValues...)
+}
+
+// dicomlogLogger is the default Logger. It forwards messages to dicomlog, at
+// verbosity 2 for verbose messages, 1 for debug messages, and 0 for the rest.
+type dicomlogLogger struct{}
+
+func (dicomlogLogger) Verbose(msg string, keysAndValues ...interface{}) {
+	logToDicomlog(2, "", msg, keysAndValues)
+}
+
+func (dicomlogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	logToDicomlog(1, "", msg, keysAndValues)
+}
+
+func (dicomlogLogger) Info(msg string, keysAndValues ...interface{}) {
+	logToDicomlog(0, "", msg, keysAndValues)
+}
+
+func (dicomlogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	logToDicomlog(0, "WARNING: ", msg, keysAndValues)
+}
+
+func (dicomlogLogger) Error(msg string, keysAndValues ...interface{}) {
+	logToDicomlog(0, "ERROR: ", msg, keysAndValues)
+}
+
+// Logs the message at the given dicomlog level. The message is formatted only
+// if the level is enabled.
+func logToDicomlog(level int, prefix, msg string, keysAndValues []interface{}) {
+	if dicomlog.Level() < level {
+		return
+	}
+	dicomlog.Vprintf(level, "%s%s", prefix, formatLogMessage(msg, keysAndValues))
+}
+
+// Formats the message as "msg key1=value1 key2=value2...".
+func formatLogMessage(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+		}
+	}
+	return b.String()
+}
+
+// valuesLogger prepends a fixed list of keys and values to every message.
+type valuesLogger struct {
+	l             Logger
+	keysAndValues []interface{}
+}
+
+// Returns a logger that adds keysAndValues to every message logged through l.
+// If l is nil, messages are sent to dicomlog.
+func withLogValues(l Logger, keysAndValues ...interface{}) Logger {
+	if l == nil {
+		l = dicomlogLogger{}
+	}
+	return &valuesLogger{l: l, keysAndValues: keysAndValues}
+}
+
+func (l *valuesLogger) with(keysAndValues []interface{}) []interface{} {
+	kv := make([]interface{}, 0, len(l.keysAndValues)+len(keysAndValues))
+	return append(append(kv, l.keysAndValues...), keysAndValues...)
+}
+
+func (l *valuesLogger) Verbose(msg string, keysAndValues ...interface{}) {
+	logVerbose(l.l, msg, l.with(keysAndValues)...)
+}
+
+func (l *valuesLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.l.Debug(msg, l.with(keysAndValues)...)
+}
+
+func (l *valuesLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.l.Info(msg, l.with(keysAndValues)...)
+}
+
+func (l *valuesLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.l.Warn(msg, l.with(keysAndValues)...)
+}
+
+func (l *valuesLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.l.Error(msg, l.with(keysAndValues)...)
+}
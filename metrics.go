@@ -0,0 +1,59 @@
+package netdicom
+
+import (
+	"io"
+	"time"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+)
+
+// Metrics receives measurements of associations, e.g., to export them to a
+// monitoring system. The association argument identifies the association; it
+// is the same value logged under the "association" key (see Logger).
+//
+// The methods are called from the goroutines that run the associations, so
+// they must be fast and safe for concurrent use.
+type Metrics interface {
+	// PDUSent is called after a PDU is written to the peer. bytes
+	// includes the PDU header.
+	PDUSent(association string, pduType pdu.Type, bytes int)
+	// PDUReceived is called after a PDU is read from the peer. bytes
+	// includes the PDU header.
+	PDUReceived(association string, pduType pdu.Type, bytes int)
+	// DIMSEOperationCompleted is called for every final (i.e., not
+	// pending) DIMSE response, sent or received. commandField identifies
+	// the response, e.g., dimse.CommandFieldCEchoRsp.
+	DIMSEOperationCompleted(association string, commandField uint16, category dimse.StatusCategory)
+	// AssociationEnded is called when the association is torn down, with
+	// the time elapsed since its state machine started.
+	AssociationEnded(association string, duration time.Duration)
+}
+
+// noopMetrics is the default Metrics. It discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) PDUSent(string, pdu.Type, int)                                {}
+func (noopMetrics) PDUReceived(string, pdu.Type, int)                            {}
+func (noopMetrics) DIMSEOperationCompleted(string, uint16, dimse.StatusCategory) {}
+func (noopMetrics) AssociationEnded(string, time.Duration)                       {}
+
+// Returns m, or noopMetrics if m is nil.
+func metricsOrDefault(m Metrics) Metrics {
+	if m == nil {
+		return noopMetrics{}
+	}
+	return m
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
@@ -0,0 +1,70 @@
+package netdicom
+
+// This file implements writing received objects as DICOM files.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// WritePart10 writes the data set of a C-STORE request to w as a DICOM file
+// (P3.10 7.1): the 128-byte preamble, the "DICM" prefix, and the file meta
+// information group, followed by data.
+//
+// data is the payload passed to CStoreCallback, or the contents of the file
+// passed to CStoreFileCallback. It must be encoded in transferSyntaxUID, the
+// transfer syntax negotiated for the request, which is recorded in the
+// TransferSyntaxUID element (0002,0010). sopClassUID and sopInstanceUID are
+// recorded as the media storage SOP class and instance UIDs. If
+// transferSyntaxUID is deflated explicit VR little endian, data, which the
+// library passes on inflated, is deflated.
+func WritePart10(w io.Writer, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) error {
+	if isDeflatedTransferSyntax(transferSyntaxUID) {
+		var err error
+		if data, err = deflatePayload(data); err != nil {
+			return fmt.Errorf("dicom.WritePart10(%s): %w", sopInstanceUID, err)
+		}
+	}
+	e := dicomio.NewEncoderWithTransferSyntax(w, transferSyntaxUID)
+	dicom.WriteFileHeader(e,
+		[]*dicom.Element{
+			dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+			dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
+			dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+		})
+	e.WriteBytes(data)
+	if err := e.Error(); err != nil {
+		return fmt.Errorf("dicom.WritePart10(%s): %w", sopInstanceUID, err)
+	}
+	return nil
+}
+
+// WritePart10File is similar to WritePart10, but writes the file at "path".
+// The file is written under a temporary name in the same directory and renamed
+// to "path" once complete, so that a partial file is never left at "path".
+func WritePart10File(path string, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := WritePart10(f, transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
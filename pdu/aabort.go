@@ -1,24 +1,66 @@
 package pdu
 
-//go:generate stringer -type AbortReasonType
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
 
+// Possible values for AAbort.Source. P3.8 Table 9-26.
+type AbortSourceType byte
+
+const (
+	AbortSourceServiceUser     AbortSourceType = 0
+	AbortSourceServiceProvider AbortSourceType = 2
+)
+
+func (s AbortSourceType) String() string {
+	switch s {
+	case AbortSourceServiceUser:
+		return "DICOM UL service-user"
+	case AbortSourceServiceProvider:
+		return "DICOM UL service-provider"
+	default:
+		return "AbortSourceType(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Possible values for AAbort.Reason. They are meaningful only when the source
+// is AbortSourceServiceProvider. P3.8 Table 9-26.
 type AbortReasonType byte
 
 const (
 	AbortReasonNotSpecified             AbortReasonType = 0
+	AbortReasonUnrecognizedPDU          AbortReasonType = 1
 	AbortReasonUnexpectedPDU            AbortReasonType = 2
-	AbortReasonUnrecognizedPDUParameter AbortReasonType = 3
-	AbortReasonUnexpectedPDUParameter   AbortReasonType = 4
-	AbortReasonInvalidPDUParameterValue AbortReasonType = 5
+	AbortReasonUnrecognizedPDUParameter AbortReasonType = 4
+	AbortReasonUnexpectedPDUParameter   AbortReasonType = 5
+	AbortReasonInvalidPDUParameterValue AbortReasonType = 6
 )
 
+func (r AbortReasonType) String() string {
+	switch r {
+	case AbortReasonNotSpecified:
+		return "reason not specified"
+	case AbortReasonUnrecognizedPDU:
+		return "unrecognized PDU"
+	case AbortReasonUnexpectedPDU:
+		return "unexpected PDU"
+	case AbortReasonUnrecognizedPDUParameter:
+		return "unrecognized PDU parameter"
+	case AbortReasonUnexpectedPDUParameter:
+		return "unexpected PDU parameter"
+	case AbortReasonInvalidPDUParameterValue:
+		return "invalid PDU parameter value"
+	default:
+		return "AbortReasonType(" + strconv.Itoa(int(r)) + ")"
+	}
+}
+
+// P3.8 9.3.8
 type AAbort struct {
-	Source SourceType
+	Source AbortSourceType
 	Reason AbortReasonType
 }
 
@@ -31,7 +73,7 @@ func (AAbort) Read(d *dicomio.Reader) (PDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	pdu.Source = SourceType(sourceType)
+	pdu.Source = AbortSourceType(sourceType)
 	reasonType, err := d.ReadUInt8()
 	if err != nil {
 		return nil, err
@@ -50,5 +92,5 @@ func (pdu *AAbort) Write() ([]byte, error) {
 }
 
 func (pdu *AAbort) String() string {
-	return fmt.Sprintf("A_ABORT{source:%v reason:%v}", pdu.Source, pdu.Reason)
+	return fmt.Sprintf("A_ABORT{source:%v(%d) reason:%v(%d)}", pdu.Source, pdu.Source, pdu.Reason, pdu.Reason)
 }
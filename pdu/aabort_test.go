@@ -0,0 +1,40 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbortSourceTypeString(t *testing.T) {
+	for source, want := range map[AbortSourceType]string{
+		AbortSourceServiceUser:     "DICOM UL service-user",
+		AbortSourceServiceProvider: "DICOM UL service-provider",
+		AbortSourceType(1):         "AbortSourceType(1)",
+	} {
+		require.Equal(t, want, source.String())
+	}
+}
+
+func TestAbortReasonTypeString(t *testing.T) {
+	for reason, want := range map[AbortReasonType]string{
+		AbortReasonNotSpecified:             "reason not specified",
+		AbortReasonUnrecognizedPDU:          "unrecognized PDU",
+		AbortReasonUnexpectedPDU:            "unexpected PDU",
+		AbortReasonUnrecognizedPDUParameter: "unrecognized PDU parameter",
+		AbortReasonUnexpectedPDUParameter:   "unexpected PDU parameter",
+		AbortReasonInvalidPDUParameterValue: "invalid PDU parameter value",
+		AbortReasonType(3):                  "AbortReasonType(3)",
+	} {
+		require.Equal(t, want, reason.String())
+	}
+}
+
+func TestAAbortString(t *testing.T) {
+	data, err := EncodePDU(&AAbort{Source: AbortSourceServiceProvider, Reason: AbortReasonUnexpectedPDU})
+	require.NoError(t, err)
+	v, err := ReadPDU(bytes.NewReader(data), 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, "A_ABORT{source:DICOM UL service-provider(2) reason:unexpected PDU(2)}", v.String())
+}
@@ -5,6 +5,7 @@ package pdu
 //go:generate stringer -type SourceType
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
@@ -28,10 +29,19 @@ const (
 type RejectReasonType byte
 
 const (
+	// Reasons used with SourceULServiceUser.
 	RejectReasonNone                               RejectReasonType = 1
 	RejectReasonApplicationContextNameNotSupported RejectReasonType = 2
 	RejectReasonCallingAETitleNotRecognized        RejectReasonType = 3
 	RejectReasonCalledAETitleNotRecognized         RejectReasonType = 7
+
+	// Reasons used with SourceULServiceProviderACSE. RejectReasonNone
+	// applies too.
+	RejectReasonProtocolVersionNotSupported RejectReasonType = 2
+
+	// Reasons used with SourceULServiceProviderPresentation.
+	RejectReasonTemporaryCongestion RejectReasonType = 1
+	RejectReasonLocalLimitExceeded  RejectReasonType = 2
 )
 
 // Possible values for AAssociateRj.Source
@@ -79,3 +89,48 @@ func (pdu *AAssociateRj) Write() ([]byte, error) {
 func (pdu *AAssociateRj) String() string {
 	return fmt.Sprintf("A_ASSOCIATE_RJ{result: %v, source: %v, reason: %v}", pdu.Result, pdu.Source, pdu.Reason)
 }
+
+// SourceDescription returns the description of the source in P3.8 Table
+// 9-21, e.g., "DICOM UL service-user".
+func (pdu *AAssociateRj) SourceDescription() string {
+	switch pdu.Source {
+	case SourceULServiceUser:
+		return "DICOM UL service-user"
+	case SourceULServiceProviderACSE:
+		return "DICOM UL service-provider (ACSE related function)"
+	case SourceULServiceProviderPresentation:
+		return "DICOM UL service-provider (presentation related function)"
+	}
+	return "SourceType(" + strconv.Itoa(int(pdu.Source)) + ")"
+}
+
+// ReasonDescription returns the description of the reason in P3.8 Table
+// 9-21, e.g., "temporary congestion". The meaning of a reason depends on the
+// source.
+func (pdu *AAssociateRj) ReasonDescription() string {
+	switch {
+	case pdu.Reason == RejectReasonNone && pdu.Source != SourceULServiceProviderPresentation:
+		return "no reason given"
+	case pdu.Source == SourceULServiceUser:
+		switch pdu.Reason {
+		case RejectReasonApplicationContextNameNotSupported:
+			return "application context name not supported"
+		case RejectReasonCallingAETitleNotRecognized:
+			return "calling AE title not recognized"
+		case RejectReasonCalledAETitleNotRecognized:
+			return "called AE title not recognized"
+		}
+	case pdu.Source == SourceULServiceProviderACSE:
+		if pdu.Reason == RejectReasonProtocolVersionNotSupported {
+			return "protocol version not supported"
+		}
+	case pdu.Source == SourceULServiceProviderPresentation:
+		switch pdu.Reason {
+		case RejectReasonTemporaryCongestion:
+			return "temporary congestion"
+		case RejectReasonLocalLimitExceeded:
+			return "local limit exceeded"
+		}
+	}
+	return "RejectReasonType(" + strconv.Itoa(int(pdu.Reason)) + ")"
+}
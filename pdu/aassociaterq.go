@@ -36,9 +36,11 @@ func (AAssociateRQ) Read(d *dicomio.Reader) (PDU, error) {
 	}
 	d.Skip(8 * 4)
 	for !d.IsLimitExhausted() {
+		// The items end where the PDU does, so an error means that
+		// the PDU is truncated or corrupt, not that the items ended.
 		item, err := pdu_item.DecodeSubItem(d)
 		if err != nil {
-			break
+			return nil, fmt.Errorf("A_ASSOCIATE_RQ: failed to decode item %d: %w", len(pdu.Items), err)
 		}
 		pdu.Items = append(pdu.Items, item)
 	}
@@ -6,16 +6,18 @@ import (
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
 
+// P3.8 9.3.7
 type AReleaseRp struct {
 }
 
 func (AReleaseRp) Read(d *dicomio.Reader) (PDU, error) {
 	pdu := &AReleaseRp{}
-	return pdu, d.Skip(4)
+	return pdu, readReleaseReserved(d, "A_RELEASE_RP")
 }
 
 func (pdu *AReleaseRp) Write() ([]byte, error) {
-	return []byte{0, 0, 0, 0}, nil
+	// The reserved field is sent as zeros.
+	return make([]byte, releasePDULength), nil
 }
 
 func (pdu *AReleaseRp) String() string {
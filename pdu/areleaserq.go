@@ -6,18 +6,34 @@ import (
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
 
+// Length of the body of A-RELEASE-RQ and A-RELEASE-RP, i.e., the value of
+// their PDU length field: a single reserved 32-bit field. P3.8 9.3.6 and 9.3.7.
+const releasePDULength = 4
+
+// P3.8 9.3.6
 type AReleaseRq struct {
 }
 
 func (AReleaseRq) Read(d *dicomio.Reader) (PDU, error) {
 	pdu := &AReleaseRq{}
-	return pdu, d.Skip(4)
+	return pdu, readReleaseReserved(d, "A_RELEASE_RQ")
 }
 
 func (pdu *AReleaseRq) Write() ([]byte, error) {
-	return []byte{0, 0, 0, 0}, nil
+	// The reserved field is sent as zeros.
+	return make([]byte, releasePDULength), nil
 }
 
 func (pdu *AReleaseRq) String() string {
 	return fmt.Sprintf("A_RELEASE_RQ(%v)", *pdu)
 }
+
+// Reads the reserved field that makes up the body of A-RELEASE-RQ and
+// A-RELEASE-RP. Its value is ignored, as required of receivers, but a body of
+// another length is rejected, since the PDU then can't be delimited reliably.
+func readReleaseReserved(d *dicomio.Reader, name string) error {
+	if n := d.BytesLeftUntilLimit(); n != releasePDULength {
+		return fmt.Errorf("%s: invalid PDU length %d, expected %d", name, n, releasePDULength)
+	}
+	return d.Skip(releasePDULength)
+}
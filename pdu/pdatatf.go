@@ -34,6 +34,43 @@ func (pdu *PDataTf) Write() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// IsEmpty is true if the PDU carries no fragment data and no last-fragment
+// flag, e.g., a P_DATA_TF with no items. Some peers send such PDUs as
+// keep-alives; they don't advance the assembly of a DIMSE message.
+func (pdu *PDataTf) IsEmpty() bool {
+	for _, item := range pdu.Items {
+		if len(item.Value) > 0 || item.Last {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendEncoded appends the encoded PDU, header included, to buf and returns
+// the extended buffer. The result is the same as EncodePDU's, but the caller
+// can reuse buf across PDUs instead of allocating a copy of every fragment.
+func (pdu *PDataTf) AppendEncoded(buf []byte) []byte {
+	length := 0
+	for _, item := range pdu.Items {
+		length += PresentationDataValueItemHeaderSize + len(item.Value)
+	}
+	buf = append(buf, byte(TypePDataTf), 0)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(length))
+	for _, item := range pdu.Items {
+		var header byte
+		if item.Command {
+			header |= 1
+		}
+		if item.Last {
+			header |= 2
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(2+len(item.Value)))
+		buf = append(buf, item.ContextID, header)
+		buf = append(buf, item.Value...)
+	}
+	return buf
+}
+
 func (pdu *PDataTf) String() string {
 	buf := bytes.Buffer{}
 	buf.WriteString("P_DATA_TF{items: [")
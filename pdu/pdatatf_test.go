@@ -0,0 +1,115 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Encode a P_DATA_TF PDU holding one presentation-data-value item with the
+// given item length and message control header.
+func encodeRawPDataTf(itemLength uint32, header byte, value []byte) []byte {
+	var item bytes.Buffer
+	binary.Write(&item, binary.BigEndian, itemLength)
+	item.WriteByte(1) // context ID
+	item.WriteByte(header)
+	item.Write(value)
+
+	var b bytes.Buffer
+	b.WriteByte(byte(TypePDataTf))
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, uint32(item.Len()))
+	b.Write(item.Bytes())
+	return b.Bytes()
+}
+
+func TestReadPDataTfMessageControlHeader(t *testing.T) {
+	value := []byte{1, 2, 3, 4}
+	v, err := ReadPDU(bytes.NewReader(encodeRawPDataTf(2+4, 0x03, value)), 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, &PDataTf{Items: []PresentationDataValueItem{{
+		ContextID: 1,
+		Command:   true,
+		Last:      true,
+		Value:     value,
+	}}}, v)
+
+	for _, header := range []byte{0x04, 0x80, 0xff} {
+		_, err = ReadPDU(bytes.NewReader(encodeRawPDataTf(2+4, header, value)), 1<<20)
+		require.Error(t, err, "header 0x%02x", header)
+		require.Contains(t, err.Error(), "reserved bits set in message control header")
+	}
+}
+
+func TestReadPDataTfShortItem(t *testing.T) {
+	_, err := ReadPDU(bytes.NewReader(encodeRawPDataTf(1, 0x02, nil)), 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid item length 1")
+}
+
+func TestReadPDataTfEmpty(t *testing.T) {
+	v, err := ReadPDU(bytes.NewReader([]byte{byte(TypePDataTf), 0, 0, 0, 0, 0}), 1<<20)
+	require.NoError(t, err)
+	require.True(t, v.(*PDataTf).IsEmpty())
+
+	v, err = ReadPDU(bytes.NewReader(encodeRawPDataTf(2, 0x01, nil)), 1<<20)
+	require.NoError(t, err)
+	require.True(t, v.(*PDataTf).IsEmpty())
+
+	// An empty last fragment terminates the message.
+	v, err = ReadPDU(bytes.NewReader(encodeRawPDataTf(2, 0x02, nil)), 1<<20)
+	require.NoError(t, err)
+	require.False(t, v.(*PDataTf).IsEmpty())
+}
+
+func TestPDataTfAppendEncoded(t *testing.T) {
+	v := &PDataTf{Items: []PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: []byte{1, 2, 3}},
+		{ContextID: 3, Value: []byte{4}},
+		{ContextID: 5, Last: true},
+	}}
+	want, err := EncodePDU(v)
+	require.NoError(t, err)
+	require.Equal(t, want, v.AppendEncoded(nil))
+	require.Equal(t, append([]byte{9}, want...), v.AppendEncoded([]byte{9}))
+}
+
+// Returns the number of bytes allocated by f.
+func bytesAllocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestReadPDUOversized(t *testing.T) {
+	// A header claiming a 2GB P_DATA_TF, with nothing after it.
+	header := []byte{byte(TypePDataTf), 0, 0x80, 0, 0, 0}
+	var err error
+	allocated := bytesAllocated(func() {
+		_, err = ReadPDU(bytes.NewReader(header), 1<<20)
+	})
+	require.ErrorIs(t, err, ErrPDUTooLarge)
+	require.Less(t, allocated, uint64(1<<20))
+
+	// The limit doesn't wrap around to zero for large max PDU sizes.
+	_, err = ReadPDU(bytes.NewReader(encodeRawPDataTf(2, 0x02, nil)), 1<<31)
+	require.NoError(t, err)
+}
+
+func TestReadPDataTfOversizedItem(t *testing.T) {
+	// A small PDU whose item claims 2GB.
+	data := encodeRawPDataTf(0x80000000, 0x02, []byte{1, 2, 3, 4})
+	var err error
+	allocated := bytesAllocated(func() {
+		_, err = ReadPDU(bytes.NewReader(data), 1<<20)
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the rest of the PDU")
+	require.Less(t, allocated, uint64(1<<20))
+}
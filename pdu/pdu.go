@@ -8,6 +8,7 @@ package pdu
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -17,6 +18,11 @@ import (
 
 const CurrentProtocolVersion uint16 = 1
 
+// PDUHeaderSize is the size of the header that precedes the variable field of
+// every PDU: the PDU type, a reserved byte, and the 4-byte PDU length. P3.8
+// 9.3.1.
+const PDUHeaderSize = 6
+
 // PDU is the interface for DUL messages like A-ASSOCIATE-AC, P-DATA-TF.
 type PDU interface {
 	fmt.Stringer
@@ -37,27 +43,31 @@ const (
 	TypeAAbort       Type = 7 // A_ABORT
 )
 
-// EncodePDU serializes "pdu" into []byte.
-func EncodePDU(pdu PDU) ([]byte, error) {
-	var pduType Type
+// TypeOf returns the type of "pdu".
+func TypeOf(pdu PDU) Type {
 	switch pdu.(type) {
 	case *AAssociateRQ:
-		pduType = TypeAAssociateRq
+		return TypeAAssociateRq
 	case *AAssociateAC:
-		pduType = TypeAAssociateAc
+		return TypeAAssociateAc
 	case *AAssociateRj:
-		pduType = TypeAAssociateRj
+		return TypeAAssociateRj
 	case *PDataTf:
-		pduType = TypePDataTf
+		return TypePDataTf
 	case *AReleaseRq:
-		pduType = TypeAReleaseRq
+		return TypeAReleaseRq
 	case *AReleaseRp:
-		pduType = TypeAReleaseRp
+		return TypeAReleaseRp
 	case *AAbort:
-		pduType = TypeAAbort
+		return TypeAAbort
 	default:
 		panic(fmt.Sprintf("Unknown PDU %v", pdu))
 	}
+}
+
+// EncodePDU serializes "pdu" into []byte.
+func EncodePDU(pdu PDU) ([]byte, error) {
+	pduType := TypeOf(pdu)
 	payload, err := pdu.Write()
 	if err != nil {
 		return nil, err
@@ -70,7 +80,23 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	return append(header[:], payload...), nil
 }
 
-// EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
+// ErrPDUTooLarge is returned by ReadPDU when a PDU header announces a length
+// that the caller doesn't accept. The PDU isn't read, so the stream can't be
+// used afterwards.
+var ErrPDUTooLarge = errors.New("PDU too large")
+
+// IsOversized is true if ReadPDU rejects a PDU whose header announces the
+// given length, without reading it, when called with maxPDUSize. Peers may
+// exceed the maximum length they were told to some extent, so a slack is
+// allowed; the check only avoids allocating memory for absurd lengths, e.g.,
+// those of a malicious peer.
+func IsOversized(length uint32, maxPDUSize int) bool {
+	// *2 is just an arbitrary slack. The product is computed in 64 bits, so
+	// that it doesn't wrap around for large maxPDUSize.
+	return int64(length) >= int64(maxPDUSize)*2
+}
+
+// ReadPDU reads a "pdu" from a stream. maxPDUSize defines the maximum
 // possible PDU size, in bytes, accepted by the caller.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	var pduType Type
@@ -88,9 +114,8 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	if length >= uint32(maxPDUSize)*2 {
-		// Avoid using too much memory. *2 is just an arbitrary slack.
-		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize)
+	if IsOversized(length, maxPDUSize) {
+		return nil, fmt.Errorf("%w: length %d is much larger than max PDU size of %d", ErrPDUTooLarge, length, maxPDUSize)
 	}
 	d := dicomio.NewReader(
 		bufio.NewReader(&io.LimitedReader{R: in, N: int64(length)}),
@@ -0,0 +1,117 @@
+package pdu_item
+
+import (
+	"fmt"
+
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+)
+
+// PS3.7 Annex D.3.3.6. Sent only by the requestor; the acceptor doesn't
+// respond to it.
+type CommonExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// The service class of SOPClassUID, e.g., "1.2.840.10008.4.2" for the
+	// storage service class.
+	ServiceClassUID string
+	// General SOP classes that SOPClassUID specializes (PS3.4 B.5), e.g.,
+	// the Enhanced SR storage class for a private SR storage class.
+	RelatedGeneralSOPClassUIDs []string
+}
+
+// Version of the sub-item encoded in its first byte.
+const commonExtendedNegotiationSubItemVersion = 0
+
+func decodeCommonExtendedNegotiationSubItem(d *dicomio.Reader, length uint16) (*CommonExtendedNegotiationSubItem, error) {
+	remaining := int(length)
+	readUID := func(what string) (string, error) {
+		if remaining < 2 {
+			return "", fmt.Errorf("CommonExtendedNegotiationSubItem: %s length exceeds the item length %dB", what, length)
+		}
+		uidLen, err := d.ReadUInt16()
+		if err != nil {
+			return "", err
+		}
+		remaining -= 2
+		if int(uidLen) > remaining {
+			return "", fmt.Errorf("CommonExtendedNegotiationSubItem: %s length %dB exceeds the item length %dB", what, uidLen, length)
+		}
+		remaining -= int(uidLen)
+		return d.ReadString(uint32(uidLen))
+	}
+	if remaining < 1 {
+		return nil, fmt.Errorf("CommonExtendedNegotiationSubItem: empty item")
+	}
+	if _, err := d.ReadUInt8(); err != nil { // Sub-item version.
+		return nil, err
+	}
+	remaining--
+	v := &CommonExtendedNegotiationSubItem{}
+	var err error
+	if v.SOPClassUID, err = readUID("SOP class UID"); err != nil {
+		return nil, err
+	}
+	if v.ServiceClassUID, err = readUID("service class UID"); err != nil {
+		return nil, err
+	}
+	if remaining < 2 {
+		return nil, fmt.Errorf("CommonExtendedNegotiationSubItem: related general SOP class list is missing")
+	}
+	listLen, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	remaining -= 2
+	if int(listLen) != remaining {
+		return nil, fmt.Errorf("CommonExtendedNegotiationSubItem: related general SOP class list length %dB doesn't match the item length %dB", listLen, length)
+	}
+	for remaining > 0 {
+		uid, err := readUID("related general SOP class UID")
+		if err != nil {
+			return nil, err
+		}
+		v.RelatedGeneralSOPClassUIDs = append(v.RelatedGeneralSOPClassUIDs, uid)
+	}
+	return v, nil
+}
+
+func (v *CommonExtendedNegotiationSubItem) Write(e *dicomio.Writer) error {
+	listLen := 0
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		listLen += 2 + len(uid)
+	}
+	length := 1 + 2 + len(v.SOPClassUID) + 2 + len(v.ServiceClassUID) + 2 + listLen
+	if length > 0xffff {
+		return fmt.Errorf("CommonExtendedNegotiationSubItem: fields too long (%dB)", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeSOPClassCommonExtendedNegotiation, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteByte(commonExtendedNegotiationSubItemVersion); err != nil {
+		return err
+	}
+	for _, uid := range []string{v.SOPClassUID, v.ServiceClassUID} {
+		if err := e.WriteUInt16(uint16(len(uid))); err != nil {
+			return err
+		}
+		if err := e.WriteString(uid); err != nil {
+			return err
+		}
+	}
+	if err := e.WriteUInt16(uint16(listLen)); err != nil {
+		return err
+	}
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		if err := e.WriteUInt16(uint16(len(uid))); err != nil {
+			return err
+		}
+		if err := e.WriteString(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *CommonExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("CommonExtendedNegotiation{sopclassuid: %v, serviceclassuid: %v, related: %v}",
+		v.SOPClassUID, v.ServiceClassUID, v.RelatedGeneralSOPClassUIDs)
+}
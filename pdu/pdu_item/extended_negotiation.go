@@ -0,0 +1,59 @@
+package pdu_item
+
+import (
+	"fmt"
+
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+)
+
+// PS3.7 Annex D.3.3.5. The meaning of ServiceClassApplicationInfo depends on
+// the SOP class. E.g., for the query/retrieve classes, byte 0 requests
+// relational queries, byte 1 combined date-time matching, and byte 2 fuzzy
+// semantic matching of person names (PS3.4 C.5.1.1).
+type ExtendedNegotiationSubItem struct {
+	SOPClassUID                 string
+	ServiceClassApplicationInfo []byte
+}
+
+func decodeExtendedNegotiationSubItem(d *dicomio.Reader, length uint16) (*ExtendedNegotiationSubItem, error) {
+	uidLen, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	if int(uidLen)+2 > int(length) {
+		return nil, fmt.Errorf("ExtendedNegotiationSubItem: SOP class UID length %dB exceeds the item length %dB", uidLen, length)
+	}
+	sopclassuid, err := d.ReadString(uint32(uidLen))
+	if err != nil {
+		return nil, err
+	}
+	info := make([]byte, int(length)-2-int(uidLen))
+	if _, err := d.Read(info); err != nil {
+		return nil, err
+	}
+	return &ExtendedNegotiationSubItem{
+		SOPClassUID:                 sopclassuid,
+		ServiceClassApplicationInfo: info,
+	}, nil
+}
+
+func (v *ExtendedNegotiationSubItem) Write(e *dicomio.Writer) error {
+	length := 2 + len(v.SOPClassUID) + len(v.ServiceClassApplicationInfo)
+	if length > 0xffff {
+		return fmt.Errorf("ExtendedNegotiationSubItem: fields too long (%dB)", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.SOPClassUID))); err != nil {
+		return err
+	}
+	if err := e.WriteString(v.SOPClassUID); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.ServiceClassApplicationInfo)
+}
+
+func (v *ExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("ExtendedNegotiation{sopclassuid: %v, info: %v}", v.SOPClassUID, v.ServiceClassApplicationInfo)
+}
@@ -38,7 +38,9 @@ type PresentationContextItem struct {
 func decodePresentationContextItem(d *dicomio.Reader, itemType byte, length uint16) (*PresentationContextItem, error) {
 	v := &PresentationContextItem{Type: itemType}
 	var err error
-	d.PushLimit(int64(length))
+	if err := d.PushLimit(int64(length)); err != nil {
+		return nil, err
+	}
 	defer d.PopLimit()
 	v.ContextID, err = d.ReadUInt8()
 	if err != nil {
@@ -3,6 +3,7 @@ package pdu_item
 import (
 	"bytes"
 	"fmt"
+	"io"
 
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
@@ -20,17 +21,21 @@ type SubItem interface {
 
 // Possible Type field values for SubItem.
 const (
-	ItemTypeApplicationContext           = 0x10
-	ItemTypePresentationContextRequest   = 0x20
-	ItemTypePresentationContextResponse  = 0x21
-	ItemTypeAbstractSyntax               = 0x30
-	ItemTypeTransferSyntax               = 0x40
-	ItemTypeUserInformation              = 0x50
-	ItemTypeUserInformationMaximumLength = 0x51
-	ItemTypeImplementationClassUID       = 0x52
-	ItemTypeAsynchronousOperationsWindow = 0x53
-	ItemTypeRoleSelection                = 0x54
-	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeApplicationContext                = 0x10
+	ItemTypePresentationContextRequest        = 0x20
+	ItemTypePresentationContextResponse       = 0x21
+	ItemTypeAbstractSyntax                    = 0x30
+	ItemTypeTransferSyntax                    = 0x40
+	ItemTypeUserInformation                   = 0x50
+	ItemTypeUserInformationMaximumLength      = 0x51
+	ItemTypeImplementationClassUID            = 0x52
+	ItemTypeAsynchronousOperationsWindow      = 0x53
+	ItemTypeRoleSelection                     = 0x54
+	ItemTypeImplementationVersionName         = 0x55
+	ItemTypeSOPClassExtendedNegotiation       = 0x56
+	ItemTypeSOPClassCommonExtendedNegotiation = 0x57
+	ItemTypeUserIdentityRequest               = 0x58
+	ItemTypeUserIdentityResponse              = 0x59
 )
 
 func DecodeSubItem(d *dicomio.Reader) (SubItem, error) {
@@ -68,8 +73,22 @@ func DecodeSubItem(d *dicomio.Reader) (SubItem, error) {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation:
+		return decodeExtendedNegotiationSubItem(d, length)
+	case ItemTypeSOPClassCommonExtendedNegotiation:
+		return decodeCommonExtendedNegotiationSubItem(d, length)
+	case ItemTypeUserIdentityRequest:
+		return decodeUserIdentitySubItem(d, length)
+	case ItemTypeUserIdentityResponse:
+		return decodeUserIdentityResponseSubItem(d, length)
 	default:
-		return nil, fmt.Errorf("unknown item type: 0x%x", itemType)
+		// P3.7 D.3.3: unrecognized items are to be ignored, so keep
+		// their bytes and let the caller skip them.
+		data := make([]byte, length)
+		if _, err := io.ReadFull(d, data); err != nil {
+			return nil, fmt.Errorf("item of unknown type 0x%x: %w", itemType, err)
+		}
+		return &SubItemUnsupported{Type: itemType, Data: data}, nil
 	}
 }
 
@@ -119,10 +138,11 @@ type SubItemUnsupported struct {
 	Data []byte
 }
 
-func (item *SubItemUnsupported) Write(e *dicomio.Writer) {
-	encodeSubItemHeader(e, item.Type, uint16(len(item.Data)))
-	// TODO: handle unicode properly
-	e.WriteBytes(item.Data)
+func (item *SubItemUnsupported) Write(e *dicomio.Writer) error {
+	if err := encodeSubItemHeader(e, item.Type, uint16(len(item.Data))); err != nil {
+		return err
+	}
+	return e.WriteBytes(item.Data)
 }
 
 func (item *SubItemUnsupported) String() string {
@@ -0,0 +1,150 @@
+package pdu_item
+
+//go:generate stringer -type UserIdentityType
+
+import (
+	"fmt"
+
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+)
+
+// UserIdentityType is the form of the identity carried in
+// UserIdentitySubItem. PS3.7 Annex D.3.3.7.1.
+type UserIdentityType byte
+
+const (
+	UserIdentityUsername            UserIdentityType = 1
+	UserIdentityUsernameAndPasscode UserIdentityType = 2
+	UserIdentityKerberos            UserIdentityType = 3
+	UserIdentitySAML                UserIdentityType = 4
+	UserIdentityJWT                 UserIdentityType = 5
+)
+
+// PS3.7 Annex D.3.3.7.1. Sent in A-ASSOCIATE-RQ.
+type UserIdentitySubItem struct {
+	Type UserIdentityType
+	// If true, the requestor asks the acceptor to send back
+	// UserIdentityResponseSubItem in A-ASSOCIATE-AC.
+	PositiveResponseRequested bool
+	// Username, Kerberos ticket, SAML assertion, or JSON web token,
+	// depending on Type.
+	PrimaryField []byte
+	// Passcode. Nonempty only for UserIdentityUsernameAndPasscode.
+	SecondaryField []byte
+}
+
+func decodeUserIdentitySubItem(d *dicomio.Reader, length uint16) (*UserIdentitySubItem, error) {
+	if length < 6 {
+		return nil, fmt.Errorf("UserIdentitySubItem must be at least 6 bytes, but found %dB", length)
+	}
+	v := &UserIdentitySubItem{}
+	identityType, err := d.ReadUInt8()
+	if err != nil {
+		return nil, err
+	}
+	v.Type = UserIdentityType(identityType)
+	positiveResponseRequested, err := d.ReadUInt8()
+	if err != nil {
+		return nil, err
+	}
+	v.PositiveResponseRequested = positiveResponseRequested != 0
+	if v.PrimaryField, err = decodeUserIdentityField(d); err != nil {
+		return nil, err
+	}
+	if v.SecondaryField, err = decodeUserIdentityField(d); err != nil {
+		return nil, err
+	}
+	if n := 6 + len(v.PrimaryField) + len(v.SecondaryField); n != int(length) {
+		return nil, fmt.Errorf("UserIdentitySubItem: item length %dB doesn't match the field lengths %dB", length, n)
+	}
+	return v, nil
+}
+
+// Read a field prefixed by a 2-byte length.
+func decodeUserIdentityField(d *dicomio.Reader) ([]byte, error) {
+	length, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	if _, err := d.Read(field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+func (v *UserIdentitySubItem) Write(e *dicomio.Writer) error {
+	length := 6 + len(v.PrimaryField) + len(v.SecondaryField)
+	if length > 0xffff {
+		return fmt.Errorf("UserIdentitySubItem: fields too long (%dB)", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeUserIdentityRequest, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteByte(byte(v.Type)); err != nil {
+		return err
+	}
+	var positiveResponseRequested byte
+	if v.PositiveResponseRequested {
+		positiveResponseRequested = 1
+	}
+	if err := e.WriteByte(positiveResponseRequested); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.PrimaryField))); err != nil {
+		return err
+	}
+	if err := e.WriteBytes(v.PrimaryField); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.SecondaryField))); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.SecondaryField)
+}
+
+func (v *UserIdentitySubItem) String() string {
+	// Don't log the credentials themselves.
+	return fmt.Sprintf("UserIdentity{type: %v, positiveresponse: %v, primary: %dB, secondary: %dB}",
+		v.Type, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2. Sent in A-ASSOCIATE-AC iff the requestor set
+// UserIdentitySubItem.PositiveResponseRequested.
+type UserIdentityResponseSubItem struct {
+	// Kerberos server ticket or SAML response. Empty for other identity
+	// types.
+	ServerResponse []byte
+}
+
+func decodeUserIdentityResponseSubItem(d *dicomio.Reader, length uint16) (*UserIdentityResponseSubItem, error) {
+	if length < 2 {
+		return nil, fmt.Errorf("UserIdentityResponseSubItem must be at least 2 bytes, but found %dB", length)
+	}
+	serverResponse, err := decodeUserIdentityField(d)
+	if err != nil {
+		return nil, err
+	}
+	if n := 2 + len(serverResponse); n != int(length) {
+		return nil, fmt.Errorf("UserIdentityResponseSubItem: item length %dB doesn't match the field length %dB", length, n)
+	}
+	return &UserIdentityResponseSubItem{ServerResponse: serverResponse}, nil
+}
+
+func (v *UserIdentityResponseSubItem) Write(e *dicomio.Writer) error {
+	length := 2 + len(v.ServerResponse)
+	if length > 0xffff {
+		return fmt.Errorf("UserIdentityResponseSubItem: server response too long (%dB)", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeUserIdentityResponse, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.ServerResponse))); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityResponseSubItem) String() string {
+	return fmt.Sprintf("UserIdentityResponse{serverresponse: %dB}", len(v.ServerResponse))
+}
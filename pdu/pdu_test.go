@@ -0,0 +1,202 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPDURoundTrip(t *testing.T) {
+	items := []pdu_item.SubItem{
+		&pdu_item.ApplicationContextItem{Name: pdu_item.DICOMApplicationContextItemName},
+		&pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu_item.SubItem{
+				&pdu_item.AbstractSyntaxSubItem{Name: "1.2.840.10008.1.1"},
+				&pdu_item.TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"},
+			},
+		},
+		&pdu_item.UserInformationItem{Items: []pdu_item.SubItem{
+			&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+		}},
+	}
+	for _, test := range []struct {
+		name string
+		in   PDU
+		// Expected result of ReadPDU, if different from "in".
+		want PDU
+	}{
+		{
+			name: "A-ASSOCIATE-RQ",
+			in:   &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "0123456789ABCDEF", CallingAETitle: "0123456789abcdef", Items: items},
+		},
+		{
+			// AE titles are padded with spaces to 16 bytes.
+			name: "A-ASSOCIATE-RQ short AE titles",
+			in:   &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP", CallingAETitle: "SCU", Items: items},
+			want: &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP             ", CallingAETitle: "SCU             ", Items: items},
+		},
+		{
+			name: "A-ASSOCIATE-RQ no items",
+			in:   &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "0123456789ABCDEF", CallingAETitle: "0123456789abcdef"},
+		},
+		{
+			name: "A-ASSOCIATE-AC",
+			in:   &AAssociateAC{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP", CallingAETitle: "SCU", Items: items},
+			want: &AAssociateAC{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP             ", CallingAETitle: "SCU             ", Items: items},
+		},
+		{
+			name: "A-ASSOCIATE-AC no items",
+			in:   &AAssociateAC{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "0123456789ABCDEF", CallingAETitle: "0123456789abcdef"},
+		},
+		{
+			name: "A-ASSOCIATE-RJ",
+			in:   &AAssociateRj{Result: ResultRejectedTransient, Source: SourceULServiceProviderPresentation, Reason: RejectReasonTemporaryCongestion},
+		},
+		{
+			name: "P-DATA-TF",
+			in: &PDataTf{Items: []PresentationDataValueItem{
+				{ContextID: 1, Command: true, Last: true, Value: []byte{1, 2, 3, 4}},
+				{ContextID: 3, Command: false, Last: false, Value: []byte{5, 6}},
+			}},
+		},
+		{
+			name: "P-DATA-TF no items",
+			in:   &PDataTf{},
+		},
+		{
+			name: "A-RELEASE-RQ",
+			in:   &AReleaseRq{},
+		},
+		{
+			name: "A-RELEASE-RP",
+			in:   &AReleaseRp{},
+		},
+		{
+			name: "A-ABORT",
+			in:   &AAbort{Source: AbortSourceServiceProvider, Reason: AbortReasonInvalidPDUParameterValue},
+		},
+	} {
+		data, err := EncodePDU(test.in)
+		require.NoError(t, err, test.name)
+		require.Equal(t, byte(TypeOf(test.in)), data[0], test.name)
+		v, err := ReadPDU(bytes.NewReader(data), 1<<20)
+		require.NoError(t, err, test.name)
+		want := test.want
+		if want == nil {
+			want = test.in
+		}
+		require.Equal(t, want, v, test.name)
+	}
+}
+
+// Receivers must ignore the value of reserved fields. P3.8 9.3.1.
+func TestReadPDUIgnoresReservedBytes(t *testing.T) {
+	for _, in := range []PDU{
+		&AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "0123456789ABCDEF", CallingAETitle: "0123456789abcdef"},
+		&AAssociateAC{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "0123456789ABCDEF", CallingAETitle: "0123456789abcdef"},
+		&AAssociateRj{Result: ResultRejectedPermanent, Source: SourceULServiceUser, Reason: RejectReasonCalledAETitleNotRecognized},
+		&AReleaseRq{},
+		&AReleaseRp{},
+		&AAbort{Source: AbortSourceServiceProvider, Reason: AbortReasonUnexpectedPDU},
+	} {
+		data, err := EncodePDU(in)
+		require.NoError(t, err)
+		data[1] = 0xff // Reserved byte of the PDU header.
+		switch in.(type) {
+		case *AAssociateRQ, *AAssociateAC:
+			// Reserved bytes after the protocol version, and the
+			// 32 bytes after the AE titles.
+			data[PDUHeaderSize+2], data[PDUHeaderSize+3] = 0xff, 0xff
+			for i := PDUHeaderSize + 36; i < PDUHeaderSize+68; i++ {
+				data[i] = 0xff
+			}
+		case *AAssociateRj:
+			data[PDUHeaderSize] = 0xff
+		case *AReleaseRq, *AReleaseRp:
+			copy(data[PDUHeaderSize:], []byte{0xff, 0xff, 0xff, 0xff})
+		case *AAbort:
+			data[PDUHeaderSize], data[PDUHeaderSize+1] = 0xff, 0xff
+		}
+		v, err := ReadPDU(bytes.NewReader(data), 1<<20)
+		require.NoError(t, err, in.String())
+		require.Equal(t, in, v)
+	}
+}
+
+func TestReadAAssociateRQTruncatedItem(t *testing.T) {
+	in := &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP", CallingAETitle: "SCU", Items: []pdu_item.SubItem{
+		&pdu_item.ApplicationContextItem{Name: pdu_item.DICOMApplicationContextItemName},
+		&pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu_item.SubItem{
+				&pdu_item.AbstractSyntaxSubItem{Name: "1.2.840.10008.1.1"},
+				&pdu_item.TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"},
+			},
+		},
+	}}
+	data, err := EncodePDU(in)
+	require.NoError(t, err)
+	// Cut the presentation context item, which comes last, short, and
+	// shorten the PDU to match.
+	data = data[:len(data)-4]
+	binary.BigEndian.PutUint32(data[2:], uint32(len(data)-PDUHeaderSize))
+	_, err = ReadPDU(bytes.NewReader(data), 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "A_ASSOCIATE_RQ: failed to decode item 1")
+}
+
+// Items of unknown types are kept, so that the receiver can ignore them.
+func TestReadAAssociateRQUnknownItem(t *testing.T) {
+	in := &AAssociateRQ{ProtocolVersion: CurrentProtocolVersion, CalledAETitle: "SCP", CallingAETitle: "SCU", Items: []pdu_item.SubItem{
+		&pdu_item.SubItemUnsupported{Type: 0x99, Data: []byte{1, 2, 3}},
+		&pdu_item.ApplicationContextItem{Name: pdu_item.DICOMApplicationContextItemName},
+	}}
+	data, err := EncodePDU(in)
+	require.NoError(t, err)
+	v, err := ReadPDU(bytes.NewReader(data), 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, "SCP             ", v.(*AAssociateRQ).CalledAETitle)
+	require.Equal(t, in.Items, v.(*AAssociateRQ).Items)
+}
+
+// A-RELEASE-RQ and -RP are a header followed by a reserved 32-bit field. P3.8
+// 9.3.6 and 9.3.7.
+func TestAReleaseWireFormat(t *testing.T) {
+	var stream []byte
+	for _, test := range []struct {
+		in   PDU
+		want []byte
+	}{
+		{&AReleaseRq{}, []byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00}},
+		{&AReleaseRp{}, []byte{0x06, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00}},
+	} {
+		data, err := EncodePDU(test.in)
+		require.NoError(t, err)
+		require.Equal(t, test.want, data, test.in.String())
+		stream = append(stream, data...)
+	}
+
+	// Read back to back, so that each must consume exactly its bytes.
+	in := bytes.NewReader(stream)
+	for _, want := range []PDU{&AReleaseRq{}, &AReleaseRp{}} {
+		v, err := ReadPDU(in, 1<<20)
+		require.NoError(t, err)
+		require.Equal(t, want, v)
+	}
+	require.Zero(t, in.Len())
+
+	// The length is fixed.
+	for _, data := range [][]byte{
+		{0x05, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x06, 0x00, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	} {
+		_, err := ReadPDU(bytes.NewReader(data), 1<<20)
+		require.ErrorContains(t, err, "invalid PDU length")
+	}
+}
@@ -7,12 +7,22 @@ import (
 	"github.com/suyashkumar/dicom/pkg/dicomio"
 )
 
+// PresentationDataValueItemHeaderSize is the size of the header that precedes
+// the fragment in a presentation-data-value item: the 4-byte item length, the
+// context ID, and the message control header. P3.8 9.3.5.1 and E.2.
+const PresentationDataValueItemHeaderSize = 6
+
+// Bits of the message control header that are defined by P3.8 E.2: bit 0 (the
+// command flag) and bit 1 (the last-fragment flag).
+const messageControlHeaderMask = 0x03
+
 // P3.8 9.3.2.2.1 & 9.3.2.2.2
 type PresentationDataValueItem struct {
 	// Length: 2 + len(Value)
 	ContextID byte
 
-	// P3.8, E.2: the following two fields encode a single byte.
+	// P3.8, E.2: the following two fields encode a single byte, the
+	// message control header. Its other bits are reserved and must be 0.
 	Command bool // Bit 7 (LSB): 1 means command 0 means data
 	Last    bool // Bit 6: 1 means last fragment. 0 means not last fragment.
 
@@ -34,6 +44,16 @@ func ReadPresentationDataValueItem(d *dicomio.Reader) (PresentationDataValueItem
 	if err != nil {
 		return PresentationDataValueItem{}, err
 	}
+	if length < 2 {
+		return PresentationDataValueItem{}, fmt.Errorf("PresentationDataValueItem: invalid item length %d for context %d", length, item.ContextID)
+	}
+	if header&^messageControlHeaderMask != 0 {
+		return PresentationDataValueItem{}, fmt.Errorf("PresentationDataValueItem: reserved bits set in message control header 0x%02x for context %d", header, item.ContextID)
+	}
+	if int64(length)-2 > d.BytesLeftUntilLimit() {
+		// Don't allocate the value before knowing that the PDU holds it.
+		return PresentationDataValueItem{}, fmt.Errorf("PresentationDataValueItem: item length %d for context %d exceeds the rest of the PDU", length, item.ContextID)
+	}
 	item.Command = (header&1 != 0)
 	item.Last = (header&2 != 0)
 	item.Value = make([]byte, length-2)
@@ -12,6 +12,9 @@ func _() {
 	_ = x[RejectReasonApplicationContextNameNotSupported-2]
 	_ = x[RejectReasonCallingAETitleNotRecognized-3]
 	_ = x[RejectReasonCalledAETitleNotRecognized-7]
+	_ = x[RejectReasonProtocolVersionNotSupported-2]
+	_ = x[RejectReasonTemporaryCongestion-1]
+	_ = x[RejectReasonLocalLimitExceeded-2]
 }
 
 const (
@@ -17,9 +17,9 @@ const _RejectResultType_name = "ResultRejectedPermanentResultRejectedTransient"
 var _RejectResultType_index = [...]uint8{0, 23, 46}
 
 func (i RejectResultType) String() string {
-	i -= 1
-	if i >= RejectResultType(len(_RejectResultType_index)-1) {
-		return "RejectResultType(" + strconv.FormatInt(int64(i+1), 10) + ")"
+	idx := int(i) - 1
+	if i < 1 || idx >= len(_RejectResultType_index)-1 {
+		return "RejectResultType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _RejectResultType_name[_RejectResultType_index[i]:_RejectResultType_index[i+1]]
+	return _RejectResultType_name[_RejectResultType_index[idx]:_RejectResultType_index[idx+1]]
 }
@@ -18,9 +18,9 @@ const _SourceType_name = "SourceULServiceUserSourceULServiceProviderACSESourceUL
 var _SourceType_index = [...]uint8{0, 19, 46, 81}
 
 func (i SourceType) String() string {
-	i -= 1
-	if i >= SourceType(len(_SourceType_index)-1) {
-		return "SourceType(" + strconv.FormatInt(int64(i+1), 10) + ")"
+	idx := int(i) - 1
+	if i < 1 || idx >= len(_SourceType_index)-1 {
+		return "SourceType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _SourceType_name[_SourceType_index[i]:_SourceType_index[i+1]]
+	return _SourceType_name[_SourceType_index[idx]:_SourceType_index[idx+1]]
 }
@@ -22,9 +22,9 @@ const _Type_name = "TypeAAssociateRqTypeAAssociateAcTypeAAssociateRjTypePDataTfT
 var _Type_index = [...]uint8{0, 16, 32, 48, 59, 73, 87, 97}
 
 func (i Type) String() string {
-	i -= 1
-	if i >= Type(len(_Type_index)-1) {
-		return "Type(" + strconv.FormatInt(int64(i+1), 10) + ")"
+	idx := int(i) - 1
+	if i < 1 || idx >= len(_Type_index)-1 {
+		return "Type(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _Type_name[_Type_index[i]:_Type_index[i+1]]
+	return _Type_name[_Type_index[idx]:_Type_index[idx+1]]
 }
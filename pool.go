@@ -0,0 +1,264 @@
+package netdicom
+
+// This file implements reusing associations across operations.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/grailbio/go-dicom/dicomlog"
+)
+
+// DefaultPoolIdleTimeout is the time an association may stay unused in an
+// AssociationPool before it is released, unless NewAssociationPool is given
+// another one.
+const DefaultPoolIdleTimeout = 30 * time.Second
+
+// AssociationPool keeps associations open after use, so that operations on
+// the same peer, e.g., a sequence of C-ECHO or C-STORE requests to a PACS,
+// don't each pay for an association handshake. Associations are reused only
+// for the same server address and the same ServiceUserParams, e.g., AE
+// titles, proposed presentation contexts, user identity and TLS
+// configuration. Associations dialed with a custom Dialer aren't reused, since
+// dialers can't be compared. The Logger, Metrics, PDUTracer and OnTransition
+// of an association are those of the caller that dialed it.
+//
+//	pool := netdicom.NewAssociationPool(0, netdicom.RetryPolicy{})
+//	defer pool.Close()
+//	su, err := pool.Get(params, "pacs:104")
+//	...
+//	err = su.CStore(ds)
+//	pool.Put(su)
+//
+// AssociationPool is safe for concurrent use. An association is handed to
+// one caller at a time, so concurrent callers get associations of their own.
+type AssociationPool struct {
+	idleTimeout time.Duration
+	retry       RetryPolicy
+
+	mu     sync.Mutex
+	idle   map[poolKey][]*pooledAssociation // Associations not in use.
+	inUse  map[*ServiceUser]poolKey         // Associations returned by Get.
+	closed bool
+}
+
+// Identifies the associations that can be used interchangeably.
+type poolKey struct {
+	serverAddr     string
+	calledAETitle  string
+	callingAETitle string
+	// The proposed SOP classes and transfer syntaxes, sorted and joined.
+	sopClasses       string
+	transferSyntaxes string
+	// ServiceUserParams.ProposedContexts, in order, since it tells which
+	// context is preferred.
+	proposedContexts string
+
+	// The other parameters that affect the negotiation or the handling of
+	// the association, in a comparable form.
+	undecodableTransferSyntaxes string
+	scpRoleSOPClasses           string
+	extendedNegotiation         string
+	commonExtendedNegotiation   string
+	maxOperationsInvoked        uint16
+	maxOperationsPerformed      uint16
+	priority                    dimse.Priority
+	userIdentity                string
+	implementationClassUID      string
+	implementationVersionName   string
+	readTimeout                 time.Duration
+	writeTimeout                time.Duration
+	idleTimeout                 time.Duration
+	releaseTimeout              time.Duration
+	skipUnknownCommands         bool
+	strictCommands              bool
+	allowedCommandElements      string
+	packCommandAndData          bool
+	tlsConfig                   *tls.Config // Compared by identity.
+	socketOptions               SocketOptions
+
+	// Set if the association may be reused at all. See AssociationPool.
+	reusable bool
+}
+
+type pooledAssociation struct {
+	su    *ServiceUser
+	timer *time.Timer // Releases su once it has been idle for too long.
+}
+
+// NewAssociationPool creates an empty pool. Associations left unused in the
+// pool for idleTimeout are released; if zero, DefaultPoolIdleTimeout is used.
+// New associations are dialed as by DialServiceUser with the given retry
+// policy.
+func NewAssociationPool(idleTimeout time.Duration, retry RetryPolicy) *AssociationPool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultPoolIdleTimeout
+	}
+	return &AssociationPool{
+		idleTimeout: idleTimeout,
+		retry:       retry,
+		idle:        make(map[poolKey][]*pooledAssociation),
+		inUse:       make(map[*ServiceUser]poolKey),
+	}
+}
+
+func newPoolKey(params ServiceUserParams, serverAddr string) poolKey {
+	sorted := func(uids []string) string {
+		uids = append([]string(nil), uids...)
+		sort.Strings(uids)
+		return strings.Join(uids, "\\")
+	}
+	var contexts []string
+	for _, c := range params.ProposedContexts {
+		contexts = append(contexts, c.SOPClassUID+":"+strings.Join(c.TransferSyntaxes, ","))
+	}
+	var extended, commonExtended []string
+	for uid, info := range params.ExtendedNegotiation {
+		extended = append(extended, fmt.Sprintf("%s=%x", uid, info))
+	}
+	for uid, c := range params.CommonExtendedNegotiation {
+		commonExtended = append(commonExtended, uid+"="+c.ServiceClassUID+":"+sorted(c.RelatedGeneralSOPClassUIDs))
+	}
+	var userIdentity string
+	if id := params.UserIdentity; id != nil {
+		userIdentity = fmt.Sprintf("%d:%x:%x:%v", id.Type, id.PrimaryField, id.SecondaryField, id.PositiveResponseRequested)
+	}
+	return poolKey{
+		serverAddr:       serverAddr,
+		calledAETitle:    params.CalledAETitle,
+		callingAETitle:   params.CallingAETitle,
+		sopClasses:       sorted(params.SOPClasses),
+		transferSyntaxes: sorted(params.TransferSyntaxes),
+		proposedContexts: strings.Join(contexts, "\\"),
+
+		undecodableTransferSyntaxes: sorted(params.UndecodableTransferSyntaxes),
+		scpRoleSOPClasses:           sorted(params.SCPRoleSOPClasses),
+		extendedNegotiation:         sorted(extended),
+		commonExtendedNegotiation:   sorted(commonExtended),
+		maxOperationsInvoked:        params.MaxOperationsInvoked,
+		maxOperationsPerformed:      params.MaxOperationsPerformed,
+		priority:                    params.Priority,
+		userIdentity:                userIdentity,
+		implementationClassUID:      params.ImplementationClassUID,
+		implementationVersionName:   params.ImplementationVersionName,
+		readTimeout:                 params.ReadTimeout,
+		writeTimeout:                params.WriteTimeout,
+		idleTimeout:                 params.IdleTimeout,
+		releaseTimeout:              params.ReleaseTimeout,
+		skipUnknownCommands:         params.SkipUnknownCommands,
+		strictCommands:              params.StrictCommands,
+		allowedCommandElements:      fmt.Sprint(params.AllowedCommandElements),
+		packCommandAndData:          params.PackCommandAndData,
+		tlsConfig:                   params.TLSConfig,
+		socketOptions:               params.SocketOptions,
+		reusable:                    params.Dialer == nil,
+	}
+}
+
+// Get returns an established association to the server at the given
+// "host:port". It reuses an idle association opened with the same parameters
+// if there's one that's still active, and dials a new one otherwise. The
+// caller must hand the association back with Put once done with it, and must
+// not call Release on it.
+func (p *AssociationPool) Get(params ServiceUserParams, serverAddr string) (*ServiceUser, error) {
+	key := newPoolKey(params, serverAddr)
+	p.mu.Lock()
+	for key.reusable && len(p.idle[key]) > 0 {
+		n := len(p.idle[key])
+		pa := p.idle[key][n-1]
+		p.idle[key] = p.idle[key][:n-1]
+		pa.timer.Stop()
+		if !pa.su.active() {
+			// The peer released or aborted it while it was idle.
+			dicomlog.Vprintf(1, "dicom.AssociationPool(%s): Dropping closed association %s", serverAddr, pa.su.label)
+			continue
+		}
+		p.inUse[pa.su] = key
+		p.mu.Unlock()
+		return pa.su, nil
+	}
+	p.mu.Unlock()
+
+	// The params are copied, so that changes made by the caller afterwards
+	// don't alter the key.
+	params.SOPClasses = append([]string(nil), params.SOPClasses...)
+	params.TransferSyntaxes = append([]string(nil), params.TransferSyntaxes...)
+	params.ProposedContexts = append([]ProposedContext(nil), params.ProposedContexts...)
+	for i, c := range params.ProposedContexts {
+		params.ProposedContexts[i].TransferSyntaxes = append([]string(nil), c.TransferSyntaxes...)
+	}
+	su, err := DialServiceUser(context.Background(), params, serverAddr, p.retry)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.inUse[su] = key
+	p.mu.Unlock()
+	return su, nil
+}
+
+// Put hands back an association obtained from Get. It's kept in the pool for
+// reuse unless it's no longer active, e.g., because the peer aborted it, or it
+// can't be reused, e.g., because it was dialed with a custom Dialer.
+func (p *AssociationPool) Put(su *ServiceUser) {
+	p.mu.Lock()
+	key, ok := p.inUse[su]
+	if !ok {
+		p.mu.Unlock()
+		panic("dicom.AssociationPool: Put called with an association not obtained from Get")
+	}
+	delete(p.inUse, su)
+	if p.closed || !key.reusable || !su.active() {
+		p.mu.Unlock()
+		su.Release()
+		return
+	}
+	pa := &pooledAssociation{su: su}
+	pa.timer = time.AfterFunc(p.idleTimeout, func() { p.expire(key, pa) })
+	p.idle[key] = append(p.idle[key], pa)
+	p.mu.Unlock()
+}
+
+// Removes "pa" from the pool and releases it, unless Get took it in the
+// meantime.
+func (p *AssociationPool) expire(key poolKey, pa *pooledAssociation) {
+	p.mu.Lock()
+	found := false
+	for i, v := range p.idle[key] {
+		if v == pa {
+			p.idle[key] = append(p.idle[key][:i], p.idle[key][i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+	p.mu.Unlock()
+	if found {
+		dicomlog.Vprintf(1, "dicom.AssociationPool(%s): Releasing idle association %s", key.serverAddr, pa.su.label)
+		pa.su.Release()
+	}
+}
+
+// Close releases the idle associations. Associations in use are released
+// when they're handed back with Put.
+func (p *AssociationPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = make(map[poolKey][]*pooledAssociation)
+	p.mu.Unlock()
+	for _, pas := range idle {
+		for _, pa := range pas {
+			pa.timer.Stop()
+			pa.su.Release()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package netdicom
+
+// This file implements decoding received objects for bridges to other
+// protocols, e.g., DICOMweb.
+
+import (
+	"fmt"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// ReceivedObject is a dataset received in a C-STORE request, e.g., by
+// CStoreCallback or a C-GET callback, along with the UIDs needed to file it,
+// e.g., in a DICOMweb (WADO/STOW-RS) store.
+type ReceivedObject struct {
+	SOPClassUID       string // Value of SOPClassUID (0008,0016).
+	SOPInstanceUID    string // Value of SOPInstanceUID (0008,0018).
+	TransferSyntaxUID string // Transfer syntax the data was encoded in.
+
+	// The decoded data. As with CStoreRequest.DataSet, it starts with the
+	// TransferSyntaxUID, MediaStorageSOPClassUID and
+	// MediaStorageSOPInstanceUID elements, so it can be written to a file
+	// as is.
+	DataSet *dicom.DataSet
+}
+
+// ParseReceivedObject decodes the data payload of a C-STORE request, encoded
+// in transferSyntaxUID, the transfer syntax negotiated for the request. The
+// SOP class and instance UIDs are taken from the dataset itself, so it returns
+// an error if it lacks SOPClassUID or SOPInstanceUID.
+func ParseReceivedObject(transferSyntaxUID string, data []byte) (*ReceivedObject, error) {
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return nil, fmt.Errorf("dicom.ParseReceivedObject: %w", err)
+	}
+	ds := &dicom.DataSet{Elements: elems}
+	var getString = func(tag dicomtag.Tag) (string, error) {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			return "", fmt.Errorf("dicom.ParseReceivedObject: data lacks %s: %w", tag.String(), err)
+		}
+		return elem.GetString()
+	}
+	sopClassUID, err := getString(dicomtag.SOPClassUID)
+	if err != nil {
+		return nil, err
+	}
+	sopInstanceUID, err := getString(dicomtag.SOPInstanceUID)
+	if err != nil {
+		return nil, err
+	}
+	ds.Elements = append([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+	}, elems...)
+	return &ReceivedObject{
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+		TransferSyntaxUID: transferSyntaxUID,
+		DataSet:           ds,
+	}, nil
+}
@@ -23,8 +23,6 @@ import (
 	"github.com/giesekow/go-netdicom"
 	"github.com/giesekow/go-netdicom/dimse"
 	"github.com/grailbio/go-dicom"
-	"github.com/grailbio/go-dicom/dicomio"
-	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 )
 
@@ -85,15 +83,7 @@ func (ss *server) onCStore(
 			out.Close()
 		}
 	}()
-	e := dicomio.NewEncoderWithTransferSyntax(out, transferSyntaxUID)
-	dicom.WriteFileHeader(e,
-		[]*dicom.Element{
-			dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
-			dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
-			dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
-		})
-	e.WriteBytes(data)
-	if err := e.Error(); err != nil {
+	if err := netdicom.WritePart10(out, transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
 		log.Printf("%s: write: %v", path, err)
 		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
 	}
@@ -2,9 +2,12 @@ package netdicom
 
 import (
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomlog"
 )
 
@@ -13,11 +16,28 @@ type serviceDispatcher struct {
 	label      string          // for logging.
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
 
+	// Closed by close, i.e., once the association is over.
+	done      chan struct{}
+	closeOnce sync.Once
+
 	mu sync.Mutex
 
-	// Set of active DIMSE commands running. Keys are message IDs.
+	// Set of active DIMSE commands running that were requested by the
+	// peer. Keys are message IDs.
 	activeCommands map[dimse.MessageID]*serviceCommandState // guarded by mu
 
+	// Set of DIMSE requests sent by this side that await responses. Keys
+	// are message IDs. The peer allocates message IDs independently, so the
+	// two sets may share keys.
+	outstandingRequests map[dimse.MessageID]*serviceCommandState // guarded by mu
+
+	// Message IDs of the abandoned requests whose final response didn't
+	// arrive within abandonTimeout. The responses that still arrive for
+	// them are discarded, and the IDs aren't reused until then.
+	expiredRequests map[dimse.MessageID]bool // guarded by mu
+	// How long to wait for the final response to an abandoned request.
+	abandonTimeout time.Duration
+
 	// A callback to be called when a dimse request message arrives. Keys
 	// are DIMSE CommandField. The callback typically creates a new command
 	// by calling findOrCreateCommand.
@@ -26,11 +46,51 @@ type serviceDispatcher struct {
 	// The last message ID used in newCommand(). Used to avoid creating duplicate
 	// IDs.
 	lastMessageID dimse.MessageID
+
+	// The number of requests from the peer whose callbacks may run at once,
+	// i.e., the asynchronous operations window this side performs; zero
+	// means unlimited. See setMaxHandlers.
+	maxHandlers int // guarded by mu
+	// The number of callbacks running, and the ones waiting for their turn,
+	// in arrival order.
+	numHandlers     int      // guarded by mu
+	pendingHandlers []func() // guarded by mu
 }
 
 type associationInfo struct {
 	CallingAETitle string
 	CalledAETitle  string
+
+	// The negotiated parameters. May be nil on the user side.
+	info *AssociationInfo
+
+	PeerImplementationClassUID    string
+	PeerImplementationVersionName string
+}
+
+func newAssociationInfo(event upcallEvent) associationInfo {
+	aInfo := associationInfo{CallingAETitle: event.CallingAETitle, CalledAETitle: event.CalledAETitle, info: event.info}
+	if event.cm != nil {
+		aInfo.PeerImplementationClassUID = event.cm.peerImplementationClassUID
+		aInfo.PeerImplementationVersionName = event.cm.peerImplementationVersionName
+	}
+	return aInfo
+}
+
+// Decodes the data payload of an upcallEventData event into a dataset, using
+// the transfer syntax negotiated for the event's presentation context. An event
+// without data yields an empty dataset.
+func (e *upcallEvent) dataSet() (*dicom.DataSet, error) {
+	doassert(e.eventType == upcallEventData)
+	_, transferSyntaxUID, err := e.cm.syntaxesByContextID(e.contextID)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := readElementsInBytes(e.data, transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	return &dicom.DataSet{Elements: elems}, nil
 }
 
 type serviceCallback func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo)
@@ -42,12 +102,36 @@ type serviceCommandState struct {
 	context   contextManagerEntry // Transfersyntax/sopclass for this command.
 	cm        *contextManager     // For looking up context -> transfersyntax/sopclass mappings
 
+	// Set if this side sent the request, i.e., the command was created by
+	// newCommand.
+	outgoing bool
+
+	// Set if the request was abandoned. See abandonCommand. Guarded by
+	// disp.mu.
+	abandoned bool
+
+	// The file that the data payload of the request was spooled to, if
+	// any. See ServiceProviderParams.CStoreFile. It is removed once the
+	// callback returns.
+	dataPath string
+
+	// The event that delivered the request, if it came from the peer. Its
+	// data payload is decoded with request.dataSet().
+	request upcallEvent
+
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
 func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
+	cs.sendMessageNotify(cmd, data)
+}
+
+// Like sendMessage, but returns a channel that is closed once the message is
+// written to the connection, or failed to be. The channel may stay open if
+// the association ends first; see serviceDispatcher.done.
+func (cs *serviceCommandState) sendMessageNotify(cmd dimse.Message, data []byte) <-chan struct{} {
 	if s := cmd.GetStatus(); s != nil && s.Status != dimse.StatusSuccess && s.Status != dimse.StatusPending {
 		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Sending DIMSE error: %v %v", cs.disp.label, cmd, cs.disp)
 	} else {
@@ -57,6 +141,7 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 		abstractSyntaxName: cs.context.abstractSyntaxUID,
 		command:            cmd,
 		data:               data,
+		sent:               make(chan struct{}),
 	}
 	cs.disp.downcallCh <- stateEvent{
 		event:        evt09,
@@ -64,6 +149,33 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 		conn:         nil,
 		dimsePayload: payload,
 	}
+	return payload.sent
+}
+
+// Watches for a C-CANCEL from the peer for the request that "cs" runs. The
+// returned channel is closed when it arrives. Call stop once the request is
+// done.
+func (cs *serviceCommandState) watchCancel() (canceled <-chan struct{}, stop func()) {
+	canceledCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case event, ok := <-cs.upcallCh:
+				if !ok {
+					return
+				}
+				if _, ok := event.command.(*dimse.CCancelRq); ok {
+					dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Command %v canceled by peer", cs.disp.label, cs.messageID)
+					close(canceledCh)
+					return
+				}
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	return canceledCh, func() { close(doneCh) }
 }
 
 func (disp *serviceDispatcher) findOrCreateCommand(
@@ -95,7 +207,10 @@ func (disp *serviceDispatcher) newCommand(
 	defer disp.mu.Unlock()
 
 	for msgID := disp.lastMessageID + 1; msgID != disp.lastMessageID; msgID++ {
-		if _, ok := disp.activeCommands[msgID]; ok {
+		if _, ok := disp.outstandingRequests[msgID]; ok {
+			continue
+		}
+		if disp.expiredRequests[msgID] {
 			continue
 		}
 
@@ -104,9 +219,10 @@ func (disp *serviceDispatcher) newCommand(
 			messageID: msgID,
 			cm:        cm,
 			context:   context,
+			outgoing:  true,
 			upcallCh:  make(chan upcallEvent, 128),
 		}
-		disp.activeCommands[msgID] = cs
+		disp.outstandingRequests[msgID] = cs
 		disp.lastMessageID = msgID
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher: Start new command %+v", cs)
 		return cs, nil
@@ -116,12 +232,110 @@ func (disp *serviceDispatcher) newCommand(
 
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
-	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
-	if _, ok := disp.activeCommands[cs.messageID]; !ok {
+	if cs.abandoned {
+		// The command is deleted once the final response arrives.
+		disp.mu.Unlock()
+		return
+	}
+	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish command %v", disp.label, cs.messageID)
+	commands := disp.activeCommands
+	if cs.outgoing {
+		commands = disp.outstandingRequests
+	}
+	if _, ok := commands[cs.messageID]; !ok {
 		panic(fmt.Sprintf("cs %+v", cs))
 	}
-	delete(disp.activeCommands, cs.messageID)
+	delete(commands, cs.messageID)
+	disp.mu.Unlock()
+}
+
+// Abandons the request sent by "cs", e.g., because the caller stopped waiting
+// for the response. The command stays registered until the final response
+// arrives, so that the responses the peer sends in the meantime are discarded
+// rather than treated as unexpected, which would abort the association.
+// deleteCommand is a no-op for an abandoned command.
+//
+// If the final response doesn't arrive within abandonTimeout, e.g., because
+// the peer ignores C-CANCEL, the command is deleted anyway, and the message ID
+// is recorded in expiredRequests.
+func (disp *serviceDispatcher) abandonCommand(cs *serviceCommandState) {
+	doassert(cs.outgoing)
+	disp.mu.Lock()
+	cs.abandoned = true
 	disp.mu.Unlock()
+	go func() {
+		timer := time.NewTimer(disp.abandonTimeout)
+		defer timer.Stop()
+		expired := false
+	loop:
+		for {
+			select {
+			case event, ok := <-cs.upcallCh:
+				if !ok {
+					break loop
+				}
+				removeSpoolFile(event.dataPath)
+				if s := event.command.GetStatus(); s != nil && !s.Status.IsPending() {
+					break loop
+				}
+			case <-timer.C:
+				expired = true
+				break loop
+			}
+		}
+		disp.mu.Lock()
+		if expired {
+			dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): No final response to abandoned command %v after %v",
+				disp.label, cs.messageID, disp.abandonTimeout)
+			disp.expiredRequests[cs.messageID] = true
+		} else {
+			dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish abandoned command %v", disp.label, cs.messageID)
+		}
+		delete(disp.outstandingRequests, cs.messageID)
+		disp.mu.Unlock()
+	}()
+}
+
+// Delivers a response from the peer to the command that sent the matching
+// request. Returns an error if no request with the message ID is outstanding.
+func (disp *serviceDispatcher) handleResponse(event upcallEvent) error {
+	messageID := event.command.GetMessageID()
+	disp.mu.Lock()
+	cs, ok := disp.outstandingRequests[messageID]
+	expired := disp.expiredRequests[messageID]
+	if expired && !event.command.GetStatus().Status.IsPending() {
+		delete(disp.expiredRequests, messageID)
+	}
+	disp.mu.Unlock()
+	if !ok && expired {
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Discarding late response to abandoned command %v", disp.label, messageID)
+		removeSpoolFile(event.dataPath)
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("dicom.serviceDispatcher(%s): Received %v for message ID %d, which has no outstanding request",
+			disp.label, event.command, messageID)
+	}
+	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding response to command: %+v %+v", disp.label, event.command, cs)
+	cs.upcallCh <- event
+	return nil
+}
+
+// Delivers a C-CANCEL from the peer to the command running the request it
+// cancels. The command may ignore it. A C-CANCEL for a request that has already
+// completed is dropped (P3.7 9.3.2.3).
+func (disp *serviceDispatcher) handleCancel(event upcallEvent) {
+	messageID := event.command.GetMessageID()
+	disp.mu.Lock()
+	cs, ok := disp.activeCommands[messageID]
+	disp.mu.Unlock()
+	if !ok {
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Ignoring %v for message ID %d, which is not running",
+			disp.label, event.command, messageID)
+		return
+	}
+	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding cancel to command: %+v", disp.label, cs)
+	cs.upcallCh <- event
 }
 
 func (disp *serviceDispatcher) registerCallback(commandField uint16, cb serviceCallback) {
@@ -144,7 +358,7 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 				event.command,
 				event.data,
 				nil,
-				associationInfo{CallingAETitle: event.CallingAETitle, CalledAETitle: event.CalledAETitle},
+				newAssociationInfo(event),
 			)
 		}()
 		return
@@ -154,12 +368,28 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	context, err := event.cm.lookupByContextID(event.contextID)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Invalid context ID %d: %v", disp.label, event.contextID, err)
+		removeSpoolFile(event.dataPath)
 		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
+	if event.command.GetStatus() != nil {
+		if err := disp.handleResponse(event); err != nil {
+			dicomlog.Vprintf(0, "%v", err)
+			disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+		}
+		return
+	}
 	messageID := event.command.GetMessageID()
+	if _, ok := event.command.(*dimse.CCancelRq); ok {
+		disp.handleCancel(event)
+		return
+	}
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
 	if found {
+		if event.command.GetCommandDataSetType() != dimse.CommandDataSetTypeNull {
+			// The running command already has its data; drop this one's.
+			removeSpoolFile(event.dataPath)
+		}
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
 		dc.upcallCh <- event
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Done forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
@@ -168,33 +398,131 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
-	go func() {
+	if cb == nil {
+		// E.g., an N-EVENT-REPORT sent to a provider, or a C-STORE sent
+		// to a user outside C-GET. The peer isn't following the roles
+		// negotiated for the association.
+		err := fmt.Errorf("dicom.serviceDispatcher(%s): Received %v, which this side doesn't handle", disp.label, event.command)
+		dicomlog.Vprintf(0, "%v", err)
+		removeSpoolFile(event.dataPath)
+		disp.deleteCommand(dc)
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+		return
+	}
+	dc.dataPath = event.dataPath
+	dc.request = event
+	err = disp.startHandler(func() {
 		cb(
 			event.command,
 			event.data,
 			dc,
-			associationInfo{CallingAETitle: event.CallingAETitle, CalledAETitle: event.CalledAETitle},
+			associationInfo{CallingAETitle: event.CallingAETitle, CalledAETitle: event.CalledAETitle, info: event.info},
 		)
+		removeSpoolFile(dc.dataPath)
+		disp.deleteCommand(dc)
+	})
+	if err != nil {
+		dicomlog.Vprintf(0, "%v", err)
+		removeSpoolFile(dc.dataPath)
 		disp.deleteCommand(dc)
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+	}
+}
+
+// Sets the number of requests from the peer whose callbacks may run at once
+// to the asynchronous operations window negotiated for this side (P3.7
+// D.3.3.3); zero means unlimited. It is 1 until set, i.e., requests are
+// handled one at a time unless the peer negotiated asynchronous operations.
+func (disp *serviceDispatcher) setMaxHandlers(n int) {
+	disp.mu.Lock()
+	disp.maxHandlers = n
+	disp.mu.Unlock()
+}
+
+// Runs "handler", the callback for a request from the peer, in a goroutine of
+// its own, so that a slow callback, e.g., a C-STORE writing to a slow disk,
+// doesn't hold up handleEvent, and with it the state machine reading PDUs off
+// the connection. If maxHandlers callbacks are running already, handler is
+// queued until one finishes. Handlers run in the order the requests arrived.
+// Their responses are serialized by the state machine, which sends the PDUs
+// one at a time.
+//
+// A callback frees its slot only after its response is queued, so a peer
+// that keeps within the window may send its next request before that. Up to
+// maxHandlers requests are thus queued; a peer with more requests
+// outstanding ignores the negotiated window, and startHandler fails instead
+// of queueing them without bound.
+func (disp *serviceDispatcher) startHandler(handler func()) error {
+	disp.mu.Lock()
+	if disp.maxHandlers > 0 && disp.numHandlers >= disp.maxHandlers {
+		if len(disp.pendingHandlers) >= disp.maxHandlers {
+			disp.mu.Unlock()
+			return fmt.Errorf("dicom.serviceDispatcher(%s): Peer exceeded the asynchronous operations window of %d requests",
+				disp.label, disp.maxHandlers)
+		}
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): %d requests running; queueing the request", disp.label, disp.numHandlers)
+		disp.pendingHandlers = append(disp.pendingHandlers, handler)
+		disp.mu.Unlock()
+		return nil
+	}
+	disp.numHandlers++
+	disp.mu.Unlock()
+	go func() {
+		for handler != nil {
+			handler()
+			disp.mu.Lock()
+			handler = nil
+			if len(disp.pendingHandlers) > 0 {
+				handler = disp.pendingHandlers[0]
+				disp.pendingHandlers = disp.pendingHandlers[1:]
+			} else {
+				disp.numHandlers--
+			}
+			disp.mu.Unlock()
+		}
 	}()
+	return nil
 }
 
 // Must be called exactly once to shut down the dispatcher.
 func (disp *serviceDispatcher) close() {
+	disp.closeOnce.Do(func() { close(disp.done) })
 	disp.mu.Lock()
 	for _, cs := range disp.activeCommands {
 		close(cs.upcallCh)
 	}
+	for _, cs := range disp.outstandingRequests {
+		close(cs.upcallCh)
+	}
 	disp.mu.Unlock()
 	// TODO(saito): prevent new command from launching.
 }
 
+// The default serviceDispatcher.abandonTimeout.
+const defaultAbandonTimeout = time.Minute
+
 func newServiceDispatcher(label string) *serviceDispatcher {
 	return &serviceDispatcher{
-		label:          label,
-		downcallCh:     make(chan stateEvent, 128),
-		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
-		callbacks:      make(map[uint16]serviceCallback),
-		lastMessageID:  123,
+		label:               label,
+		downcallCh:          make(chan stateEvent, 128),
+		done:                make(chan struct{}),
+		activeCommands:      make(map[dimse.MessageID]*serviceCommandState),
+		outstandingRequests: make(map[dimse.MessageID]*serviceCommandState),
+		expiredRequests:     make(map[dimse.MessageID]bool),
+		abandonTimeout:      defaultAbandonTimeout,
+		callbacks:           make(map[uint16]serviceCallback),
+		lastMessageID:       123,
+		maxHandlers:         1,
+	}
+}
+
+// Removes a spool file. It is a no-op if path is empty or the file is gone,
+// e.g., because a handler renamed it.
+func removeSpoolFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		dicomlog.Vprintf(0, "dicom.serviceDispatcher: Failed to remove spool file %s: %v", path, err)
 	}
 }
@@ -0,0 +1,330 @@
+package netdicom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceDispatcherCorrelatesResponses(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{&pdu_item.PresentationContextItem{
+		Type:      pdu_item.ItemTypePresentationContextResponse,
+		ContextID: 1,
+		Result:    pdu_item.PresentationContextAccepted,
+		Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian}},
+	}}))
+	context, err := cm.lookupByAbstractSyntaxUID(dicomuid.StudyRootQRFind)
+	require.NoError(t, err)
+
+	disp := newServiceDispatcher("test")
+	find1, err := disp.newCommand(cm, context)
+	require.NoError(t, err)
+	find2, err := disp.newCommand(cm, context)
+	require.NoError(t, err)
+	require.NotEqual(t, find1.messageID, find2.messageID)
+
+	response := func(messageID dimse.MessageID, status dimse.StatusCode) upcallEvent {
+		return upcallEvent{
+			eventType: upcallEventData,
+			cm:        cm,
+			contextID: context.contextID,
+			command: &dimse.CFindRsp{
+				AffectedSOPClassUID:       dicomuid.StudyRootQRFind,
+				MessageIDBeingRespondedTo: messageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Status{Status: status},
+			},
+		}
+	}
+	// Two C-FINDs whose responses interleave.
+	for _, event := range []upcallEvent{
+		response(find1.messageID, dimse.StatusPending),
+		response(find2.messageID, dimse.StatusPending),
+		response(find2.messageID, dimse.StatusSuccess),
+		response(find1.messageID, dimse.StatusPending),
+		response(find1.messageID, dimse.StatusSuccess),
+	} {
+		disp.handleEvent(event)
+	}
+	receive := func(cs *serviceCommandState) []dimse.StatusCode {
+		var statuses []dimse.StatusCode
+		for {
+			select {
+			case event := <-cs.upcallCh:
+				require.Equal(t, cs.messageID, event.command.GetMessageID())
+				statuses = append(statuses, event.command.GetStatus().Status)
+			default:
+				return statuses
+			}
+		}
+	}
+	require.Equal(t, []dimse.StatusCode{dimse.StatusPending, dimse.StatusPending, dimse.StatusSuccess}, receive(find1))
+	require.Equal(t, []dimse.StatusCode{dimse.StatusPending, dimse.StatusSuccess}, receive(find2))
+
+	// A request from the peer that reuses an outstanding message ID is a new
+	// command, not a response.
+	requests := make(chan dimse.MessageID, 1)
+	disp.registerCallback(dimse.CommandFieldCFindRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			requests <- cs.messageID
+		})
+	disp.handleEvent(upcallEvent{
+		eventType: upcallEventData,
+		cm:        cm,
+		contextID: context.contextID,
+		command: &dimse.CFindRq{
+			AffectedSOPClassUID: dicomuid.StudyRootQRFind,
+			MessageID:           find1.messageID,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		},
+	})
+	require.Equal(t, find1.messageID, <-requests)
+	require.Empty(t, receive(find1))
+
+	// A response without an outstanding request aborts the association.
+	disp.deleteCommand(find2)
+	disp.handleEvent(response(find2.messageID, dimse.StatusSuccess))
+	event := <-disp.downcallCh
+	require.Equal(t, evt19, event.event)
+	require.Contains(t, event.err.Error(), "no outstanding request")
+}
+
+func TestUpcallEventDataSetExplicitVRBigEndian(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind},
+		TransferSyntaxes: []string{dicomuid.ExplicitVRBigEndian},
+	})
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{&pdu_item.PresentationContextItem{
+		Type:      pdu_item.ItemTypePresentationContextResponse,
+		ContextID: 1,
+		Result:    pdu_item.PresentationContextAccepted,
+		Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ExplicitVRBigEndian}},
+	}}))
+
+	data := []byte{
+		0x00, 0x10, 0x00, 0x10, 'P', 'N', 0x00, 0x08, 'D', 'O', 'E', '^', 'J', 'O', 'H', 'N', // PatientName
+		0x00, 0x28, 0x00, 0x10, 'U', 'S', 0x00, 0x02, 0x02, 0x00, // Rows = 512
+	}
+	event := upcallEvent{
+		eventType: upcallEventData,
+		cm:        cm,
+		contextID: 1,
+		command:   &dimse.CFindRq{CommandDataSetType: dimse.CommandDataSetTypeNonNull},
+		data:      data,
+	}
+	ds, err := event.dataSet()
+	require.NoError(t, err)
+	require.Len(t, ds.Elements, 2)
+	require.Equal(t, dicomtag.PatientName, ds.Elements[0].Tag)
+	require.Equal(t, "DOE^JOHN", ds.Elements[0].MustGetString())
+	require.Equal(t, dicomtag.Rows, ds.Elements[1].Tag)
+	require.Equal(t, uint16(512), ds.Elements[1].MustGetUInt16())
+
+	encoded, err := writeElementsToBytes(ds.Elements, dicomuid.ExplicitVRBigEndian)
+	require.NoError(t, err)
+	require.Equal(t, data, encoded)
+}
+
+func TestServiceDispatcherCancel(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{&pdu_item.PresentationContextItem{
+		Type:      pdu_item.ItemTypePresentationContextResponse,
+		ContextID: 1,
+		Result:    pdu_item.PresentationContextAccepted,
+		Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian}},
+	}}))
+	context, err := cm.lookupByAbstractSyntaxUID(dicomuid.StudyRootQRFind)
+	require.NoError(t, err)
+	newEvent := func(command dimse.Message) upcallEvent {
+		return upcallEvent{eventType: upcallEventData, cm: cm, contextID: context.contextID, command: command}
+	}
+	response := func(messageID dimse.MessageID, status dimse.StatusCode) upcallEvent {
+		return newEvent(&dimse.CFindRsp{
+			AffectedSOPClassUID:       dicomuid.StudyRootQRFind,
+			MessageIDBeingRespondedTo: messageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: status},
+		})
+	}
+	disp := newServiceDispatcher("test")
+
+	// The responses to an abandoned request are discarded until the final
+	// one, after which the message ID is free.
+	find, err := disp.newCommand(cm, context)
+	require.NoError(t, err)
+	disp.abandonCommand(find)
+	disp.deleteCommand(find)
+	disp.handleEvent(response(find.messageID, dimse.StatusPending))
+	disp.handleEvent(response(find.messageID, dimse.StatusCancel))
+	require.Eventually(t, func() bool {
+		disp.mu.Lock()
+		defer disp.mu.Unlock()
+		return len(disp.outstandingRequests) == 0
+	}, 10*time.Second, time.Millisecond)
+	require.Empty(t, disp.downcallCh)
+
+	// An abandoned request whose final response doesn't arrive in time is
+	// deleted anyway. Its message ID isn't reused, and the late responses
+	// are still discarded.
+	disp.abandonTimeout = time.Millisecond
+	find, err = disp.newCommand(cm, context)
+	require.NoError(t, err)
+	disp.abandonCommand(find)
+	require.Eventually(t, func() bool {
+		disp.mu.Lock()
+		defer disp.mu.Unlock()
+		return len(disp.outstandingRequests) == 0
+	}, 10*time.Second, time.Millisecond)
+	next, err := disp.newCommand(cm, context)
+	require.NoError(t, err)
+	require.NotEqual(t, find.messageID, next.messageID)
+	disp.deleteCommand(next)
+	disp.handleEvent(response(find.messageID, dimse.StatusPending))
+	disp.handleEvent(response(find.messageID, dimse.StatusCancel))
+	require.Empty(t, disp.downcallCh)
+	disp.mu.Lock()
+	require.Empty(t, disp.expiredRequests)
+	disp.mu.Unlock()
+
+	// C-CANCEL from the peer is delivered to the command it cancels.
+	started := make(chan *serviceCommandState)
+	done := make(chan dimse.Message)
+	disp.registerCallback(dimse.CommandFieldCFindRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			started <- cs
+			done <- (<-cs.upcallCh).command
+		})
+	disp.handleEvent(newEvent(&dimse.CFindRq{
+		AffectedSOPClassUID: dicomuid.StudyRootQRFind,
+		MessageID:           7,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}))
+	<-started
+	cancel := &dimse.CCancelRq{MessageIDBeingRespondedTo: 7, CommandDataSetType: dimse.CommandDataSetTypeNull}
+	disp.handleEvent(newEvent(cancel))
+	require.Equal(t, cancel, <-done)
+
+	// C-CANCEL for a request that isn't running is ignored.
+	disp.handleEvent(newEvent(&dimse.CCancelRq{MessageIDBeingRespondedTo: 8, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+	require.Empty(t, disp.downcallCh)
+}
+
+func TestServiceDispatcherSlowHandler(t *testing.T) {
+	cm := newContextManager("test")
+	cm.generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, cm.onAssociateResponse([]pdu_item.SubItem{&pdu_item.PresentationContextItem{
+		Type:      pdu_item.ItemTypePresentationContextResponse,
+		ContextID: 1,
+		Result:    pdu_item.PresentationContextAccepted,
+		Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian}},
+	}}))
+	context, err := cm.lookupByAbstractSyntaxUID(dicomuid.StudyRootQRFind)
+	require.NoError(t, err)
+	newEvent := func(command dimse.Message) upcallEvent {
+		return upcallEvent{eventType: upcallEventData, cm: cm, contextID: context.contextID, command: command}
+	}
+	request := func(messageID dimse.MessageID) upcallEvent {
+		return newEvent(&dimse.CFindRq{
+			AffectedSOPClassUID: dicomuid.StudyRootQRFind,
+			MessageID:           messageID,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		})
+	}
+	disp := newServiceDispatcher("test")
+	// handleEvent runs in the goroutine reading PDUs, so it must not wait
+	// for the callbacks.
+	handle := func(event upcallEvent) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			disp.handleEvent(event)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("handleEvent(%v) blocked on a slow callback", event.command)
+		}
+	}
+	started := make(chan dimse.MessageID, 10)
+	finish := make(chan struct{})
+	disp.registerCallback(dimse.CommandFieldCFindRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			started <- cs.messageID
+			<-finish
+		})
+	requireStarted := func(want ...dimse.MessageID) {
+		var got []dimse.MessageID
+		for range want {
+			select {
+			case id := <-started:
+				got = append(got, id)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("callbacks %v started, want %v", got, want)
+			}
+		}
+		require.ElementsMatch(t, want, got)
+		select {
+		case id := <-started:
+			t.Fatalf("callback for request %d started too early", id)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Without asynchronous operations, the requests are handled one at a
+	// time, in order.
+	handle(request(1))
+	handle(request(2))
+	requireStarted(1)
+
+	// Responses to this side's requests still get through meanwhile.
+	find, err := disp.newCommand(cm, context)
+	require.NoError(t, err)
+	handle(newEvent(&dimse.CFindRsp{
+		AffectedSOPClassUID:       dicomuid.StudyRootQRFind,
+		MessageIDBeingRespondedTo: find.messageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Status{Status: dimse.StatusSuccess},
+	}))
+	require.Equal(t, find.messageID, (<-find.upcallCh).command.GetMessageID())
+	disp.deleteCommand(find)
+
+	// One request running and one queued: a third one exceeds the window
+	// by more than the slack given to the peer, which aborts the
+	// association.
+	handle(request(3))
+	event := <-disp.downcallCh
+	require.Equal(t, evt19, event.event)
+	require.ErrorContains(t, event.err, "asynchronous operations window")
+	finish <- struct{}{}
+	requireStarted(2)
+	finish <- struct{}{}
+
+	// With a window of two, two requests are handled at once.
+	disp.setMaxHandlers(2)
+	handle(request(4))
+	handle(request(5))
+	handle(request(6))
+	requireStarted(4, 5)
+	finish <- struct{}{}
+	requireStarted(6)
+	close(finish)
+	require.Empty(t, disp.downcallCh)
+}
@@ -3,16 +3,24 @@
 package netdicom
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/giesekow/go-netdicom/commandset"
 	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
 	"github.com/giesekow/go-netdicom/sopclass"
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
 )
 
 // CMoveResult is an object streamed by CMove implementation.
@@ -24,13 +32,46 @@ type CMoveResult struct {
 }
 
 func handleCStore(
-	cb CStoreCallback,
+	params ServiceProviderParams,
 	connState ConnectionState,
 	c *dimse.CStoreRq, data []byte,
 	cs *serviceCommandState) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
-	if cb != nil {
-		status = cb(
+	handler := params.CStoreHandlers[c.AffectedSOPClassUID]
+	if handler == nil {
+		handler = params.DefaultCStoreHandler
+	}
+	if params.CStoreFile != nil {
+		if cs.dataPath == "" {
+			// The request carries no data.
+			status = dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: "C-STORE data was not spooled"}
+		} else {
+			status = params.CStoreFile(
+				connState,
+				cs.context.transferSyntaxUID,
+				c.AffectedSOPClassUID,
+				c.AffectedSOPInstanceUID,
+				cs.dataPath)
+		}
+	} else if handler != nil {
+		ds, err := decodeCStoreDataSet(cs.context.transferSyntaxUID, c, data)
+		if err != nil {
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-STORE: Failed to decode %v: %v", c.AffectedSOPInstanceUID, err)
+			status = dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+		} else {
+			status = handler(&CStoreRequest{
+				Conn:                    connState,
+				SOPClassUID:             c.AffectedSOPClassUID,
+				SOPInstanceUID:          c.AffectedSOPInstanceUID,
+				TransferSyntaxUID:       cs.context.transferSyntaxUID,
+				Priority:                c.Priority,
+				MoveOriginatorAETitle:   c.MoveOriginatorApplicationEntityTitle,
+				MoveOriginatorMessageID: c.MoveOriginatorMessageID,
+				DataSet:                 ds,
+			})
+		}
+	} else if params.CStore != nil {
+		status = params.CStore(
 			connState,
 			cs.context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
@@ -61,8 +102,18 @@ func handleAssocRQ(
 func handleCFind(
 	params ServiceProviderParams,
 	connState ConnectionState,
-	c *dimse.CFindRq, data []byte,
+	c *dimse.CFindRq,
 	cs *serviceCommandState) {
+	if handler := params.CFindRequestHandlers[c.AffectedSOPClassUID]; handler != nil {
+		runCFindHandler(handler, connState, c, cs)
+		return
+	}
+	if handler := params.CFindHandlers[c.AffectedSOPClassUID]; handler != nil {
+		runCFindHandler(func(req *CFindRequest, emit func(match *dicom.DataSet) error) dimse.Status {
+			return handler(req.Query, emit)
+		}, connState, c, cs)
+		return
+	}
 	if params.CFind == nil {
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -72,7 +123,7 @@ func handleCFind(
 		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	ds, err := cs.request.dataSet()
 	if err != nil {
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -82,14 +133,28 @@ func handleCFind(
 		}, nil)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RQ payload: %s", elementsString(elems))
+	dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RQ payload: %s", elementsString(ds.Elements))
 
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
 	go func() {
-		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, ds.Elements, responseCh)
 	}()
-	for resp := range responseCh {
+	canceled, stopWatching := cs.watchCancel()
+	defer stopWatching()
+loop:
+	for {
+		var resp CFindResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-canceled:
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -98,7 +163,7 @@ func handleCFind(
 			break
 		}
 		dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RSP: %s", elementsString(resp.Elements))
-		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
+		payload, err := EncodeIdentifier(&dicom.DataSet{Elements: resp.Elements}, cs.context.transferSyntaxUID)
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-FIND: encode error %v", err)
 			status = dimse.Status{
@@ -124,10 +189,99 @@ func handleCFind(
 	}
 }
 
+// ErrCFindCanceled is returned by the emit function of a CFindHandler once the
+// client cancels the request with C-CANCEL.
+var ErrCFindCanceled = errors.New("C-FIND canceled")
+
+// Answers C-FIND request "c" by running "handler". Each match is sent as a
+// pending response, and the status returned by the handler as the final one.
+func runCFindHandler(
+	handler CFindRequestHandler,
+	connState ConnectionState,
+	c *dimse.CFindRq,
+	cs *serviceCommandState) {
+	respond := func(status dimse.Status, payload []byte) <-chan struct{} {
+		dataSetType := dimse.CommandDataSetTypeNull
+		if payload != nil {
+			dataSetType = dimse.CommandDataSetTypeNonNull
+		}
+		return cs.sendMessageNotify(&dimse.CFindRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			Status:                    status,
+		}, payload)
+	}
+	query, err := cs.request.dataSet()
+	if err != nil {
+		respond(dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: err.Error()}, nil)
+		return
+	}
+	canceled, stopWatching := cs.watchCancel()
+	defer stopWatching()
+	// Closed once the previous match is written to the connection.
+	var sent <-chan struct{}
+	// Set once emit fails. stopStatus is then the final status of the
+	// request, whatever the handler returns.
+	var stopErr error
+	var stopStatus dimse.Status
+	stop := func(status dimse.Status, err error) error {
+		stopStatus, stopErr = status, err
+		return err
+	}
+	emit := func(match *dicom.DataSet) error {
+		if stopErr != nil {
+			return stopErr
+		}
+		if sent != nil {
+			// Apply backpressure: don't queue up matches faster than
+			// the client reads them.
+			select {
+			case <-sent:
+			case <-canceled:
+			case <-cs.disp.done:
+				return stop(dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: "association closed"},
+					errors.New("dicom.serviceProvider: C-FIND: association closed"))
+			}
+		}
+		select {
+		case <-canceled:
+			return stop(dimse.Status{Status: dimse.StatusCancel}, ErrCFindCanceled)
+		default:
+		}
+		payload, err := EncodeIdentifier(match, cs.context.transferSyntaxUID)
+		if err != nil {
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-FIND: encode error %v", err)
+			return stop(dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: err.Error()},
+				fmt.Errorf("dicom.serviceProvider: C-FIND: failed to encode match: %w", err))
+		}
+		sent = respond(dimse.Status{Status: dimse.StatusPending}, payload)
+		return nil
+	}
+	status := handler(&CFindRequest{
+		Conn:        connState,
+		SOPClassUID: c.AffectedSOPClassUID,
+		Priority:    c.Priority,
+		Query:       query,
+	}, emit)
+	if stopErr != nil {
+		status = stopStatus
+	}
+	if status.Status == dimse.StatusSuccess {
+		// The request was canceled after the last match.
+		select {
+		case <-canceled:
+			status = dimse.Status{Status: dimse.StatusCancel}
+		default:
+		}
+	}
+	respond(status, nil)
+}
+
 func handleCMove(
 	params ServiceProviderParams,
 	connState ConnectionState,
-	c *dimse.CMoveRq, data []byte,
+	c *dimse.CMoveRq,
 	cs *serviceCommandState) {
 	sendError := func(err error) {
 		cs.sendMessage(&dimse.CMoveRsp{
@@ -146,25 +300,48 @@ func handleCMove(
 		}, nil)
 		return
 	}
-	remoteHostPort, ok := params.RemoteAEs[c.MoveDestination]
+	remoteHostPort, ok := lookupMoveDestination(params.RemoteAEs, c.MoveDestination)
 	if !ok {
-		sendError(fmt.Errorf("C-MOVE destination '%v' not registered in the server", c.MoveDestination))
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status: dimse.Status{
+				Status:       dimse.CMoveMoveDestinationUnknown,
+				ErrorComment: fmt.Sprintf("C-MOVE destination '%v' not registered in the server", c.MoveDestination),
+			},
+		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	ds, err := cs.request.dataSet()
 	if err != nil {
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(elems))
+	dicomlog.Vprintf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(ds.Elements))
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, ds.Elements, responseCh)
 	}()
-	// responseCh :=
+	canceled, stopWatching := cs.watchCancel()
+	defer stopWatching()
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+	remaining := -1 // Unknown until the first result.
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-canceled:
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
+		remaining = resp.Remaining
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -173,7 +350,8 @@ func handleCMove(
 			break
 		}
 		dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
+		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, c.Priority, resp.DataSet,
+			moveOriginator{aeTitle: strings.TrimSpace(connState.CallingAETitle), messageID: c.MessageID})
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
 			numFailures++
@@ -190,22 +368,42 @@ func handleCMove(
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 	}
-	cs.sendMessage(&dimse.CMoveRsp{
+	final := &dimse.CMoveRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		Status:                         status}
+	if status.Status == dimse.StatusCancel && remaining > 0 {
+		// The sub-operations left undone (P3.4 C.4.2.1.6).
+		final.NumberOfRemainingSuboperations = uint16(remaining)
+	}
+	cs.sendMessage(final, nil)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
 }
 
+// Returns the host:port of the C-MOVE destination named aeTitle. AE titles are
+// matched regardless of leading and trailing spaces, since peers may pad them.
+func lookupMoveDestination(remoteAEs map[string]string, aeTitle string) (string, bool) {
+	if hostPort, ok := remoteAEs[aeTitle]; ok {
+		return hostPort, true
+	}
+	aeTitle = strings.TrimSpace(aeTitle)
+	for title, hostPort := range remoteAEs {
+		if strings.TrimSpace(title) == aeTitle {
+			return hostPort, true
+		}
+	}
+	return "", false
+}
+
 func handleCGet(
 	params ServiceProviderParams,
 	connState ConnectionState,
-	c *dimse.CGetRq, data []byte, cs *serviceCommandState) {
+	c *dimse.CGetRq, cs *serviceCommandState) {
 	sendError := func(err error) {
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -223,19 +421,35 @@ func handleCGet(
 		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	ds, err := cs.request.dataSet()
 	if err != nil {
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(elems))
+	dicomlog.Vprintf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(ds.Elements))
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, ds.Elements, responseCh)
 	}()
+	canceled, stopWatching := cs.watchCancel()
+	defer stopWatching()
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+	remaining := -1 // Unknown until the first result.
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-canceled:
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
+		remaining = resp.Remaining
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -251,7 +465,9 @@ func handleCGet(
 			}
 			break
 		}
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		// C-GET sub-operations don't carry the move originator. They
+		// inherit the priority of the C-GET.
+		err = runCStoreOnAssociation(context.Background(), subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, c.Priority, resp.DataSet, moveOriginator{})
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
 			numFailures++
@@ -270,13 +486,18 @@ func handleCGet(
 		}, nil)
 		cs.disp.deleteCommand(subCs)
 	}
-	cs.sendMessage(&dimse.CGetRsp{
+	final := &dimse.CGetRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		Status:                         status}
+	if status.Status == dimse.StatusCancel && remaining > 0 {
+		// The sub-operations left undone (P3.4 C.4.2.1.6).
+		final.NumberOfRemainingSuboperations = uint16(remaining)
+	}
+	cs.sendMessage(final, nil)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -287,12 +508,13 @@ func handleCEcho(
 	connState ConnectionState,
 	c *dimse.CEchoRq, data []byte,
 	cs *serviceCommandState) {
-	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
+	status := dimse.Success
 	if params.CEcho != nil {
 		status = params.CEcho(connState)
 	}
 	dicomlog.Vprintf(0, "dicom.serviceProvider: Received E-ECHO: context: %+v, status: %+v", cs.context, status)
 	resp := &dimse.CEchoRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
 		Status:                    status,
@@ -300,28 +522,81 @@ func handleCEcho(
 	cs.sendMessage(resp, nil)
 }
 
+func handleNEventReport(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NEventReportRq, data []byte,
+	cs *serviceCommandState) {
+	if params.StorageCommitmentReport == nil || c.AffectedSOPClassUID != sopclass.StorageCommitmentClasses[0] {
+		sendNEventReportRsp(cs, c, dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for N-EVENT-REPORT",
+		})
+		return
+	}
+	result, status := handleStorageCommitmentReport(c, data, cs.context.transferSyntaxUID)
+	if result != nil {
+		status = params.StorageCommitmentReport(connState, result)
+	}
+	sendNEventReportRsp(cs, c, status)
+}
+
 // ServiceProviderParams defines parameters for ServiceProvider.
+//
+// The callbacks for the requests of an association run in goroutines apart
+// from the one reading PDUs off the connection, so a slow callback doesn't
+// stall the association. Unless the client negotiated asynchronous operations
+// (P3.7 D.3.3.3), they are called one at a time for an association, in the
+// order the requests arrived; otherwise up to the negotiated number of them
+// run at once. Callbacks for different associations may always run
+// concurrently.
 type ServiceProviderParams struct {
 	// The application-entity title of the server. Must be nonempty
 	AETitle string
 
-	// Names of remote AEs and their host:ports. Used only by C-MOVE. This
-	// map should be nonempty iff the server supports CMove.
+	// AE titles the server answers to. If non-empty, associations whose
+	// called AE title isn't listed are rejected with reason
+	// "called-AE-title-not-recognized" (P3.8 9.3.4). Leading and trailing
+	// spaces are ignored. If empty, any called AE title is accepted, e.g.,
+	// for a gateway that serves many titles.
+	CalledAETitles []string
+
+	// AE titles of the clients allowed to connect. If non-empty,
+	// associations from other calling AE titles are rejected with reason
+	// "calling-AE-title-not-recognized" (P3.8 9.3.4) during the handshake,
+	// before the user identity is checked. Leading and trailing spaces are
+	// ignored. If empty, any client may connect.
+	CallingAETitles []string
+
+	// Names of remote AEs and their host:ports. Used only by C-MOVE, to
+	// find where to send the sub-operations; C-MOVE requests naming an AE
+	// that isn't in the map are answered with status
+	// CMoveMoveDestinationUnknown. This map should be nonempty iff the server
+	// supports CMove. See also RegisterMoveDestination.
 	RemoteAEs map[string]string
 
 	// Called on Assoc RQ request. If nil, a C-ECHO call will produce an error response.
 	//
 	AssocRQ AssocReQCallback
 
-	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
-	//
-	// TODO(saito) Support a default C-ECHO callback?
+	// Called on C_ECHO request. If nil, C-ECHO requests are answered with
+	// success. See also ServiceProvider.RegisterCEchoHandler.
 	CEcho CEchoCallback
 
 	// Called on C_FIND request.
 	// If CFindCallback=nil, a C-FIND call will produce an error response.
 	CFind CFindCallback
 
+	// C-FIND handlers keyed by SOP class UID. A C-FIND request is passed
+	// to the handler for its SOP class, or to CFind if there's none. See
+	// also ServiceProvider.RegisterCFindHandler.
+	CFindHandlers map[string]CFindHandler
+
+	// Similar to CFindHandlers, but the handlers are passed the whole
+	// request. They take precedence over those in CFindHandlers. See also
+	// ServiceProvider.RegisterCFindRequestHandler.
+	CFindRequestHandlers map[string]CFindRequestHandler
+
 	// CMove is called on C_MOVE request.
 	CMove CMoveCallback
 
@@ -334,10 +609,131 @@ type ServiceProviderParams struct {
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
 
+	// CStoreFile, if non-nil, handles all C-STORE requests in place of
+	// CStore and the C-STORE handlers. The data payload of each request is
+	// spooled to a temporary file in SpoolDir as it arrives, rather than
+	// buffered in memory. If SpoolDir is empty, os.TempDir() is used.
+	CStoreFile CStoreFileCallback
+	SpoolDir   string
+
+	// C-STORE handlers keyed by SOP class UID. A C-STORE request is
+	// passed to the handler for its SOP class, or DefaultCStoreHandler if
+	// there's none, or CStore if neither is set. See also
+	// ServiceProvider.RegisterCStoreHandler.
+	CStoreHandlers       map[string]CStoreHandler
+	DefaultCStoreHandler CStoreHandler
+
+	// StorageCommitmentReport, if non-nil, is called when a storage
+	// commitment SCP reports the outcome of a request through
+	// N-EVENT-REPORT on an association it opened. See also
+	// ServiceUser.RequestStorageCommitment.
+	StorageCommitmentReport StorageCommitmentReportCallback
+
+	// Authenticate, if non-nil, is called on A-ASSOCIATE-RQ to check the
+	// user identity sent by the client. If nil, all clients are accepted.
+	Authenticate AuthenticateCallback
+
+	// ExtendedNegotiation, if non-nil, is called for each SOP class
+	// extended negotiation item (P3.7 D.3.3.5) in A-ASSOCIATE-RQ. If nil,
+	// extended negotiation is never accepted.
+	ExtendedNegotiation ExtendedNegotiationCallback
+
+	// MaxOperationsInvoked and MaxOperationsPerformed bound the
+	// asynchronous operations window (P3.7 D.3.3.3) accepted from clients.
+	// The window sent in A-ASSOCIATE-AC is the one proposed by the client,
+	// lowered to these limits. Zero means no limit.
+	MaxOperationsInvoked   int
+	MaxOperationsPerformed int
+
+	// RoleSelection, if non-nil, is called for each SCP/SCU role selection
+	// item (P3.7 D.3.3.4) in A-ASSOCIATE-RQ. If nil, the roles proposed by
+	// the client are accepted as is.
+	RoleSelection RoleSelectionCallback
+
+	// Implementation class UID and version name sent to clients in
+	// A-ASSOCIATE-AC. If empty, the go-dicom defaults are used. The version
+	// name must be at most 16 bytes long.
+	ImplementationClassUID    string
+	ImplementationVersionName string
+
+	// ApplicationContextName is the application context name the server
+	// expects in A-ASSOCIATE-RQ and echoes in A-ASSOCIATE-AC. Requests
+	// proposing another name are rejected. If empty,
+	// pdu_item.DICOMApplicationContextItemName is used; override it only to
+	// talk to peers that use a private application context.
+	ApplicationContextName string
+
+	// Transfer syntaxes the server accepts, most preferred first. For each
+	// presentation context, the server picks the first syntax in this list
+	// that the client proposed, and rejects the context if there's none. If
+	// empty, the server accepts the first syntax proposed by the client.
+	TransferSyntaxes []string
+
+	// MaxConcurrentAssociations, if positive, limits the number of
+	// associations served at a time. Connections beyond the limit are
+	// rejected with A-ASSOCIATE-RJ (transient, local limit exceeded).
+	MaxConcurrentAssociations int
+
+	// ReadTimeout, if positive, is the max time to wait for each PDU from
+	// the peer. Since it also bounds how long the association may stay
+	// idle, it should be generous. WriteTimeout, if positive, is the max
+	// time to send each PDU. On timeout, the connection is closed.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout, if positive, releases the association once no PDU has
+	// been sent or received for that long, e.g., so that an association
+	// kept for reuse isn't silently dropped by a NAT gateway. Unlike
+	// ReadTimeout, it ends the association gracefully. An operation whose
+	// peer stays silent for that long, e.g., a slow C-MOVE, is cut short.
+	IdleTimeout time.Duration
+
+	// SkipUnknownCommands, if set, makes the association log and ignore
+	// DIMSE commands with an unrecognized command field, e.g., private
+	// commands of some vendors, instead of aborting.
+	SkipUnknownCommands bool
+
+	// StrictCommands, if set, makes the association abort on DIMSE commands
+	// with elements that their message type doesn't define, e.g., private
+	// elements, instead of passing them on in the Extra field of the
+	// message. See dimse.ReadMessageStrict.
+	StrictCommands bool
+
+	// AllowedCommandElements lists the elements, e.g., private elements
+	// of some vendors, that StrictCommands accepts in addition to those the
+	// message type defines. Ignored unless StrictCommands is set.
+	AllowedCommandElements []dicomtag.Tag
+
+	// PackCommandAndData, if set, fills each P-DATA-TF PDU sent up to the
+	// peer's max PDU size, so that a short DIMSE command shares its PDU with
+	// the start of the data, instead of taking up a PDU of its own (P3.8
+	// E.2). It is off by default, since some old implementations expect a
+	// single PDV item per PDU.
+	PackCommandAndData bool
+
+	// Logger receives the log messages of the association. If nil, they
+	// are sent to dicomlog.
+	Logger Logger
+
+	// Metrics receives PDU, DIMSE and duration measurements of the
+	// associations. If nil, they are discarded.
+	Metrics Metrics
+
+	// PDUTracer, if non-nil, receives the raw bytes of every PDU sent and
+	// received, e.g., NewHexDumpPDUTracer(os.Stderr).
+	PDUTracer PDUTracer
+
+	// OnTransition, if non-nil, receives every transition of the state
+	// machine of the association.
+	OnTransition TransitionTracer
+
 	// TLSConfig, if non-nil, enables TLS on the connection. See
 	// https://gist.github.com/michaljemala/d6f4e01c4834bf47a9c4 for an
 	// example for creating a TLS config from x509 cert files.
 	TLSConfig *tls.Config
+
+	// SocketOptions tunes the TCP connections of the associations.
+	SocketOptions SocketOptions
 }
 
 // DefaultMaxPDUSize is the the PDU size advertized by go-netdicom.
@@ -353,7 +749,9 @@ const DefaultMaxPDUSize = 4 << 20
 // objects in transferSyntaxUID.  "data" does not contain metadata elements
 // (elements whose Tag.Group=2 -- e.g., TransferSyntaxUID and
 // MediaStorageSOPClassUID), since they are stripped by the requster (two key
-// metadata are passed as sop{Class,Instance)UID).
+// metadata are passed as sop{Class,Instance)UID). If transferSyntaxUID is
+// deflated explicit VR little endian, "data" has already been inflated, i.e.,
+// it's encoded in explicit VR little endian; WritePart10 deflates it again.
 //
 // The function should store encode the sop{Class,InstanceUID} as the DICOM
 // header, followed by data. It should return either dimse.Success0 on success,
@@ -365,6 +763,53 @@ type CStoreCallback func(
 	sopInstanceUID string,
 	data []byte) dimse.Status
 
+// CStoreRequest is a C-STORE request received by the provider.
+type CStoreRequest struct {
+	Conn ConnectionState
+
+	SOPClassUID    string
+	SOPInstanceUID string
+
+	// Transfer syntax negotiated for the request. A handler that can't
+	// decode it, e.g., because it's a compressed syntax, should return
+	// dimse.CStoreCannotUnderstand. To keep such requests from arriving
+	// at all, leave the syntax out of ServiceProviderParams.TransferSyntaxes.
+	TransferSyntaxUID string
+
+	// Priority requested by the client. The provider doesn't order
+	// requests by priority: each request is passed to its handler as soon
+	// as it arrives, so handlers that queue work may use it to order the
+	// work themselves.
+	Priority dimse.Priority
+
+	// Set only if the request is a sub-operation of a C-MOVE: the AE title
+	// of the C-MOVE requestor and the message ID of its C-MOVE request.
+	MoveOriginatorAETitle   string
+	MoveOriginatorMessageID dimse.MessageID
+
+	// The decoded data. It starts with the TransferSyntaxUID,
+	// MediaStorageSOPClassUID and MediaStorageSOPInstanceUID elements, so
+	// it can be written to a file as is.
+	DataSet *dicom.DataSet
+}
+
+// CStoreFileCallback is called on C-STORE request when
+// ServiceProviderParams.CStoreFile is set. It is like CStoreCallback, but the
+// data payload is in the file named by dataPath. The file is removed once the
+// callback returns, so the callback must copy or rename it to keep the data.
+// As with CStoreCallback, a deflated payload is inflated in the file.
+type CStoreFileCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	dataPath string) dimse.Status
+
+// CStoreHandler handles a C-STORE request for ServiceProviderParams.CStoreHandlers.
+// It should return dimse.Success on success, or one of the C-STORE error
+// statuses, e.g., dimse.CStoreOutOfResources.
+type CStoreHandler func(req *CStoreRequest) dimse.Status
+
 // CFindCallback implements a C-FIND handler.  sopClassUID is the data type
 // requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the
 // data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
@@ -376,6 +821,10 @@ type CStoreCallback func(
 // matches, the callback should send multiple CFindResult objects, one for each
 // dataset.  The callback must close the channel after it produces all the
 // responses.
+//
+// If the client cancels the request with C-CANCEL, the request ends with
+// status Cancel, and the results the callback sends afterwards are discarded.
+// The callback must close the channel all the same.
 type CFindCallback func(
 	conn ConnectionState,
 	transferSyntaxUID string,
@@ -383,6 +832,41 @@ type CFindCallback func(
 	filters []*dicom.Element,
 	ch chan CFindResult)
 
+// CFindHandler handles a C-FIND request for ServiceProviderParams.CFindHandlers.
+// query is the identifier sent by the client. The handler should call emit once
+// for each match, which sends the match in a pending C-FIND response, and
+// return the final status, e.g., dimse.Success or dimse.CFindUnableToProcess.
+//
+// emit blocks until the response for the previous match has been written to
+// the connection, so a client that reads the responses slowly throttles the
+// handler, and the matches can be generated lazily, e.g., from a database
+// cursor, without piling up in memory.
+//
+// If the client cancels the request with C-CANCEL, a match can't be encoded,
+// or the association ends, emit returns an error, ErrCFindCanceled in the
+// first case, and so does every later call. The handler should then stop
+// and return: the request ends with status Cancel or CFindUnableToProcess,
+// whatever status the handler returns.
+type CFindHandler func(query *dicom.DataSet, emit func(match *dicom.DataSet) error) dimse.Status
+
+// CFindRequest is a C-FIND request passed to a CFindRequestHandler.
+type CFindRequest struct {
+	Conn ConnectionState
+
+	SOPClassUID string
+
+	// Priority requested by the client. See CStoreRequest.Priority.
+	Priority dimse.Priority
+
+	// The identifier sent by the client, i.e., the query.
+	Query *dicom.DataSet
+}
+
+// CFindRequestHandler is similar to CFindHandler, but is passed the whole
+// request, e.g., its priority, instead of just the query. See
+// ServiceProviderParams.CFindRequestHandlers.
+type CFindRequestHandler func(req *CFindRequest, emit func(match *dicom.DataSet) error) dimse.Status
+
 // CMoveCallback implements C-MOVE or C-GET handler.  sopClassUID is the data
 // type requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is
 // the data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
@@ -391,6 +875,12 @@ type CFindCallback func(
 // The callback must stream datasets or error to "ch". The callback may
 // block. The callback must close the channel after it produces all the
 // datasets.
+//
+// If the client cancels the request with C-CANCEL, no more sub-operations
+// are started, and the request ends with status Cancel, reporting the
+// Remaining count of the last result as the sub-operations left undone. The
+// results the callback sends afterwards are discarded, but it must close the
+// channel all the same.
 type CMoveCallback func(
 	conn ConnectionState,
 	transferSyntaxUID string,
@@ -407,24 +897,110 @@ type ConnectionState struct {
 	CalledAETitle  string
 	CallingAETitle string
 	RemoteAddr     string
+
+	// Implementation class UID and version name advertised by the client.
+	// They are empty if the client didn't send them.
+	PeerImplementationClassUID    string
+	PeerImplementationVersionName string
+
+	// The parameters negotiated during the association handshake.
+	Association *AssociationInfo
 }
 
 // CEchoCallback implements C-ECHO callback. It typically just returns
-// dimse.Success.
+// dimse.Success. conn.CalledAETitle and conn.CallingAETitle identify the
+// association, e.g., for auditing.
 type CEchoCallback func(conn ConnectionState) dimse.Status
 
 type AssocReQCallback func(conn ConnectionState) dimse.Status
 
+// StorageCommitmentReportCallback is called on a storage commitment
+// N-EVENT-REPORT request. It should return dimse.Success once it has taken
+// note of the result.
+type StorageCommitmentReportCallback func(conn ConnectionState, result *StorageCommitmentResult) dimse.Status
+
+// AuthenticateCallback checks the user identity proposed by a client (P3.7
+// D.3.3.7). identity is nil if the client sent none. Returning a non-nil error
+// rejects the association. If identity.PositiveResponseRequested, serverResponse
+// is sent back to the client; it should be empty unless the identity type is
+// Kerberos or SAML.
+type AuthenticateCallback func(conn ConnectionState, identity *UserIdentity) (serverResponse []byte, err error)
+
+// ExtendedNegotiationCallback decides the service-class-application-information
+// to accept for sopClassUID, given the one proposed by the client. Returning nil
+// declines extended negotiation for the SOP class. For the query/retrieve
+// classes, each byte is a flag and the returned slice should clear the flags the
+// server doesn't support.
+type ExtendedNegotiationCallback func(sopClassUID string, proposed []byte) []byte
+
+// RoleSelectionCallback decides the roles that the client may play for
+// sopClassUID, given the ones it proposed. For instance, a C-GET client
+// proposes the SCP role for the storage classes, so that the server can send
+// the matching datasets back. A role that the client didn't propose is never
+// accepted, whatever the callback returns.
+type RoleSelectionCallback func(sopClassUID string, scuRole, scpRole bool) (acceptSCURole, acceptSCPRole bool)
+
 // ServiceProvider encapsulates the state for DICOM server (provider).
 type ServiceProvider struct {
-	params   ServiceProviderParams
-	listener net.Listener
+	mu        sync.Mutex
+	params    ServiceProviderParams // Guarded by mu.
+	listeners []net.Listener
 	// Label is a unique string used in log messages to identify this provider.
 	label string
+	// Number of connections currently being served.
+	numAssociations atomic.Int32
+	// Tracks the accept loops started by Run, and the associations they
+	// accepted.
+	acceptLoops  sync.WaitGroup
+	associations sync.WaitGroup
+	// Canceling ctx aborts all the associations. See Shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Returns the byte order and VR explicitness of dataset payloads encoded in
+// transferSyntaxUID, which is a transfer syntax negotiated for a presentation
+// context. E.g., explicit VR big endian payloads are decoded as such, unlike
+// commands, which are always implicit VR little endian.
+func dataSetEncoding(transferSyntaxUID string) (binary.ByteOrder, dicomio.IsImplicitVR, error) {
+	// UIDs in PDUs may be padded to an even length.
+	canonicalUID, err := dicomio.CanonicalTransferSyntaxUID(strings.TrimRight(transferSyntaxUID, "\x00 "))
+	if err != nil {
+		return nil, dicomio.UnknownVR, fmt.Errorf("dicom.dataSet: unsupported transfer syntax %q: %w", transferSyntaxUID, err)
+	}
+	byteOrder, implicit, err := dicomio.ParseTransferSyntaxUID(canonicalUID)
+	if err != nil {
+		return nil, dicomio.UnknownVR, fmt.Errorf("dicom.dataSet: unsupported transfer syntax %q: %w", transferSyntaxUID, err)
+	}
+	return byteOrder, implicit, nil
+}
+
+// Creates an encoder for a dataset payload in transferSyntaxUID. If the
+// transfer syntax isn't supported, the encoder's Error() reports it.
+func newDataSetEncoder(transferSyntaxUID string) *dicomio.Encoder {
+	byteOrder, implicit, err := dataSetEncoding(transferSyntaxUID)
+	if err != nil {
+		e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ExplicitVR)
+		e.SetError(err)
+		return e
+	}
+	return dicomio.NewBytesEncoder(byteOrder, implicit)
+}
+
+// Creates a decoder for dataset payload "data" in transferSyntaxUID. If the
+// transfer syntax isn't supported, the decoder's Error() reports it.
+func newDataSetDecoder(data []byte, transferSyntaxUID string) *dicomio.Decoder {
+	byteOrder, implicit, err := dataSetEncoding(transferSyntaxUID)
+	if err != nil {
+		d := dicomio.NewBytesDecoder(data, binary.LittleEndian, dicomio.ExplicitVR)
+		d.SetError(err)
+		return d
+	}
+	return dicomio.NewBytesDecoder(data, byteOrder, implicit)
 }
 
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
-	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
+	dataEncoder := newDataSetEncoder(transferSyntaxUID)
 	for _, elem := range elems {
 		dicom.WriteElement(dataEncoder, elem)
 	}
@@ -435,7 +1011,7 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 }
 
 func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
-	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
+	decoder := newDataSetDecoder(data, transferSyntaxUID)
 	var elems []*dicom.Element
 	for !decoder.EOF() {
 		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
@@ -462,18 +1038,20 @@ func elementsString(elems []*dicom.Element) string {
 	return s + "]"
 }
 
-// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.DataSet) error {
+// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE. "origin"
+// identifies the C-MOVE request, and "priority" is its priority.
+func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, priority dimse.Priority, ds *dicom.DataSet, origin moveOriginator) error {
 	su, err := NewServiceUser(ServiceUserParams{
 		CalledAETitle:  remoteAETitle,
 		CallingAETitle: myAETitle,
-		SOPClasses:     sopclass.StorageClasses})
+		SOPClasses:     sopclass.StorageClasses,
+		Priority:       priority})
 	if err != nil {
 		return err
 	}
 	defer su.Release()
 	su.Connect(remoteHostPort)
-	err = su.CStore(ds)
+	err = su.cstore(context.Background(), ds, origin)
 	dicomlog.Vprintf(1, "dicom.serviceProvider: C-STORE subop done: %v", err)
 	return err
 }
@@ -483,19 +1061,40 @@ func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string,
 // IP address that this machine can bind to.  Run() will actually start running
 // the service.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
+	return NewServiceProviderOnAddrs(params, []string{port})
+}
+
+// NewServiceProviderOnAddrs is similar to NewServiceProvider, but listens to
+// each of "listenAddrs", e.g., {"0.0.0.0:104", "[::]:104"} to serve both IPv4
+// and IPv6 clients, or {":104", ":11112"} to serve two ports. The associations
+// accepted on all the addresses share the handlers and the
+// MaxConcurrentAssociations limit.
+func NewServiceProviderOnAddrs(params ServiceProviderParams, listenAddrs []string) (*ServiceProvider, error) {
+	if len(listenAddrs) == 0 {
+		return nil, fmt.Errorf("dicom.serviceProvider: no listen address")
+	}
+	if len(params.ImplementationVersionName) > 16 {
+		return nil, fmt.Errorf("ServiceProviderParams.ImplementationVersionName '%s' is longer than 16 bytes", params.ImplementationVersionName)
+	}
 	dicomlog.SetLevel(0)
 	sp := &ServiceProvider{
 		params: params,
 		label:  newUID("sp"),
 	}
-	var err error
-	if params.TLSConfig != nil {
-		sp.listener, err = tls.Listen("tcp", port, params.TLSConfig)
-	} else {
-		sp.listener, err = net.Listen("tcp", port)
-	}
-	if err != nil {
-		return nil, err
+	sp.ctx, sp.cancel = context.WithCancel(context.Background())
+	for _, addr := range listenAddrs {
+		var listener net.Listener
+		var err error
+		if params.TLSConfig != nil {
+			listener, err = tls.Listen("tcp", addr, params.TLSConfig)
+		} else {
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			sp.Close()
+			return nil, err
+		}
+		sp.listeners = append(sp.listeners, listener)
 	}
 	return sp, nil
 }
@@ -510,6 +1109,9 @@ func getConnState(conn net.Conn, aInfo associationInfo) (cs ConnectionState) {
 	cs.CalledAETitle = aInfo.CalledAETitle
 	cs.CallingAETitle = aInfo.CallingAETitle
 	cs.RemoteAddr = conn.RemoteAddr().String()
+	cs.PeerImplementationClassUID = aInfo.PeerImplementationClassUID
+	cs.PeerImplementationVersionName = aInfo.PeerImplementationVersionName
+	cs.Association = aInfo.info
 
 	return
 }
@@ -517,8 +1119,21 @@ func getConnState(conn net.Conn, aInfo associationInfo) (cs ConnectionState) {
 // RunProviderForConn starts threads for running a DICOM server on "conn". This
 // function returns immediately; "conn" will be cleaned up in the background.
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+	RunProviderForConnContext(context.Background(), conn, params)
+}
+
+// RunProviderForConnContext is similar to RunProviderForConn, but the
+// association is aborted when ctx is done.
+func RunProviderForConnContext(ctx context.Context, conn net.Conn, params ServiceProviderParams) {
+	if params.ImplementationClassUID == "" {
+		params.ImplementationClassUID = dicom.GoDICOMImplementationClassUID
+	}
+	if params.ImplementationVersionName == "" {
+		params.ImplementationVersionName = dicom.GoDICOMImplementationVersionName
+	}
 	upcallCh := make(chan upcallEvent, 128)
 	label := newUID("sc")
+	applySocketOptions(conn, params.SocketOptions, withLogValues(params.Logger, "association", label))
 	disp := newServiceDispatcher(label)
 	assocInfo := associationInfo{}
 	disp.registerCallback(dimse.CommandFieldAssocRq,
@@ -527,34 +1142,50 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 		})
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
-			handleCStore(params.CStore, getConnState(conn, aInfo), msg.(*dimse.CStoreRq), data, cs)
+			handleCStore(params, getConnState(conn, aInfo), msg.(*dimse.CStoreRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCFindRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
-			handleCFind(params, getConnState(conn, aInfo), msg.(*dimse.CFindRq), data, cs)
+			handleCFind(params, getConnState(conn, aInfo), msg.(*dimse.CFindRq), cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
-			handleCMove(params, getConnState(conn, aInfo), msg.(*dimse.CMoveRq), data, cs)
+			handleCMove(params, getConnState(conn, aInfo), msg.(*dimse.CMoveRq), cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCGetRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
-			handleCGet(params, getConnState(conn, aInfo), msg.(*dimse.CGetRq), data, cs)
+			handleCGet(params, getConnState(conn, aInfo), msg.(*dimse.CGetRq), cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
 			handleCEcho(params, getConnState(conn, aInfo), msg.(*dimse.CEchoRq), data, cs)
 		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label)
+	disp.registerCallback(dimse.CommandFieldNEventReportRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+			handleNEventReport(params, getConnState(conn, aInfo), msg.(*dimse.NEventReportRq), data, cs)
+		})
+	go runStateMachineForServiceProvider(ctx, conn, params, upcallCh, disp.downcallCh, label)
 	for event := range upcallCh {
+		if event.eventType == upcallEventAborted {
+			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Association aborted by peer: %v", label, event.abort)
+			continue
+		}
+		if event.eventType == upcallEventReleased {
+			dicomlog.Vprintf(1, "dicom.serviceProvider(%s): Association released", label)
+			continue
+		}
 		if event.eventType == upcallEventHandshakeCompleted {
+			// The peer invokes the operations this side performs.
+			disp.setMaxHandlers(event.cm.maxOpsInvoked)
 			// Copy assoc info from event
 			assocInfo.CalledAETitle = event.CalledAETitle
 			assocInfo.CallingAETitle = event.CallingAETitle
+			assocInfo.info = event.info
 		} else {
 			// Write Assoc info to event
 			event.CalledAETitle = assocInfo.CalledAETitle
 			event.CallingAETitle = assocInfo.CallingAETitle
+			event.info = assocInfo.info
 		}
 		disp.handleEvent(event)
 	}
@@ -563,23 +1194,215 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
-// protocol. This function never returns.
+// protocol. It returns once Close is called.
 func (sp *ServiceProvider) Run() {
-	commandset.Init()
+	for _, listener := range sp.listeners {
+		sp.acceptLoops.Add(1)
+		go func(listener net.Listener) {
+			defer sp.acceptLoops.Done()
+			sp.acceptLoop(listener)
+		}(listener)
+	}
+	sp.acceptLoops.Wait()
+}
+
+// Accepts connections on "listener" until it is closed.
+func (sp *ServiceProvider) acceptLoop(listener net.Listener) {
 	for {
-		conn, err := sp.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accept error: %v", sp.label, err)
 			continue
 		}
+		sp.mu.Lock()
+		params := sp.params
+		sp.mu.Unlock()
+		if limit := params.MaxConcurrentAssociations; limit > 0 && int(sp.numAssociations.Load()) >= limit {
+			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Rejecting connection %p (remote: %+v): %d associations active",
+				sp.label, conn, conn.RemoteAddr(), limit)
+			go rejectAssociation(conn, &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedTransient,
+				Source: pdu.SourceULServiceProviderPresentation,
+				Reason: pdu.RejectReasonLocalLimitExceeded,
+			})
+			continue
+		}
 		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accepted connection %p (remote: %+v)", sp.label, conn, conn.RemoteAddr())
-		go func() { RunProviderForConn(conn, sp.params) }()
+		sp.numAssociations.Add(1)
+		sp.associations.Add(1)
+		go func() {
+			defer sp.associations.Done()
+			defer sp.numAssociations.Add(-1)
+			RunProviderForConnContext(sp.ctx, conn, params)
+		}()
+	}
+}
+
+// Close stops listening on all the addresses, which makes Run return. The
+// associations already accepted keep running; see Shutdown.
+func (sp *ServiceProvider) Close() error {
+	var firstErr error
+	for _, listener := range sp.listeners {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Shutdown stops the server gracefully. It stops listening, as Close does, and
+// waits for the associations in progress to end, e.g., for the C-STORE
+// requests being received to complete and the clients to release the
+// associations. If ctx is done first, the remaining associations are aborted,
+// and Shutdown returns ctx.Err() once they have ended.
+func (sp *ServiceProvider) Shutdown(ctx context.Context) error {
+	closeErr := sp.Close()
+	// Once the accept loops have exited, no association is added.
+	sp.acceptLoops.Wait()
+	done := make(chan struct{})
+	go func() {
+		sp.associations.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return closeErr
+	case <-ctx.Done():
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Aborting %d associations on shutdown", sp.label, sp.NumAssociations())
+		sp.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// RegisterCEchoHandler sets the callback that answers C-ECHO requests,
+// replacing ServiceProviderParams.CEcho. It applies to the associations
+// accepted afterwards.
+func (sp *ServiceProvider) RegisterCEchoHandler(handler CEchoCallback) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.params.CEcho = handler
+}
+
+// RegisterCStoreHandler sets the handler for C-STORE requests of the given SOP
+// class. If sopClassUID is empty, the handler is used for the SOP classes that
+// have no handler of their own (see ServiceProviderParams.CStoreHandlers). It
+// applies to the associations accepted afterwards.
+func (sp *ServiceProvider) RegisterCStoreHandler(sopClassUID string, handler CStoreHandler) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sopClassUID == "" {
+		sp.params.DefaultCStoreHandler = handler
+		return
+	}
+	// The running associations share the old map, so update a copy.
+	handlers := make(map[string]CStoreHandler, len(sp.params.CStoreHandlers)+1)
+	for uid, h := range sp.params.CStoreHandlers {
+		handlers[uid] = h
+	}
+	handlers[sopClassUID] = handler
+	sp.params.CStoreHandlers = handlers
+}
+
+// RegisterCFindHandler sets the handler for C-FIND requests of the given SOP
+// class, e.g., dicomuid.StudyRootQRFind, in place of ServiceProviderParams.CFind.
+// It applies to the associations accepted afterwards.
+func (sp *ServiceProvider) RegisterCFindHandler(sopClassUID string, handler CFindHandler) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// The running associations share the old map, so update a copy.
+	handlers := make(map[string]CFindHandler, len(sp.params.CFindHandlers)+1)
+	for uid, h := range sp.params.CFindHandlers {
+		handlers[uid] = h
+	}
+	handlers[sopClassUID] = handler
+	sp.params.CFindHandlers = handlers
+}
+
+// RegisterCFindRequestHandler is similar to RegisterCFindHandler, but for
+// ServiceProviderParams.CFindRequestHandlers.
+func (sp *ServiceProvider) RegisterCFindRequestHandler(sopClassUID string, handler CFindRequestHandler) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// The running associations share the old map, so update a copy.
+	handlers := make(map[string]CFindRequestHandler, len(sp.params.CFindRequestHandlers)+1)
+	for uid, h := range sp.params.CFindRequestHandlers {
+		handlers[uid] = h
+	}
+	handlers[sopClassUID] = handler
+	sp.params.CFindRequestHandlers = handlers
+}
+
+// RegisterMoveDestination adds the AE named aeTitle, listening at the given
+// "host:port", to the destinations of C-MOVE requests (see
+// ServiceProviderParams.RemoteAEs), or changes its address. It returns an
+// error if aeTitle isn't a legal AE title. It applies to the associations
+// accepted afterwards.
+func (sp *ServiceProvider) RegisterMoveDestination(aeTitle, hostPort string) error {
+	if err := validateAETitle(aeTitle); err != nil {
+		return fmt.Errorf("dicom.RegisterMoveDestination: %w", err)
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// The running associations share the old map, so update a copy.
+	remoteAEs := make(map[string]string, len(sp.params.RemoteAEs)+1)
+	for title, addr := range sp.params.RemoteAEs {
+		remoteAEs[title] = addr
+	}
+	remoteAEs[aeTitle] = hostPort
+	sp.params.RemoteAEs = remoteAEs
+	return nil
+}
+
+// NumAssociations returns the number of connections currently being served.
+func (sp *ServiceProvider) NumAssociations() int {
+	return int(sp.numAssociations.Load())
+}
+
+// How long rejectAssociation waits for the A-ASSOCIATE-RQ.
+const rejectAssociationTimeout = 10 * time.Second
+
+// Waits for the A-ASSOCIATE-RQ on a connection that the provider doesn't serve,
+// answers it with "rj", and closes the connection. The state machine isn't run.
+func rejectAssociation(conn net.Conn, rj *pdu.AAssociateRj) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectAssociationTimeout))
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to read A-ASSOCIATE-RQ from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if _, ok := v.(*pdu.AAssociateRQ); !ok {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Expect A-ASSOCIATE-RQ from %v, but found %v", conn.RemoteAddr(), v)
+		return
+	}
+	data, err := pdu.EncodePDU(rj)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to encode %v: %v", rj, err)
+		return
+	}
+	if _, err := conn.Write(data); err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to send %v to %v: %v", rj, conn.RemoteAddr(), err)
 	}
 }
 
 // ListenAddr returns the TCP address that the server is listening on. It is the
 // address passed to the NewServiceProvider(), except that if value was of form
-// <name>:0, the ":0" part is replaced by the actual port numwber.
+// <name>:0, the ":0" part is replaced by the actual port numwber. If the server
+// listens to several addresses, it returns the first one.
 func (sp *ServiceProvider) ListenAddr() net.Addr {
-	return sp.listener.Addr()
+	return sp.listeners[0].Addr()
+}
+
+// ListenAddrs returns the TCP addresses that the server is listening on, in
+// the order passed to NewServiceProviderOnAddrs.
+func (sp *ServiceProvider) ListenAddrs() []net.Addr {
+	addrs := make([]net.Addr, len(sp.listeners))
+	for i, listener := range sp.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
 }
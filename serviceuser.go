@@ -5,11 +5,21 @@ package netdicom
 //go:generate stringer -type QRLevel
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/giesekow/go-netdicom/sopclass"
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
@@ -42,30 +52,53 @@ const (
 type ServiceUser struct {
 	label    string // For  logging
 	upcallCh chan upcallEvent
+	priority dimse.Priority // ServiceUserParams.Priority.
+	// ServiceUserParams.UndecodableTransferSyntaxes.
+	undecodableTransferSyntaxes map[string]bool
 
-	mu   *sync.Mutex
-	cond *sync.Cond // Broadcast when status changes.
-	disp *serviceDispatcher
+	mu         *sync.Mutex
+	cond       *sync.Cond // Broadcast when status changes.
+	disp       *serviceDispatcher
+	tlsConfig  *tls.Config
+	socketOpts SocketOptions
+	logger     Logger // ServiceUserParams.Logger, labeled with the association.
+	dialer     func(ctx context.Context, network, addr string) (net.Conn, error)
+	ctx        context.Context // Bounds Connect's dial.
 
 	// Following fields are guarded by mu.
-	status serviceUserStatus
-	cm     *contextManager // Set only after the handshake completes.
+	status   serviceUserStatus
+	cm       *contextManager  // Set only after the handshake completes.
+	info     *AssociationInfo // Set only after the handshake completes.
+	abortErr *AbortError      // Set if the peer aborted the association.
+	assoc    *Association     // Created by the first call to Association.
+
+	// Storage commitment reports awaited by StorageCommit, keyed by
+	// transaction UID.
+	commitWaiters map[string]chan *StorageCommitmentResult
+
+	rejectErr *AssociateRejectError // Set if the peer rejected the association.
+	dialErr   error                 // Set if Connect failed to reach the peer.
 	// activeCommands map[uint16]*userCommandState // List of commands running
 }
 
 // ServiceUserParams defines parameters for a ServiceUser.
 type ServiceUserParams struct {
-	// Application-entity title of the peer. If empty, set to "unknown-called-ae"
+	// Application-entity title of the peer. If empty, set to
+	// "unknown-called". AE titles are at most 16 characters of the DICOM
+	// default character repertoire, excluding backslash (P3.5 6.2).
 	CalledAETitle string
 	// Application-entity title of the client. If empty, set to
-	// "unknown-calling-ae"
+	// "unknown-calling".
 	CallingAETitle string
 
 	// List of SOPUIDs wanted by the client. The value is typically one of
-	// the constants listed in sopclass package.
+	// the constants listed in sopclass package. Each is proposed in a
+	// presentation context of its own, so at most 128 may be listed. See
+	// also ProposedContexts.
 	SOPClasses []string
 
-	// List of Transfer syntaxes supported by the user.  If you know the
+	// List of Transfer syntaxes supported by the user, most preferred
+	// first. They are proposed to the peer in this order. If you know the
 	// transer syntax of the file you are going to copy, set that here.
 	// Otherwise, you'll need to re-encode the data w/ the given transfer
 	// syntax yourself.
@@ -74,27 +107,302 @@ type ServiceUserParams struct {
 	// spec is particularly moronic here, since we could just have specified
 	// the transfer syntax per data sent.
 	TransferSyntaxes []string
+
+	// Presentation contexts to propose after those of SOPClasses, each
+	// with transfer syntaxes of its own. A SOP class may be listed several
+	// times, and may also be in SOPClasses, e.g., to propose each of several
+	// transfer syntaxes in a context of its own, so that the peer accepts
+	// the ones it supports instead of picking one. When the peer accepts
+	// several contexts for a SOP class, operations use the one proposed
+	// first, except that C-STORE prefers one that accepted the transfer
+	// syntax of the dataset. SOPClasses and ProposedContexts together may list at most 128
+	// contexts.
+	ProposedContexts []ProposedContext
+
+	// Transfer syntaxes, e.g., compressed ones, that are proposed to the
+	// peer but whose data the C-GET callbacks can't decode. They should
+	// also be listed in TransferSyntaxes. The user can still send C-STORE
+	// requests in them, but C-STORE sub-operations of a C-GET received in
+	// them are answered with dimse.CStoreCannotUnderstand without calling
+	// the callback.
+	UndecodableTransferSyntaxes []string
+
+	// SOP classes for which the user proposes to act as an SCP as well as
+	// an SCU (P3.7 D.3.3.4). C-GET needs the SCP role for the storage
+	// classes, since the peer sends the datasets back using C-STORE on the
+	// same association. If nil and SOPClasses contains a C-GET SOP class,
+	// it defaults to the storage classes in SOPClasses.
+	SCPRoleSOPClasses []string
+
+	// Service-class-application-information to propose through SOP class
+	// extended negotiation (P3.7 D.3.3.5), keyed by SOP class UID. E.g.,
+	// {dicomuid.StudyRootQRFind: {1}} asks for relational queries. Keys
+	// not in SOPClasses are ignored. Use ExtendedNegotiation() to find
+	// out what the peer accepted.
+	ExtendedNegotiation map[string][]byte
+
+	// Service class and related general SOP classes to advertise through
+	// SOP class common extended negotiation (P3.7 D.3.3.6), keyed by SOP
+	// class UID. Some SCPs need it to accept a specialized or private SOP
+	// class. Keys not in SOPClasses are ignored. The peer doesn't respond
+	// to it; see AssociationContext.CommonExtendedNegotiation on the
+	// provider side.
+	CommonExtendedNegotiation map[string]CommonExtendedNegotiation
+
+	// Asynchronous operations window to propose to the peer (P3.7
+	// D.3.3.3). MaxOperationsInvoked is the max number of outstanding
+	// operations the client wants to invoke, and MaxOperationsPerformed is
+	// the max number of outstanding operations it can perform. Zero means
+	// unlimited. If both are zero, the window isn't proposed and the
+	// association defaults to synchronous operations.
+	MaxOperationsInvoked   uint16
+	MaxOperationsPerformed uint16
+
+	// Priority of the C-STORE, C-FIND, C-GET and C-MOVE requests sent to
+	// the peer. The zero value is dimse.PriorityMedium. Peers may ignore
+	// it.
+	Priority dimse.Priority
+
+	// UserIdentity, if non-nil, is sent to the peer for authentication.
+	UserIdentity *UserIdentity
+
+	// Implementation class UID and version name sent to the peer in
+	// A-ASSOCIATE-RQ. If empty, the go-dicom defaults are used.
+	ImplementationClassUID    string
+	ImplementationVersionName string
+
+	// ReadTimeout, if positive, is the max time to wait for each PDU from
+	// the peer. Since it also bounds how long the association may stay
+	// idle, it should be generous. WriteTimeout, if positive, is the max
+	// time to send each PDU. On timeout, the connection is closed.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// SkipUnknownCommands, if set, makes the association log and ignore
+	// DIMSE commands with an unrecognized command field, e.g., private
+	// commands of some vendors, instead of aborting.
+	SkipUnknownCommands bool
+
+	// StrictCommands, if set, makes the association abort on DIMSE commands
+	// with elements that their message type doesn't define, e.g., private
+	// elements, instead of passing them on in the Extra field of the
+	// message. See dimse.ReadMessageStrict.
+	StrictCommands bool
+
+	// AllowedCommandElements lists the elements, e.g., private elements
+	// of some vendors, that StrictCommands accepts in addition to those the
+	// message type defines. Ignored unless StrictCommands is set.
+	AllowedCommandElements []dicomtag.Tag
+
+	// PackCommandAndData, if set, fills each P-DATA-TF PDU sent up to the
+	// peer's max PDU size, so that a short DIMSE command shares its PDU with
+	// the start of the data, instead of taking up a PDU of its own (P3.8
+	// E.2). It is off by default, since some old implementations expect a
+	// single PDV item per PDU.
+	PackCommandAndData bool
+
+	// IdleTimeout, if positive, releases the association once no PDU has
+	// been sent or received for that long, e.g., so that an association
+	// kept for reuse isn't silently dropped by a NAT gateway. Unlike
+	// ReadTimeout, it ends the association gracefully. An operation whose
+	// peer stays silent for that long, e.g., a slow C-MOVE, is cut short.
+	IdleTimeout time.Duration
+
+	// ReleaseTimeout, if positive, is the max time to wait for the peer to
+	// answer A-RELEASE-RQ after Release. On timeout, the association is
+	// aborted and the connection is closed. Unlike the ARTIM timer, it
+	// applies only to releases initiated by this side.
+	ReleaseTimeout time.Duration
+
+	// Logger receives the log messages of the association. If nil, they
+	// are sent to dicomlog.
+	Logger Logger
+
+	// Metrics receives PDU, DIMSE and duration measurements of the
+	// association. If nil, they are discarded.
+	Metrics Metrics
+
+	// PDUTracer, if non-nil, receives the raw bytes of every PDU sent and
+	// received, e.g., NewHexDumpPDUTracer(os.Stderr).
+	PDUTracer PDUTracer
+
+	// OnTransition, if non-nil, receives every transition of the state
+	// machine of the association.
+	OnTransition TransitionTracer
+
+	// TLSConfig, if non-nil, makes Connect() dial the peer over TLS (DICOM
+	// Secure Transport Connection profile, P3.15 B.1). It has no effect on
+	// SetConn().
+	TLSConfig *tls.Config
+
+	// SocketOptions tunes the TCP connection to the peer.
+	SocketOptions SocketOptions
+
+	// Dialer, if non-nil, is used by Connect() to open the connection to
+	// the peer instead of net.Dial, e.g., to go through a SOCKS proxy or an
+	// SSH tunnel. It's called with network "tcp" and the address passed to
+	// Connect(). If TLSConfig is also set, the TLS handshake runs over the
+	// connection it returns.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ProposedContext is a presentation context listed in
+// ServiceUserParams.ProposedContexts.
+type ProposedContext struct {
+	SOPClassUID string
+	// Transfer syntaxes, most preferred first. If empty,
+	// ServiceUserParams.TransferSyntaxes are proposed.
+	TransferSyntaxes []string
+}
+
+// Returns the presentation contexts to propose: one for each of SOPClasses,
+// then ProposedContexts.
+func (params *ServiceUserParams) presentationContexts() []ProposedContext {
+	contexts := make([]ProposedContext, 0, len(params.SOPClasses)+len(params.ProposedContexts))
+	for _, sop := range params.SOPClasses {
+		contexts = append(contexts, ProposedContext{SOPClassUID: sop, TransferSyntaxes: params.TransferSyntaxes})
+	}
+	return append(contexts, params.ProposedContexts...)
+}
+
+// Returns the SOP classes of presentationContexts(), without duplicates.
+func (params *ServiceUserParams) proposedSOPClasses() []string {
+	var sopClasses []string
+	seen := make(map[string]bool)
+	for _, c := range params.presentationContexts() {
+		if !seen[c.SOPClassUID] {
+			seen[c.SOPClassUID] = true
+			sopClasses = append(sopClasses, c.SOPClassUID)
+		}
+	}
+	return sopClasses
+}
+
+// UserIdentity is the identity of the client, sent during the association
+// handshake (P3.7 D.3.3.7).
+type UserIdentity struct {
+	Type pdu_item.UserIdentityType
+	// Username, Kerberos ticket, SAML assertion, or JSON web token,
+	// depending on Type.
+	PrimaryField []byte
+	// Passcode. Used only when Type is UserIdentityUsernameAndPasscode.
+	SecondaryField []byte
+	// If true, the client asks the server to confirm the identity in
+	// A-ASSOCIATE-AC.
+	PositiveResponseRequested bool
+}
+
+// CommonExtendedNegotiation describes a SOP class through SOP class common
+// extended negotiation (P3.7 D.3.3.6).
+type CommonExtendedNegotiation struct {
+	// The service class of the SOP class, e.g., "1.2.840.10008.4.2" for the
+	// storage service class.
+	ServiceClassUID string
+	// General SOP classes that the SOP class specializes (P3.4 B.5).
+	RelatedGeneralSOPClassUIDs []string
+}
+
+// AbortError reports that the peer terminated the association with an
+// A-ABORT PDU (P3.8 9.3.8).
+type AbortError struct {
+	Source pdu.AbortSourceType
+	// Reason is meaningful only when Source is the service provider.
+	Reason pdu.AbortReasonType
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("association aborted by peer (source: %v, reason: %v)", e.Source, e.Reason)
+}
+
+// Checks that "title" is a legal AE title (P3.5 6.2): at most 16 characters
+// from the default character repertoire, excluding backslash and control
+// characters, and not all spaces. Without this check, the title would be
+// silently truncated in A-ASSOCIATE-RQ.
+func validateAETitle(title string) error {
+	if len(title) > 16 {
+		return fmt.Errorf("AE title '%s' is longer than 16 characters", title)
+	}
+	if strings.TrimSpace(title) == "" {
+		return fmt.Errorf("AE title '%s' is empty", title)
+	}
+	for i := 0; i < len(title); i++ {
+		if c := title[i]; c < 0x20 || c > 0x7e || c == '\\' {
+			return fmt.Errorf("AE title '%s' contains an illegal character %q", title, c)
+		}
+	}
+	return nil
 }
 
 func validateServiceUserParams(params *ServiceUserParams) error {
 	if params.CalledAETitle == "" {
-		params.CalledAETitle = "unknown-called-ae"
+		params.CalledAETitle = "unknown-called"
 	}
 	if params.CallingAETitle == "" {
-		params.CallingAETitle = "unknown-calling-ae"
+		params.CallingAETitle = "unknown-calling"
 	}
-	if len(params.SOPClasses) == 0 {
+	if err := validateAETitle(params.CalledAETitle); err != nil {
+		return fmt.Errorf("ServiceUserParams.CalledAETitle: %w", err)
+	}
+	if n := len(params.SOPClasses) + len(params.ProposedContexts); n > maxPresentationContexts {
+		return fmt.Errorf("ServiceUserParams.SOPClasses: %d presentation contexts proposed, but an association can carry at most %d presentation contexts",
+			n, maxPresentationContexts)
+	}
+	if err := validateAETitle(params.CallingAETitle); err != nil {
+		return fmt.Errorf("ServiceUserParams.CallingAETitle: %w", err)
+	}
+	if len(params.SOPClasses) == 0 && len(params.ProposedContexts) == 0 {
 		return fmt.Errorf("Empty ServiceUserParams.SOPClasses")
 	}
+	if sopClasses := params.proposedSOPClasses(); params.SCPRoleSOPClasses == nil && containsCGetSOPClass(sopClasses) {
+		storageClasses := make(map[string]bool)
+		for _, uid := range sopclass.StorageClasses {
+			storageClasses[uid] = true
+		}
+		for _, uid := range sopClasses {
+			if storageClasses[uid] {
+				params.SCPRoleSOPClasses = append(params.SCPRoleSOPClasses, uid)
+			}
+		}
+	}
+	if params.ImplementationClassUID == "" {
+		params.ImplementationClassUID = dicom.GoDICOMImplementationClassUID
+	}
+	if params.ImplementationVersionName == "" {
+		params.ImplementationVersionName = dicom.GoDICOMImplementationVersionName
+	} else if len(params.ImplementationVersionName) > 16 {
+		return fmt.Errorf("ServiceUserParams.ImplementationVersionName '%s' is longer than 16 bytes", params.ImplementationVersionName)
+	}
 	if len(params.TransferSyntaxes) == 0 {
 		params.TransferSyntaxes = dicomio.StandardTransferSyntaxes
-	} else {
-		for i, uid := range params.TransferSyntaxes {
-			canonicalUID, err := dicomio.CanonicalTransferSyntaxUID(uid)
-			if err != nil {
-				return err
-			}
-			params.TransferSyntaxes[i] = canonicalUID
+	} else if err := validateTransferSyntaxes(params.TransferSyntaxes); err != nil {
+		return err
+	}
+	// Copy the contexts, so that filling them in doesn't change the
+	// caller's.
+	contexts := make([]ProposedContext, len(params.ProposedContexts))
+	for i, c := range params.ProposedContexts {
+		if c.SOPClassUID == "" {
+			return fmt.Errorf("ServiceUserParams.ProposedContexts[%d]: empty SOP class UID", i)
+		}
+		if len(c.TransferSyntaxes) == 0 {
+			c.TransferSyntaxes = params.TransferSyntaxes
+		} else if err := validateTransferSyntaxes(c.TransferSyntaxes); err != nil {
+			return fmt.Errorf("ServiceUserParams.ProposedContexts[%d]: %w", i, err)
+		}
+		contexts[i] = c
+	}
+	params.ProposedContexts = contexts
+	return validateTransferSyntaxes(params.UndecodableTransferSyntaxes)
+}
+
+// Checks that the given UIDs are transfer syntaxes. They are kept as given:
+// canonicalizing them would turn compressed syntaxes into explicit VR little
+// endian, so they could be neither proposed nor matched against the
+// negotiated ones.
+func validateTransferSyntaxes(uids []string) error {
+	for _, uid := range uids {
+		if _, err := dicomio.CanonicalTransferSyntaxUID(uid); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -103,20 +411,40 @@ func validateServiceUserParams(params *ServiceUserParams) error {
 // NewServiceUser creates a new ServiceUser. The caller must call either
 // Connect() or SetConn() before calling any other method, such as Cstore.
 func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
+	return NewServiceUserContext(context.Background(), params)
+}
+
+// NewServiceUserContext is similar to NewServiceUser, but the association is
+// aborted when ctx is done. A deadline on ctx thus bounds the lifetime of the
+// association.
+func NewServiceUserContext(ctx context.Context, params ServiceUserParams) (*ServiceUser, error) {
 	if err := validateServiceUserParams(&params); err != nil {
 		return nil, err
 	}
 	mu := &sync.Mutex{}
 	label := newUID("user")
 	su := &ServiceUser{
-		label:    label,
-		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
-		mu:       mu,
-		cond:     sync.NewCond(mu),
-		status:   serviceUserInitial,
-	}
-	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
+		label:      label,
+		upcallCh:   make(chan upcallEvent, 128),
+		disp:       newServiceDispatcher(label),
+		mu:         mu,
+		cond:       sync.NewCond(mu),
+		status:     serviceUserInitial,
+		tlsConfig:  params.TLSConfig,
+		socketOpts: params.SocketOptions,
+		logger:     withLogValues(params.Logger, "association", label),
+		dialer:     params.Dialer,
+		ctx:        ctx,
+		priority:   params.Priority,
+
+		undecodableTransferSyntaxes: make(map[string]bool),
+		commitWaiters:               make(map[string]chan *StorageCommitmentResult),
+	}
+	for _, uid := range params.UndecodableTransferSyntaxes {
+		su.undecodableTransferSyntaxes[uid] = true
+	}
+	su.disp.registerCallback(dimse.CommandFieldNEventReportRq, su.onStorageCommitmentReport)
+	go runStateMachineForServiceUser(ctx, params, su.upcallCh, su.disp.downcallCh, label)
 	go func() {
 		for event := range su.upcallCh {
 			if event.eventType == upcallEventHandshakeCompleted {
@@ -125,8 +453,28 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 				su.status = serviceUserAssociationActive
 				su.cond.Broadcast()
 				su.cm = event.cm
+				su.info = event.info
 				doassert(su.cm != nil)
 				su.mu.Unlock()
+				su.disp.setMaxHandlers(event.cm.maxOpsPerformed)
+				continue
+			}
+			if event.eventType == upcallEventAborted {
+				dicomlog.Vprintf(0, "dicom.serviceUser(%s): Association aborted by peer: %v", su.label, event.abort)
+				su.mu.Lock()
+				su.abortErr = &AbortError{Source: event.abort.Source, Reason: event.abort.Reason}
+				su.mu.Unlock()
+				continue
+			}
+			if event.eventType == upcallEventRejected {
+				dicomlog.Vprintf(0, "dicom.serviceUser(%s): Association rejected by peer: %v", su.label, event.reject)
+				su.mu.Lock()
+				su.rejectErr = &AssociateRejectError{Result: event.reject.Result, Source: event.reject.Source, Reason: event.reject.Reason}
+				su.mu.Unlock()
+				continue
+			}
+			if event.eventType == upcallEventReleased {
+				dicomlog.Vprintf(1, "dicom.serviceUser(%s): Association released", su.label)
 				continue
 			}
 			doassert(event.eventType == upcallEventData)
@@ -151,65 +499,233 @@ func (su *ServiceUser) waitUntilReady() error {
 	if su.status != serviceUserAssociationActive {
 		// Will get an error when waiting for a response.
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connection failed")
+		switch {
+		case su.abortErr != nil:
+			return fmt.Errorf("dicom.serviceUser: Connection failed: %w", su.abortErr)
+		case su.rejectErr != nil:
+			return fmt.Errorf("dicom.serviceUser: Connection failed: %w", su.rejectErr)
+		case su.dialErr != nil:
+			return fmt.Errorf("dicom.serviceUser: Connection failed: %w", su.dialErr)
+		}
 		return fmt.Errorf("dicom.serviceUser: Connection failed")
 	}
 	return nil
 }
 
+// closedError annotates err, an error caused by the connection closing
+// mid-operation, with the A-ABORT received from the peer, if any.
+func (su *ServiceUser) closedError(err error) error {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.abortErr != nil {
+		return fmt.Errorf("%v: %w", err, su.abortErr)
+	}
+	return err
+}
+
+// AbortError returns the A-ABORT the peer sent to terminate the association,
+// or nil if the association wasn't aborted by the peer.
+func (su *ServiceUser) AbortError() *AbortError {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.abortErr
+}
+
+// active returns true if the association is established and hasn't been
+// released or aborted since.
+func (su *ServiceUser) active() bool {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.status == serviceUserAssociationActive && su.abortErr == nil
+}
+
 // Connect connects to the server at the given "host:port". Either Connect or
 // SetConn must be before calling CStore, etc.
 func (su *ServiceUser) Connect(serverAddr string) {
 	if su.status != serviceUserInitial {
 		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
 	}
-	conn, err := net.Dial("tcp", serverAddr)
+	conn, err := su.dial(serverAddr)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
+		su.mu.Lock()
+		su.dialErr = err
+		su.mu.Unlock()
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
 	} else {
+		applySocketOptions(conn, su.socketOpts, su.logger)
 		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 	}
 }
 
+// Opens a connection to serverAddr with ServiceUserParams.Dialer, or net.Dial
+// by default, then runs the TLS handshake over it if TLS is configured.
+func (su *ServiceUser) dial(serverAddr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if su.dialer != nil {
+		conn, err = su.dialer(su.ctx, "tcp", serverAddr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(su.ctx, "tcp", serverAddr)
+	}
+	if err != nil || su.tlsConfig == nil {
+		return conn, err
+	}
+	config := su.tlsConfig
+	if config.ServerName == "" {
+		// As in tls.Dial, the server name defaults to the host dialed.
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			host = serverAddr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(su.ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 // SetConn instructs ServiceUser to use the given network connection to talk to
 // the server. Either Connect or SetConn must be before calling CStore, etc.
 func (su *ServiceUser) SetConn(conn net.Conn) {
 	doassert(su.status == serviceUserInitial)
+	applySocketOptions(conn, su.socketOpts, su.logger)
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
+// AsyncOperationsWindow returns the asynchronous operations window negotiated
+// with the peer. It blocks until the association handshake completes. The
+// values are 1 unless the window was negotiated, and zero means unlimited.
+func (su *ServiceUser) AsyncOperationsWindow() (maxOpsInvoked, maxOpsPerformed int, err error) {
+	if err := su.waitUntilReady(); err != nil {
+		return 0, 0, err
+	}
+	return su.cm.maxOpsInvoked, su.cm.maxOpsPerformed, nil
+}
+
+// Returns true if sopClasses contains one of the C-GET information models of
+// sopclass.QRGetClasses, i.e., one of its classes other than the storage
+// classes it lists for the C-STORE sub-operations.
+func containsCGetSOPClass(sopClasses []string) bool {
+	for _, uid := range sopClasses {
+		if slices.Contains(sopclass.QRGetClasses, uid) && !slices.Contains(sopclass.StorageClasses, uid) {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiatedContexts returns the presentation contexts proposed to the peer,
+// along with the peer's verdict on each. It blocks until the association
+// handshake completes. Sending a request on a rejected context fails, so the
+// caller may use this list to find out up front which SOP classes and
+// transfer syntaxes are usable.
+func (su *ServiceUser) NegotiatedContexts() ([]NegotiatedContext, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.cm.negotiatedContexts(), nil
+}
+
+// AssociationInfo returns the parameters negotiated during the association
+// handshake. It blocks until the handshake completes.
+func (su *ServiceUser) AssociationInfo() (*AssociationInfo, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.info, nil
+}
+
+// ExtendedNegotiation returns the service-class-application-information
+// the peer accepted for sopClassUID through SOP class extended negotiation
+// (see ServiceUserParams.ExtendedNegotiation). It blocks until the association
+// handshake completes. It returns nil if the peer accepted none.
+func (su *ServiceUser) ExtendedNegotiation(sopClassUID string) ([]byte, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.cm.extendedNegotiation[sopClassUID], nil
+}
+
+// PeerImplementation returns the implementation class UID and version name
+// advertised by the peer. It blocks until the association handshake completes.
+// The values are empty if the peer didn't send them.
+func (su *ServiceUser) PeerImplementation() (classUID, versionName string, err error) {
+	if err := su.waitUntilReady(); err != nil {
+		return "", "", err
+	}
+	return su.cm.peerImplementationClassUID, su.cm.peerImplementationVersionName, nil
+}
+
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
+//
+// Deprecated: Use CEchoStatus, which also returns the status sent by the
+// remote AE, instead of folding a non-success status into the error.
 func (su *ServiceUser) CEcho() error {
-	err := su.waitUntilReady()
+	status, err := su.CEchoStatus()
 	if err != nil {
 		return err
 	}
+	if status.Status != dimse.StatusSuccess {
+		return fmt.Errorf("Non-OK status in C-ECHO response: %+v", status)
+	}
+	return nil
+}
+
+// CEchoStatus sends a C-ECHO request to the remote AE and returns the status
+// in its response. The error is non-nil if the response didn't arrive, e.g.,
+// because the peer didn't accept the verification SOP class. A non-success
+// status doesn't count as an error.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CEchoStatus() (dimse.Status, error) {
+	resp, err := su.CEchoResponse()
+	if err != nil {
+		return dimse.Status{}, err
+	}
+	return resp.Status, nil
+}
+
+// CEchoResponse is similar to CEchoStatus, but returns the whole response,
+// including the command elements unknown to this package (see
+// dimse.CEchoRsp.Extra).
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CEchoResponse() (*dimse.CEchoRsp, error) {
+	err := su.waitUntilReady()
+	if err != nil {
+		return nil, err
+	}
 	context, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("C-ECHO: the verification SOP class wasn't negotiated: %w", err)
 	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer su.disp.deleteCommand(cs)
 	cs.sendMessage(
-		&dimse.CEchoRq{MessageID: cs.messageID,
-			CommandDataSetType: dimse.CommandDataSetTypeNull,
+		&dimse.CEchoRq{
+			AffectedSOPClassUID: dicomuid.VerificationSOPClass,
+			MessageID:           cs.messageID,
+			CommandDataSetType:  dimse.CommandDataSetTypeNull,
 		}, nil)
 	event, ok := <-cs.upcallCh
 	if !ok {
-		return fmt.Errorf("Failed to receive C-ECHO response")
+		return nil, su.closedError(fmt.Errorf("Failed to receive C-ECHO response"))
 	}
 	resp, ok := event.command.(*dimse.CEchoRsp)
 	if !ok {
-		return fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
+		return nil, fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
 	}
-	if resp.Status.Status != dimse.StatusSuccess {
-		err = fmt.Errorf("Non-OK status in C-ECHO response: %+v", resp.Status)
-	}
-	return err
+	return resp, nil
 }
 
 // CStore issues a C-STORE request to transfer "ds" in remove peer.  It blocks
@@ -217,32 +733,196 @@ func (su *ServiceUser) CEcho() error {
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
-	err := su.waitUntilReady()
+	return su.cstore(context.Background(), ds, moveOriginator{})
+}
+
+// CStoreContext is similar to CStore, but it stops waiting for the response
+// and returns ctx.Err() when ctx is done. C-STORE can't be canceled, so the
+// peer may still store the dataset. The association stays usable.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreContext(ctx context.Context, ds *dicom.DataSet) error {
+	return su.cstore(ctx, ds, moveOriginator{})
+}
+
+// CStoreResponse is similar to CStoreContext, but returns the whole response
+// sent by the peer, including the command elements unknown to this package
+// (see dimse.CStoreRsp.Extra). A non-success status doesn't count as an
+// error; the caller should inspect the status of the response.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreResponse(ctx context.Context, ds *dicom.DataSet) (*dimse.CStoreRsp, error) {
+	return su.cstoreResponse(ctx, ds, moveOriginator{})
+}
+
+// Sends "ds" using C-STORE. "origin" is set if the C-STORE is a sub-operation
+// of a C-MOVE served by this process.
+func (su *ServiceUser) cstore(ctx context.Context, ds *dicom.DataSet, origin moveOriginator) error {
+	resp, err := su.cstoreResponse(ctx, ds, origin)
 	if err != nil {
 		return err
 	}
+	if resp.Status.Status != 0 {
+		return fmt.Errorf("dicom.cstore(%s): failed: %v", su.cm.label, resp.String())
+	}
+	return nil
+}
+
+// Similar to cstore, but returns the response sent by the peer.
+func (su *ServiceUser) cstoreResponse(ctx context.Context, ds *dicom.DataSet, origin moveOriginator) (*dimse.CStoreRsp, error) {
+	err := su.waitUntilReady()
+	if err != nil {
+		return nil, err
+	}
 	doassert(su.cm != nil)
 
 	var sopClassUID string
 	if sopClassUIDElem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID); err != nil {
-		return err
+		return nil, err
 	} else if sopClassUID, err = sopClassUIDElem.GetString(); err != nil {
-		return err
+		return nil, err
 	}
 	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
-		return err
+		return nil, err
+	}
+	defer su.disp.deleteCommand(cs)
+	resp, err := sendCStore(ctx, cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, su.priority, ds, origin)
+	if err != nil && ctx.Err() != nil {
+		su.abandonRequest(cs, false)
+	}
+	return resp, err
+}
+
+// Abandons the request sent by "cs" because the caller's context is done. If
+// "cancel", the peer is asked to stop the operation with C-CANCEL (P3.7
+// 9.3.2.3); it then sends a final response with the Cancel status, which is
+// discarded like the other responses to the request.
+func (su *ServiceUser) abandonRequest(cs *serviceCommandState, cancel bool) {
+	dicomlog.Vprintf(0, "dicom.serviceUser(%s): Abandoning request %d (cancel: %v)", su.label, cs.messageID, cancel)
+	if cancel {
+		cs.sendMessage(&dimse.CCancelRq{
+			MessageIDBeingRespondedTo: cs.messageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		}, nil)
+	}
+	su.disp.abandonCommand(cs)
+}
+
+// Receives the next response to the request sent by "cs". If ctx is done
+// first, the request is abandoned as described in abandonRequest, and
+// ctx.Err() is returned. ok is false if the association closed.
+func (su *ServiceUser) nextResponse(ctx context.Context, cs *serviceCommandState, cancel bool) (event upcallEvent, ok bool, err error) {
+	select {
+	case event, ok = <-cs.upcallCh:
+		return event, ok, nil
+	case <-ctx.Done():
+		su.abandonRequest(cs, cancel)
+		return upcallEvent{}, false, ctx.Err()
+	}
+}
+
+// CStoreFromReader reads a DICOM file from "r" and sends it to the peer using
+// C-STORE. The SOP class and instance UIDs are taken from the file's metadata.
+// It returns the status sent by the peer. The error is non-nil iff the request
+// couldn't be sent, or the response couldn't be received.
+//
+// The file is sent on the presentation context negotiated for its SOP class.
+// Files in one of the uncompressed transfer syntaxes are re-encoded as
+// needed, but compressed files must use the transfer syntax negotiated for the
+// context.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreFromReader(r io.Reader) (dimse.Status, error) {
+	ds, err := dicom.ReadDataSet(r, dicom.ReadOptions{})
+	if err != nil {
+		return dimse.Status{}, fmt.Errorf("dicom.serviceUser: C-STORE: failed to read the dataset: %w", err)
+	}
+	return su.cstoreDataSet(context.Background(), ds)
+}
+
+// CStoreFromFile is similar to CStoreFromReader, but reads the dataset from
+// the given file.
+func (su *ServiceUser) CStoreFromFile(path string) (dimse.Status, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return dimse.Status{}, err
+	}
+	defer f.Close()
+	return su.CStoreFromReader(f)
+}
+
+func (su *ServiceUser) cstoreDataSet(ctx context.Context, ds *dicom.DataSet) (dimse.Status, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return dimse.Status{}, err
+	}
+	var getString = func(tag dicomtag.Tag) (string, error) {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			return "", fmt.Errorf("dicom.serviceUser: C-STORE: data lacks %s: %w", tag.String(), err)
+		}
+		return elem.GetString()
+	}
+	sopClassUID, err := getString(dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return dimse.Status{}, err
+	}
+	transferSyntaxUID, err := getString(dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return dimse.Status{}, err
+	}
+	// Prefer a context that accepted the dataset's own transfer syntax, so
+	// that it's sent as is. Otherwise, uncompressed datasets are re-encoded
+	// in the syntax of the context that operations on the SOP class use.
+	context, ok := su.cm.lookupByAbstractAndTransferSyntaxUID(sopClassUID, transferSyntaxUID)
+	if !ok {
+		context, err = su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+		if err != nil {
+			return dimse.Status{}, err
+		}
+	}
+	if context.transferSyntaxUID != transferSyntaxUID &&
+		!(isUncompressedTransferSyntax(context.transferSyntaxUID) && isUncompressedTransferSyntax(transferSyntaxUID)) {
+		return dimse.Status{}, fmt.Errorf("dicom.serviceUser: C-STORE: no presentation context accepts %s in transfer syntax %s; the peer accepted only %s",
+			dicomuid.UIDString(sopClassUID),
+			dicomuid.UIDString(transferSyntaxUID),
+			dicomuid.UIDString(context.transferSyntaxUID))
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return dimse.Status{}, err
 	}
 	defer su.disp.deleteCommand(cs)
-	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+	resp, err := sendCStore(ctx, cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, su.priority, ds, moveOriginator{})
+	if err != nil {
+		if ctx.Err() != nil {
+			su.abandonRequest(cs, false)
+			return dimse.Status{}, err
+		}
+		return dimse.Status{}, su.closedError(err)
+	}
+	return resp.Status, nil
+}
+
+// isUncompressedTransferSyntax returns true if data in the given transfer
+// syntax can be re-encoded element by element. Deflated datasets qualify,
+// since they're inflated when read and deflated by the state machine when
+// sent.
+func isUncompressedTransferSyntax(uid string) bool {
+	switch uid {
+	case dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian,
+		dicomuid.DeflatedExplicitVRLittleEndian:
+		return true
+	}
+	return false
 }
 
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
@@ -272,6 +952,12 @@ type CFindResult struct {
 	// Exactly one of Err or Elements is set.
 	Err      error
 	Elements []*dicom.Element // Elements belonging to one dataset.
+
+	// The response that carried the match, or the failed final response
+	// that caused Err. Command elements that the dimse package doesn't
+	// know, e.g., vendor-specific ones, are in Response.Extra. Nil if Err
+	// wasn't caused by a response.
+	Response *dimse.CFindRsp
 }
 
 func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element, cm *contextManager) (contextManagerEntry, []byte, error) {
@@ -315,7 +1001,7 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 	}
 
 	// Encode the data payload containing the filtering conditions.
-	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
+	dataEncoder := newDataSetEncoder(context.transferSyntaxUID)
 	foundQRLevel := false
 	for _, elem := range filter {
 		if elem.Tag == dicomtag.QueryRetrieveLevel {
@@ -339,11 +1025,21 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 // either an error or a dataset found. The caller MUST read all responses from
 // the channel before issuing any other DIMSE command (C-FIND, C-STORE, etc).
 //
-// The param sopClassUID is one of the UIDs defined in sopclass.QRFindClasses.
+// The SOP class is picked from sopclass.QRFindClasses according to qrLevel.
 // filter is the list of elements to match and retrieve.
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindContext(context.Background(), qrLevel, filter)
+}
+
+// CFindContext is similar to CFind, but the operation is canceled when ctx is
+// done: a C-CANCEL is sent to the peer, and the channel yields ctx.Err() and is
+// closed. The association stays usable; the responses that the peer sends
+// for the canceled request are discarded.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
 	ch := make(chan CFindResult, 128)
 	err := su.waitUntilReady()
 	if err != nil {
@@ -357,11 +1053,115 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 		close(ch)
 		return ch
 	}
+	su.runCFind(ctx, context, payload, ch)
+	return ch
+}
+
+// CFindWithSOPClass is similar to CFind, but it lets the caller pick the SOP
+// class, e.g., Modality Worklist Information Model - FIND
+// ("1.2.840.10008.5.1.4.31"). The identifier
+// is sent as is, so it must contain QueryRetrieveLevel if the SOP class
+// requires one.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CFindWithSOPClass(sopClassUID string, identifier []*dicom.Element) chan CFindResult {
+	return su.CFindWithSOPClassContext(context.Background(), sopClassUID, identifier)
+}
+
+// CFindWithSOPClassContext is similar to CFindWithSOPClass, but the operation
+// is canceled when ctx is done, as in CFindContext.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CFindWithSOPClassContext(ctx context.Context, sopClassUID string, identifier []*dicom.Element) chan CFindResult {
+	ch := make(chan CFindResult, 128)
+	err := su.waitUntilReady()
+	if err == nil {
+		var context contextManagerEntry
+		context, err = su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+		if err == nil {
+			var payload []byte
+			payload, err = writeElementsToBytes(identifier, context.transferSyntaxUID)
+			if err == nil {
+				su.runCFind(ctx, context, payload, ch)
+				return ch
+			}
+		}
+	}
+	ch <- CFindResult{Err: err}
+	close(ch)
+	return ch
+}
+
+// CFindQuery sends a C-FIND request of the given SOP class, with "query" as
+// the identifier, and streams the matches. The channel is closed after the
+// final response; a failed final response yields a result with Err set, as in
+// CFind. Unlike CFindWithSOPClass, errors that prevent the request from being
+// sent, e.g., the SOP class wasn't negotiated, are returned directly, and the
+// channel is nil.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CFindQuery(sopClassUID string, query *dicom.DataSet) (<-chan CFindResult, error) {
+	return su.CFindQueryContext(context.Background(), sopClassUID, query)
+}
+
+// CFindQueryContext is similar to CFindQuery, but the operation is canceled
+// when ctx is done, as in CFindContext.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CFindQueryContext(ctx context.Context, sopClassUID string, query *dicom.DataSet) (<-chan CFindResult, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := writeElementsToBytes(query.Elements, context.transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan CFindResult, 128)
+	su.runCFind(ctx, context, payload, ch)
+	return ch, nil
+}
+
+// Checks that a C-FIND, C-GET, or C-MOVE response carries a data set iff its
+// status allows one. A pending C-FIND response must carry the matching
+// identifier, and the final one must not (P3.4 C.4.1.1.4). C-GET and C-MOVE
+// responses may carry a data set only when reporting failed sub-operations,
+// i.e., never when pending or successful (P3.4 C.4.2.1.4 and C.4.3.1.4).
+func checkResponseDataSet(resp dimse.Message) error {
+	var op string
+	var status dimse.StatusCode
+	switch r := resp.(type) {
+	case *dimse.CFindRsp:
+		op, status = "C-FIND", r.Status.Status
+	case *dimse.CGetRsp:
+		op, status = "C-GET", r.Status.Status
+	case *dimse.CMoveRsp:
+		op, status = "C-MOVE", r.Status.Status
+	default:
+		return nil
+	}
+	needData := op == "C-FIND" && status.IsPending()
+	allowData := needData || (op != "C-FIND" && !status.IsPending() && !status.IsSuccess())
+	if needData && !resp.HasData() {
+		return fmt.Errorf("dicom.serviceUser: %s: pending response lacks an identifier: %v", op, resp)
+	}
+	if !allowData && resp.HasData() {
+		return fmt.Errorf("dicom.serviceUser: %s: response with status %v carries an unexpected data set: %v", op, status, resp)
+	}
+	return nil
+}
+
+// Sends a C-FIND-RQ with the given identifier and streams the matches to ch
+// until the final response arrives, or ctx is done. Closes ch on return.
+func (su *ServiceUser) runCFind(ctx context.Context, context contextManagerEntry, payload []byte, ch chan CFindResult) {
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
-		return ch
+		return
 	}
 	go func() {
 		defer close(ch)
@@ -370,14 +1170,18 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 			&dimse.CFindRq{
 				AffectedSOPClassUID: context.abstractSyntaxUID,
 				MessageID:           cs.messageID,
+				Priority:            su.priority,
 				CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
 			},
 			payload)
 		for {
-			event, ok := <-cs.upcallCh
+			event, ok, err := su.nextResponse(ctx, cs, true)
+			if err != nil {
+				ch <- CFindResult{Err: err}
+				break
+			}
 			if !ok {
-				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+				ch <- CFindResult{Err: su.closedError(fmt.Errorf("Connection closed while waiting for C-FIND response"))}
 				break
 			}
 			doassert(event.eventType == upcallEventData)
@@ -387,23 +1191,27 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
 				break
 			}
-			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
-			if err != nil {
-				dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
+			if err := checkResponseDataSet(resp); err != nil {
 				ch <- CFindResult{Err: err}
-			} else {
-				ch <- CFindResult{Elements: elems}
+				break
 			}
-			if resp.Status.Status != dimse.StatusPending {
-				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
+			if !resp.Status.Status.IsPending() {
+				// The final response carries no match (P3.4
+				// C.4.1.1.4).
+				if !resp.Status.Status.IsSuccess() && !resp.Status.Status.IsWarning() {
+					ch <- CFindResult{Err: fmt.Errorf("C-FIND failed: %+v", resp.Status), Response: resp}
 				}
 				break
 			}
+			ds, err := event.dataSet()
+			if err != nil {
+				dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
+				ch <- CFindResult{Err: err, Response: resp}
+			} else {
+				ch <- CFindResult{Elements: ds.Elements, Response: resp}
+			}
 		}
 	}()
-	return ch
 }
 
 // CGet runs a C-GET command. It calls "cb" sequentially for every dataset
@@ -417,27 +1225,124 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 // TODO(saito) We should parse the data into DataSet before passing to "cb".
 func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
-	err := su.waitUntilReady()
+	return su.CGetContext(context.Background(), qrLevel, filter, cb)
+}
+
+// CGetContext is similar to CGet, but the operation is canceled when ctx is
+// done: a C-CANCEL is sent to the peer, and ctx.Err() is returned. The
+// association stays usable; the C-STORE sub-operations that the peer sends
+// afterwards are refused, and its responses are discarded.
+func (su *ServiceUser) CGetContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	resp, err := su.CGetResponse(ctx, qrLevel, filter, cb)
 	if err != nil {
 		return err
 	}
+	if resp.Status.Status != 0 {
+		e := fmt.Errorf("Received C-GET error: %+v", resp)
+		dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
+		return e
+	}
+	return nil
+}
+
+// CGetResponse is similar to CGetContext, but returns the final response sent
+// by the peer, including the sub-operation counts and the command elements
+// unknown to this package (see dimse.CGetRsp.Extra). A non-success status
+// doesn't count as an error; the caller should inspect the status of the
+// response.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CGetResponse(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) (*dimse.CGetRsp, error) {
+	err := su.waitUntilReady()
+	if err != nil {
+		return nil, err
+	}
 	context, payload, err := encodeQRPayload(qrOpCGet, qrLevel, filter, su.cm)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return su.runCGet(ctx, context, payload,
+		func(transferSyntaxUID string, c *dimse.CStoreRq, data []byte) dimse.Status {
+			return cb(transferSyntaxUID, c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, data)
+		})
+}
+
+// CGetWithSOPClass runs a C-GET command using the given SOP class. The
+// identifier is sent as is, so it must contain QueryRetrieveLevel. The peer
+// sends the matching datasets back using C-STORE on the same association, so
+// the storage classes must be listed in ServiceUserParams.SCPRoleSOPClasses
+// (done by default when SOPClasses contains a C-GET class).
+//
+// onStore is called sequentially for every dataset received. It should return
+// dimse.Success iff the dataset was successfully and stably written. The
+// dataset passed to onStore includes the TransferSyntaxUID,
+// MediaStorageSOPClassUID, and MediaStorageSOPInstanceUID metadata elements.
+//
+// CGetWithSOPClass blocks until the final response arrives, and returns it. The
+// error is non-nil iff the request couldn't be sent or the final response
+// couldn't be received; the caller should inspect the status of the final
+// response.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CGetWithSOPClass(sopClassUID string, identifier []*dicom.Element,
+	onStore func(ds *dicom.DataSet) dimse.Status) (*dimse.CGetRsp, error) {
+	return su.CGetWithSOPClassContext(context.Background(), sopClassUID, identifier, onStore)
+}
+
+// CGetWithSOPClassContext is similar to CGetWithSOPClass, but the operation is
+// canceled when ctx is done, as in CGetContext.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CGetWithSOPClassContext(ctx context.Context, sopClassUID string, identifier []*dicom.Element,
+	onStore func(ds *dicom.DataSet) dimse.Status) (*dimse.CGetRsp, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := writeElementsToBytes(identifier, context.transferSyntaxUID)
+	if err != nil {
+		return nil, err
 	}
+	return su.runCGet(ctx, context, payload,
+		func(transferSyntaxUID string, c *dimse.CStoreRq, data []byte) dimse.Status {
+			ds, err := decodeCStoreDataSet(transferSyntaxUID, c, data)
+			if err != nil {
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: Failed to decode %v: %v", c.AffectedSOPInstanceUID, err)
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+			}
+			return onStore(ds)
+		})
+}
+
+// Sends a C-GET-RQ with the given identifier and waits for the final
+// response, or until ctx is done. C-STORE requests received in the meantime are
+// handed to onStore, along with the transfer syntax of the data.
+func (su *ServiceUser) runCGet(ctx context.Context, context contextManagerEntry, payload []byte,
+	onStore func(transferSyntaxUID string, c *dimse.CStoreRq, data []byte) dimse.Status) (*dimse.CGetRsp, error) {
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer su.disp.deleteCommand(cs)
 
-	handleCStore := func(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+	handleCStore := func(msg dimse.Message, data []byte, storeCS *serviceCommandState, aInfo associationInfo) {
 		c := msg.(*dimse.CStoreRq)
-		status := cb(
-			context.transferSyntaxUID,
-			c.AffectedSOPClassUID,
-			c.AffectedSOPInstanceUID,
-			data)
+		var status dimse.Status
+		if transferSyntaxUID := storeCS.context.transferSyntaxUID; su.undecodableTransferSyntaxes[transferSyntaxUID] {
+			dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: Declining %v in undecodable transfer syntax %v",
+				c.AffectedSOPInstanceUID, dicomuid.UIDString(transferSyntaxUID))
+			status = dimse.Status{
+				Status:       dimse.CStoreCannotUnderstand,
+				ErrorComment: fmt.Sprintf("Cannot decode transfer syntax %s", transferSyntaxUID),
+			}
+		} else {
+			status = onStore(transferSyntaxUID, c, data)
+		}
 		resp := &dimse.CStoreRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -445,39 +1350,144 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 			AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
 			Status:                    status,
 		}
-		cs.sendMessage(resp, nil)
+		storeCS.sendMessage(resp, nil)
 	}
 	su.disp.registerCallback(dimse.CommandFieldCStoreRq, handleCStore)
-	defer su.disp.unregisterCallback(dimse.CommandFieldCStoreRq)
+	canceled := false
+	defer func() {
+		if canceled {
+			// The peer may still be sending sub-operations.
+			su.disp.registerCallback(dimse.CommandFieldCStoreRq, refuseCStore)
+		} else {
+			su.disp.unregisterCallback(dimse.CommandFieldCStoreRq)
+		}
+	}()
 	cs.sendMessage(
 		&dimse.CGetRq{
 			AffectedSOPClassUID: context.abstractSyntaxUID,
 			MessageID:           cs.messageID,
+			Priority:            su.priority,
 			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
 		},
 		payload)
 	for {
-		event, ok := <-cs.upcallCh
+		event, ok, err := su.nextResponse(ctx, cs, true)
+		if err != nil {
+			canceled = true
+			return nil, err
+		}
 		if !ok {
-			su.status = serviceUserClosed
-			return fmt.Errorf("Connection closed while waiting for C-GET response")
+			return nil, su.closedError(fmt.Errorf("Connection closed while waiting for C-GET response"))
 		}
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CGetRsp)
 		if !ok {
-			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
+			return nil, fmt.Errorf("Found wrong response for C-GET: %v", event.command)
+		}
+		if err := checkResponseDataSet(resp); err != nil {
+			return nil, err
+		}
+		if !resp.Status.Status.IsPending() {
+			return resp, nil
 		}
-		if resp.Status.Status != dimse.StatusPending {
-			if resp.Status.Status != 0 {
-				e := fmt.Errorf("Received C-GET error: %+v", resp)
-				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
-				return e
+	}
+}
+
+// Answers a C-STORE request that arrives after the C-GET that caused it was
+// canceled.
+func refuseCStore(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+	c := msg.(*dimse.CStoreRq)
+	cs.sendMessage(&dimse.CStoreRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+		Status:                    dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: "C-GET canceled"},
+	}, nil)
+}
+
+// CMove runs a C-MOVE command. It asks the peer to send the datasets matching
+// "identifier" to the AE named destinationAE, which must be known to the peer;
+// otherwise, the final response has status CMoveMoveDestinationUnknown. An
+// error is returned without contacting the peer if destinationAE isn't a legal
+// AE title. The identifier is sent as is, so it must contain QueryRetrieveLevel.
+//
+// progress, if non-nil, is called with every pending response, which reports
+// the number of remaining, completed, failed, and warning sub-operations. CMove
+// blocks until the final response arrives, and returns it. The error is
+// non-nil iff the request couldn't be sent or the final response couldn't be
+// received; the caller should inspect the status of the final response.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMove(sopClassUID, destinationAE string, identifier []*dicom.Element,
+	progress func(*dimse.CMoveRsp)) (*dimse.CMoveRsp, error) {
+	return su.CMoveContext(context.Background(), sopClassUID, destinationAE, identifier, progress)
+}
+
+// CMoveContext is similar to CMove, but the operation is canceled when ctx is
+// done: a C-CANCEL is sent to the peer, and ctx.Err() is returned. The
+// association stays usable; the responses that the peer sends for the
+// canceled request are discarded.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMoveContext(ctx context.Context, sopClassUID, destinationAE string, identifier []*dicom.Element,
+	progress func(*dimse.CMoveRsp)) (*dimse.CMoveRsp, error) {
+	if err := validateAETitle(destinationAE); err != nil {
+		return nil, fmt.Errorf("dicom.serviceUser: C-MOVE: invalid destination: %w", err)
+	}
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := writeElementsToBytes(identifier, context.transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return nil, err
+	}
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(
+		&dimse.CMoveRq{
+			AffectedSOPClassUID: context.abstractSyntaxUID,
+			MessageID:           cs.messageID,
+			Priority:            su.priority,
+			MoveDestination:     destinationAE,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		},
+		payload)
+	for {
+		event, ok, err := su.nextResponse(ctx, cs, true)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, su.closedError(fmt.Errorf("Connection closed while waiting for C-MOVE response"))
+		}
+		doassert(event.eventType == upcallEventData)
+		doassert(event.command != nil)
+		resp, ok := event.command.(*dimse.CMoveRsp)
+		if !ok {
+			return nil, fmt.Errorf("Found wrong response for C-MOVE: %v", event.command)
+		}
+		if err := checkResponseDataSet(resp); err != nil {
+			return nil, err
+		}
+		if !resp.Status.Status.IsPending() {
+			if !resp.Status.Status.IsSuccess() {
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-MOVE: Received non-success response: %+v", resp)
 			}
-			break
+			return resp, nil
+		}
+		if progress != nil {
+			progress(resp)
 		}
 	}
-	return nil
 }
 
 // Release shuts down the connection. It must be called exactly once.  After
@@ -490,3 +1500,50 @@ func (su *ServiceUser) Release() {
 	su.cond.Broadcast()
 	su.disp.close()
 }
+
+// Abort terminates the association at once by sending an A-ABORT PDU with the
+// given source and reason (P3.8 9.3.8) and closing the connection, e.g., to
+// give up on a transfer that's no longer wanted. Operations in progress fail.
+// If source is pdu.AbortSourceServiceUser, reason must be
+// pdu.AbortReasonNotSpecified, since the reason is significant only for the
+// service-provider source.
+//
+// Abort may be called instead of Release, but not after it. Calling Release
+// after Abort is harmless.
+func (su *ServiceUser) Abort(source pdu.AbortSourceType, reason pdu.AbortReasonType) error {
+	if err := validateAbort(source, reason); err != nil {
+		return fmt.Errorf("dicom.serviceUser(%s): Abort: %w", su.label, err)
+	}
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.status == serviceUserClosed {
+		return fmt.Errorf("dicom.serviceUser(%s): Abort: association already closed", su.label)
+	}
+	dicomlog.Vprintf(0, "dicom.serviceUser(%s): Aborting association (source: %v, reason: %v)", su.label, source, reason)
+	su.disp.downcallCh <- stateEvent{event: evt15, pdu: &pdu.AAbort{Source: source, Reason: reason}}
+	su.status = serviceUserClosed
+	su.cond.Broadcast()
+	return nil
+}
+
+// Checks that "source" and "reason" are legal in an A-ABORT PDU (P3.8 Table
+// 9-26).
+func validateAbort(source pdu.AbortSourceType, reason pdu.AbortReasonType) error {
+	switch source {
+	case pdu.AbortSourceServiceUser:
+		if reason != pdu.AbortReasonNotSpecified {
+			return fmt.Errorf("reason %v is not allowed for source %v", reason, source)
+		}
+	case pdu.AbortSourceServiceProvider:
+		switch reason {
+		case pdu.AbortReasonNotSpecified, pdu.AbortReasonUnrecognizedPDU, pdu.AbortReasonUnexpectedPDU,
+			pdu.AbortReasonUnrecognizedPDUParameter, pdu.AbortReasonUnexpectedPDUParameter,
+			pdu.AbortReasonInvalidPDUParameterValue:
+		default:
+			return fmt.Errorf("invalid abort reason %v", reason)
+		}
+	default:
+		return fmt.Errorf("invalid abort source %v", source)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package netdicom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/giesekow/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceUserParamsAETitles(t *testing.T) {
+	newParams := func(called, calling string) ServiceUserParams {
+		return ServiceUserParams{
+			CalledAETitle:    called,
+			CallingAETitle:   calling,
+			SOPClasses:       sopclass.VerificationClasses,
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}
+	}
+
+	// Valid titles are kept as is.
+	params := newParams("STORESCP", "0123456789ABCDEF")
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Equal(t, "STORESCP", params.CalledAETitle)
+	require.Equal(t, "0123456789ABCDEF", params.CallingAETitle)
+
+	// Empty titles are replaced by legal defaults.
+	params = newParams("", "")
+	require.NoError(t, validateServiceUserParams(&params))
+	require.NoError(t, validateAETitle(params.CalledAETitle))
+	require.NoError(t, validateAETitle(params.CallingAETitle))
+
+	for _, tc := range []struct{ called, calling string }{
+		{"0123456789ABCDEFG", "SCU"}, // too long
+		{"SCP", "0123456789ABCDEFG"},
+		{"    ", "SCU"}, // all spaces
+		{"SCP", "SC\\U"},
+		{"SCP", "SC\nU"},
+		{"SCP", "SCÜ"},
+	} {
+		params := newParams(tc.called, tc.calling)
+		require.Error(t, validateServiceUserParams(&params), "called: %q, calling: %q", tc.called, tc.calling)
+		_, err := NewServiceUser(newParams(tc.called, tc.calling))
+		require.Error(t, err)
+	}
+}
+
+func TestServiceUserParamsContextIDs(t *testing.T) {
+	newParams := func(n int) ServiceUserParams {
+		params := ServiceUserParams{TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}}
+		for i := 0; i < n; i++ {
+			params.SOPClasses = append(params.SOPClasses, fmt.Sprintf("1.2.3.%d", i))
+		}
+		return params
+	}
+
+	// 128 contexts use up all the odd IDs, each once.
+	params := newParams(128)
+	require.NoError(t, validateServiceUserParams(&params))
+	seen := map[byte]bool{}
+	for _, item := range newContextManager("test").generateAssociateRequest(params) {
+		if pc, ok := item.(*pdu_item.PresentationContextItem); ok {
+			require.Equal(t, byte(1), pc.ContextID%2, "even context ID %d", pc.ContextID)
+			require.False(t, seen[pc.ContextID], "context ID %d reused", pc.ContextID)
+			seen[pc.ContextID] = true
+		}
+	}
+	require.Len(t, seen, 128)
+
+	// One more would wrap around.
+	params = newParams(129)
+	err := validateServiceUserParams(&params)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "at most 128 presentation contexts")
+	_, err = NewServiceUser(newParams(129))
+	require.Error(t, err)
+}
+
+// Returns the abstract and transfer syntaxes of the presentation contexts that
+// "params" proposes, as "abstract: transfer1 transfer2...".
+func proposedContexts(params ServiceUserParams) []string {
+	var contexts []string
+	for _, item := range newContextManager("test").generateAssociateRequest(params) {
+		pc, ok := item.(*pdu_item.PresentationContextItem)
+		if !ok {
+			continue
+		}
+		var names []string
+		for _, subItem := range pc.Items {
+			switch v := subItem.(type) {
+			case *pdu_item.AbstractSyntaxSubItem:
+				names = append(names, v.Name+":")
+			case *pdu_item.TransferSyntaxSubItem:
+				names = append(names, v.Name)
+			}
+		}
+		contexts = append(contexts, strings.Join(names, " "))
+	}
+	return contexts
+}
+
+func TestServiceUserParamsHelpers(t *testing.T) {
+	context := func(sopClassUID string, transferSyntaxes ...string) string {
+		return strings.Join(append([]string{sopClassUID + ":"}, transferSyntaxes...), " ")
+	}
+	littleEndian := []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian}
+	require.Equal(t, []string{context(dicomuid.VerificationSOPClass, littleEndian...)},
+		proposedContexts(VerificationSCUParams(ServiceUserParams{})))
+
+	params := StorageSCUParams(ServiceUserParams{CalledAETitle: "STORESCP"}, sopclass.StorageClasses[0], sopclass.StorageClasses[1])
+	require.Equal(t, "STORESCP", params.CalledAETitle)
+	require.Equal(t, []string{
+		context(sopclass.StorageClasses[0], dicomio.StandardTransferSyntaxes...),
+		context(sopclass.StorageClasses[1], dicomio.StandardTransferSyntaxes...),
+	}, proposedContexts(params))
+	require.Len(t, proposedContexts(StorageSCUParams(ServiceUserParams{})), len(sopclass.StorageClasses))
+
+	var want []string
+	for _, uid := range []string{
+		dicomuid.PatientRootQRFind, dicomuid.StudyRootQRFind, "1.2.840.10008.5.1.4.1.2.3.1", "1.2.840.10008.5.1.4.31",
+		dicomuid.PatientRootQRMove, dicomuid.StudyRootQRMove, "1.2.840.10008.5.1.4.1.2.3.2",
+		dicomuid.PatientRootQRGet, dicomuid.StudyRootQRGet, "1.2.840.10008.5.1.4.1.2.3.3",
+	} {
+		want = append(want, context(uid, littleEndian...))
+	}
+	require.Equal(t, want, proposedContexts(QueryRetrieveSCUParams(ServiceUserParams{})))
+
+	// The helpers compose. Duplicate SOP classes are dropped, and the
+	// transfer syntaxes set first are kept.
+	params = StorageSCUParams(VerificationSCUParams(VerificationSCUParams(ServiceUserParams{})), sopclass.StorageClasses[0])
+	require.Equal(t, []string{
+		context(dicomuid.VerificationSOPClass, littleEndian...),
+		context(sopclass.StorageClasses[0], littleEndian...),
+	}, proposedContexts(params))
+
+	// The caller's transfer syntaxes win, and aren't aliased.
+	syntaxes := []string{dicomuid.ExplicitVRLittleEndian}
+	params = VerificationSCUParams(ServiceUserParams{TransferSyntaxes: syntaxes})
+	require.Equal(t, []string{context(dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian)}, proposedContexts(params))
+	params.TransferSyntaxes[0] = dicomuid.ImplicitVRLittleEndian
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, syntaxes[0])
+}
+
+func TestContainsCGetSOPClass(t *testing.T) {
+	require.True(t, containsCGetSOPClass([]string{dicomuid.StudyRootQRGet}))
+	// Patient/Study Only Query/Retrieve Information Model - GET.
+	require.True(t, containsCGetSOPClass([]string{"1.2.840.10008.5.1.4.1.2.3.3"}))
+	// QRGetClasses also lists the storage classes, which don't count.
+	require.False(t, containsCGetSOPClass(sopclass.StorageClasses))
+	require.False(t, containsCGetSOPClass(sopclass.QRMoveClasses))
+}
+
+func TestTransferSyntaxesForDataSet(t *testing.T) {
+	const jpegLossless = "1.2.840.10008.1.2.4.70"
+	want := []string{jpegLossless, dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+	require.Equal(t, want, TransferSyntaxesForDataSet(jpegLossless))
+	require.Equal(t, want, TransferSyntaxesForDataSet(jpegLossless+"\x00"))
+	require.Equal(t, []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+		TransferSyntaxesForDataSet(dicomuid.ImplicitVRLittleEndian))
+	require.Equal(t, []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+		TransferSyntaxesForDataSet(""))
+
+	// The proposal keeps the order.
+	params := StorageSCUParams(ServiceUserParams{TransferSyntaxes: TransferSyntaxesForDataSet(jpegLossless)},
+		sopclass.StorageClasses[0])
+	require.Equal(t, []string{strings.Join(append([]string{sopclass.StorageClasses[0] + ":"}, want...), " ")},
+		proposedContexts(params))
+}
+
+func TestCheckResponseDataSet(t *testing.T) {
+	pending := dimse.Status{Status: dimse.StatusPending}
+	failure := dimse.Status{Status: dimse.CMoveOutOfResourcesUnableToPerformSubOperations}
+	for _, test := range []struct {
+		resp dimse.Message
+		err  string
+	}{
+		{&dimse.CFindRsp{Status: pending, CommandDataSetType: dimse.CommandDataSetTypeNonNull}, ""},
+		{&dimse.CFindRsp{Status: dimse.Success, CommandDataSetType: dimse.CommandDataSetTypeNull}, ""},
+		{&dimse.CFindRsp{Status: pending, CommandDataSetType: dimse.CommandDataSetTypeNull}, "C-FIND: pending response lacks an identifier"},
+		{&dimse.CFindRsp{Status: dimse.Success, CommandDataSetType: dimse.CommandDataSetTypeNonNull}, "C-FIND: response with status StatusSuccess carries an unexpected data set"},
+		{&dimse.CGetRsp{Status: pending, CommandDataSetType: dimse.CommandDataSetTypeNull}, ""},
+		{&dimse.CGetRsp{Status: pending, CommandDataSetType: dimse.CommandDataSetTypeNonNull}, "C-GET: response with status StatusPending carries an unexpected data set"},
+		{&dimse.CMoveRsp{Status: dimse.Success, CommandDataSetType: dimse.CommandDataSetTypeNonNull}, "C-MOVE: response with status StatusSuccess carries an unexpected data set"},
+		// A failure may list the failed SOP instances.
+		{&dimse.CMoveRsp{Status: failure, CommandDataSetType: dimse.CommandDataSetTypeNonNull}, ""},
+	} {
+		err := checkResponseDataSet(test.resp)
+		if test.err == "" {
+			require.NoError(t, err, test.resp.String())
+		} else {
+			require.Error(t, err, test.resp.String())
+			require.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestAssociateRejectErrorClassification(t *testing.T) {
+	permanent := &AssociateRejectError{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+	}
+	require.False(t, permanent.Transient())
+	require.Equal(t, "DICOM UL service-user", permanent.SourceDescription())
+	require.Equal(t, "called AE title not recognized", permanent.ReasonDescription())
+	require.Equal(t, "association rejected by peer (permanent, source: DICOM UL service-user, reason: called AE title not recognized)",
+		permanent.Error())
+
+	transient := &AssociateRejectError{
+		Result: pdu.ResultRejectedTransient,
+		Source: pdu.SourceULServiceProviderPresentation,
+		Reason: pdu.RejectReasonTemporaryCongestion,
+	}
+	require.True(t, transient.Transient())
+	require.Equal(t, "DICOM UL service-provider (presentation related function)", transient.SourceDescription())
+	require.Equal(t, "temporary congestion", transient.ReasonDescription())
+
+	// Reason 2 means different things depending on the source.
+	acse := &AssociateRejectError{Result: pdu.ResultRejectedTransient, Source: pdu.SourceULServiceProviderACSE, Reason: 2}
+	require.Equal(t, "protocol version not supported", acse.ReasonDescription())
+	require.Equal(t, "RejectReasonType(5)", (&AssociateRejectError{Source: pdu.SourceULServiceUser, Reason: 5}).ReasonDescription())
+}
@@ -0,0 +1,110 @@
+package netdicom
+
+// This file defines helpers that fill ServiceUserParams for common roles.
+
+import (
+	"strings"
+
+	"github.com/giesekow/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// Transfer syntaxes proposed by VerificationSCUParams and
+// QueryRetrieveSCUParams. Every peer must support implicit VR little endian
+// (P3.5 10.1).
+var uncompressedLittleEndianTransferSyntaxes = []string{
+	dicomuid.ImplicitVRLittleEndian,
+	dicomuid.ExplicitVRLittleEndian,
+}
+
+// VerificationSCUParams returns a copy of "params" that also proposes the
+// Verification SOP class, for issuing C-ECHO. If params.TransferSyntaxes is
+// empty, implicit and explicit VR little endian are proposed.
+//
+// The helpers compose, e.g.,
+//
+//	params := netdicom.StorageSCUParams(
+//		netdicom.VerificationSCUParams(netdicom.ServiceUserParams{CalledAETitle: "STORESCP"}))
+func VerificationSCUParams(params ServiceUserParams) ServiceUserParams {
+	return withSOPClasses(params, sopclass.VerificationClasses, uncompressedLittleEndianTransferSyntaxes)
+}
+
+// StorageSCUParams returns a copy of "params" that also proposes the given
+// storage SOP classes, for issuing C-STORE. If sopClasses is empty, all of
+// sopclass.StorageClasses are proposed. If params.TransferSyntaxes is empty,
+// dicomio.StandardTransferSyntaxes are proposed.
+func StorageSCUParams(params ServiceUserParams, sopClasses ...string) ServiceUserParams {
+	if len(sopClasses) == 0 {
+		sopClasses = sopclass.StorageClasses
+	}
+	return withSOPClasses(params, sopClasses, dicomio.StandardTransferSyntaxes)
+}
+
+// QueryRetrieveSCUParams returns a copy of "params" that also proposes the
+// query/retrieve SOP classes for issuing C-FIND, C-MOVE and C-GET. If
+// params.TransferSyntaxes is empty, implicit and explicit VR little endian are
+// proposed.
+//
+// C-GET also needs the storage classes of the objects to retrieve; add them
+// with StorageSCUParams. Proposing all of sopclass.StorageClasses along with
+// the query/retrieve classes exceeds the 128 presentation contexts an
+// association can carry, so list only the classes you expect.
+func QueryRetrieveSCUParams(params ServiceUserParams) ServiceUserParams {
+	var sopClasses []string
+	sopClasses = append(sopClasses, sopclass.QRFindClasses...)
+	sopClasses = append(sopClasses, sopclass.QRMoveClasses...)
+	// QRGetClasses ends with the storage classes.
+	sopClasses = append(sopClasses, sopclass.QRGetClasses[:len(sopclass.QRGetClasses)-len(sopclass.StorageClasses)]...)
+	return withSOPClasses(params, sopClasses, uncompressedLittleEndianTransferSyntaxes)
+}
+
+// Returns a copy of "params" with sopClasses appended to params.SOPClasses,
+// skipping the ones already there. params.TransferSyntaxes is set to
+// transferSyntaxes if it is empty. The slices are copied, so that the result
+// doesn't share them with the caller's params.
+func withSOPClasses(params ServiceUserParams, sopClasses, transferSyntaxes []string) ServiceUserParams {
+	seen := make(map[string]bool)
+	merged := make([]string, 0, len(params.SOPClasses)+len(sopClasses))
+	for _, list := range [][]string{params.SOPClasses, sopClasses} {
+		for _, uid := range list {
+			if !seen[uid] {
+				seen[uid] = true
+				merged = append(merged, uid)
+			}
+		}
+	}
+	params.SOPClasses = merged
+	if len(params.TransferSyntaxes) == 0 {
+		params.TransferSyntaxes = append([]string(nil), transferSyntaxes...)
+	} else {
+		params.TransferSyntaxes = append([]string(nil), params.TransferSyntaxes...)
+	}
+	return params
+}
+
+// TransferSyntaxesForDataSet returns the transfer syntaxes to propose for
+// sending a dataset encoded in sourceTransferSyntaxUID, most preferred first:
+// the source syntax, so that the dataset can be sent as is, then explicit and
+// implicit VR little endian. The latter are proposed as fallbacks for peers
+// that don't support the source syntax; sending a compressed dataset in them
+// requires decompressing it first, which this package doesn't do. Use the
+// result as ServiceUserParams.TransferSyntaxes, e.g.,
+//
+//	params := netdicom.StorageSCUParams(netdicom.ServiceUserParams{
+//		TransferSyntaxes: netdicom.TransferSyntaxesForDataSet(transferSyntaxUID),
+//	}, sopClassUID)
+func TransferSyntaxesForDataSet(sourceTransferSyntaxUID string) []string {
+	// UIDs read from a file may be padded to an even length.
+	source := strings.TrimRight(sourceTransferSyntaxUID, "\x00 ")
+	var syntaxes []string
+	if source != "" {
+		syntaxes = append(syntaxes, source)
+	}
+	for _, uid := range []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian} {
+		if uid != source {
+			syntaxes = append(syntaxes, uid)
+		}
+	}
+	return syntaxes
+}
@@ -0,0 +1,83 @@
+package netdicom
+
+// This file implements tuning the sockets that carry associations.
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// SocketOptions tunes the TCP connection of an association. They are applied
+// to connections dialed by ServiceUser.Connect and accepted by
+// ServiceProvider, as well as to connections passed to ServiceUser.SetConn and
+// RunProviderForConn that support them, e.g., *net.TCPConn. The zero value
+// leaves the defaults of the net package alone.
+type SocketOptions struct {
+	// Nagle, if set, enables Nagle's algorithm, i.e., turns TCP_NODELAY off.
+	// By default TCP_NODELAY is on, as in the net package, so that small
+	// PDUs, e.g., DIMSE commands, are sent without delay.
+	Nagle bool
+
+	// ReadBufferSize and WriteBufferSize, if positive, set the size of the
+	// receive and send buffers of the socket (SO_RCVBUF and SO_SNDBUF).
+	// Larger buffers speed up large transfers on links with a high
+	// bandwidth-delay product.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// KeepAlive, if positive, enables TCP keepalives with the given period.
+	// If negative, keepalives are disabled. If zero, the default of the net
+	// package is kept.
+	KeepAlive time.Duration
+}
+
+// The socket option setters of *net.TCPConn.
+type noDelaySetter interface {
+	SetNoDelay(noDelay bool) error
+}
+
+type bufferSizeSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+type keepAliveSetter interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// Applies "opts" to conn, or to the connection underneath if it's a TLS
+// connection. Options that conn doesn't support are skipped. Failures are
+// logged to "logger", but are not fatal, since the association works with the
+// default settings too.
+func applySocketOptions(conn net.Conn, opts SocketOptions, logger Logger) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	check := func(option string, err error) {
+		if err != nil {
+			logger.Warn("Failed to set socket option", "option", option, "err", err)
+		}
+	}
+	if c, ok := conn.(noDelaySetter); ok {
+		check("TCP_NODELAY", c.SetNoDelay(!opts.Nagle))
+	}
+	if c, ok := conn.(bufferSizeSetter); ok {
+		if opts.ReadBufferSize > 0 {
+			check("SO_RCVBUF", c.SetReadBuffer(opts.ReadBufferSize))
+		}
+		if opts.WriteBufferSize > 0 {
+			check("SO_SNDBUF", c.SetWriteBuffer(opts.WriteBufferSize))
+		}
+	}
+	if c, ok := conn.(keepAliveSetter); ok {
+		switch {
+		case opts.KeepAlive > 0:
+			check("SO_KEEPALIVE", c.SetKeepAlive(true))
+			check("keepalive period", c.SetKeepAlivePeriod(opts.KeepAlive))
+		case opts.KeepAlive < 0:
+			check("SO_KEEPALIVE", c.SetKeepAlive(false))
+		}
+	}
+}
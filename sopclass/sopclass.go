@@ -19,6 +19,12 @@ var VerificationClasses = []string{
 	standardUID("1.2.840.10008.1.1"),
 }
 
+// StorageCommitmentClasses is for requesting storage commitment through
+// N-ACTION.
+var StorageCommitmentClasses = []string{
+	standardUID("1.2.840.10008.1.20.1"),
+}
+
 // StorageClasses for issuing C-STORE requests.
 var StorageClasses = []string{
 	standardUID("1.2.840.10008.5.1.1.27"),
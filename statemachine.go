@@ -5,17 +5,21 @@ package netdicom
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
+	"os"
 	"time"
 
 	"github.com/giesekow/go-netdicom/dimse"
 	"github.com/giesekow/go-netdicom/pdu"
 	"github.com/giesekow/go-netdicom/pdu/pdu_item"
-	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
+	suyashtag "github.com/suyashkumar/dicom/pkg/tag"
 )
 
 type stateType int
@@ -82,6 +86,11 @@ const (
 	evt17
 	evt18
 	evt19
+
+	// Not defined in P3.8. See ServiceUserParams.ReleaseTimeout.
+	evtReleaseTimerExpired
+	// Not defined in P3.8. See ServiceUserParams.IdleTimeout.
+	evtIdleTimerExpired
 )
 
 var eventDescriptions = map[eventType]string{
@@ -104,6 +113,9 @@ var eventDescriptions = map[eventType]string{
 	evt17: "Transport connection closed indication (local transport service)",
 	evt18: "ARTIM timer expired (Association reject/release timer)",
 	evt19: "Unrecognized or invalid PDU received",
+
+	evtReleaseTimerExpired: "Release timer expired (local; not in P3.8)",
+	evtIdleTimerExpired:    "Idle timer expired (local; not in P3.8)",
 }
 
 func (e *eventType) String() string {
@@ -136,10 +148,8 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
-		items := sm.contextManager.generateAssociateRequest(
-			sm.userParams.SOPClasses,
-			sm.userParams.TransferSyntaxes)
+		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.readTimeout, sm.logger, sm.metrics, sm.tracer, sm.faults, sm.label)
+		items := sm.contextManager.generateAssociateRequest(sm.userParams)
 		pdu := &pdu.AAssociateRQ{
 			ProtocolVersion: pdu.CurrentProtocolVersion,
 			CalledAETitle:   sm.userParams.CalledAETitle,
@@ -155,20 +165,33 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 	func(sm *stateMachine, event stateEvent) stateType {
 		sm.stopTimer()
 		v := event.pdu.(*pdu.AAssociateAC)
+		if v.ProtocolVersion != pdu.CurrentProtocolVersion {
+			err := fmt.Errorf("AE-3: wrong remote protocol version 0x%x", v.ProtocolVersion)
+			sm.logger.Error("AE-3: Wrong remote protocol version", "version", fmt.Sprintf("0x%x", v.ProtocolVersion))
+			return actionAa8.Callback(sm, stateEvent{event: evt19, pdu: event.pdu, err: err})
+		}
 		err := sm.contextManager.onAssociateResponse(v.Items)
 		if err == nil {
 			sm.upcallCh <- upcallEvent{
 				eventType: upcallEventHandshakeCompleted,
 				cm:        sm.contextManager,
+				info:      sm.contextManager.associationInfo(v.CalledAETitle, v.CallingAETitle),
 			}
+			sm.startIdleTimer()
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine: AE-3: %v", err)
-		return actionAa8.Callback(sm, event)
+		sm.logger.Error("AE-3: Invalid A-ASSOCIATE-AC", "err", err)
+		return actionAa8.Callback(sm, stateEvent{event: evt19, pdu: event.pdu, err: err})
 	}}
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if rj, ok := event.pdu.(*pdu.AAssociateRj); ok {
+			sm.upcallCh <- upcallEvent{
+				eventType: upcallEventRejected,
+				reject:    rj,
+			}
+		}
 		sm.closeConnection()
 		return sta01
 	}}
@@ -178,7 +201,7 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 		doassert(event.conn != nil)
 		sm.startTimer()
 		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
+			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.readTimeout, sm.logger, sm.metrics, sm.tracer, sm.faults, sm.label)
 		}(sm.netCh, event.conn)
 		return sta02
 	}}
@@ -199,22 +222,45 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 	func(sm *stateMachine, event stateEvent) stateType {
 		sm.stopTimer()
 		v := event.pdu.(*pdu.AAssociateRQ)
-		if v.ProtocolVersion != 0x0001 {
-			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
-			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
+		if v.ProtocolVersion != pdu.CurrentProtocolVersion {
+			sm.logger.Warn("Wrong remote protocol version", "version", fmt.Sprintf("0x%x", v.ProtocolVersion))
+			rj := pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: pdu.RejectReasonProtocolVersionNotSupported,
+			}
 			sendPDU(sm, &rj)
 			sm.startTimer()
 			return sta13
 		}
-		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		var responses []pdu_item.SubItem
+		err := checkAETitles(sm.providerParams, v.CalledAETitle, v.CallingAETitle)
+		if err == nil {
+			responses, err = sm.contextManager.onAssociateRequest(sm.providerParams, v.Items)
+		}
 		if err != nil {
-			// TODO(saito) set proper error code.
+			sm.logger.Warn("Rejecting association", "callingAE", v.CallingAETitle, "err", err)
+			rj := &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: pdu.RejectReasonNone,
+			}
+			var rejectErr *associateRejectError
+			if errors.As(err, &rejectErr) {
+				rj.Source = rejectErr.source
+				rj.Reason = rejectErr.reason
+			}
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+		} else if err := authenticateUser(sm, v, responses); err != nil {
+			sm.logger.Warn("Authentication failed", "callingAE", v.CallingAETitle, "err", err)
+			// P3.7 D.3.3.7: identity rejections are reported by the
+			// service user, without a specific reason.
 			sm.downcallCh <- stateEvent{
 				event: evt08,
 				pdu: &pdu.AAssociateRj{
 					Result: pdu.ResultRejectedPermanent,
-					Source: pdu.SourceULServiceProviderACSE,
-					Reason: 1,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.RejectReasonNone,
 				},
 			}
 		} else {
@@ -233,6 +279,42 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		}
 		return sta03
 	}}
+
+// Run the provider's authentication callback, if any, against the user
+// identity in the A-ASSOCIATE-RQ. On success, the server response is added to
+// "responses" if the client asked for it.
+func authenticateUser(sm *stateMachine, rq *pdu.AAssociateRQ, responses []pdu_item.SubItem) error {
+	if sm.providerParams.Authenticate == nil {
+		return nil
+	}
+	var identity *UserIdentity
+	if item := sm.contextManager.peerUserIdentity; item != nil {
+		identity = &UserIdentity{
+			Type:                      item.Type,
+			PrimaryField:              item.PrimaryField,
+			SecondaryField:            item.SecondaryField,
+			PositiveResponseRequested: item.PositiveResponseRequested,
+		}
+	}
+	connState := getConnState(sm.conn, associationInfo{
+		CalledAETitle:  rq.CalledAETitle,
+		CallingAETitle: rq.CallingAETitle,
+	})
+	serverResponse, err := sm.providerParams.Authenticate(connState, identity)
+	if err != nil {
+		return err
+	}
+	if identity != nil && identity.PositiveResponseRequested {
+		for _, item := range responses {
+			if userInfo, ok := item.(*pdu_item.UserInformationItem); ok {
+				userInfo.Items = append(userInfo.Items,
+					&pdu_item.UserIdentityResponseSubItem{ServerResponse: serverResponse})
+			}
+		}
+	}
+	return nil
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociateAC))
@@ -240,9 +322,11 @@ var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 		sm.upcallCh <- upcallEvent{
 			eventType:      upcallEventHandshakeCompleted,
 			cm:             sm.contextManager,
+			info:           sm.contextManager.associationInfo(assPdu.CalledAETitle, assPdu.CallingAETitle),
 			CalledAETitle:  assPdu.CalledAETitle,
 			CallingAETitle: assPdu.CallingAETitle,
 		}
+		sm.startIdleTimer()
 		return sta06
 	}}
 
@@ -253,41 +337,198 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 		return sta13
 	}}
 
-// Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
+// Calls "fn" for each of the P_DATA_TF PDUs that collectively store "data", in
+// order. The last one has the Last bit set. The PDUs are produced one at a
+// time, and the PDU passed to fn is reused for the next one, so fn must not
+// retain it. If fn returns an error, the rest of the PDUs are skipped and the
+// error is returned.
+func forEachDataPDU(sm *stateMachine, abstractSyntaxName string, command bool, data []byte, fn func(*pdu.PDataTf) error) error {
 	doassert(len(data) > 0)
 	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
 	if err != nil {
-		// TODO(saito) Don't crash here.
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
-	}
-	var pdus []pdu.PDataTf
-	// two byte header overhead.
-	//
-	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
+		return fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %w", sm.label, dicomuid.UIDString(abstractSyntaxName), err)
+	}
+	// P3.8 D.1 applies the max PDU size to the variable field of
+	// P-DATA-TF, which holds the PDV item header and the fragment. Some
+	// SCPs apply it to the whole PDU, so leave room for the PDU header too.
+	var maxChunkSize = sm.contextManager.peerMaxPDUSize - pdu.PDUHeaderSize - pdu.PresentationDataValueItemHeaderSize
 	if maxChunkSize <= 0 {
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Invalid max PDU size %d", sm.label, sm.contextManager.peerMaxPDUSize))
+		return fmt.Errorf("dicom.stateMachine(%s): Invalid max PDU size %d", sm.label, sm.contextManager.peerMaxPDUSize)
 	}
+	items := []pdu.PresentationDataValueItem{{
+		ContextID: context.contextID,
+		Command:   command,
+	}}
+	v := &pdu.PDataTf{Items: items}
 	for len(data) > 0 {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
 			chunkSize = maxChunkSize
 		}
-		chunk := data[0:chunkSize]
+		items[0].Value = data[0:chunkSize]
 		data = data[chunkSize:]
-		pdus = append(pdus, pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
-			pdu.PresentationDataValueItem{
+		items[0].Last = len(data) == 0
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends "data" as a sequence of P_DATA_TF PDUs. Each PDU is written to the
+// connection as soon as it is produced, and they are all encoded in the same
+// buffer, so sending a large payload doesn't copy it. Stops at the first PDU
+// that fails to be written; see writePDU.
+func sendDataPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) error {
+	buf := make([]byte, 0, pDataTfBufferSize(sm, len(data)))
+	return forEachDataPDU(sm, abstractSyntaxName, command, data, func(v *pdu.PDataTf) error {
+		buf = v.AppendEncoded(buf[:0])
+		return writePDU(sm, v, buf)
+	})
+}
+
+// Returns the size of a buffer that holds any of the P_DATA_TF PDUs that carry
+// "n" bytes of a DIMSE message, so that encoding them doesn't grow it. A PDU
+// holds at most two PDV items (see forEachPackedPDU), and is no larger than
+// the peer's max PDU size allows.
+func pDataTfBufferSize(sm *stateMachine, n int) int {
+	size := min(n+2*pdu.PresentationDataValueItemHeaderSize, sm.contextManager.peerMaxPDUSize-pdu.PDUHeaderSize)
+	return pdu.PDUHeaderSize + max(size, 0)
+}
+
+// Calls "fn" for each of the P_DATA_TF PDUs that collectively store a DIMSE
+// message, i.e., "command" followed by "data", which is empty if the message
+// has none. Unlike forEachDataPDU, PDUs are filled up to the peer's max PDU
+// size, so the last fragment of the command and the first fragment of the
+// data may share a PDU; the command fragment, with the Last bit set, comes
+// first (P3.8 E.2). As in forEachDataPDU, fn must not retain the PDU, and an
+// error from fn ends the iteration.
+func forEachPackedPDU(sm *stateMachine, abstractSyntaxName string, command, data []byte, fn func(*pdu.PDataTf) error) error {
+	doassert(len(command) > 0)
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+	if err != nil {
+		return fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %w", sm.label, dicomuid.UIDString(abstractSyntaxName), err)
+	}
+	// The room for PDV items in a PDU. As in forEachDataPDU, the PDU header
+	// counts against the max PDU size.
+	maxItemsSize := sm.contextManager.peerMaxPDUSize - pdu.PDUHeaderSize
+	if maxItemsSize <= pdu.PresentationDataValueItemHeaderSize {
+		return fmt.Errorf("dicom.stateMachine(%s): Invalid max PDU size %d", sm.label, sm.contextManager.peerMaxPDUSize)
+	}
+	v := &pdu.PDataTf{}
+	room := maxItemsSize
+	add := func(isCommand bool, value []byte) error {
+		for len(value) > 0 {
+			if room <= pdu.PresentationDataValueItemHeaderSize {
+				if err := fn(v); err != nil {
+					return err
+				}
+				v.Items = v.Items[:0]
+				room = maxItemsSize
+			}
+			chunkSize := min(len(value), room-pdu.PresentationDataValueItemHeaderSize)
+			v.Items = append(v.Items, pdu.PresentationDataValueItem{
 				ContextID: context.contextID,
-				Command:   command,
-				Last:      false, // Set later.
-				Value:     chunk,
-			}}})
+				Command:   isCommand,
+				Last:      chunkSize == len(value),
+				Value:     value[:chunkSize],
+			})
+			value = value[chunkSize:]
+			room -= pdu.PresentationDataValueItemHeaderSize + chunkSize
+		}
+		return nil
+	}
+	if err := add(true, command); err != nil {
+		return err
 	}
-	if len(pdus) > 0 {
-		pdus[len(pdus)-1].Items[0].Last = true
+	if err := add(false, data); err != nil {
+		return err
 	}
-	return pdus
+	return fn(v)
+}
+
+// Sends DIMSE message "payload", whose command is encoded in "command", as a
+// sequence of P_DATA_TF PDUs. Returns a non-nil error if the action should
+// abort the association, unless it wraps errPDUWriteFailed, in which case the
+// connection is gone already. "action" names the calling action in log
+// messages.
+func sendDIMSEMessage(sm *stateMachine, action string, payload *stateEventDIMSEPayload, command []byte) error {
+	cmd := payload.command
+	if !cmd.HasData() && len(payload.data) > 0 {
+		err := fmt.Errorf("dicom.stateMachine(%s): Found DIMSE data of %db for command %v, which has no data", sm.label, len(payload.data), cmd)
+		sm.logger.Error(action+": Refusing to send DIMSE message", "err", err)
+		return err
+	}
+	data, err := deflateDataPayload(sm, payload.abstractSyntaxName, payload.data)
+	if err != nil {
+		sm.logger.Error(action+": Failed to deflate DIMSE data", "err", err)
+		return err
+	}
+	if sm.packCommandAndData {
+		buf := make([]byte, 0, pDataTfBufferSize(sm, len(command)+len(data)))
+		err = forEachPackedPDU(sm, payload.abstractSyntaxName, command, data, func(v *pdu.PDataTf) error {
+			buf = v.AppendEncoded(buf[:0])
+			return writePDU(sm, v, buf)
+		})
+		if err != nil {
+			sm.logger.Error(action+": Failed to send DIMSE message", "err", err)
+			return err
+		}
+		sm.recordDIMSEOutcome(cmd)
+		return nil
+	}
+	if err := sendDataPDUs(sm, payload.abstractSyntaxName, true /*command*/, command); err != nil {
+		sm.logger.Error(action+": Failed to send DIMSE command", "err", err)
+		return err
+	}
+	sm.recordDIMSEOutcome(cmd)
+	if cmd.HasData() {
+		sm.logger.Debug("Send DIMSE data", "bytes", len(data), "command", cmd)
+		if err := sendDataPDUs(sm, payload.abstractSyntaxName, false /*data*/, data); err != nil {
+			sm.logger.Error(action+": Failed to send DIMSE data", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns "data", the data payload of a DIMSE message, as it's sent: deflated
+// if the context negotiated for abstractSyntaxName uses the deflated transfer
+// syntax, and as is otherwise.
+func deflateDataPayload(sm *stateMachine, abstractSyntaxName string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+	if err != nil || !isDeflatedTransferSyntax(context.transferSyntaxUID) {
+		// An unknown syntax is reported when the PDUs are produced.
+		return data, nil
+	}
+	return deflatePayload(data)
+}
+
+// Encodes "command", the command of a DIMSE message to send, in a buffer of
+// the right size. Fails if the command exceeds the max command size of this
+// side; the peer likely applies the same limit, and a command that large is
+// a bug anyway.
+func encodeCommand(sm *stateMachine, command dimse.Message) ([]byte, error) {
+	size, err := dimse.EncodedSize(command)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := sm.commandAssembler.MaxCommandSize
+	if maxSize <= 0 {
+		maxSize = dimse.DefaultMaxCommandSize
+	}
+	if int64(size) > maxSize {
+		return nil, fmt.Errorf("dicom.stateMachine(%s): command is %d bytes, more than the max command size of %d bytes",
+			sm.label, size, maxSize)
+	}
+	e := bytes.NewBuffer(make([]byte, 0, size))
+	if err := dimse.EncodeMessage(e, command); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
 }
 
 // Data transfer related actions
@@ -296,63 +537,83 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 		doassert(event.dimsePayload != nil)
 		command := event.dimsePayload.command
 		doassert(command != nil)
-		e := bytes.Buffer{}
-		err := dimse.EncodeMessage(&e, command)
+		encoded, err := encodeCommand(sm, command)
 		if err != nil {
-			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, err))
-		}
-		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
+			sm.logger.Error("DT-1: Failed to encode DIMSE command", "command", command, "err", err)
+			return actionAa8.Callback(sm, stateEvent{event: evt19, err: err})
+		}
+		sm.logger.Debug("Send DIMSE msg", "command", command)
+		if err := sendDIMSEMessage(sm, "DT-1", event.dimsePayload, encoded); err != nil {
+			if errors.Is(err, errPDUWriteFailed) {
+				// evt17 is queued.
+				return sta06
 			}
-		} else if len(event.dimsePayload.data) > 0 {
-			panic(fmt.Sprintf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command))
+			return actionAa8.Callback(sm, event)
 		}
 		return sta06
 	}}
 
 var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
-		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.PDataTf))
-		if err == nil {
-			if command != nil { // All fragments received
-				dicomlog.Vprintf(1, "dicom.stateMachine(%s): DIMSE request: %v", sm.label, command)
+		pdataTf := event.pdu.(*pdu.PDataTf)
+		if pdataTf.IsEmpty() {
+			// A keep-alive. Don't let it start a message or switch
+			// the context of the one being assembled.
+			sm.logger.Debug("Ignoring empty P-DATA-TF", "pdu", pdataTf.String())
+			return sta06
+		}
+		contextID, command, data, err := sm.commandAssembler.AddDataPDU(pdataTf)
+		if _, ok := command.(*dimse.UnknownMessage); ok && err == nil {
+			// Only returned if params.SkipUnknownCommands is set.
+			sm.logger.Warn("Ignoring unknown DIMSE command", "command", command)
+			return sta06
+		}
+		if err == nil && command != nil { // All fragments received
+			var dataPath string
+			dataPath, err = sm.closeSpoolFile()
+			if err == nil {
+				data, err = sm.inflateDataPayload(contextID, data, dataPath)
+				if err != nil {
+					removeSpoolFile(dataPath)
+				}
+			}
+			if err == nil {
+				sm.logger.Debug("DIMSE request", "command", command)
+				sm.recordDIMSEOutcome(command)
 				sm.upcallCh <- upcallEvent{
 					eventType: upcallEventData,
 					cm:        sm.contextManager,
 					contextID: contextID,
 					command:   command,
-					data:      data}
+					data:      data,
+					dataPath:  dataPath}
 			}
+		}
+		if err == nil {
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err) // TODO(saito)
-		return actionAa8.Callback(sm, event)
+		sm.logger.Error("Failed to assemble data", "err", err) // TODO(saito)
+		return actionAa8.Callback(sm, stateEvent{event: evt19, pdu: event.pdu, err: err})
 	}}
 
 // Assocation Release related actions
 var actionAr1 = &stateAction{"AR-1", "Send A-RELEASE-RQ PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AReleaseRq{})
+		sm.startReleaseTimer()
 		return sta07
 	}}
 var actionAr2 = &stateAction{"AR-2", "Issue A-RELEASE indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
-		// TODO(saito) Do RELEASE callback here.
+		// The local user always accepts the release, so respond to the
+		// indication on its behalf.
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
 	}}
 
 var actionAr3 = &stateAction{"AR-3", "Issue A-RELEASE confirmation primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AReleaseRp{})
+		sm.upcallCh <- upcallEvent{eventType: upcallEventReleased}
 		sm.closeConnection()
 		return sta01
 	}}
@@ -379,22 +640,17 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 		doassert(event.dimsePayload != nil)
 		command := event.dimsePayload.command
 		doassert(command != nil)
-		e := bytes.Buffer{}
-		err := dimse.EncodeMessage(&e, command)
+		encoded, err := encodeCommand(sm, command)
 		if err != nil {
-			panic(fmt.Sprintf("dicom.StateMachine %s: Failed to encode DIMSE cmd %v: %v", sm.label, command, err))
+			sm.logger.Error("AR-7: Failed to encode DIMSE command", "command", command, "err", err)
+			return actionAa8.Callback(sm, stateEvent{event: evt19, err: err})
 		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
+		if err := sendDIMSEMessage(sm, "AR-7", event.dimsePayload, encoded); err != nil {
+			if errors.Is(err, errPDUWriteFailed) {
+				// evt17 is queued.
+				return sta07
 			}
-		} else {
-			doassert(len(event.dimsePayload.data) == 0)
+			return actionAa8.Callback(sm, event)
 		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
@@ -402,9 +658,16 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 
 var actionAr8 = &stateAction{"AR-8", "Issue A-RELEASE indication (release collision): if association-requestor, next state is Sta09, if not next state is Sta10",
 	func(sm *stateMachine, event stateEvent) stateType {
+		sm.logger.Info("A-RELEASE collision", "requestor", sm.isUser)
 		if sm.isUser {
+			// As in AR-2, respond to the indication on behalf of
+			// the local user. P3.8 9.2.3: the association-requestor
+			// sends A-RELEASE-RP first.
+			sm.downcallCh <- stateEvent{event: evt14}
 			return sta09
 		}
+		// The acceptor responds only after receiving A-RELEASE-RP; see
+		// AR-10.
 		return sta10
 	}}
 
@@ -416,17 +679,45 @@ var actionAr9 = &stateAction{"AR-9", "Send A-RELEASE-RP PDU",
 
 var actionAr10 = &stateAction{"AR-10", "Issue A-RELEASE confimation primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
+		sm.upcallCh <- upcallEvent{eventType: upcallEventReleased}
+		// Now respond to the indication issued in AR-8.
+		sm.downcallCh <- stateEvent{event: evt14}
 		return sta12
 	}}
 
+// Not defined in P3.8. Fired when the peer fails to answer A-RELEASE-RQ within
+// ServiceUserParams.ReleaseTimeout.
+var actionArTimeout = &stateAction{"AR-TIMEOUT", "Send A-ABORT PDU (service-user source) and close transport connection",
+	func(sm *stateMachine, event stateEvent) stateType {
+		sm.logger.Warn("Peer didn't respond to A-RELEASE-RQ; aborting the association", "timeout", sm.releaseTimeout)
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: pdu.AbortReasonNotSpecified})
+		sm.stopTimer()
+		sm.closeConnection()
+		return sta01
+	}}
+
+// Not defined in P3.8. Fired when no PDU is sent or received for
+// ServiceUserParams.IdleTimeout.
+var actionArIdle = &stateAction{"AR-IDLE", "Send A-RELEASE-RQ PDU (association idle)",
+	func(sm *stateMachine, event stateEvent) stateType {
+		sm.logger.Info("Association idle; releasing it", "timeout", sm.idleTimeout)
+		return actionAr1.Callback(sm, event)
+	}}
+
 // Association abort related actions
 var actionAa1 = &stateAction{"AA-1", "Send A-ABORT PDU (service-user source) and start (or restart if already started) ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
-		diagnostic := pdu.AbortReasonType(0)
-		if sm.currentState == sta02 {
-			diagnostic = pdu.AbortReasonUnexpectedPDU
+		if abort, ok := event.pdu.(*pdu.AAbort); ok {
+			// Requested by ServiceUser.Abort.
+			sendPDU(sm, abort)
+		} else {
+			diagnostic := pdu.AbortReasonNotSpecified
+			if sm.currentState == sta02 {
+				diagnostic = pdu.AbortReasonUnexpectedPDU
+			}
+			sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: diagnostic})
 		}
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: diagnostic})
+		sm.stopReleaseTimer()
 		sm.restartTimer()
 		return sta13
 	}}
@@ -440,6 +731,12 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if abort, ok := event.pdu.(*pdu.AAbort); ok {
+			sm.upcallCh <- upcallEvent{
+				eventType: upcallEventAborted,
+				abort:     abort,
+			}
+		}
 		sm.closeConnection()
 		return sta01
 	}}
@@ -462,13 +759,21 @@ var actionAa6 = &stateAction{"AA-6", "Ignore PDU",
 
 var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: 0})
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: pdu.AbortReasonNotSpecified})
 		return sta13
 	}}
 
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
+		reason := pdu.AbortReasonNotSpecified
+		if isPDUEvent(event.event) {
+			// The state table doesn't allow this PDU here, e.g., a
+			// P-DATA-TF before the handshake completes. Actions that
+			// find a PDU malformed pass evt19 instead.
+			reason = pdu.AbortReasonUnexpectedPDU
+		}
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceProvider, Reason: reason})
+		sm.stopReleaseTimer()
 		sm.startTimer()
 		return sta13
 	}}
@@ -478,8 +783,15 @@ type upcallEventType int
 const (
 	upcallEventHandshakeCompleted = upcallEventType(100)
 	upcallEventData               = upcallEventType(101)
+	upcallEventAborted            = upcallEventType(102)
+	upcallEventReleased           = upcallEventType(103)
+	upcallEventRejected           = upcallEventType(104)
 	// Note: connection shutdown and any error will result in channel
-	// closure, so they don't have event types.
+	// closure, so they don't have event types. An A-ABORT from the peer is
+	// reported as upcallEventAborted just before the closure. Likewise, the
+	// A-RELEASE confirmation for a release requested by this side is
+	// reported as upcallEventReleased, and an A-ASSOCIATE-RJ as
+	// upcallEventRejected.
 )
 
 func (e *upcallEventType) String() string {
@@ -489,6 +801,12 @@ func (e *upcallEventType) String() string {
 		description = "Handshake completed"
 	case upcallEventData:
 		description = "P_DATA_TF PDU received"
+	case upcallEventAborted:
+		description = "A_ABORT PDU received"
+	case upcallEventReleased:
+		description = "A_RELEASE confirmed"
+	case upcallEventRejected:
+		description = "A_ASSOCIATE_RJ PDU received"
 	default:
 		panic(fmt.Sprintf("dicom.StateMachine: Unknown event type %v", int(*e)))
 	}
@@ -516,8 +834,24 @@ type upcallEvent struct {
 	CalledAETitle  string
 	CallingAETitle string
 
+	// The negotiated parameters. Set in upcallEventHandshakeCompleted
+	// event, and by the provider in the events that follow.
+	info *AssociationInfo
+
 	command dimse.Message
 	data    []byte
+
+	// The file that the data payload was spooled to, in which case data is
+	// nil. The receiver of the event must remove the file.
+	dataPath string
+
+	// The A-ABORT PDU sent by the peer. Set only in upcallEventAborted
+	// event.
+	abort *pdu.AAbort
+
+	// The A-ASSOCIATE-RJ PDU sent by the peer. Set only in
+	// upcallEventRejected event.
+	reject *pdu.AAssociateRj
 }
 
 type stateEventDIMSEPayload struct {
@@ -531,6 +865,10 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// If non-nil, closed once the state machine is done with the message,
+	// i.e., once its PDUs are written to the connection, or failed to be.
+	sent chan struct{}
 }
 
 type stateEventDebugInfo struct {
@@ -698,6 +1036,34 @@ var stateTransitions = map[stateTransitionKey]*stateAction{
 	{sta13, evt17}: actionAr5,
 	{sta13, evt18}: actionAa2,
 	{sta13, evt19}: actionAa7,
+
+	// Extensions to P3.8. The release timer runs while the service user
+	// awaits A-RELEASE-RP.
+	{sta07, evtReleaseTimerExpired}: actionArTimeout,
+	{sta09, evtReleaseTimerExpired}: actionArTimeout,
+	{sta11, evtReleaseTimerExpired}: actionArTimeout,
+
+	// The idle timer matters only while data may be transferred.
+	{sta06, evtIdleTimerExpired}: actionArIdle,
+}
+
+// Returns true if "e" reports the arrival of a well-formed PDU from the peer.
+func isPDUEvent(e eventType) bool {
+	switch e {
+	case evt03, evt04, evt06, evt10, evt12, evt13, evt16:
+		return true
+	}
+	return false
+}
+
+// Converts the tags in ServiceUserParams.AllowedCommandElements and
+// ServiceProviderParams.AllowedCommandElements into those of the dimse package.
+func commandElementTags(tags []dicomtag.Tag) []suyashtag.Tag {
+	var result []suyashtag.Tag
+	for _, t := range tags {
+		result = append(result, suyashtag.Tag{Group: t.Group, Element: t.Element})
+	}
+	return result
 }
 
 func findAction(currentState stateType, event *stateEvent) *stateAction {
@@ -716,6 +1082,9 @@ type stateMachine struct {
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
 
+	// providerParams is set only for a server-side statemachine
+	providerParams ServiceProviderParams
+
 	// Manages mappings between one-byte contextID to the
 	// <abstractsyntaxUID, transfersyntaxuid> pair.  Filled during A_ACCEPT
 	// handshake.
@@ -739,56 +1108,205 @@ type stateMachine struct {
 	// For Timer expiration event
 	timerCh chan stateEvent
 
+	// Max time to wait for A-RELEASE-RP after sending A-RELEASE-RQ. Zero
+	// means no limit. releaseTimerCh receives evtReleaseTimerExpired; it
+	// is nil unless a release is in progress.
+	releaseTimeout time.Duration
+	releaseTimerCh chan stateEvent
+
+	// Max time the association may stay idle, i.e., without a PDU being
+	// sent or received, before it is released. Zero means no limit.
+	// lastActivity is when the last PDU was sent or received, and
+	// idleTimerCh receives evtIdleTimerExpired. It is nil unless the
+	// timer is running.
+	idleTimeout  time.Duration
+	lastActivity time.Time
+	idleTimerCh  chan stateEvent
+
+	// Closed when the context passed to runStateMachineFor* is done. Set to
+	// nil once the resulting A-ABORT request has been issued.
+	ctxDone <-chan struct{}
+
 	// The socket to the remote peer.
 	conn         net.Conn
 	currentState stateType
 
+	// Max time to wait for a PDU to arrive, and to write a PDU. Zero means
+	// no limit.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// Receives log messages. It tags every message with the association
+	// label.
+	logger Logger
+
+	// Receives PDU, DIMSE and association measurements. Never nil.
+	metrics Metrics
+
+	// Receives the raw bytes of every PDU. May be nil.
+	tracer PDUTracer
+
+	// Receives every state transition. May be nil.
+	onTransition TransitionTracer
+
+	// If set, the end of a DIMSE command and the start of its data share
+	// a P-DATA-TF PDU when they fit. See
+	// ServiceUserParams.PackCommandAndData.
+	packCommandAndData bool
+
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
 
+	// The file that the data payload of the C-STORE request being
+	// assembled is spooled to. Set only if ServiceProviderParams.CStoreFile
+	// is set.
+	spoolFile *os.File
+
+	// Drives the ARTIM and release timers. Never nil.
+	clock Clock
+
 	// Only for testing.
 	faults FaultInjector
 }
 
 func (sm *stateMachine) closeConnection() {
 	close(sm.upcallCh)
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: Closing connection %v", sm.label, sm.conn)
 	if sm.conn != nil {
+		sm.logger.Debug("Closing connection", "remote", sm.conn.RemoteAddr())
 		sm.conn.Close()
 	}
 }
 
+// Creates the file that the data payload of a C-STORE request is spooled to.
+// Used as the NewDataWriter of the command assembler. Other requests are
+// buffered in memory.
+func (sm *stateMachine) newSpoolFile(contextID byte, command dimse.Message) (io.Writer, error) {
+	if _, ok := command.(*dimse.CStoreRq); !ok {
+		return nil, nil
+	}
+	f, err := os.CreateTemp(sm.providerParams.SpoolDir, "netdicom-cstore-*")
+	if err != nil {
+		return nil, err
+	}
+	sm.logger.Debug("Spooling C-STORE data", "path", f.Name())
+	sm.spoolFile = f
+	return f, nil
+}
+
+// Closes the spool file of the request whose fragments have all arrived, and
+// returns its path. Returns "" if the request wasn't spooled.
+func (sm *stateMachine) closeSpoolFile() (string, error) {
+	f := sm.spoolFile
+	if f == nil {
+		return "", nil
+	}
+	sm.spoolFile = nil
+	if err := f.Close(); err != nil {
+		removeSpoolFile(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Inflates the data payload of a message received on contextID, i.e., "data",
+// or the file at dataPath if it was spooled, if the context uses the deflated
+// transfer syntax. Returns the payload to pass on.
+func (sm *stateMachine) inflateDataPayload(contextID byte, data []byte, dataPath string) ([]byte, error) {
+	if len(data) == 0 && dataPath == "" {
+		return data, nil
+	}
+	_, transferSyntaxUID, err := sm.contextManager.syntaxesByContextID(contextID)
+	if err != nil || !isDeflatedTransferSyntax(transferSyntaxUID) {
+		// An unknown context is reported by the service dispatcher.
+		return data, nil
+	}
+	maxSize := sm.commandAssembler.MaxDataSize
+	if maxSize <= 0 {
+		maxSize = dimse.DefaultMaxDataSize
+	}
+	if dataPath != "" {
+		return nil, inflateSpoolFile(dataPath, maxSize)
+	}
+	return inflatePayload(data, maxSize)
+}
+
+// Removes the spool file of an incomplete request.
+func (sm *stateMachine) discardSpoolFile() {
+	if sm.spoolFile != nil {
+		sm.spoolFile.Close()
+		removeSpoolFile(sm.spoolFile.Name())
+		sm.spoolFile = nil
+	}
+}
+
 func sendPDU(sm *stateMachine, v pdu.PDU) {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
+		sm.logger.Error("Failed to encode PDU; closing connection", "err", err, "remote", sm.conn.RemoteAddr())
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
 		return
 	}
+	if writePDU(sm, v, data) == nil {
+		// Unlike P-DATA-TF, which may come by the thousand, these PDUs
+		// are few, so log them in full.
+		logVerbose(sm.logger, "Sent PDU", "pdu", v.String())
+	}
+}
+
+// errPDUWriteFailed is wrapped by the error of writePDU. The connection is
+// closed by then, and evt17 is queued, so the caller shouldn't try to send
+// anything else, e.g., an A-ABORT.
+var errPDUWriteFailed = errors.New("failed to write PDU")
+
+// Writes "data", the encoding of "v", to the connection. On failure, the
+// connection is closed, evt17 is queued, and an error wrapping
+// errPDUWriteFailed is returned.
+func writePDU(sm *stateMachine, v pdu.PDU, data []byte) error {
+	if sm.tracer != nil {
+		sm.tracer(sm.label, PDUSent, data)
+	}
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
 		if action == faultInjectorDisconnect {
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: FAULT: closing connection for test", sm.label)
+			sm.logger.Warn("FAULT: closing connection for test")
 			sm.conn.Close()
 		}
 	}
+	if sm.writeTimeout > 0 {
+		sm.conn.SetWriteDeadline(time.Now().Add(sm.writeTimeout))
+	}
 	n, err := sm.conn.Write(data)
 	if n != len(data) || err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
+		sm.logger.Error("Failed to write PDU; closing connection", "bytes", len(data), "written", n, "err", err, "remote", sm.conn.RemoteAddr())
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return fmt.Errorf("dicom.stateMachine(%s): %w: %w", sm.label, errPDUWriteFailed, err)
+	}
+	sm.metrics.PDUSent(sm.label, pdu.TypeOf(v), len(data))
+	sm.noteActivity()
+	return nil
+}
+
+// Reports the outcome of a DIMSE operation to sm.metrics if "command" is a
+// final response.
+func (sm *stateMachine) recordDIMSEOutcome(command dimse.Message) {
+	status := command.GetStatus()
+	if status == nil || status.Status.Category() == dimse.StatusCategoryPending {
 		return
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+	sm.metrics.DIMSEOperationCompleted(sm.label, command.CommandField(), status.Status.Category())
 }
 
 func (sm *stateMachine) startTimer() {
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	sm.clock.AfterFunc(time.Duration(10)*time.Second,
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
@@ -803,14 +1321,130 @@ func (sm *stateMachine) stopTimer() {
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
-func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
+func (sm *stateMachine) startReleaseTimer() {
+	if sm.releaseTimeout <= 0 {
+		return
+	}
+	ch := make(chan stateEvent, 1)
+	sm.releaseTimerCh = ch
+	sm.clock.AfterFunc(sm.releaseTimeout,
+		func() {
+			ch <- stateEvent{event: evtReleaseTimerExpired}
+			close(ch)
+		})
+}
+
+func (sm *stateMachine) stopReleaseTimer() {
+	sm.releaseTimerCh = nil
+}
+
+// Starts the idle timer, if sm.idleTimeout is set. Instead of restarting the
+// timer on each PDU, which would create a timer per PDU, the PDUs only update
+// sm.lastActivity, and the timer is re-armed on expiry if there was activity
+// since it started; see idleTimerExpired.
+func (sm *stateMachine) startIdleTimer() {
+	if sm.idleTimeout <= 0 {
+		return
+	}
+	sm.lastActivity = sm.clock.Now()
+	sm.armIdleTimer(sm.idleTimeout)
+}
+
+func (sm *stateMachine) armIdleTimer(d time.Duration) {
+	ch := make(chan stateEvent, 1)
+	sm.idleTimerCh = ch
+	sm.clock.AfterFunc(d,
+		func() {
+			ch <- stateEvent{event: evtIdleTimerExpired}
+			close(ch)
+		})
+}
+
+// Records that a PDU was sent or received.
+func (sm *stateMachine) noteActivity() {
+	if sm.idleTimerCh != nil {
+		sm.lastActivity = sm.clock.Now()
+	}
+}
+
+// Called when the idle timer fires. Returns true if the association has been
+// idle for sm.idleTimeout. Otherwise, re-arms the timer to fire idleTimeout
+// after the last activity.
+func (sm *stateMachine) idleTimerExpired() bool {
+	if sm.currentState != sta06 {
+		// The association is being released or aborted anyway.
+		sm.idleTimerCh = nil
+		return false
+	}
+	idle := sm.clock.Now().Sub(sm.lastActivity)
+	if idle >= sm.idleTimeout {
+		sm.idleTimerCh = nil
+		return true
+	}
+	sm.armIdleTimer(sm.idleTimeout - idle)
+	return false
+}
+
+// Reads the raw bytes of one PDU. If the PDU header announces an oversized
+// PDU, only the header is returned so that pdu.ReadPDU reports the error.
+func readRawPDU(in io.Reader, maxPDUSize int) ([]byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if pdu.IsOversized(length, maxPDUSize) {
+		return header, nil
+	}
+	data := make([]byte, 6+int(length))
+	copy(data, header)
+	if _, err := io.ReadFull(in, data[6:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Reads the next PDU from in. If tracer is non-nil, it receives the raw bytes,
+// labeled with "label". If faults is non-nil, it may alter the raw bytes before
+// they are decoded.
+func readPDU(in io.Reader, maxPDUSize int, faults FaultInjector, tracer PDUTracer, label string) (pdu.PDU, error) {
+	if faults == nil && tracer == nil {
+		return pdu.ReadPDU(in, maxPDUSize)
+	}
+	data, err := readRawPDU(in, maxPDUSize)
+	if err != nil {
+		return nil, err
+	}
+	if tracer != nil {
+		tracer(label, PDUReceived, data)
+	}
+	if faults != nil {
+		data = faults.onReceive(data)
+	}
+	v, err := pdu.ReadPDU(bytes.NewReader(data), maxPDUSize)
+	if err == io.EOF {
+		// The injector emptied the PDU, but the connection is still
+		// open.
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, readTimeout time.Duration, logger Logger, metrics Metrics, tracer PDUTracer, faults FaultInjector, label string) {
+	logVerbose(logger, "Starting network reader", "maxPDU", maxPDUSize)
 	doassert(maxPDUSize > 16*1024)
+	in := &countingReader{r: conn}
 	for {
-		v, err := pdu.ReadPDU(conn, maxPDUSize)
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		in.n = 0
+		v, err := readPDU(in, maxPDUSize, faults, tracer, label)
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to read PDU: %v,", smName, err)
-			if err == io.EOF {
+			logger.Info("Failed to read PDU", "err", err)
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+				// A timeout means that the peer is gone, so treat it
+				// like a closed connection.
 				ch <- stateEvent{event: evt17, pdu: nil, err: nil}
 			} else {
 				ch <- stateEvent{event: evt19, pdu: nil, err: err}
@@ -818,9 +1452,9 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			close(ch)
 			break
 		}
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: read PDU: %v", smName, v.String())
 		doassert(v != nil)
-		dicomlog.Vprintf(2, "dicom.StateMachine %s: read PDU: %v", smName, v.String())
+		metrics.PDUReceived(label, pdu.TypeOf(v), in.n)
+		logVerbose(logger, "Read PDU", "pdu", v.String())
 		switch n := v.(type) {
 		case *pdu.AAssociateRQ:
 			ch <- stateEvent{event: evt06, pdu: n, err: nil}
@@ -829,7 +1463,7 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			ch <- stateEvent{event: evt03, pdu: n, err: nil}
 			continue
 		case *pdu.AAssociateRj:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association rejected: %v", smName, v.String())
+			logger.Warn("Association rejected", "pdu", v.String())
 			ch <- stateEvent{event: evt04, pdu: n, err: nil}
 			continue
 		case *pdu.PDataTf:
@@ -842,17 +1476,17 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			ch <- stateEvent{event: evt13, pdu: n, err: nil}
 			continue
 		case *pdu.AAbort:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association aborted: %v", smName, v.String())
+			logger.Warn("Association aborted", "pdu", v.String())
 			ch <- stateEvent{event: evt16, pdu: n, err: nil}
 			continue
 		default:
-			err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", v.String(), smName)
+			err := fmt.Errorf("dicom.StateMachine: Unknown PDU type: %v", v.String())
 			ch <- stateEvent{event: evt19, pdu: v, err: err}
-			dicomlog.Vprintf(0, "dicom.StateMachine: %v", err)
+			logger.Error("Unknown PDU type", "pdu", v.String())
 			continue
 		}
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Exiting network reader", smName)
+	logVerbose(logger, "Exiting network reader")
 }
 
 func (sm *stateMachine) getNextEvent() stateEvent {
@@ -870,12 +1504,29 @@ func (sm *stateMachine) getNextEvent() stateEvent {
 			if !ok {
 				sm.timerCh = nil
 			}
+		case event, ok = <-sm.releaseTimerCh:
+			if !ok {
+				sm.releaseTimerCh = nil
+			}
+		case event, ok = <-sm.idleTimerCh:
+			if !ok {
+				sm.idleTimerCh = nil
+			} else if !sm.idleTimerExpired() {
+				event = stateEvent{}
+			}
 		case event, ok = <-sm.downcallCh:
 			if !ok {
 				sm.downcallCh = nil
 			}
+		case <-sm.ctxDone:
+			sm.logger.Info("Context done; aborting the association")
+			sm.ctxDone = nil
+			event = stateEvent{event: evt15}
 		}
 	}
+	if isPDUEvent(event.event) {
+		sm.noteActivity()
+	}
 	switch event.event {
 	case evt02:
 		doassert(event.conn != nil)
@@ -887,39 +1538,55 @@ func (sm *stateMachine) getNextEvent() stateEvent {
 	return event
 }
 
+// Reports a state transition to sm.onTransition, if set.
+func (sm *stateMachine) traceTransition(oldState stateType, event stateEvent, action *stateAction, newState stateType) {
+	if sm.onTransition == nil {
+		return
+	}
+	sm.onTransition(sm.label, StateTransition{
+		OldState: fmt.Sprintf("sta%02d", oldState),
+		Event:    fmt.Sprintf("evt%02d", event.event),
+		Action:   action.Name,
+		NewState: fmt.Sprintf("sta%02d", newState),
+	})
+}
+
 func (sm *stateMachine) runOneStep() {
 	event := sm.getNextEvent()
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Current state: %v, Event %v", sm.label, sm.currentState.String(), event)
+	logVerbose(sm.logger, "Processing event", "state", sm.currentState.String(), "event", event.String())
 	action := findAction(sm.currentState, &event)
 	if action == nil {
-		msg := fmt.Sprintf("dicom.StateMachine %s: No action found for state %v, event %v", sm.label, sm.currentState.String(), event.String())
+		kv := []interface{}{"state", sm.currentState.String(), "event", event.String()}
 		if sm.faults != nil {
-			msg += " FIhistory: " + sm.faults.String()
-		}
-		dicomlog.Vprintf(0, "dicom.StateMachine: Unknown state transition:")
-		for _, s := range strings.Split(msg, "\n") {
-			dicomlog.Vprintf(0, s)
+			kv = append(kv, "faultHistory", sm.faults.String())
 		}
-		dicomlog.Vprintf(0, msg)
+		sm.logger.Error("Unknown state transition", kv...)
 
 		action = actionAa2 // This will force connection abortion
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Running action %v", sm.label, action)
+	logVerbose(sm.logger, "Running action", "action", action.Name)
 	newState := action.Callback(sm, event)
+	if event.dimsePayload != nil && event.dimsePayload.sent != nil {
+		close(event.dimsePayload.sent)
+	}
 	if sm.faults != nil {
 		sm.faults.onStateTransition(sm.currentState, &event, action, newState)
 	}
+	sm.traceTransition(sm.currentState, event, action, newState)
 	sm.currentState = newState
-	dicomlog.Vprintf(2, "dicom.StateMachine Next state: %v", sm.currentState.String())
+	logVerbose(sm.logger, "Next state", "state", sm.currentState.String())
 }
 
+// runStateMachineForServiceUser runs the client-side state machine until the
+// association ends. When ctx is done, the association is aborted.
 func runStateMachineForServiceUser(
+	ctx context.Context,
 	params ServiceUserParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
 	label string) {
 	doassert(params.CallingAETitle != "")
-	doassert(len(params.SOPClasses) > 0)
+	doassert(len(params.SOPClasses)+len(params.ProposedContexts) > 0)
 	doassert(len(params.TransferSyntaxes) > 0)
 	sm := &stateMachine{
 		label:          label,
@@ -930,19 +1597,43 @@ func runStateMachineForServiceUser(
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
+		ctxDone:        ctx.Done(),
+		readTimeout:    params.ReadTimeout,
+		writeTimeout:   params.WriteTimeout,
+		releaseTimeout: params.ReleaseTimeout,
+		idleTimeout:    params.IdleTimeout,
+		logger:         withLogValues(params.Logger, "association", label),
+		metrics:        metricsOrDefault(params.Metrics),
+		tracer:         params.PDUTracer,
+		onTransition:   params.OnTransition,
+		clock:          realClock{},
 		faults:         getUserFaultInjector(),
+
+		packCommandAndData: params.PackCommandAndData,
 	}
+	sm.contextManager.logger = sm.logger
+	sm.commandAssembler.SkipUnknownCommands = params.SkipUnknownCommands
+	sm.commandAssembler.StrictCommands = params.StrictCommands
+	sm.commandAssembler.AllowedCommandElements = commandElementTags(params.AllowedCommandElements)
+	start := sm.clock.Now()
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
+	sm.traceTransition(sta01, event, action, sm.currentState)
 	for sm.currentState != sta01 {
 		sm.runOneStep()
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine(%s): statemachine finished", sm.label)
+	sm.metrics.AssociationEnded(label, sm.clock.Now().Sub(start))
+	sm.logger.Debug("Statemachine finished")
 }
 
+// runStateMachineForServiceProvider runs the server-side state machine for
+// "conn" until the association ends. When ctx is done, the association is
+// aborted.
 func runStateMachineForServiceProvider(
+	ctx context.Context,
 	conn net.Conn,
+	params ServiceProviderParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
 	label string) {
@@ -950,18 +1641,41 @@ func runStateMachineForServiceProvider(
 		label:          label,
 		isUser:         false,
 		contextManager: newContextManager(label),
+		providerParams: params,
 		conn:           conn,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
+		ctxDone:        ctx.Done(),
+		readTimeout:    params.ReadTimeout,
+		writeTimeout:   params.WriteTimeout,
+		idleTimeout:    params.IdleTimeout,
+		logger:         withLogValues(params.Logger, "association", label),
+		metrics:        metricsOrDefault(params.Metrics),
+		tracer:         params.PDUTracer,
+		onTransition:   params.OnTransition,
+		clock:          realClock{},
 		faults:         getProviderFaultInjector(),
+
+		packCommandAndData: params.PackCommandAndData,
+	}
+	sm.contextManager.logger = sm.logger
+	sm.commandAssembler.SkipUnknownCommands = params.SkipUnknownCommands
+	sm.commandAssembler.StrictCommands = params.StrictCommands
+	sm.commandAssembler.AllowedCommandElements = commandElementTags(params.AllowedCommandElements)
+	if params.CStoreFile != nil {
+		sm.commandAssembler.NewDataWriter = sm.newSpoolFile
 	}
+	start := sm.clock.Now()
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
+	sm.traceTransition(sta01, event, action, sm.currentState)
 	for sm.currentState != sta01 {
 		sm.runOneStep()
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
+	sm.discardSpoolFile()
+	sm.metrics.AssociationEnded(label, sm.clock.Now().Sub(start))
+	sm.logger.Debug("Statemachine finished")
 }
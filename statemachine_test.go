@@ -0,0 +1,1434 @@
+package netdicom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/pdu"
+	"github.com/giesekow/go-netdicom/pdu/pdu_item"
+	"github.com/giesekow/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+// Create a provider-side state machine in state sta06 whose peer is the
+// returned conn.
+func newTestStateMachine(t *testing.T) (*stateMachine, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	label := newUID("test")
+	sm := &stateMachine{
+		label:          label,
+		contextManager: newContextManager("test"),
+		conn:           local,
+		netCh:          make(chan stateEvent, 128),
+		errorCh:        make(chan stateEvent, 128),
+		downcallCh:     make(chan stateEvent, 128),
+		upcallCh:       make(chan upcallEvent, 128),
+		currentState:   sta06,
+		logger:         withLogValues(nil, "association", label),
+		metrics:        noopMetrics{},
+		clock:          realClock{},
+	}
+	return sm, remote
+}
+
+// fakeClock is a Clock whose time advances only when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	f    func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, fakeTimer{when: c.now.Add(d), f: f})
+}
+
+// Advance moves the clock forward by d and runs the timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var expired []func()
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.when.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			expired = append(expired, timer.f)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, f := range expired {
+		go f()
+	}
+}
+
+func TestARTIMExpiryAborts(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sm.clock = clock
+	// Awaiting A-ASSOCIATE-AC, with the ARTIM timer running.
+	sm.currentState = sta05
+	sm.startTimer()
+
+	done := make(chan struct{})
+	go func() {
+		sm.runOneStep()
+		close(done)
+	}()
+	clock.Advance(9 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("ARTIM timer fired early")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+	<-done
+	require.Equal(t, sta13, sm.currentState)
+}
+
+func TestIdleTimeoutReleases(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sm.clock = clock
+	sm.idleTimeout = time.Minute
+	sm.startIdleTimer()
+	received := make(chan pdu.PDU, 1)
+	go func() {
+		v, _ := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+		received <- v
+	}()
+
+	// A PDU from the peer postpones the release.
+	clock.Advance(40 * time.Second)
+	sm.netCh <- stateEvent{event: evt10, pdu: &pdu.PDataTf{}}
+	sm.runOneStep()
+	done := make(chan struct{})
+	go func() {
+		sm.runOneStep()
+		close(done)
+	}()
+	clock.Advance(40 * time.Second)
+	select {
+	case v := <-received:
+		t.Fatalf("released early: %v", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(20 * time.Second)
+	require.Equal(t, &pdu.AReleaseRq{}, <-received)
+	<-done
+	require.Equal(t, sta07, sm.currentState)
+}
+
+func TestOversizedPDataAborts(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	sm.commandAssembler = dimse.CommandAssembler{MaxCommandSize: 1024}
+	received := make(chan pdu.PDU, 1)
+	go func() {
+		v, _ := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+		received <- v
+	}()
+	// The peer never sets the Last bit.
+	for i := 0; i < 100 && sm.currentState == sta06; i++ {
+		event := stateEvent{event: evt10, pdu: &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: 1,
+			Command:   true,
+			Value:     make([]byte, 100),
+		}}}}
+		sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+	}
+	require.Equal(t, sta13, sm.currentState)
+	_, ok := (<-received).(*pdu.AAbort)
+	require.True(t, ok)
+}
+
+func TestUnknownCommandSkipped(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	sm.commandAssembler = dimse.CommandAssembler{SkipUnknownCommands: true}
+	go io.Copy(io.Discard, peer) // Don't block if the command aborts.
+	var b bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&b, &dimse.UnknownMessage{Field: 0x0ff1, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+	event := stateEvent{event: evt10, pdu: &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+		ContextID: 1,
+		Command:   true,
+		Last:      true,
+		Value:     b.Bytes(),
+	}}}}
+	sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+	require.Equal(t, sta06, sm.currentState)
+	require.Empty(t, sm.upcallCh)
+}
+
+// A P-DATA-TF that arrives before the handshake completes aborts the
+// association, and never reaches the command assembler.
+func TestEarlyPDataAborts(t *testing.T) {
+	for _, tc := range []struct {
+		state  stateType
+		source pdu.AbortSourceType
+	}{
+		{sta02, pdu.AbortSourceServiceUser},     // Provider awaiting A-ASSOCIATE-RQ.
+		{sta03, pdu.AbortSourceServiceProvider}, // Provider deciding on A-ASSOCIATE-RQ.
+		{sta05, pdu.AbortSourceServiceProvider}, // User awaiting A-ASSOCIATE-AC.
+	} {
+		sm, peer := newTestStateMachine(t)
+		sm.currentState = tc.state
+		received := make(chan pdu.PDU, 1)
+		go func() {
+			v, _ := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+			received <- v
+		}()
+		event := stateEvent{event: evt10, pdu: &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: 1,
+			Command:   true,
+			Last:      true,
+			Value:     make([]byte, 100),
+		}}}}
+		sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+		require.Equal(t, sta13, sm.currentState, "state %v", tc.state)
+		require.Equal(t, &pdu.AAbort{Source: tc.source, Reason: pdu.AbortReasonUnexpectedPDU}, <-received, "state %v", tc.state)
+		require.Equal(t, dimse.CommandAssembler{}, sm.commandAssembler, "state %v", tc.state)
+		require.Empty(t, sm.upcallCh, "state %v", tc.state)
+	}
+}
+
+func TestEmptyPDataIgnored(t *testing.T) {
+	sm, _ := newTestStateMachine(t)
+	feed := func(v *pdu.PDataTf) {
+		event := stateEvent{event: evt10, pdu: v}
+		sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+	}
+	// The first fragment of a command on context 1.
+	feed(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{ContextID: 1, Command: true, Value: make([]byte, 10)}}})
+	assembler := sm.commandAssembler
+
+	feed(&pdu.PDataTf{})
+	require.Equal(t, sta06, sm.currentState)
+	// An empty fragment on another context must not be taken for a mixed
+	// context.
+	feed(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{ContextID: 3, Command: true}}})
+	require.Equal(t, sta06, sm.currentState)
+	require.Equal(t, assembler, sm.commandAssembler)
+	require.Empty(t, sm.upcallCh)
+}
+
+func TestSendOnUnnegotiatedContextAborts(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	received := make(chan pdu.PDU, 1)
+	go func() {
+		v, _ := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+		received <- v
+	}()
+	event := stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: dicomuid.VerificationSOPClass,
+			command: &dimse.CEchoRq{
+				MessageID:          1,
+				CommandDataSetType: dimse.CommandDataSetTypeNull,
+			},
+		},
+	}
+	require.NotPanics(t, func() {
+		sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+	})
+	require.Equal(t, sta13, sm.currentState)
+	_, ok := (<-received).(*pdu.AAbort)
+	require.True(t, ok)
+}
+
+func writeTestPDU(t *testing.T, conn net.Conn, v pdu.PDU) {
+	data, err := pdu.EncodePDU(v)
+	require.NoError(t, err)
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+}
+
+func TestAssociateRejectReasons(t *testing.T) {
+	validItems := func() []pdu_item.SubItem { return newTestAssociateRQ().Items }
+	for _, test := range []struct {
+		name  string
+		items func() []pdu_item.SubItem
+		rq    func(*pdu.AAssociateRQ)
+		want  *pdu.AAssociateRj
+	}{
+		{
+			name: "protocol version",
+			rq:   func(rq *pdu.AAssociateRQ) { rq.ProtocolVersion = 2 },
+			want: &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceProviderACSE,
+				Reason: pdu.RejectReasonProtocolVersionNotSupported},
+		},
+		{
+			name: "application context",
+			items: func() []pdu_item.SubItem {
+				items := validItems()
+				items[0] = &pdu_item.ApplicationContextItem{Name: "1.2.3.4"}
+				return items
+			},
+			want: &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceUser,
+				Reason: pdu.RejectReasonApplicationContextNameNotSupported},
+		},
+		{
+			name:  "no application context",
+			items: func() []pdu_item.SubItem { return validItems()[1:] },
+			want: &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceUser,
+				Reason: pdu.RejectReasonApplicationContextNameNotSupported},
+		},
+		{
+			name: "no presentation context",
+			items: func() []pdu_item.SubItem {
+				var items []pdu_item.SubItem
+				for _, item := range validItems() {
+					if _, ok := item.(*pdu_item.PresentationContextItem); !ok {
+						items = append(items, item)
+					}
+				}
+				return items
+			},
+			want: &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceUser,
+				Reason: pdu.RejectReasonNone},
+		},
+		{
+			name: "malformed presentation context",
+			items: func() []pdu_item.SubItem {
+				items := validItems()
+				items[1].(*pdu_item.PresentationContextItem).Items = []pdu_item.SubItem{
+					&pdu_item.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+				}
+				return items
+			},
+			want: &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceProviderACSE,
+				Reason: pdu.RejectReasonNone},
+		},
+	} {
+		rq := newTestAssociateRQ()
+		if test.items != nil {
+			rq.Items = test.items()
+		}
+		if test.rq != nil {
+			test.rq(rq)
+		}
+		require.Equal(t, test.want, associateWithTestProvider(t, ServiceProviderParams{}, rq), test.name)
+	}
+}
+
+func TestApplicationContextNameOverride(t *testing.T) {
+	const name = "1.2.826.0.1.3680043.2.1"
+	params := ServiceProviderParams{ApplicationContextName: name}
+	v := associateWithTestProvider(t, params, newTestAssociateRQ())
+	require.Equal(t, &pdu.AAssociateRj{Result: pdu.ResultRejectedPermanent, Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonApplicationContextNameNotSupported}, v)
+
+	rq := newTestAssociateRQ()
+	rq.Items[0] = &pdu_item.ApplicationContextItem{Name: name}
+	ac, ok := associateWithTestProvider(t, params, rq).(*pdu.AAssociateAC)
+	require.True(t, ok)
+	require.Equal(t, &pdu_item.ApplicationContextItem{Name: name}, ac.Items[0])
+}
+
+// Returns an A-ASSOCIATE-RQ from "user" to "provider" for the verification
+// SOP class.
+func newTestAssociateRQ() *pdu.AAssociateRQ {
+	return &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items: newContextManager("test").generateAssociateRequest(ServiceUserParams{
+			SOPClasses:       sopclass.VerificationClasses,
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}),
+	}
+}
+
+// Sends "rq" to a provider state machine running with "params", and returns
+// its response.
+func associateWithTestProvider(t *testing.T, params ServiceProviderParams, rq *pdu.AAssociateRQ) pdu.PDU {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	go runStateMachineForServiceProvider(context.Background(), local, params,
+		make(chan upcallEvent, 128), make(chan stateEvent, 128), newUID("test"))
+	writeTestPDU(t, peer, rq)
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	return v
+}
+
+func TestCalledAETitleMatching(t *testing.T) {
+	params := ServiceProviderParams{CalledAETitles: []string{"STORESCP", "ARCHIVE"}}
+	rq := newTestAssociateRQ()
+	rq.CalledAETitle = "OTHER"
+	require.Equal(t, &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+	}, associateWithTestProvider(t, params, rq))
+
+	// AE titles are padded with spaces in the PDU.
+	for _, title := range []string{"STORESCP", "ARCHIVE         "} {
+		rq.CalledAETitle = title
+		require.IsType(t, &pdu.AAssociateAC{}, associateWithTestProvider(t, params, rq), title)
+	}
+
+	// Without a list, any title is accepted.
+	rq.CalledAETitle = "OTHER"
+	require.IsType(t, &pdu.AAssociateAC{}, associateWithTestProvider(t, ServiceProviderParams{}, rq))
+}
+
+func TestCallingAETitleAllowlist(t *testing.T) {
+	authenticated := 0
+	params := ServiceProviderParams{
+		CallingAETitles: []string{"MODALITY"},
+		Authenticate: func(conn ConnectionState, identity *UserIdentity) ([]byte, error) {
+			authenticated++
+			return nil, nil
+		},
+	}
+	rq := newTestAssociateRQ()
+	rq.CallingAETitle = "MODALITY        "
+	require.IsType(t, &pdu.AAssociateAC{}, associateWithTestProvider(t, params, rq))
+	require.Equal(t, 1, authenticated)
+
+	// Unknown callers are rejected before their identity is checked.
+	rq.CallingAETitle = "INTRUDER"
+	require.Equal(t, &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+	}, associateWithTestProvider(t, params, rq))
+	require.Equal(t, 1, authenticated)
+}
+
+func TestContextCancelAbortsAssociation(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runStateMachineForServiceProvider(ctx, local, ServiceProviderParams{},
+			make(chan upcallEvent, 128), make(chan stateEvent, 128), newUID("test"))
+		close(done)
+	}()
+
+	items := newContextManager("test").generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	writeTestPDU(t, peer, &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items:           items,
+	})
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAssociateAC{}, v)
+
+	// Start sending a command, then cancel before it completes.
+	writeTestPDU(t, peer, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+		ContextID: 1,
+		Command:   true,
+		Value:     make([]byte, 16),
+	}}})
+	cancel()
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+
+	peer.Close()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("state machine did not exit")
+	}
+}
+
+func TestPeerAbortIsReported(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAssociateRQ{}, v)
+	writeTestPDU(t, peer, &pdu.AAbort{
+		Source: pdu.AbortSourceServiceProvider,
+		Reason: pdu.AbortReasonUnexpectedPDUParameter,
+	})
+
+	err = su.CEcho()
+	require.Error(t, err)
+	var abortErr *AbortError
+	require.ErrorAs(t, err, &abortErr)
+	require.Equal(t, pdu.AbortSourceServiceProvider, abortErr.Source)
+	require.Equal(t, pdu.AbortReasonUnexpectedPDUParameter, abortErr.Reason)
+	require.Equal(t, abortErr, su.AbortError())
+}
+
+func TestReleaseTimeoutAbortsAssociation(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		ReleaseTimeout:   100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+	_, err = su.NegotiatedContexts()
+	require.NoError(t, err)
+
+	// Never answer the A-RELEASE-RQ.
+	su.Release()
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRq{}, v)
+	start := time.Now()
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+	require.Less(t, time.Since(start), 10*time.Second, "aborted by the ARTIM timer, not the release timer")
+	_, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.Error(t, err, "connection not closed")
+}
+
+func TestAbortMidTransfer(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+
+	echoErr := make(chan error, 1)
+	go func() { echoErr <- su.CEcho() }()
+	// Leave the C-ECHO unanswered.
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.PDataTf{}, v)
+
+	require.Error(t, su.Abort(pdu.AbortSourceServiceUser, pdu.AbortReasonUnexpectedPDU))
+	require.Error(t, su.Abort(pdu.AbortSourceType(1), pdu.AbortReasonNotSpecified))
+	require.Error(t, su.Abort(pdu.AbortSourceServiceProvider, pdu.AbortReasonType(3)))
+	require.NoError(t, su.Abort(pdu.AbortSourceServiceProvider, pdu.AbortReasonInvalidPDUParameterValue))
+	require.Error(t, su.Abort(pdu.AbortSourceServiceUser, pdu.AbortReasonNotSpecified), "aborted twice")
+
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.Equal(t, &pdu.AAbort{
+		Source: pdu.AbortSourceServiceProvider,
+		Reason: pdu.AbortReasonInvalidPDUParameterValue,
+	}, v)
+	peer.Close()
+	select {
+	case err := <-echoErr:
+		require.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("C-ECHO didn't fail after the abort")
+	}
+}
+
+func TestDuplicateContextIDInAssociateACAborts(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{dicomuid.VerificationSOPClass, sopclass.StorageClasses[0]},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	response := func(transferSyntaxUID string) *pdu_item.PresentationContextItem {
+		return &pdu_item.PresentationContextItem{
+			Type:      pdu_item.ItemTypePresentationContextResponse,
+			ContextID: 1,
+			Result:    pdu_item.PresentationContextAccepted,
+			Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: transferSyntaxUID}},
+		}
+	}
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items: []pdu_item.SubItem{
+			&pdu_item.ApplicationContextItem{Name: pdu_item.DICOMApplicationContextItemName},
+			response(dicomuid.ImplicitVRLittleEndian),
+			response(dicomuid.ExplicitVRLittleEndian),
+		},
+	})
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.Equal(t, &pdu.AAbort{Source: pdu.AbortSourceServiceProvider, Reason: pdu.AbortReasonNotSpecified}, v)
+	peer.Close()
+	_, err = su.NegotiatedContexts()
+	require.Error(t, err)
+}
+
+// Waits for the upcall channel to deliver an event of the given type, skipping
+// others, and then for the channel to close.
+func requireUpcallThenClose(t *testing.T, upcallCh chan upcallEvent, eventType upcallEventType) {
+	found := false
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case event, ok := <-upcallCh:
+			if !ok {
+				require.True(t, found, "channel closed before %v", eventType)
+				return
+			}
+			if event.eventType == eventType {
+				found = true
+			}
+		case <-timeout:
+			t.Fatalf("state machine did not exit")
+		}
+	}
+}
+
+// Both sides send A-RELEASE-RQ before seeing the other's. Drive each role
+// against a scripted peer through the P3.8 9.2.3 collision sequence.
+func TestReleaseCollisionAsRequestor(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	upcallCh := make(chan upcallEvent, 128)
+	downcallCh := make(chan stateEvent, 128)
+	go runStateMachineForServiceUser(context.Background(), ServiceUserParams{
+		CalledAETitle:    "provider",
+		CallingAETitle:   "user",
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	}, upcallCh, downcallCh, newUID("test"))
+	downcallCh <- stateEvent{event: evt02, conn: local}
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+	require.Equal(t, upcallEventHandshakeCompleted, (<-upcallCh).eventType)
+
+	downcallCh <- stateEvent{event: evt11}
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRq{}, v)
+	writeTestPDU(t, peer, &pdu.AReleaseRq{})
+	// The requestor answers first.
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+	writeTestPDU(t, peer, &pdu.AReleaseRp{})
+
+	requireUpcallThenClose(t, upcallCh, upcallEventReleased)
+	_, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.Error(t, err, "connection not closed")
+}
+
+func TestAssociateACProtocolVersion(t *testing.T) {
+	for _, version := range []uint16{pdu.CurrentProtocolVersion, 0x0002} {
+		local, peer := net.Pipe()
+		upcallCh := make(chan upcallEvent, 128)
+		downcallCh := make(chan stateEvent, 128)
+		go runStateMachineForServiceUser(context.Background(), ServiceUserParams{
+			CalledAETitle:    "provider",
+			CallingAETitle:   "user",
+			SOPClasses:       sopclass.VerificationClasses,
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		}, upcallCh, downcallCh, newUID("test"))
+		downcallCh <- stateEvent{event: evt02, conn: local}
+
+		v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+		require.NoError(t, err)
+		rq := v.(*pdu.AAssociateRQ)
+		require.Equal(t, pdu.CurrentProtocolVersion, rq.ProtocolVersion)
+		items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+		require.NoError(t, err)
+		writeTestPDU(t, peer, &pdu.AAssociateAC{
+			ProtocolVersion: version,
+			CalledAETitle:   rq.CalledAETitle,
+			CallingAETitle:  rq.CallingAETitle,
+			Items:           items,
+		})
+		if version == pdu.CurrentProtocolVersion {
+			require.Equal(t, upcallEventHandshakeCompleted, (<-upcallCh).eventType)
+			downcallCh <- stateEvent{event: evt15, pdu: &pdu.AAbort{}}
+		} else {
+			v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+			require.NoError(t, err)
+			require.IsType(t, &pdu.AAbort{}, v, "version 0x%x", version)
+		}
+		// The state machine exits once the connection is closed.
+		peer.Close()
+		for range upcallCh {
+		}
+	}
+}
+
+func TestAssociationInfoMatchesNegotiation(t *testing.T) {
+	local, remote := net.Pipe()
+	providerInfo := make(chan *AssociationInfo, 1)
+	go RunProviderForConn(remote, ServiceProviderParams{
+		AETitle:          "provider",
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian},
+		CEcho: func(conn ConnectionState) dimse.Status {
+			providerInfo <- conn.Association
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:          "provider",
+		CallingAETitle:         "user",
+		SOPClasses:             []string{dicomuid.VerificationSOPClass, dicomuid.StudyRootQRGet, sopclass.StorageClasses[0]},
+		TransferSyntaxes:       []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+		MaxOperationsInvoked:   4,
+		MaxOperationsPerformed: 2,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+
+	info, err := su.AssociationInfo()
+	require.NoError(t, err)
+	want := &AssociationInfo{
+		CalledAETitle:                 "provider",
+		CallingAETitle:                "user",
+		PeerMaxPDUSize:                DefaultMaxPDUSize,
+		PeerImplementationClassUID:    dicom.GoDICOMImplementationClassUID,
+		PeerImplementationVersionName: dicom.GoDICOMImplementationVersionName,
+		MaxOperationsInvoked:          4,
+		MaxOperationsPerformed:        2,
+		Contexts: []AssociationContext{
+			{ContextID: 1, AbstractSyntaxUID: dicomuid.VerificationSOPClass, TransferSyntaxUID: dicomuid.ExplicitVRLittleEndian},
+			{ContextID: 3, AbstractSyntaxUID: dicomuid.StudyRootQRGet, TransferSyntaxUID: dicomuid.ExplicitVRLittleEndian},
+			{ContextID: 5, AbstractSyntaxUID: sopclass.StorageClasses[0], TransferSyntaxUID: dicomuid.ExplicitVRLittleEndian,
+				RequestorSCPRole: true},
+		},
+	}
+	require.Equal(t, want, info)
+
+	// The provider sees the same parameters, except for the peer
+	// implementation, which is the user's.
+	require.NoError(t, su.CEcho())
+	got := <-providerInfo
+	require.NotNil(t, got)
+	want.PeerImplementationClassUID, want.PeerImplementationVersionName = got.PeerImplementationClassUID, got.PeerImplementationVersionName
+	require.Equal(t, want, got)
+}
+
+func TestReleaseCollisionAsAcceptor(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	upcallCh := make(chan upcallEvent, 128)
+	downcallCh := make(chan stateEvent, 128)
+	go runStateMachineForServiceProvider(context.Background(), local, ServiceProviderParams{},
+		upcallCh, downcallCh, newUID("test"))
+
+	items := newContextManager("test").generateAssociateRequest(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	writeTestPDU(t, peer, &pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "provider",
+		CallingAETitle:  "user",
+		Items:           items,
+	})
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAssociateAC{}, v)
+	require.Equal(t, upcallEventHandshakeCompleted, (<-upcallCh).eventType)
+
+	downcallCh <- stateEvent{event: evt11}
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRq{}, v)
+	writeTestPDU(t, peer, &pdu.AReleaseRq{})
+	// The acceptor answers only after the requestor's A-RELEASE-RP.
+	writeTestPDU(t, peer, &pdu.AReleaseRp{})
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+	peer.Close()
+
+	requireUpcallThenClose(t, upcallCh, upcallEventReleased)
+}
+
+// corruptingFaultInjector corrupts the type field of every received PDU of the
+// given type and records the events the state machine processes.
+type corruptingFaultInjector struct {
+	pduType pdu.Type
+
+	mu     sync.Mutex
+	events []eventType
+}
+
+func (fi *corruptingFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+	fi.mu.Lock()
+	fi.events = append(fi.events, event.event)
+	fi.mu.Unlock()
+}
+
+func (fi *corruptingFaultInjector) onSend(data []byte) faultInjectorAction {
+	return faultInjectorContinue
+}
+
+func (fi *corruptingFaultInjector) onReceive(data []byte) []byte {
+	if pdu.Type(data[0]) == fi.pduType {
+		data[0] ^= 0x80
+	}
+	return data
+}
+
+func (fi *corruptingFaultInjector) String() string {
+	return "corruptingFaultInjector"
+}
+
+func TestCorruptedAssociateACAborts(t *testing.T) {
+	faults := &corruptingFaultInjector{pduType: pdu.TypeAAssociateAc}
+	SetUserFaultInjector(faults)
+	defer SetUserFaultInjector(nil)
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+	v, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+
+	// The transition is recorded after AA-8 has sent the A-ABORT.
+	require.Eventually(t, func() bool {
+		faults.mu.Lock()
+		defer faults.mu.Unlock()
+		return len(faults.events) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	require.Equal(t, []eventType{evt02, evt19}, faults.events)
+}
+
+func TestPDUTracerSeesRawPDUs(t *testing.T) {
+	type trace struct {
+		direction PDUDirection
+		data      []byte
+	}
+	var mu sync.Mutex
+	var traces []trace
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		PDUTracer: func(association string, direction PDUDirection, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			traces = append(traces, trace{direction, append([]byte(nil), data...)})
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+
+	v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	rq := v.(*pdu.AAssociateRQ)
+	items, err := newContextManager("provider").onAssociateRequest(ServiceProviderParams{}, rq.Items)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAssociateAC{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+	_, err = su.NegotiatedContexts()
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, traces, 2)
+	require.Equal(t, PDUSent, traces[0].direction)
+	require.Equal(t, byte(0x01), traces[0].data[0], "A-ASSOCIATE-RQ")
+	require.Equal(t, PDUReceived, traces[1].direction)
+	require.Equal(t, byte(0x02), traces[1].data[0], "A-ASSOCIATE-AC")
+
+	var buf bytes.Buffer
+	NewHexDumpPDUTracer(&buf)("test", PDUSent, traces[0].data[:4])
+	require.True(t, strings.HasPrefix(buf.String(), "association=test sent 4 bytes\n00000000  01 00 00 00 "), buf.String())
+}
+
+func TestUpcallEventDataSetUsesContextTransferSyntax(t *testing.T) {
+	cm := newContextManager("test")
+	addContextMapping(cm, dicomuid.StudyRootQRFind, dicomuid.ExplicitVRLittleEndian, 3,
+		pdu_item.PresentationContextAccepted)
+	identifier := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "STUDY"),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^John"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3.4"),
+	}
+	data, err := writeElementsToBytes(identifier, dicomuid.ExplicitVRLittleEndian)
+	require.NoError(t, err)
+	event := upcallEvent{
+		eventType: upcallEventData,
+		cm:        cm,
+		contextID: 3,
+		command: &dimse.CFindRsp{
+			AffectedSOPClassUID:       dicomuid.StudyRootQRFind,
+			MessageIDBeingRespondedTo: 1,
+			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+			Status:                    dimse.Status{Status: dimse.StatusPending},
+		},
+		data: data,
+	}
+	ds, err := event.dataSet()
+	require.NoError(t, err)
+	require.Len(t, ds.Elements, len(identifier))
+	for i, elem := range identifier {
+		require.Equal(t, elem.Tag, ds.Elements[i].Tag)
+		require.Equal(t, elem.MustGetString(), ds.Elements[i].MustGetString())
+	}
+	// The VRs were read from the data, as Explicit VR requires.
+	require.Equal(t, "PN", ds.Elements[1].VR)
+
+	event.contextID = 5
+	_, err = event.dataSet()
+	require.Error(t, err)
+}
+
+func TestForEachDataPDUHonorsPeerMaxPDUSize(t *testing.T) {
+	sm, _ := newTestStateMachine(t)
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, maxPDUSize := range []int{13, 64, 999, 1012, 1013, 4096} {
+		sm.contextManager.peerMaxPDUSize = maxPDUSize
+		var pdus []*pdu.PDataTf
+		err := forEachDataPDU(sm, dicomuid.VerificationSOPClass, false, data, func(p *pdu.PDataTf) error {
+			encoded, err := pdu.EncodePDU(p)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(encoded), maxPDUSize)
+			decoded, err := pdu.ReadPDU(bytes.NewReader(encoded), DefaultMaxPDUSize)
+			require.NoError(t, err)
+			pdus = append(pdus, decoded.(*pdu.PDataTf))
+			return nil
+		})
+		require.NoError(t, err)
+		var reassembled []byte
+		for i, p := range pdus {
+			require.Len(t, p.Items, 1)
+			require.Equal(t, i == len(pdus)-1, p.Items[0].Last)
+			reassembled = append(reassembled, p.Items[0].Value...)
+		}
+		require.Equal(t, data, reassembled)
+	}
+
+	sm.contextManager.peerMaxPDUSize = 12
+	err := forEachDataPDU(sm, dicomuid.VerificationSOPClass, false, data, func(*pdu.PDataTf) error {
+		t.Fatal("unexpected PDU")
+		return nil
+	})
+	require.Error(t, err)
+
+	// An error from fn stops the iteration.
+	sm.contextManager.peerMaxPDUSize = 64
+	n := 0
+	errStop := errors.New("stop")
+	err = forEachDataPDU(sm, dicomuid.VerificationSOPClass, false, data, func(*pdu.PDataTf) error {
+		n++
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 1, n)
+}
+
+// A write failure in the middle of a large payload is reported once, rather
+// than once per remaining PDU, which would fill errorCh and wedge the state
+// machine.
+func TestSendDataPDUsStopsOnWriteFailure(t *testing.T) {
+	local, peer := net.Pipe()
+	peer.Close()
+	sm := &stateMachine{
+		label:          "test",
+		contextManager: newContextManager("test"),
+		conn:           local,
+		errorCh:        make(chan stateEvent, 128),
+		logger:         withLogValues(nil, "association", "test"),
+		metrics:        noopMetrics{},
+	}
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	sm.contextManager.peerMaxPDUSize = 64
+	err := sendDataPDUs(sm, dicomuid.VerificationSOPClass, false, make([]byte, 1<<20))
+	require.ErrorIs(t, err, errPDUWriteFailed)
+	require.Len(t, sm.errorCh, 1)
+	require.Equal(t, evt17, (<-sm.errorCh).event)
+
+	// Likewise when the command and the data share PDUs.
+	sm.packCommandAndData = true
+	err = sendDIMSEMessage(sm, "DT-1", &stateEventDIMSEPayload{
+		abstractSyntaxName: dicomuid.VerificationSOPClass,
+		command:            &dimse.CStoreRq{CommandDataSetType: dimse.CommandDataSetTypeNonNull},
+		data:               make([]byte, 1<<20),
+	}, make([]byte, 100))
+	require.ErrorIs(t, err, errPDUWriteFailed)
+	require.Len(t, sm.errorCh, 1)
+	require.Equal(t, evt17, (<-sm.errorCh).event)
+}
+
+// Data for a command whose CommandDataSetType says it has none is refused
+// before anything is written.
+func TestSendDIMSEMessageRejectsDataForCommandWithoutData(t *testing.T) {
+	local, peer := net.Pipe()
+	defer local.Close()
+	defer peer.Close()
+	sm := &stateMachine{
+		label:  "test",
+		conn:   local,
+		logger: withLogValues(nil, "association", "test"),
+	}
+	err := sendDIMSEMessage(sm, "DT-1", &stateEventDIMSEPayload{
+		abstractSyntaxName: dicomuid.VerificationSOPClass,
+		command:            &dimse.CEchoRq{CommandDataSetType: dimse.CommandDataSetTypeNull},
+		data:               []byte{1, 2},
+	}, make([]byte, 100))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errPDUWriteFailed)
+	require.Contains(t, err.Error(), "which has no data")
+}
+
+func TestEncodeCommandChecksMaxCommandSize(t *testing.T) {
+	sm := &stateMachine{label: "test"}
+	command := &dimse.CEchoRq{
+		AffectedSOPClassUID: dicomuid.VerificationSOPClass,
+		MessageID:           1,
+		CommandDataSetType:  dimse.CommandDataSetTypeNull,
+	}
+	encoded, err := encodeCommand(sm, command)
+	require.NoError(t, err)
+	// The buffer is sized up front.
+	require.Equal(t, len(encoded), cap(encoded))
+
+	sm.commandAssembler.MaxCommandSize = int64(len(encoded) - 1)
+	_, err = encodeCommand(sm, command)
+	require.ErrorContains(t, err, "max command size")
+}
+
+func TestUnencodableCommandAborts(t *testing.T) {
+	sm, peer := newTestStateMachine(t)
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	// No command fits.
+	sm.commandAssembler.MaxCommandSize = 1
+	received := make(chan pdu.PDU, 1)
+	go func() {
+		v, err := pdu.ReadPDU(peer, DefaultMaxPDUSize)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- v
+	}()
+	event := stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: dicomuid.VerificationSOPClass,
+			command: &dimse.CEchoRq{
+				AffectedSOPClassUID: dicomuid.VerificationSOPClass,
+				MessageID:           1,
+				CommandDataSetType:  dimse.CommandDataSetTypeNull,
+			},
+		},
+	}
+	require.NotPanics(t, func() {
+		sm.currentState = findAction(sm.currentState, &event).Callback(sm, event)
+	})
+	require.Equal(t, sta13, sm.currentState)
+	_, ok := (<-received).(*pdu.AAbort)
+	require.True(t, ok)
+}
+
+func TestForEachPackedPDU(t *testing.T) {
+	sm, _ := newTestStateMachine(t)
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	command := bytes.Repeat([]byte{0xcc}, 30)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, test := range []struct {
+		maxPDUSize int
+		data       []byte
+		numPDUs    int
+	}{
+		// The command and the start of the data share the first PDU.
+		{maxPDUSize: 64, data: data, numPDUs: 20},
+		{maxPDUSize: 4096, data: data, numPDUs: 1},
+		// The command is split, and its last fragment shares a PDU with
+		// the data.
+		{maxPDUSize: 26, data: data, numPDUs: 74},
+		{maxPDUSize: 4096, data: nil, numPDUs: 1},
+	} {
+		sm.contextManager.peerMaxPDUSize = test.maxPDUSize
+		var pdus []*pdu.PDataTf
+		err := forEachPackedPDU(sm, dicomuid.VerificationSOPClass, command, test.data, func(p *pdu.PDataTf) error {
+			encoded, err := pdu.EncodePDU(p)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(encoded), test.maxPDUSize)
+			decoded, err := pdu.ReadPDU(bytes.NewReader(encoded), DefaultMaxPDUSize)
+			require.NoError(t, err)
+			pdus = append(pdus, decoded.(*pdu.PDataTf))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, pdus, test.numPDUs, test.maxPDUSize)
+
+		var gotCommand, gotData []byte
+		var items []pdu.PresentationDataValueItem
+		for _, p := range pdus {
+			require.NotEmpty(t, p.Items)
+			items = append(items, p.Items...)
+		}
+		for i, item := range items {
+			if item.Command {
+				require.Nil(t, gotData, "command fragment after data")
+				gotCommand = append(gotCommand, item.Value...)
+				// The command is complete before any data.
+				require.Equal(t, len(gotCommand) == len(command), item.Last)
+			} else {
+				gotData = append(gotData, item.Value...)
+				require.Equal(t, i == len(items)-1, item.Last)
+			}
+		}
+		require.Equal(t, command, gotCommand)
+		require.Equal(t, test.data, []byte(gotData))
+		if test.data != nil {
+			// The last command fragment and the first data fragment
+			// share a PDU.
+			for _, p := range pdus {
+				if p.Items[0].Command && p.Items[0].Last {
+					require.Len(t, p.Items, 2)
+					require.False(t, p.Items[1].Command)
+				}
+			}
+		}
+	}
+
+	sm.contextManager.peerMaxPDUSize = 12
+	err := forEachPackedPDU(sm, dicomuid.VerificationSOPClass, command, data, func(*pdu.PDataTf) error {
+		t.Fatal("unexpected PDU")
+		return nil
+	})
+	require.Error(t, err)
+
+	// An error from fn stops the iteration, in the command or the data.
+	errStop := errors.New("stop")
+	for _, maxPDUSize := range []int{26, 64} {
+		sm.contextManager.peerMaxPDUSize = maxPDUSize
+		n := 0
+		err = forEachPackedPDU(sm, dicomuid.VerificationSOPClass, command, data, func(*pdu.PDataTf) error {
+			n++
+			return errStop
+		})
+		require.ErrorIs(t, err, errStop)
+		require.Equal(t, 1, n)
+	}
+}
+
+// Measures the cost of sending a 100MB C-STORE payload. The PDUs are written
+// as they are produced, so memory use is bounded by the max PDU size rather
+// than the payload size.
+func BenchmarkSendDataPDUs(b *testing.B) {
+	local, peer := net.Pipe()
+	defer local.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	sm := &stateMachine{
+		label:          "bench",
+		contextManager: newContextManager("bench"),
+		conn:           local,
+		errorCh:        make(chan stateEvent, 128),
+		logger:         withLogValues(nil, "association", "bench"),
+		metrics:        noopMetrics{},
+	}
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	sm.contextManager.peerMaxPDUSize = DefaultMaxPDUSize
+	data := make([]byte, 100<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendDataPDUs(sm, dicomuid.VerificationSOPClass, false, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadTimeoutEndsNetworkReader(t *testing.T) {
+	local, peer := net.Pipe()
+	defer local.Close()
+	defer peer.Close()
+	ch := make(chan stateEvent, 128)
+	done := make(chan struct{})
+	go func() {
+		networkReaderThread(ch, local, DefaultMaxPDUSize, 50*time.Millisecond, withLogValues(nil, "association", "test"), noopMetrics{}, nil, nil, "test")
+		close(done)
+	}()
+	// Send a partial PDU header, then stall.
+	go peer.Write([]byte{byte(pdu.TypePDataTf), 0})
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("network reader did not exit")
+	}
+	event := <-ch
+	require.Equal(t, evt17, event.event)
+	_, ok := <-ch
+	require.False(t, ok)
+}
+
+func TestWriteTimeoutClosesConnection(t *testing.T) {
+	sm, _ := newTestStateMachine(t)
+	sm.writeTimeout = 50 * time.Millisecond
+	// Nobody reads from the peer, so the write stalls.
+	sendPDU(sm, &pdu.AReleaseRq{})
+	event := <-sm.errorCh
+	require.Equal(t, evt17, event.event)
+	require.Error(t, event.err)
+}
+
+type testLogEntry struct {
+	level         string
+	msg           string
+	keysAndValues []interface{}
+}
+
+// testLogger records the messages logged through it.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []testLogEntry
+}
+
+func (l *testLogger) log(level, msg string, keysAndValues []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, testLogEntry{level, msg, keysAndValues})
+}
+
+func (l *testLogger) Debug(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *testLogger) Info(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *testLogger) Warn(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *testLogger) Error(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func TestLoggerReceivesAssociationMessages(t *testing.T) {
+	logger := &testLogger{}
+	local, peer := net.Pipe()
+	defer peer.Close()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		Logger:           logger,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(local)
+	_, err = pdu.ReadPDU(peer, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	writeTestPDU(t, peer, &pdu.AAbort{})
+	require.Error(t, su.CEcho())
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var found bool
+	for _, e := range logger.entries {
+		require.GreaterOrEqual(t, len(e.keysAndValues), 2, e.msg)
+		require.Equal(t, "association", e.keysAndValues[0], e.msg)
+		require.Equal(t, su.label, e.keysAndValues[1], e.msg)
+		if e.level == "warn" && e.msg == "Association aborted" {
+			found = true
+		}
+	}
+	require.True(t, found, "A-ABORT not logged: %+v", logger.entries)
+}
+
+// verboseTestLogger also records the verbose messages.
+type verboseTestLogger struct {
+	testLogger
+}
+
+func (l *verboseTestLogger) Verbose(msg string, kv ...interface{}) { l.log("verbose", msg, kv) }
+
+func TestLogVerbose(t *testing.T) {
+	// Loggers without a verbose level receive the messages as debug ones.
+	plain := &testLogger{}
+	logVerbose(withLogValues(plain, "association", "a1"), "Read PDU", "pdu", "x")
+	require.Equal(t, []testLogEntry{{"debug", "Read PDU", []interface{}{"association", "a1", "pdu", "x"}}}, plain.entries)
+
+	verbose := &verboseTestLogger{}
+	logger := withLogValues(verbose, "association", "a1")
+	logVerbose(logger, "Read PDU", "pdu", "x")
+	logger.Debug("Send DIMSE msg")
+	require.Equal(t, []testLogEntry{
+		{"verbose", "Read PDU", []interface{}{"association", "a1", "pdu", "x"}},
+		{"debug", "Send DIMSE msg", []interface{}{"association", "a1"}},
+	}, verbose.entries)
+}
+
+func TestFormatLogMessage(t *testing.T) {
+	require.Equal(t, "msg", formatLogMessage("msg", nil))
+	require.Equal(t, "msg a=1 b=x", formatLogMessage("msg", []interface{}{"a", 1, "b", "x"}))
+	require.Equal(t, "msg a=1 dangling", formatLogMessage("msg", []interface{}{"a", 1, "dangling"}))
+}
+
+// stringCounter counts the calls to its String method.
+type stringCounter struct{ n int }
+
+func (c *stringCounter) String() string {
+	c.n++
+	return "counter"
+}
+
+func TestDicomlogLoggerFormatsOnlyEnabledLevels(t *testing.T) {
+	defer dicomlog.SetLevel(dicomlog.Level())
+	dicomlog.SetLevel(0)
+	var c stringCounter
+	var logger dicomlogLogger
+	logger.Verbose("msg", "value", &c)
+	logger.Debug("msg", "value", &c)
+	require.Equal(t, 0, c.n)
+	dicomlog.SetLevel(1)
+	logger.Debug("msg", "value", &c)
+	require.Equal(t, 1, c.n)
+}
+
+func TestDeflatedDataPayload(t *testing.T) {
+	sm, _ := newTestStateMachine(t)
+	addContextMapping(sm.contextManager, dicomuid.StudyRootQRFind, dicomuid.DeflatedExplicitVRLittleEndian, 1,
+		pdu_item.PresentationContextAccepted)
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian, 3,
+		pdu_item.PresentationContextAccepted)
+	data := bytes.Repeat([]byte("(0010,0010) PN DOE^JOHN "), 100)
+	data = append(data, 0)
+
+	wire, err := deflateDataPayload(sm, dicomuid.StudyRootQRFind, data)
+	require.NoError(t, err)
+	require.Less(t, len(wire), len(data))
+	require.Zero(t, len(wire)%2) // P3.5 A.5: padded to an even length.
+	got, err := sm.inflateDataPayload(1, wire, "")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// Other contexts are left alone.
+	got, err = deflateDataPayload(sm, dicomuid.VerificationSOPClass, data)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	got, err = sm.inflateDataPayload(3, data, "")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// Spooled payloads are inflated in place.
+	path := filepath.Join(t.TempDir(), "spool")
+	require.NoError(t, os.WriteFile(path, wire, 0o600))
+	got, err = sm.inflateDataPayload(1, nil, path)
+	require.NoError(t, err)
+	require.Nil(t, got)
+	spooled, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, data, spooled)
+
+	// The inflated size counts against the max data size.
+	sm.commandAssembler.MaxDataSize = int64(len(data) - 1)
+	_, err = sm.inflateDataPayload(1, wire, "")
+	require.ErrorIs(t, err, errInflatedPayloadTooLarge)
+}
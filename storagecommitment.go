@@ -0,0 +1,313 @@
+package netdicom
+
+// This file implements the SCU side of the Storage Commitment Push Model
+// (P3.4 J).
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/giesekow/go-netdicom/dimse"
+	"github.com/giesekow/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// StorageCommitmentSOPInstanceUID is the well-known SOP instance of the
+// Storage Commitment Push Model SOP class. P3.4 J.3.5.
+const StorageCommitmentSOPInstanceUID = "1.2.840.10008.1.20.1.1"
+
+// Action and event types of the Storage Commitment Push Model. P3.4 J.3.2 and
+// J.3.3.
+const (
+	storageCommitmentActionRequest = 1
+	storageCommitmentEventSuccess  = 1
+	storageCommitmentEventFailures = 2
+)
+
+// SOPInstanceRef identifies a SOP instance.
+type SOPInstanceRef struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+}
+
+// StorageCommitmentFailure is a SOP instance that the SCP failed to commit.
+type StorageCommitmentFailure struct {
+	SOPInstanceRef
+	// Failure Reason (0008,1197), e.g., 0x0112 for "no such object
+	// instance". P3.4 J.3.3.1.1.
+	FailureReason uint16
+}
+
+// StorageCommitmentResult is the outcome of a storage commitment request, as
+// reported by the SCP through N-EVENT-REPORT.
+type StorageCommitmentResult struct {
+	// Transaction UID of the request.
+	TransactionUID string
+	// Instances the SCP committed.
+	Committed []SOPInstanceRef
+	// Instances the SCP failed to commit.
+	Failed []StorageCommitmentFailure
+}
+
+// Generates a UID for a storage commitment transaction. It is derived from a
+// random UUID, as described in P3.5 B.2.
+func newTransactionUID() (string, error) {
+	v, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+	return "2.25." + v.String(), nil
+}
+
+// Returns the datasets in the items of sequence element "elem".
+func sequenceItems(elem *dicom.Element) ([][]*dicom.Element, error) {
+	var items [][]*dicom.Element
+	for _, v := range elem.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok || item.Tag != dicomtag.Item {
+			return nil, fmt.Errorf("dicom.storageCommitment: %v is not a sequence", elem)
+		}
+		var elems []*dicom.Element
+		for _, iv := range item.Value {
+			e, ok := iv.(*dicom.Element)
+			if !ok {
+				return nil, fmt.Errorf("dicom.storageCommitment: malformed item in %v", elem)
+			}
+			elems = append(elems, e)
+		}
+		items = append(items, elems)
+	}
+	return items, nil
+}
+
+// Encodes the N-ACTION-RQ payload that asks for "refs" to be committed.
+func encodeStorageCommitmentRequest(transactionUID string, refs []SOPInstanceRef, transferSyntaxUID string) ([]byte, error) {
+	var items []interface{}
+	for _, ref := range refs {
+		items = append(items, dicom.MustNewElement(dicomtag.Item,
+			dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, ref.SOPClassUID),
+			dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, ref.SOPInstanceUID)))
+	}
+	return writeElementsToBytes([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransactionUID, transactionUID),
+		dicom.MustNewElement(dicomtag.ReferencedSOPSequence, items...),
+	}, transferSyntaxUID)
+}
+
+// Decodes the payload of an N-EVENT-REPORT-RQ that reports the outcome of a
+// storage commitment request.
+func decodeStorageCommitmentReport(c *dimse.NEventReportRq, data []byte, transferSyntaxUID string) (*StorageCommitmentResult, error) {
+	if c.EventTypeID != storageCommitmentEventSuccess && c.EventTypeID != storageCommitmentEventFailures {
+		return nil, fmt.Errorf("dicom.storageCommitment: unknown event type %d", c.EventTypeID)
+	}
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	result := &StorageCommitmentResult{}
+	for _, elem := range elems {
+		switch elem.Tag {
+		case dicomtag.TransactionUID:
+			if result.TransactionUID, err = elem.GetString(); err != nil {
+				return nil, err
+			}
+		case dicomtag.ReferencedSOPSequence, dicomtag.FailedSOPSequence:
+			items, err := sequenceItems(elem)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				var failure StorageCommitmentFailure
+				for _, e := range item {
+					switch e.Tag {
+					case dicomtag.ReferencedSOPClassUID:
+						failure.SOPClassUID, err = e.GetString()
+					case dicomtag.ReferencedSOPInstanceUID:
+						failure.SOPInstanceUID, err = e.GetString()
+					case dicomtag.FailureReason:
+						failure.FailureReason, err = e.GetUInt16()
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+				if elem.Tag == dicomtag.ReferencedSOPSequence {
+					result.Committed = append(result.Committed, failure.SOPInstanceRef)
+				} else {
+					result.Failed = append(result.Failed, failure)
+				}
+			}
+		}
+	}
+	if result.TransactionUID == "" {
+		return nil, fmt.Errorf("dicom.storageCommitment: N-EVENT-REPORT lacks TransactionUID")
+	}
+	return result, nil
+}
+
+// Decodes a storage commitment N-EVENT-REPORT-RQ and returns the status to send
+// back to the SCP.
+func handleStorageCommitmentReport(c *dimse.NEventReportRq, data []byte, transferSyntaxUID string) (*StorageCommitmentResult, dimse.Status) {
+	result, err := decodeStorageCommitmentReport(c, data, transferSyntaxUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.storageCommitment: Invalid N-EVENT-REPORT: %v", err)
+		return nil, dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: err.Error()}
+	}
+	return result, dimse.Success
+}
+
+// Sends the N-EVENT-REPORT-RSP for request "c".
+func sendNEventReportRsp(cs *serviceCommandState, c *dimse.NEventReportRq, status dimse.Status) {
+	cs.sendMessage(&dimse.NEventReportRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+		EventTypeID:               c.EventTypeID,
+		Status:                    status,
+	}, nil)
+}
+
+// StorageCommit asks the peer to commit to storing the given SOP instances
+// (P3.4 J), and waits for the outcome, which the peer reports through
+// N-EVENT-REPORT on this association. The storage commitment push model SOP
+// class (sopclass.StorageCommitmentClasses) must have been negotiated.
+// Concurrent calls are matched with their reports by transaction UID.
+//
+// Use RequestStorageCommitment instead if the peer reports on a new
+// association.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) StorageCommit(refs []SOPInstanceRef) (*StorageCommitmentResult, error) {
+	transactionUID, err := newTransactionUID()
+	if err != nil {
+		return nil, err
+	}
+	// The peer may report as soon as it has responded to the N-ACTION, so
+	// wait for the report before sending the request.
+	reportCh := make(chan *StorageCommitmentResult, 1)
+	su.mu.Lock()
+	su.commitWaiters[transactionUID] = reportCh
+	su.mu.Unlock()
+	defer func() {
+		su.mu.Lock()
+		delete(su.commitWaiters, transactionUID)
+		su.mu.Unlock()
+	}()
+
+	cs, err := su.requestStorageCommitment(refs, transactionUID)
+	if err != nil {
+		return nil, err
+	}
+	defer su.disp.deleteCommand(cs)
+	select {
+	case result := <-reportCh:
+		return result, nil
+	case event, ok := <-cs.upcallCh:
+		// The command stays registered only so that the channel is
+		// closed when the association ends.
+		if !ok {
+			return nil, su.closedError(fmt.Errorf("Connection closed while waiting for storage commitment report"))
+		}
+		return nil, fmt.Errorf("Found unexpected response for N-ACTION: %v", event.command)
+	}
+}
+
+// Handles an N-EVENT-REPORT-RQ from the peer, which reports the outcome of a
+// storage commitment request. The report is handed to the StorageCommit call
+// waiting for its transaction; reports that no call waits for, e.g., repeated
+// ones, are answered with an error status.
+func (su *ServiceUser) onStorageCommitmentReport(msg dimse.Message, data []byte, cs *serviceCommandState, aInfo associationInfo) {
+	c := msg.(*dimse.NEventReportRq)
+	result, status := handleStorageCommitmentReport(c, data, cs.context.transferSyntaxUID)
+	if result != nil {
+		su.mu.Lock()
+		reportCh, ok := su.commitWaiters[result.TransactionUID]
+		// Only the first report of a transaction is delivered.
+		delete(su.commitWaiters, result.TransactionUID)
+		su.mu.Unlock()
+		if ok {
+			select {
+			case reportCh <- result:
+			default:
+			}
+		} else {
+			dicomlog.Vprintf(0, "dicom.serviceUser(%s): Storage commitment report for unknown transaction %s", su.label, result.TransactionUID)
+			status = dimse.Status{
+				Status:       dimse.StatusInvalidArgumentValue,
+				ErrorComment: fmt.Sprintf("Unknown storage commitment transaction %s", result.TransactionUID),
+			}
+		}
+	}
+	sendNEventReportRsp(cs, c, status)
+}
+
+// RequestStorageCommitment asks the peer to commit to storing the given SOP
+// instances (P3.4 J), and returns the transaction UID of the request once the
+// peer acknowledges it. The peer reports the outcome later, typically on a new
+// association; see ServiceProviderParams.StorageCommitmentReport.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) RequestStorageCommitment(refs []SOPInstanceRef) (string, error) {
+	transactionUID, err := newTransactionUID()
+	if err != nil {
+		return "", err
+	}
+	cs, err := su.requestStorageCommitment(refs, transactionUID)
+	if err != nil {
+		return "", err
+	}
+	su.disp.deleteCommand(cs)
+	return transactionUID, nil
+}
+
+// Sends an N-ACTION-RQ for "refs" as transaction "transactionUID", and waits for
+// the response. On success, it returns the command, which the caller must
+// delete.
+func (su *ServiceUser) requestStorageCommitment(refs []SOPInstanceRef, transactionUID string) (*serviceCommandState, error) {
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("dicom.serviceUser: storage commitment: no SOP instances")
+	}
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopclass.StorageCommitmentClasses[0])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := encodeStorageCommitmentRequest(transactionUID, refs, context.transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return nil, err
+	}
+	cs.sendMessage(
+		&dimse.NActionRq{
+			RequestedSOPClassUID:    context.abstractSyntaxUID,
+			MessageID:               cs.messageID,
+			CommandDataSetType:      dimse.CommandDataSetTypeNonNull,
+			RequestedSOPInstanceUID: StorageCommitmentSOPInstanceUID,
+			ActionTypeID:            storageCommitmentActionRequest,
+		},
+		payload)
+	event, ok := <-cs.upcallCh
+	if !ok {
+		su.disp.deleteCommand(cs)
+		return nil, su.closedError(fmt.Errorf("Connection closed while waiting for N-ACTION response"))
+	}
+	resp, ok := event.command.(*dimse.NActionRsp)
+	if !ok {
+		su.disp.deleteCommand(cs)
+		return nil, fmt.Errorf("Found wrong response for N-ACTION: %v", event.command)
+	}
+	if resp.Status.Status != dimse.StatusSuccess {
+		su.disp.deleteCommand(cs)
+		return nil, fmt.Errorf("dicom.serviceUser: storage commitment request failed: %v", resp.Status)
+	}
+	return cs, nil
+}
@@ -0,0 +1,77 @@
+package netdicom
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PDUDirection tells whether a traced PDU was sent to or received from the
+// peer.
+type PDUDirection int
+
+const (
+	// PDUSent marks a PDU written to the peer.
+	PDUSent PDUDirection = iota
+	// PDUReceived marks a PDU read from the peer.
+	PDUReceived
+)
+
+func (d PDUDirection) String() string {
+	switch d {
+	case PDUSent:
+		return "sent"
+	case PDUReceived:
+		return "received"
+	}
+	return fmt.Sprintf("PDUDirection(%d)", int(d))
+}
+
+// PDUTracer receives the raw bytes of every PDU of an association, e.g., to
+// dump them while diagnosing why a peer rejects the association. The
+// association argument identifies the association, as in Metrics. data holds
+// the PDU header and body; it must not be modified or retained after the call.
+// Incoming PDUs are traced before they are decoded, so malformed PDUs are
+// traced too, but the body of a PDU longer than twice the max PDU size is not
+// read.
+//
+// The tracer is called from the goroutines that run the association, so it
+// must be safe for concurrent use. Tracing is off if the tracer is nil.
+type PDUTracer func(association string, direction PDUDirection, data []byte)
+
+// NewHexDumpPDUTracer returns a PDUTracer that writes a header line and a hex
+// dump of every PDU to w.
+func NewHexDumpPDUTracer(w io.Writer) PDUTracer {
+	var mu sync.Mutex
+	return func(association string, direction PDUDirection, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "association=%s %s %d bytes\n%s", association, direction, len(data), hex.Dump(data))
+	}
+}
+
+// StateTransition is one step of the upper layer state machine that runs an
+// association, as in the state transition table of P3.8 9.2. States, events
+// and actions are named as in the standard, e.g., "sta06", "evt10", "DT-2".
+// Events that aren't in the standard, e.g., those of the local release
+// and idle timers, are numbered after the standard ones.
+type StateTransition struct {
+	OldState string
+	Event    string
+	Action   string
+	NewState string
+}
+
+func (t StateTransition) String() string {
+	return fmt.Sprintf("%s --%s/%s--> %s", t.OldState, t.Event, t.Action, t.NewState)
+}
+
+// TransitionTracer receives every state transition of an association, e.g.,
+// to log the exact path taken while diagnosing interoperability problems. The
+// association argument identifies the association, as in PDUTracer.
+//
+// The tracer is called from the goroutine that runs the state machine, so it
+// must not block, and it must be safe for concurrent use if shared by
+// associations. Tracing is off if the tracer is nil.
+type TransitionTracer func(association string, transition StateTransition)